@@ -12,6 +12,7 @@ import (
 	"log"
 	"net/http"
 	"net/http/pprof"
+	"os"
 	"time"
 
 	"github.com/go-logr/zapr"
@@ -24,15 +25,33 @@ import (
 
 	"github.com/siderolabs/kube-service-exposer/internal/debug"
 	"github.com/siderolabs/kube-service-exposer/internal/exposer"
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
 	"github.com/siderolabs/kube-service-exposer/internal/version"
 )
 
 var rootCmdArgs struct {
-	annotationKey            string
-	pprofBindAddr            string
-	bindCIDRs                []string
-	disallowedHostPortRanges []string
-	ipRefreshPeriod          time.Duration
+	annotationKey             string
+	pprofBindAddr             string
+	bindCIDRs                 []string
+	bindInterfaces            []string
+	staticBindAddresses       []string
+	wildcardIPFamilies        string
+	disallowedHostPortRanges  []string
+	proxyProtocol             string
+	proxyProtocolTrustedCIDRs []string
+	tlsSecretLabelSelector    string
+	tlsSecretNamespaces       []string
+	ipRefreshPeriod           time.Duration
+	watchAddresses            bool
+	maxConnectionsWait        time.Duration
+	maxConnections            int
+	timeouts                  ip.Timeouts
+	drainTimeout              time.Duration
+	upstream                  string
+	nodeName                  string
+	withoutLocalEndpoints     string
+	nftPath                   string
+	handoverSocket            string
 
 	debug bool
 }
@@ -67,10 +86,27 @@ var rootCmd = &cobra.Command{
 		controllerruntimelog.SetLogger(zapr.NewLogger(logger.Named("runtime")))
 
 		exposer, err := exposer.New(exposer.Options{
-			AnnotationKey:            rootCmdArgs.annotationKey,
-			BindCIDRs:                rootCmdArgs.bindCIDRs,
-			DisallowedHostPortRanges: rootCmdArgs.disallowedHostPortRanges,
-			IPRefreshPeriod:          rootCmdArgs.ipRefreshPeriod,
+			AnnotationKey:             rootCmdArgs.annotationKey,
+			BindCIDRs:                 rootCmdArgs.bindCIDRs,
+			BindInterfaces:            rootCmdArgs.bindInterfaces,
+			StaticBindAddresses:       rootCmdArgs.staticBindAddresses,
+			WildcardIPFamilies:        rootCmdArgs.wildcardIPFamilies,
+			DisallowedHostPortRanges:  rootCmdArgs.disallowedHostPortRanges,
+			IPRefreshPeriod:           rootCmdArgs.ipRefreshPeriod,
+			WatchAddresses:            rootCmdArgs.watchAddresses,
+			ProxyProtocol:             rootCmdArgs.proxyProtocol,
+			ProxyProtocolTrustedCIDRs: rootCmdArgs.proxyProtocolTrustedCIDRs,
+			TLSSecretLabelSelector:    rootCmdArgs.tlsSecretLabelSelector,
+			TLSSecretNamespaces:       rootCmdArgs.tlsSecretNamespaces,
+			MaxConnections:            rootCmdArgs.maxConnections,
+			MaxConnectionsWait:        rootCmdArgs.maxConnectionsWait,
+			Timeouts:                  rootCmdArgs.timeouts,
+			DrainTimeout:              rootCmdArgs.drainTimeout,
+			Upstream:                  rootCmdArgs.upstream,
+			NodeName:                  rootCmdArgs.nodeName,
+			WithoutLocalEndpoints:     rootCmdArgs.withoutLocalEndpoints,
+			NFTPath:                   rootCmdArgs.nftPath,
+			HandoverSocket:            rootCmdArgs.handoverSocket,
 		}, logger.Named("exposer"))
 		if err != nil {
 			return err
@@ -145,15 +181,81 @@ func runPprofServer(ctx context.Context, logger *zap.Logger) error {
 func init() {
 	rootCmd.Flags().StringVarP(&rootCmdArgs.annotationKey, "annotation-key", "a", version.Name+".sidero.dev/port",
 		"The annotation key to be looked for on the services to determine which port to expose it from. "+
-			"The value is a comma-separated list of <host-port> or <host-port>:<service-port-name-or-number>.")
+			"The value is a comma-separated list of <host-port> or <host-port>:<service-port-name-or-number>, "+
+			"each optionally suffixed with /tcp (default) or /udp and followed by @<option>=<value>[;<option>=<value>...].")
 
 	rootCmd.Flags().StringVar(&rootCmdArgs.pprofBindAddr, "pprof-bind-addr", "",
 		"The address to bind the pprof server to. Disabled when empty.")
 	rootCmd.Flags().StringSliceVarP(&rootCmdArgs.bindCIDRs, "bind-cidrs", "b", nil,
-		"The CIDRs to match the host IPs with. Only the ports on the IPs that match these CIDRs will be listened. When empty, all IPs will be listened.")
+		"The CIDRs to match the host IPs with. Only the ports on the IPs that match these CIDRs will be listened. When empty, all IPs will be listened. "+
+			"Can be narrowed down per Service with the bind-cidrs annotation.")
+	rootCmd.Flags().StringSliceVar(&rootCmdArgs.bindInterfaces, "bind-interfaces", nil,
+		"The name patterns of the network interfaces to match the host IPs with, e.g. bond0 or vlan*. Only the ports on the IPs of the matching interfaces will be listened, "+
+			"together with --bind-cidrs only the ones matching both. When empty, the IPs of all interfaces will be listened. "+
+			"Can be narrowed down per Service with the bind-interfaces annotation.")
+	rootCmd.Flags().StringSliceVar(&rootCmdArgs.staticBindAddresses, "static-bind-addresses", nil,
+		"The host IPs to listen on whether they are assigned to the host or not (IP_FREEBIND), e.g. the virtual IPs of keepalived, so that they are served as soon as they are assigned. "+
+			"They are listened on regardless of --bind-cidrs and --bind-interfaces. "+
+			"Services can be exposed on their own static bind addresses with the static-bind-addresses annotation, within --bind-cidrs.")
+	rootCmd.Flags().StringVar(&rootCmdArgs.wildcardIPFamilies, "wildcard-ip-families", "ipv4",
+		"The IP families to listen on when --bind-cidrs and --bind-interfaces are empty: ipv4 to listen on 0.0.0.0, ipv6 on ::, "+
+			"or dual-stack on both with separate listeners. The Services are exposed only on the families of their spec.ipFamilies, unless they prefer or require dual-stack.")
 	rootCmd.Flags().StringSliceVar(&rootCmdArgs.disallowedHostPortRanges, "disallowed-host-port-ranges", nil,
 		"The port ranges on the host that are not allowed to be used. When a disallowed host port is attempted to be exposed, it will be skipped and a warning will be logged.")
 	rootCmd.Flags().DurationVar(&rootCmdArgs.ipRefreshPeriod, "ip-refresh-period", 30*time.Second,
-		"How often to re-scan host IPs and reconcile mappings against them. Only takes effect when --bind-cidrs is set.")
+		"How often to re-scan host IPs and reconcile mappings against them when they changed, for the --bind-cidrs, the --bind-interfaces, and the bind-cidrs and bind-interfaces annotations of the Services. "+
+			"0 re-scans them only on the notifications of --watch-addresses.")
+	rootCmd.Flags().BoolVar(&rootCmdArgs.watchAddresses, "watch-addresses", true,
+		"Re-scan host IPs as soon as rtnetlink notifies of an added or removed address, in addition to every --ip-refresh-period.")
+	rootCmd.Flags().StringVar(&rootCmdArgs.proxyProtocol, "proxy-protocol", "none",
+		"The default PROXY protocol version (v1, v2 or none) to send to the upstreams of TCP mappings. Can be overridden per mapping with the proxy-protocol option.")
+	rootCmd.Flags().StringSliceVar(&rootCmdArgs.proxyProtocolTrustedCIDRs, "proxy-protocol-trusted-cidrs", nil,
+		"The source CIDRs of the downstream load balancers allowed to send a PROXY protocol header to the mappings with the accept-proxy-protocol option. "+
+			"Connections from other sources to such mappings are rejected. When empty, no source is trusted, and all connections to such mappings are rejected.")
+	rootCmd.Flags().StringVar(&rootCmdArgs.tlsSecretLabelSelector, "tls-secret-label-selector", version.Name+".sidero.dev/tls=true",
+		"The label selector of the kubernetes.io/tls Secrets to load certificates from for the mappings with the tls-secret option. "+
+			"Secrets not matching it are not watched. When empty, all Secrets are watched.")
+	rootCmd.Flags().StringSliceVar(&rootCmdArgs.tlsSecretNamespaces, "tls-secret-namespaces", nil,
+		"The namespaces of the Secrets to load certificates from, so that reading Secrets can be granted in these namespaces only. "+
+			"When empty, the Secrets of all namespaces are watched.")
+	rootCmd.Flags().IntVar(&rootCmdArgs.maxConnections, "max-connections", 0,
+		"The default maximum number of connections proxied concurrently per TCP mapping, across all host IPs. 0 means no limit. "+
+			"Can be overridden per mapping with the max-connections option.")
+	rootCmd.Flags().DurationVar(&rootCmdArgs.maxConnectionsWait, "max-connections-wait", 0,
+		"The default time a connection over the maximum waits for another one to finish before it is rejected. 0 rejects it immediately. "+
+			"Can be overridden per mapping with the max-connections-wait option.")
+	rootCmd.Flags().DurationVar(&rootCmdArgs.timeouts.Dial, "dial-timeout", 10*time.Second,
+		"The default timeout for dialing the upstream of a TCP mapping. Can be overridden per mapping with the dial-timeout option.")
+	rootCmd.Flags().DurationVar(&rootCmdArgs.timeouts.ClientIdle, "client-idle-timeout", 0,
+		"The default time after which a connection is closed when its client has sent nothing. 0 means no timeout. "+
+			"Can be overridden per mapping with the client-idle-timeout option.")
+	rootCmd.Flags().DurationVar(&rootCmdArgs.timeouts.UpstreamIdle, "upstream-idle-timeout", 0,
+		"The default time after which a connection is closed when its upstream has sent nothing. 0 means no timeout. "+
+			"Can be overridden per mapping with the upstream-idle-timeout option.")
+	rootCmd.Flags().DurationVar(&rootCmdArgs.timeouts.KeepAlive, "tcp-keepalive", 15*time.Second,
+		"The default interval of the TCP keepalive probes on the client and upstream connections. A negative value disables them. "+
+			"Can be overridden per mapping with the tcp-keepalive option.")
+	rootCmd.Flags().DurationVar(&rootCmdArgs.timeouts.HealthCheckTimeout, "health-check-timeout", time.Second,
+		"The default timeout of the upstream health checks. Can be overridden per mapping with the health-check-timeout option.")
+	rootCmd.Flags().DurationVar(&rootCmdArgs.timeouts.HealthCheckInterval, "health-check-interval", time.Second,
+		"The default interval of the upstream health checks. Can be overridden per mapping with the health-check-interval option.")
+	rootCmd.Flags().DurationVar(&rootCmdArgs.drainTimeout, "drain-timeout", 0,
+		"The default time the connections of a removed or recycled TCP mapping, or of all mappings on shutdown, can take to finish before they are closed. "+
+			"0 closes them immediately. Can be overridden per mapping with the drain-timeout option.")
+	rootCmd.Flags().StringVar(&rootCmdArgs.upstream, "upstream", "dns",
+		"The default upstream of the mappings: dns to connect to the DNS name of the Service, cluster-ip to connect to its ClusterIP, "+
+			"or endpoints to connect to its ready endpoints directly. "+
+			"Can be overridden per mapping with the upstream option.")
+	rootCmd.Flags().StringVar(&rootCmdArgs.nodeName, "node-name", os.Getenv("NODE_NAME"),
+		"The name of the node, the mappings of the Services with the Local external traffic policy connect only to the endpoints on it. "+
+			"Defaults to the NODE_NAME environment variable. The policy is ignored when it is empty.")
+	rootCmd.Flags().StringVar(&rootCmdArgs.withoutLocalEndpoints, "without-local-endpoints", "stop",
+		"What to do with the mappings of a Service with the Local external traffic policy when the node has no ready endpoints of it: "+
+			"stop to stop listening on the host ports, or reject to close the connections.")
+	rootCmd.Flags().StringVar(&rootCmdArgs.nftPath, "nft-path", "nft",
+		"The path of the nft binary programming the nftables rules of the mappings in the nat mode.")
+	rootCmd.Flags().StringVar(&rootCmdArgs.handoverSocket, "handover-socket", "",
+		"The path of the Unix socket to take over the listeners of the previous process from on start, and to hand them over to the next one, "+
+			"so that the host ports keep accepting connections during a restart. Disabled when empty.")
 	rootCmd.Flags().BoolVar(&rootCmdArgs.debug, "debug", false, "enable debug logs.")
 }
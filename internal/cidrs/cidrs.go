@@ -6,12 +6,15 @@
 package cidrs
 
 import (
+	"fmt"
 	"net/netip"
+	"strings"
 )
 
 // FilterIPSet filters an IP set by a list of CIDRs.
 // It returns the filtered IP set.
 // If there is an error while parsing an IP address, it will be passed to the errHandler.
+// The IPv6 addresses with a zone, e.g. "fe80::1%eth0", are matched without it, and kept with it.
 func FilterIPSet(cidrs []netip.Prefix, ipSet map[string]struct{}, errHandler func(ip string, err error)) map[string]struct{} {
 	filteredIPSet := make(map[string]struct{}, len(cidrs)*2)
 
@@ -26,7 +29,7 @@ func FilterIPSet(cidrs []netip.Prefix, ipSet map[string]struct{}, errHandler fun
 		}
 
 		for _, cidr := range cidrs {
-			if cidr.Contains(parsedIP) {
+			if cidr.Contains(parsedIP.WithZone("")) {
 				filteredIPSet[parsedIP.String()] = struct{}{}
 			}
 		}
@@ -34,3 +37,63 @@ func FilterIPSet(cidrs []netip.Prefix, ipSet map[string]struct{}, errHandler fun
 
 	return filteredIPSet
 }
+
+// Parse parses a list of CIDRs.
+func Parse(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CIDR %q: %w", cidr, err)
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+// Contains reports whether any of the CIDRs contains the IP address.
+//
+// IPv4-mapped IPv6 addresses are matched as IPv4 addresses.
+func Contains(cidrs []netip.Prefix, ip netip.Addr) bool {
+	ip = ip.Unmap()
+
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// List is a list of CIDRs in a comparable form, so that it can be part of values compared
+// with ==, e.g. the mappings.
+//
+// The zero value is an empty list.
+type List string
+
+// NewList returns the List of the CIDRs.
+func NewList(cidrs []netip.Prefix) List {
+	strs := make([]string, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		strs = append(strs, cidr.String())
+	}
+
+	return List(strings.Join(strs, ","))
+}
+
+// Prefixes returns the CIDRs of the list.
+func (l List) Prefixes() []netip.Prefix {
+	if l == "" {
+		return nil
+	}
+
+	// the list was built from valid prefixes, so it parses
+	prefixes, _ := Parse(strings.Split(string(l), ",")) //nolint:errcheck
+
+	return prefixes
+}
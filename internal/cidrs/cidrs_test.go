@@ -11,6 +11,7 @@ import (
 	"github.com/siderolabs/gen/maps"
 	"github.com/siderolabs/gen/xslices"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/siderolabs/kube-service-exposer/internal/cidrs"
 )
@@ -43,4 +44,48 @@ func TestFilterIPSet(t *testing.T) {
 
 	assert.ElementsMatch(t, filterErrIPs, []string{"invalid1", "invalid2"})
 	assert.Len(t, filterErrs, 2)
+
+	// the zones are kept
+	filtered = cidrs.FilterIPSet([]netip.Prefix{netip.MustParsePrefix("fe80::/10")}, xslices.ToSet([]string{"fe80::1%eth0", "fd00::1"}), nil)
+	assert.ElementsMatch(t, maps.Keys(filtered), []string{"fe80::1%eth0"})
+}
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	prefixes, err := cidrs.Parse([]string{"10.0.0.0/8", "2001:db8::/32"})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}, prefixes)
+
+	prefixes, err = cidrs.Parse(nil)
+	require.NoError(t, err)
+	assert.Empty(t, prefixes)
+
+	_, err = cidrs.Parse([]string{"10.0.0.0/8", "10.0.0.1"})
+	assert.ErrorContains(t, err, `failed to parse CIDR "10.0.0.1"`)
+}
+
+func TestContains(t *testing.T) {
+	t.Parallel()
+
+	prefixes := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+
+	assert.True(t, cidrs.Contains(prefixes, netip.MustParseAddr("10.1.2.3")))
+	assert.True(t, cidrs.Contains(prefixes, netip.MustParseAddr("::ffff:10.1.2.3")))
+	assert.True(t, cidrs.Contains(prefixes, netip.MustParseAddr("2001:db8::1")))
+	assert.False(t, cidrs.Contains(prefixes, netip.MustParseAddr("192.168.1.1")))
+	assert.False(t, cidrs.Contains(nil, netip.MustParseAddr("10.1.2.3")))
+}
+
+func TestList(t *testing.T) {
+	t.Parallel()
+
+	prefixes := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+
+	list := cidrs.NewList(prefixes)
+	assert.Equal(t, cidrs.List("10.0.0.0/8,2001:db8::/32"), list)
+	assert.Equal(t, prefixes, list.Prefixes())
+
+	assert.Equal(t, cidrs.List(""), cidrs.NewList(nil))
+	assert.Empty(t, cidrs.List("").Prefixes())
 }
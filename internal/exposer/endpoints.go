@@ -0,0 +1,104 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package exposer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/siderolabs/kube-service-exposer/internal/service"
+)
+
+var _ service.EndpointsWatcher = &endpointsWatcher{}
+
+// endpointsWatcher provides the client of the manager to the Service reconciler, and watches
+// the EndpointSlices once it first resolves the endpoints of a Service.
+type endpointsWatcher struct {
+	manager       manager.Manager
+	controller    controller.Controller
+	annotationKey string
+
+	lock     sync.Mutex
+	watching bool
+}
+
+// GetClient implements service.ClientProvider.
+func (w *endpointsWatcher) GetClient() client.Client {
+	return w.manager.GetClient()
+}
+
+// WatchEndpoints implements service.EndpointsWatcher.
+//
+// The Service owning a changed EndpointSlice is reconciled again, as its endpoints are
+// resolved from its EndpointSlices.
+func (w *endpointsWatcher) WatchEndpoints() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.watching {
+		return nil
+	}
+
+	endpointSliceSource := source.Kind(
+		w.manager.GetCache(),
+		&discoveryv1.EndpointSlice{},
+		handler.TypedEnqueueRequestsFromMapFunc(endpointSliceService),
+		annotatedServicePredicate(w.manager.GetCache(), w.annotationKey),
+	)
+
+	if err := w.controller.Watch(endpointSliceSource); err != nil {
+		return fmt.Errorf("failed to watch EndpointSlices: %w", err)
+	}
+
+	w.watching = true
+
+	return nil
+}
+
+// annotatedServicePredicate filters EndpointSlice events to only those of the Services which
+// have the configured annotation.
+//
+// The events of the EndpointSlices whose Service is not cached yet are dropped: the Service
+// is reconciled anyway once it is.
+func annotatedServicePredicate(reader client.Reader, annotationKey string) predicate.TypedPredicate[*discoveryv1.EndpointSlice] {
+	return predicate.NewTypedPredicateFuncs(func(endpointSlice *discoveryv1.EndpointSlice) bool {
+		requests := endpointSliceService(context.Background(), endpointSlice)
+		if len(requests) == 0 {
+			return false
+		}
+
+		var svc corev1.Service
+
+		if err := reader.Get(context.Background(), requests[0].NamespacedName, &svc); err != nil {
+			return false
+		}
+
+		_, ok := svc.GetAnnotations()[annotationKey]
+
+		return ok
+	})
+}
+
+// endpointSliceService maps the EndpointSlice to the Service it belongs to.
+func endpointSliceService(_ context.Context, endpointSlice *discoveryv1.EndpointSlice) []reconcile.Request {
+	name, ok := endpointSlice.Labels[discoveryv1.LabelServiceName]
+	if !ok {
+		return nil
+	}
+
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: endpointSlice.Namespace, Name: name}}}
+}
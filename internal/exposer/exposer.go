@@ -7,45 +7,160 @@ package exposer
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
+	"github.com/siderolabs/kube-service-exposer/internal/cidrs"
+	"github.com/siderolabs/kube-service-exposer/internal/handover"
 	"github.com/siderolabs/kube-service-exposer/internal/ip"
 	"github.com/siderolabs/kube-service-exposer/internal/memoizer"
+	"github.com/siderolabs/kube-service-exposer/internal/proxyproto"
+	"github.com/siderolabs/kube-service-exposer/internal/secret"
 	"github.com/siderolabs/kube-service-exposer/internal/service"
 	"github.com/siderolabs/kube-service-exposer/internal/version"
 )
 
+const (
+	// handoverTimeout is how long taking over the sockets of the previous process can take.
+	handoverTimeout = 30 * time.Second
+
+	// handoverClaimPeriod is how long after the cache is synced the sockets taken over for no
+	// mapping are closed.
+	handoverClaimPeriod = 30 * time.Second
+
+	// addressChangeDelay is how long after a change of the host IP addresses the IP set is
+	// refreshed, so that the changes made together are reconciled once.
+	addressChangeDelay = 500 * time.Millisecond
+
+	// readyPath is the path of the readiness endpoint, served on the metrics address.
+	readyPath = "/readyz"
+)
+
 // Options configures the Exposer.
 type Options struct {
 	AnnotationKey            string
 	BindCIDRs                []string
 	DisallowedHostPortRanges []string
-	IPRefreshPeriod          time.Duration
+
+	// IPRefreshPeriod is how often the host IP addresses are re-scanned. When zero, they are
+	// only re-scanned on the changes notified by rtnetlink, see WatchAddresses.
+	IPRefreshPeriod time.Duration
+
+	// WatchAddresses refreshes the IP set as soon as the host IP addresses change, as
+	// notified by rtnetlink, in addition to every IPRefreshPeriod.
+	WatchAddresses bool
+
+	// BindInterfaces are the patterns of the names of the network interfaces whose host IPs
+	// are listened on, e.g. "bond0" or "vlan*". All the interfaces are listened on when empty.
+	BindInterfaces []string
+
+	// StaticBindAddresses are host IPs listened on whether they are assigned to the host or
+	// not, e.g. the virtual IPs moved between the hosts by keepalived, so that they are served
+	// as soon as they are assigned. They are listened on regardless of BindCIDRs and
+	// BindInterfaces.
+	StaticBindAddresses []string
+
+	// WildcardIPFamilies are the IP families listened on without BindCIDRs and
+	// BindInterfaces: "ipv4", "ipv6", or "dual-stack" for separate IPv4 and IPv6 listeners.
+	WildcardIPFamilies string
+
+	// ProxyProtocol is the default PROXY protocol version sent to upstreams of TCP mappings:
+	// "v1", "v2", or "none"/empty to disable.
+	ProxyProtocol string
+
+	// ProxyProtocolTrustedCIDRs are the source CIDRs allowed to send a PROXY protocol header
+	// to the mappings which accept it. When empty, no source is trusted, so that the
+	// connections to such mappings are rejected.
+	ProxyProtocolTrustedCIDRs []string
+
+	// TLSSecretLabelSelector selects the Secrets watched for the certificates of the mappings
+	// terminating TLS. When empty, all Secrets are watched.
+	TLSSecretLabelSelector string
+
+	// TLSSecretNamespaces are the namespaces of the Secrets watched for the certificates of
+	// the mappings terminating TLS. When empty, the Secrets of all namespaces are watched.
+	TLSSecretNamespaces []string
+
+	// MaxConnections is the default limit of concurrent connections of TCP mappings, zero
+	// for no limit.
+	MaxConnections int
+
+	// MaxConnectionsWait is the default time a connection over the limit waits before it is
+	// rejected.
+	MaxConnectionsWait time.Duration
+
+	// Timeouts are the default timeouts of TCP mappings.
+	Timeouts ip.Timeouts
+
+	// DrainTimeout is the default time the connections of a removed TCP mapping can take to
+	// finish before they are closed. They are closed right away when it is zero.
+	DrainTimeout time.Duration
+
+	// Upstream is the default upstream mode of the mappings: "dns", "cluster-ip", or
+	// "endpoints".
+	Upstream string
+
+	// NodeName is the name of the node the Exposer runs on. The mappings of the Services with
+	// the Local external traffic policy connect only to the endpoints on it.
+	NodeName string
+
+	// WithoutLocalEndpoints is what is done with the mappings of such a Service when it has no
+	// ready endpoints on the node: "stop" listening, or "reject" the connections.
+	WithoutLocalEndpoints string
+
+	// NFTPath is the path of the nft binary programming the rules of the mappings in the nat
+	// mode, "nft" from the PATH when empty.
+	NFTPath string
+
+	// HandoverSocket is the path of the Unix socket the listeners are handed over on from the
+	// previous process, and to the next one. The listeners are not handed over when it is
+	// empty.
+	HandoverSocket string
 }
 
 // Exposer is a controller that exposes the given services on the given host interfaces.
 type Exposer struct {
-	manager         manager.Manager
-	controller      controller.Controller
-	logger          *zap.Logger
-	ipMapper        *ip.Mapper
-	refreshCh       chan event.TypedGenericEvent[*corev1.Service]
-	annotationKey   string
-	bindCIDRs       []string
-	ipRefreshPeriod time.Duration
+	manager          manager.Manager
+	controller       controller.Controller
+	secretController controller.Controller
+	endpoints        *endpointsWatcher
+	logger           *zap.Logger
+	ipMapper         *ip.Mapper
+	listeners        *ip.HandoverRegistry
+	nftables         *ip.NFTables
+	refreshCh        chan event.TypedGenericEvent[*corev1.Service]
+	addressChanged   chan struct{}
+	ready            *atomic.Bool
+	hostIPsChanged   chan struct{}
+	annotationKey    string
+	bindCIDRs        []string
+	bindInterfaces   []string
+	ipRefreshPeriod  time.Duration
+	watchAddresses   bool
+	watchEndpoints   bool
+	handoverSocket   string
 }
 
 // New creates a new Exposer.
@@ -54,13 +169,20 @@ func New(opts Options, logger *zap.Logger) (*Exposer, error) {
 		logger = zap.NewNop()
 	}
 
-	if len(opts.BindCIDRs) > 0 && opts.IPRefreshPeriod <= 0 {
-		return nil, fmt.Errorf("ip-refresh-period must be positive when bind-cidrs is set, got %s", opts.IPRefreshPeriod)
+	if opts.IPRefreshPeriod < 0 {
+		return nil, fmt.Errorf("ip-refresh-period must not be negative, got %s", opts.IPRefreshPeriod)
+	}
+
+	// the host IPs the global bind CIDRs and interfaces select would never be refreshed
+	if opts.IPRefreshPeriod == 0 && !opts.WatchAddresses && (len(opts.BindCIDRs) > 0 || len(opts.BindInterfaces) > 0) {
+		return nil, errors.New("ip-refresh-period must be positive when bind-cidrs or bind-interfaces is set without watch-addresses")
 	}
 
 	logger = logger.With(
 		zap.String("annotation-key", opts.AnnotationKey),
 		zap.Strings("bind-cidrs", opts.BindCIDRs),
+		zap.Strings("bind-interfaces", opts.BindInterfaces),
+		zap.Strings("static-bind-addresses", opts.StaticBindAddresses),
 		zap.Strings("disallowed-host-port-ranges", opts.DisallowedHostPortRanges),
 	)
 
@@ -69,27 +191,161 @@ func New(opts Options, logger *zap.Logger) (*Exposer, error) {
 		return nil, fmt.Errorf("failed to get config: %w", err)
 	}
 
-	mgr, err := manager.New(conf, manager.Options{})
+	tlsSecretSelector, err := labels.Parse(opts.TLSSecretLabelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tls-secret-label-selector: %w", err)
+	}
+
+	ready := &atomic.Bool{}
+
+	mgr, err := manager.New(conf, manager.Options{
+		Metrics: metricsserver.Options{
+			ExtraHandlers: map[string]http.Handler{readyPath: readyHandler(ready)},
+		},
+		Cache: cache.Options{
+			// only the Secrets holding the certificates are of interest, and watching all of
+			// them would keep every Secret of the cluster in memory on every node
+			ByObject: map[client.Object]cache.ByObject{
+				&corev1.Secret{}: {Label: tlsSecretSelector, Namespaces: tlsSecretNamespaces(opts.TLSSecretNamespaces)},
+			},
+		},
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create manager: %w", err)
 	}
 
-	ipSetMemoizer, err := memoizer.New(ip.NewCollector().Get)
+	ipSetMemoizer, err := memoizer.NewObservable(ip.NewCollector().Get, maps.Equal[map[string]string])
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ipSetMemoizer: %w", err)
 	}
 
-	ipSetProvider, err := NewFilteringIPSetProvider(opts.BindCIDRs, ipSetMemoizer, logger.Named("ip-set-provider"))
+	hostIPsChanged := make(chan struct{}, 1)
+
+	ipSetMemoizer.Subscribe(func(previous, current map[string]string) {
+		added, removed := diffAddrs(previous, current)
+
+		logger.Info("host IP addresses changed", zap.Strings("added-ips", added), zap.Strings("removed-ips", removed))
+
+		select {
+		case hostIPsChanged <- struct{}{}:
+		default:
+		}
+	})
+
+	wildcardFamilies, err := ip.ParseFamilies(opts.WildcardIPFamilies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wildcard-ip-families: %w", err)
+	}
+
+	ipSetProvider, err := NewFilteringIPSetProvider(opts.BindCIDRs, opts.BindInterfaces, opts.StaticBindAddresses, wildcardFamilies, ipSetMemoizer,
+		logger.Named("ip-set-provider"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ipSetProvider: %w", err)
 	}
 
-	ipMapper, err := ip.NewMapper(ipSetProvider, &ip.TCPLoadBalancerProvider{}, logger.Named("ip-mapper"))
+	proxyProtocolTrustedCIDRs, err := cidrs.Parse(opts.ProxyProtocolTrustedCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy-protocol-trusted-cidrs: %w", err)
+	}
+
+	certStore := secret.NewStore()
+
+	var (
+		listeners        *ip.HandoverRegistry
+		listenerRegistry ip.ListenerRegistry
+	)
+
+	if opts.HandoverSocket != "" {
+		listeners = &ip.HandoverRegistry{}
+		listenerRegistry = listeners
+	}
+
+	nftables := &ip.NFTables{
+		Logger: logger.Named("nftables"),
+		Runner: ip.NFTCommand{Path: opts.NFTPath},
+	}
+
+	lbProvider := &ip.ProtocolLoadBalancerProvider{
+		TCP: &ip.TCPLoadBalancerProvider{
+			Certificates:              certStore,
+			ProxyProtocolTrustedCIDRs: proxyProtocolTrustedCIDRs,
+			Listeners:                 listenerRegistry,
+		},
+		UDP: &ip.UDPLoadBalancerProvider{Listeners: listenerRegistry},
+		NAT: &ip.NATLoadBalancerProvider{Table: nftables},
+	}
+
+	ipMapper, err := ip.NewMapper(ipSetProvider, lbProvider, logger.Named("ip-mapper"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ipMapper: %w", err)
 	}
 
-	rec, err := service.NewReconciler(opts.AnnotationKey, mgr, ipMapper, opts.DisallowedHostPortRanges, logger.Named("service-reconciler"))
+	// served by the metrics server of the manager
+	if err = metrics.Registry.Register(NewConnectionCollector(ipMapper)); err != nil {
+		return nil, fmt.Errorf("failed to register connection metrics: %w", err)
+	}
+
+	if err = metrics.Registry.Register(NewBindFailureCollector(ipMapper)); err != nil {
+		return nil, fmt.Errorf("failed to register bind failure metrics: %w", err)
+	}
+
+	proxyProtocol, err := proxyproto.ParseVersion(opts.ProxyProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy-protocol: %w", err)
+	}
+
+	if opts.MaxConnections < 0 {
+		return nil, fmt.Errorf("max-connections must not be negative, got %d", opts.MaxConnections)
+	}
+
+	if opts.MaxConnectionsWait < 0 {
+		return nil, fmt.Errorf("max-connections-wait must not be negative, got %s", opts.MaxConnectionsWait)
+	}
+
+	for name, timeout := range map[string]time.Duration{
+		"dial-timeout":          opts.Timeouts.Dial,
+		"client-idle-timeout":   opts.Timeouts.ClientIdle,
+		"upstream-idle-timeout": opts.Timeouts.UpstreamIdle,
+		"health-check-timeout":  opts.Timeouts.HealthCheckTimeout,
+		"health-check-interval": opts.Timeouts.HealthCheckInterval,
+		"drain-timeout":         opts.DrainTimeout,
+	} {
+		if timeout < 0 {
+			return nil, fmt.Errorf("%s must not be negative, got %s", name, timeout)
+		}
+	}
+
+	upstream, err := ip.ParseUpstreamMode(opts.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream: %w", err)
+	}
+
+	mappingDefaults := service.MappingDefaults{
+		Upstream:           upstream,
+		ProxyProtocol:      proxyProtocol,
+		MaxConnections:     opts.MaxConnections,
+		MaxConnectionsWait: opts.MaxConnectionsWait,
+		Timeouts:           opts.Timeouts,
+		DrainTimeout:       opts.DrainTimeout,
+	}
+
+	withoutLocalEndpoints, err := service.ParseWithoutLocalEndpoints(opts.WithoutLocalEndpoints)
+	if err != nil {
+		return nil, fmt.Errorf("invalid without-local-endpoints: %w", err)
+	}
+
+	localTraffic := service.LocalTraffic{
+		NodeName:         opts.NodeName,
+		WithoutEndpoints: withoutLocalEndpoints,
+	}
+
+	endpoints := &endpointsWatcher{
+		manager:       mgr,
+		annotationKey: opts.AnnotationKey,
+	}
+
+	rec, err := service.NewReconciler(opts.AnnotationKey, endpoints, ipMapper, opts.DisallowedHostPortRanges, mappingDefaults, localTraffic,
+		logger.Named("service-reconciler"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create reconciler: %w", err)
 	}
@@ -105,25 +361,99 @@ func New(opts Options, logger *zap.Logger) (*Exposer, error) {
 		return nil, fmt.Errorf("failed to create controller: %w", err)
 	}
 
+	endpoints.controller = ctrller
+
+	secretRec, err := secret.NewReconciler(mgr, certStore, logger.Named("secret-reconciler"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secret reconciler: %w", err)
+	}
+
+	secretCtrller, err := controller.New(version.Name+"-secret-controller", mgr,
+		controller.Options{
+			Reconciler: secretRec,
+			// every replica terminates TLS with its own copy of the certificates
+			NeedLeaderElection: new(false),
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secret controller: %w", err)
+	}
+
 	return &Exposer{
-		annotationKey:   opts.AnnotationKey,
-		bindCIDRs:       opts.BindCIDRs,
-		ipRefreshPeriod: opts.IPRefreshPeriod,
-		logger:          logger,
-		ipMapper:        ipMapper,
-		manager:         mgr,
-		controller:      ctrller,
-		refreshCh:       make(chan event.TypedGenericEvent[*corev1.Service], 1),
+		annotationKey:    opts.AnnotationKey,
+		bindCIDRs:        opts.BindCIDRs,
+		bindInterfaces:   opts.BindInterfaces,
+		ipRefreshPeriod:  opts.IPRefreshPeriod,
+		watchAddresses:   opts.WatchAddresses,
+		handoverSocket:   opts.HandoverSocket,
+		logger:           logger,
+		ipMapper:         ipMapper,
+		listeners:        listeners,
+		nftables:         nftables,
+		manager:          mgr,
+		controller:       ctrller,
+		secretController: secretCtrller,
+		endpoints:        endpoints,
+		watchEndpoints:   upstream == ip.UpstreamEndpoints,
+		refreshCh:        make(chan event.TypedGenericEvent[*corev1.Service], 1),
+		addressChanged:   make(chan struct{}, 1),
+		hostIPsChanged:   hostIPsChanged,
+		ready:            ready,
 	}, nil
 }
 
+// readyHandler serves the readiness of the Exposer, once its caches are synced.
+//
+// It is served along with the metrics, which are only served once the listeners are taken over
+// from the previous process, or it is given up on, so that the previous process is not
+// stopped by a rolling update before then.
+func readyHandler(ready *atomic.Bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+
+			return
+		}
+
+		fmt.Fprintln(w, "ok") //nolint:errcheck
+	})
+}
+
+// tlsSecretNamespaces returns the cache configs limiting the watched Secrets to the namespaces,
+// or nil to watch the Secrets of all namespaces.
+func tlsSecretNamespaces(namespaces []string) map[string]cache.Config {
+	if len(namespaces) == 0 {
+		return nil
+	}
+
+	configs := make(map[string]cache.Config, len(namespaces))
+
+	for _, namespace := range namespaces {
+		configs[namespace] = cache.Config{}
+	}
+
+	return configs
+}
+
 // Run runs the Exposer.
+//
+// With a handover socket, it first takes over the listeners of the previous process. Once it
+// hands them over to the next process, it stops, and waits for the context to be done.
 func (e *Exposer) Run(ctx context.Context) error {
 	e.logger.Info("starting exposer")
 	defer e.ipMapper.Close()
 
-	if len(e.bindCIDRs) == 0 {
-		e.logger.Info("bindCIDRs are empty, mappings will listen on all interfaces")
+	var handoverServer *handover.Server
+
+	if e.handoverSocket != "" {
+		var err error
+
+		if handoverServer, err = e.takeOver(ctx); err != nil {
+			return err
+		}
+	}
+
+	if len(e.bindCIDRs) == 0 && len(e.bindInterfaces) == 0 {
+		e.logger.Info("bindCIDRs and bindInterfaces are empty, mappings will listen on all interfaces")
 	}
 
 	kindSource := source.Kind(
@@ -137,6 +467,14 @@ func (e *Exposer) Run(ctx context.Context) error {
 		return fmt.Errorf("failed to watch Services: %w", err)
 	}
 
+	// the EndpointSlices are watched from the start with the endpoints upstream by default, and
+	// otherwise once a mapping first connects to the endpoints, e.g. of a Local Service
+	if e.watchEndpoints {
+		if err := e.endpoints.WatchEndpoints(); err != nil {
+			return err
+		}
+	}
+
 	// the refresh channel feeds the same workqueue as the K8s informer, so any concurrent
 	// K8s events for the same Service get deduped against a refresh-driven event. The
 	// controller's reconciler always reads the latest Service state from the cache at
@@ -147,41 +485,205 @@ func (e *Exposer) Run(ctx context.Context) error {
 		return fmt.Errorf("failed to watch refresh channel: %w", err)
 	}
 
-	eg, ctx := errgroup.WithContext(ctx)
+	secretSource := source.Kind(
+		e.manager.GetCache(),
+		&corev1.Secret{},
+		&handler.TypedEnqueueRequestForObject[*corev1.Secret]{},
+	)
+
+	if err := e.secretController.Watch(secretSource); err != nil {
+		return fmt.Errorf("failed to watch Secrets: %w", err)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	eg, runCtx := errgroup.WithContext(runCtx)
 
 	eg.Go(func() error {
-		if err := e.manager.Start(ctx); err != nil {
+		if err := e.manager.Start(runCtx); err != nil {
 			return fmt.Errorf("failed to start manager: %w", err)
 		}
 
 		return nil
 	})
 
-	if len(e.bindCIDRs) > 0 {
-		e.logger.Info("bindCIDRs are specified, start IP refresh loop", zap.Duration("period", e.ipRefreshPeriod))
+	// the connection to the next process, which is closed once this one has stopped
+	var successor io.Closer
 
+	if handoverServer != nil {
 		eg.Go(func() error {
-			return e.runRefreshLoop(ctx)
+			conn, err := handoverServer.Serve(runCtx, e.listeners)
+			if err != nil {
+				return fmt.Errorf("failed to serve listener handover: %w", err)
+			}
+
+			if conn != nil {
+				successor = conn
+
+				cancel()
+			}
+
+			return nil
+		})
+
+		eg.Go(func() error {
+			return e.closeUnclaimedListeners(runCtx)
+		})
+	}
+
+	eg.Go(func() error {
+		if e.manager.GetCache().WaitForCacheSync(runCtx) {
+			e.ready.Store(true)
+
+			e.logger.Info("ready")
+		}
+
+		return nil
+	})
+
+	e.logger.Info("start IP refresh loop", zap.Duration("period", e.ipRefreshPeriod))
+
+	eg.Go(func() error {
+		return e.runRefreshLoop(runCtx)
+	})
+
+	if e.watchAddresses {
+		eg.Go(func() error {
+			e.watchAddressChanges(runCtx)
+
+			return nil
 		})
-	} else {
-		e.logger.Info("bindCIDRs are empty, IP refresh loop will not be started")
 	}
 
-	return eg.Wait()
+	if err := eg.Wait(); err != nil || successor == nil {
+		return err
+	}
+
+	// the nftables rules are left to the next process, which replaces them with its own
+	e.nftables.Detach()
+
+	// the listeners stop accepting before the next process starts, so that only one process
+	// accepts on the handed over sockets; the connections arriving meanwhile are queued on them
+	e.ipMapper.CloseListeners()
+
+	// the manager has stopped, the next process can start its own
+	successor.Close() //nolint:errcheck
+
+	e.logger.Info("handed the listeners over to the next process, waiting to be stopped")
+
+	// only the connections already being proxied are left to drain
+	e.ipMapper.Close()
+
+	<-ctx.Done()
+
+	return nil
+}
+
+// takeOver takes over the listeners of the previous process, and listens on the handover
+// socket for the next one.
+//
+// Failing to take over the listeners is not fatal: the host ports are bound again instead.
+func (e *Exposer) takeOver(ctx context.Context) (*handover.Server, error) {
+	requestCtx, cancel := context.WithTimeout(ctx, handoverTimeout)
+	defer cancel()
+
+	files, err := handover.Request(requestCtx, e.handoverSocket, e.logger.Named("handover"))
+	if err != nil {
+		e.logger.Warn("failed to take over the listeners of the previous process", zap.Error(err))
+	} else if err = e.listeners.Adopt(files); err != nil {
+		e.logger.Warn("failed to adopt the listeners of the previous process", zap.Error(err))
+	}
+
+	server, err := handover.Listen(e.handoverSocket, e.logger.Named("handover"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for listener handover: %w", err)
+	}
+
+	return server, nil
+}
+
+// closeUnclaimedListeners closes the listeners taken over from the previous process which no
+// mapping has adopted once the Services had the time to be reconciled.
+func (e *Exposer) closeUnclaimedListeners(ctx context.Context) error {
+	if !e.manager.GetCache().WaitForCacheSync(ctx) {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-time.After(handoverClaimPeriod):
+	}
+
+	if names := e.listeners.CloseUnclaimed(); len(names) > 0 {
+		e.logger.Info("closed the listeners taken over for no mapping", zap.Strings("listeners", names))
+	}
+
+	return nil
 }
 
-// runRefreshLoop periodically busts the IP cache and enqueues a reconcile request for
-// every service the mapper currently tracks. The actual reconciliation reads fresh state
-// from the K8s cache, so this never resurrects deleted services or reverts updates.
+// watchAddressChanges triggers the refresh loop as soon as the host IP addresses change.
+//
+// Failing to watch them is not fatal: the IP set is still refreshed periodically.
+func (e *Exposer) watchAddressChanges(ctx context.Context) {
+	addressSource, err := ip.NewNetlinkAddressSource()
+	if err != nil {
+		e.logger.Warn("failed to watch host IP address changes, relying on the periodic refresh", zap.Error(err))
+
+		return
+	}
+
+	watcher := &ip.AddressWatcher{
+		Source: addressSource,
+		Logger: e.logger.Named("address-watcher"),
+		Delay:  addressChangeDelay,
+	}
+
+	e.logger.Info("watching host IP address changes")
+
+	err = watcher.Run(ctx, func() {
+		select {
+		case e.addressChanged <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		e.logger.Warn("stopped watching host IP address changes, relying on the periodic refresh", zap.Error(err))
+	}
+}
+
+// runRefreshLoop periodically, and on the changes of the host IP addresses, busts the IP
+// cache and, if the host IP addresses changed since they were last fetched, enqueues a
+// reconcile request for every service the mapper currently tracks. The actual reconciliation
+// reads fresh state from the K8s cache, so this never resurrects deleted services or reverts
+// updates.
 func (e *Exposer) runRefreshLoop(ctx context.Context) error {
-	ticker := time.NewTicker(e.ipRefreshPeriod)
-	defer ticker.Stop()
+	// without a period, the IP set is only refreshed on the changes of the host IP addresses
+	var (
+		ticker *time.Ticker
+		tick   <-chan time.Time
+	)
+
+	if e.ipRefreshPeriod > 0 {
+		ticker = time.NewTicker(e.ipRefreshPeriod)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case <-ticker.C:
+		case <-tick:
+		case <-e.addressChanged:
+			e.logger.Debug("host IP addresses changed, refreshing the IP set")
+
+			// the periodic refresh is a safety net, it is not needed right after this one
+			if ticker != nil {
+				ticker.Reset(e.ipRefreshPeriod)
+			}
 		}
 
 		if err := e.ipMapper.RefreshIPSet(); err != nil {
@@ -190,6 +692,15 @@ func (e *Exposer) runRefreshLoop(ctx context.Context) error {
 			continue
 		}
 
+		// signaled by the subscriber of the IP cache, also when a reconcile fetched the changes
+		select {
+		case <-e.hostIPsChanged:
+		default:
+			e.logger.Debug("host IP addresses unchanged")
+
+			continue
+		}
+
 		for _, key := range e.ipMapper.KnownServices() {
 			ev := event.TypedGenericEvent[*corev1.Service]{
 				Object: &corev1.Service{
@@ -13,7 +13,7 @@ import (
 	"github.com/siderolabs/kube-service-exposer/internal/exposer"
 )
 
-func TestNewRejectsNonPositiveRefreshPeriodWithBindCIDRs(t *testing.T) {
+func TestNewRefreshPeriod(t *testing.T) {
 	t.Parallel()
 
 	_, err := exposer.New(exposer.Options{
@@ -25,8 +25,26 @@ func TestNewRejectsNonPositiveRefreshPeriodWithBindCIDRs(t *testing.T) {
 
 	_, err = exposer.New(exposer.Options{
 		AnnotationKey:   "test",
-		BindCIDRs:       []string{"10.0.0.0/8"},
-		IPRefreshPeriod: -1,
+		BindInterfaces:  []string{"eth0"},
+		IPRefreshPeriod: 0,
 	}, zaptest.NewLogger(t))
 	assert.ErrorContains(t, err, "ip-refresh-period must be positive")
+
+	_, err = exposer.New(exposer.Options{
+		AnnotationKey:   "test",
+		IPRefreshPeriod: -1,
+	}, zaptest.NewLogger(t))
+	assert.ErrorContains(t, err, "ip-refresh-period must not be negative")
+
+	// the host IPs are then only re-scanned on the notifications of rtnetlink, or not at all
+	// without global bind CIDRs and interfaces
+	for _, opts := range []exposer.Options{
+		{AnnotationKey: "test", BindCIDRs: []string{"10.0.0.0/8"}, WatchAddresses: true},
+		{AnnotationKey: "test"},
+	} {
+		_, err = exposer.New(opts, zaptest.NewLogger(t))
+		if err != nil {
+			assert.NotContains(t, err.Error(), "ip-refresh-period")
+		}
+	}
 }
@@ -5,48 +5,75 @@
 package exposer
 
 import (
+	"cmp"
 	"fmt"
 	"net/netip"
+	"slices"
 
 	"github.com/siderolabs/gen/maps"
 	"go.uber.org/zap"
 
 	"github.com/siderolabs/kube-service-exposer/internal/cidrs"
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
 )
 
-// IPSetProvider is an interface for getting a set of IP addresses.
+var (
+	_ ip.NarrowingSetProvider = &FilteringIPSetProvider{}
+	_ ip.StaticSetProvider    = &FilteringIPSetProvider{}
+)
+
+// AddressProvider is an interface for getting the IP addresses of the host, mapped to the
+// names of their network interfaces.
 //
-// Refresh invalidates any cached value and returns a freshly fetched set; Get returns
+// Refresh invalidates any cached value and returns freshly fetched addresses; Get returns
 // the cached value (or fetches it on first call).
-type IPSetProvider interface {
-	Get() (map[string]struct{}, error)
-	Refresh() (map[string]struct{}, error)
+type AddressProvider interface {
+	Get() (map[string]string, error)
+	Refresh() (map[string]string, error)
 }
 
-// FilteringIPSetProvider is an IPSetProvider that filters the underlying IPSetProvider by a list of CIDRs.
+// FilteringIPSetProvider is an ip.SetProvider that filters the addresses of the underlying
+// AddressProvider by a list of CIDRs and a list of network interface name patterns.
+//
+// If both lists are empty, it will return the wildcard addresses of the wildcard families:
+// "0.0.0.0" for IPv4, "::" for IPv6.
 //
-// If the list of CIDRs is empty, it will return "0.0.0.0" as the only IP address.
+// The static bind addresses are host IP addresses whether they are assigned to the host or
+// not, on no network interface until they are, and they are not filtered.
+//
+// It implements ip.NarrowingSetProvider for the bind CIDRs and the bind interfaces of the Services,
+// and ip.StaticSetProvider for their static bind addresses.
 type FilteringIPSetProvider struct {
-	ipCache          IPSetProvider
+	ipCache          AddressProvider
 	logger           *zap.Logger
 	bindCIDRPrefixes []netip.Prefix
+	bindInterfaces   []string
+	staticAddrs      []netip.Addr
+	wildcardFamilies ip.Families
 }
 
 // NewFilteringIPSetProvider returns a new FilteringIPSetProvider.
-func NewFilteringIPSetProvider(bindCIDRs []string, underlyingProvider IPSetProvider, logger *zap.Logger) (*FilteringIPSetProvider, error) {
+//
+// The wildcard families default to IPv4 when zero.
+func NewFilteringIPSetProvider(bindCIDRs, bindInterfaces, staticBindAddresses []string, wildcardFamilies ip.Families,
+	underlyingProvider AddressProvider, logger *zap.Logger,
+) (*FilteringIPSetProvider, error) {
 	if logger == nil {
 		logger = zap.NewNop()
 	}
 
-	bindCIDRPrefixes := make([]netip.Prefix, 0, len(bindCIDRs))
+	bindCIDRPrefixes, err := cidrs.Parse(bindCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bindCIDR: %w", err)
+	}
 
-	for _, bindCIDR := range bindCIDRs {
-		prefix, err := netip.ParsePrefix(bindCIDR)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse bindCIDR: %w", err)
-		}
+	if _, err = ip.ParseInterfaceList(bindInterfaces); err != nil {
+		return nil, fmt.Errorf("failed to parse bindInterfaces: %w", err)
+	}
 
-		bindCIDRPrefixes = append(bindCIDRPrefixes, prefix)
+	staticAddrs, err := ip.ParseAddresses(staticBindAddresses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse staticBindAddresses: %w", err)
 	}
 
 	if underlyingProvider == nil {
@@ -56,38 +83,128 @@ func NewFilteringIPSetProvider(bindCIDRs []string, underlyingProvider IPSetProvi
 	return &FilteringIPSetProvider{
 		logger:           logger,
 		bindCIDRPrefixes: bindCIDRPrefixes,
+		bindInterfaces:   bindInterfaces,
+		staticAddrs:      staticAddrs,
+		wildcardFamilies: cmp.Or(wildcardFamilies, ip.FamilyIPv4),
 		ipCache:          underlyingProvider,
 	}, nil
 }
 
-// Get implements the IPSetProvider interface.
+// Get implements the ip.SetProvider interface.
 //
 // It returns the set of host IP addresses to bind the load balancer to.
 func (e *FilteringIPSetProvider) Get() (map[string]struct{}, error) {
 	return e.filter(e.ipCache.Get)
 }
 
-// Refresh implements the IPSetProvider interface. It busts the underlying cache and
+// Refresh implements the ip.SetProvider interface. It busts the underlying cache and
 // returns a freshly fetched, filtered IP set.
+//
+// The cache is busted also without bind CIDRs and bind interfaces, as the IP sets of the
+// Services with their own come from it, see GetWithin.
 func (e *FilteringIPSetProvider) Refresh() (map[string]struct{}, error) {
+	if !e.filtered() {
+		if _, err := e.ipCache.Refresh(); err != nil {
+			return nil, fmt.Errorf("failed to get all IP addresses: %w", err)
+		}
+	}
+
 	return e.filter(e.ipCache.Refresh)
 }
 
-func (e *FilteringIPSetProvider) filter(fetch func() (map[string]struct{}, error)) (map[string]struct{}, error) {
-	if len(e.bindCIDRPrefixes) == 0 {
-		e.logger.Debug("no bind CIDRs configured, use wildcard IP")
+// GetWithin implements the ip.NarrowingSetProvider interface.
+//
+// It returns the set of host IP addresses to bind the load balancer to, narrowed down to the
+// ones within the CIDRs and on the interfaces matching the patterns, unless either is empty.
+// The host IP addresses are matched also without bind CIDRs and bind interfaces.
+func (e *FilteringIPSetProvider) GetWithin(bindCIDRs []netip.Prefix, bindInterfaces []string) (map[string]struct{}, error) {
+	addrs, err := e.hostAddrs(e.ipCache.Get)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterAddrs(addrs, bindCIDRs, bindInterfaces, nil), nil
+}
+
+// GetStatic implements the ip.StaticSetProvider interface.
+//
+// It returns the set of the static bind addresses of a Service which can be host IP addresses
+// to bind the load balancer to: all of them without bind CIDRs and bind interfaces. Otherwise,
+// the ones within the bind CIDRs without bind interfaces, as the addresses which are not
+// assigned yet are on no interface, and the ones which are host IP addresses to bind to.
+func (e *FilteringIPSetProvider) GetStatic(addrs []netip.Addr) (map[string]struct{}, error) {
+	ips := make(map[string]struct{}, len(addrs))
+
+	if !e.filtered() {
+		for _, addr := range addrs {
+			ips[addr.String()] = struct{}{}
+		}
+
+		return ips, nil
+	}
+
+	hostAddrs, err := e.hostAddrs(e.ipCache.Get)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		_, isHostAddr := hostAddrs[addr.String()]
+
+		if isHostAddr || (len(e.bindInterfaces) == 0 && cidrs.Contains(e.bindCIDRPrefixes, addr.WithZone(""))) {
+			ips[addr.String()] = struct{}{}
+		} else {
+			e.logger.Debug("static bind address is not allowed", zap.Stringer("ip", addr))
+		}
+	}
+
+	return ips, nil
+}
+
+func (e *FilteringIPSetProvider) filtered() bool {
+	return len(e.bindCIDRPrefixes) > 0 || len(e.bindInterfaces) > 0
+}
+
+func (e *FilteringIPSetProvider) filter(fetch func() (map[string]string, error)) (map[string]struct{}, error) {
+	if !e.filtered() {
+		e.logger.Debug("no bind CIDRs or bind interfaces configured, use wildcard IP", zap.Stringer("families", e.wildcardFamilies))
+
+		ips := e.wildcardFamilies.Wildcards()
 
-		return map[string]struct{}{"0.0.0.0": {}}, nil
+		// the wildcard addresses cover the static bind addresses of their families
+		for _, addr := range e.staticAddrs {
+			if !e.wildcardFamilies.Contains(addr) {
+				ips[addr.String()] = struct{}{}
+			}
+		}
+
+		return ips, nil
+	}
+
+	addrs, err := e.hostAddrs(fetch)
+	if err != nil {
+		return nil, err
 	}
 
-	allIPsSet, err := fetch()
+	return filterAddrs(addrs, nil, nil, nil), nil
+}
+
+// hostAddrs returns the host IP addresses within the bind CIDRs and on the bind interfaces,
+// mapped to the names of their interfaces, or all of them without either, and the static
+// bind addresses.
+func (e *FilteringIPSetProvider) hostAddrs(fetch func() (map[string]string, error)) (map[string]string, error) {
+	allAddrs, err := fetch()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get all IP addresses: %w", err)
 	}
 
-	e.logger.Debug("filter host IP set", zap.Int("ip-count", len(allIPsSet)))
+	if !e.filtered() {
+		return e.withStaticAddrs(allAddrs, allAddrs), nil
+	}
 
-	filteredIPs := cidrs.FilterIPSet(e.bindCIDRPrefixes, allIPsSet, func(ip string, err error) {
+	e.logger.Debug("filter host IP set", zap.Int("ip-count", len(allAddrs)))
+
+	filteredIPs := filterAddrs(allAddrs, e.bindCIDRPrefixes, e.bindInterfaces, func(ip string, err error) {
 		e.logger.Info("failed to parse IP address", zap.String("ip", ip), zap.Error(err))
 	})
 
@@ -95,5 +212,70 @@ func (e *FilteringIPSetProvider) filter(fetch func() (map[string]struct{}, error
 		ce.Write(zap.Int("ip-count", len(filteredIPs)), zap.Strings("ips", maps.Keys(filteredIPs)))
 	}
 
-	return filteredIPs, nil
+	filteredAddrs := make(map[string]string, len(filteredIPs))
+
+	for ip := range filteredIPs {
+		filteredAddrs[ip] = allAddrs[ip]
+	}
+
+	return e.withStaticAddrs(filteredAddrs, allAddrs), nil
+}
+
+// withStaticAddrs returns the addresses with the static bind addresses added, on their network
+// interfaces in allAddrs, or on none. The addresses are not modified.
+func (e *FilteringIPSetProvider) withStaticAddrs(addrs, allAddrs map[string]string) map[string]string {
+	if len(e.staticAddrs) == 0 {
+		return addrs
+	}
+
+	withStatic := make(map[string]string, len(addrs)+len(e.staticAddrs))
+
+	for addr, iface := range addrs {
+		withStatic[addr] = iface
+	}
+
+	for _, addr := range e.staticAddrs {
+		withStatic[addr.String()] = allAddrs[addr.String()]
+	}
+
+	return withStatic
+}
+
+// filterAddrs returns the set of the IP addresses within the CIDRs and on the interfaces
+// matching the patterns, either of which is not filtered by when it is empty.
+func filterAddrs(addrs map[string]string, bindCIDRs []netip.Prefix, bindInterfaces []string, errHandler func(ip string, err error)) map[string]struct{} {
+	ips := make(map[string]struct{}, len(addrs))
+
+	for addr, iface := range addrs {
+		if len(bindInterfaces) == 0 || ip.MatchInterface(bindInterfaces, iface) {
+			ips[addr] = struct{}{}
+		}
+	}
+
+	if len(bindCIDRs) == 0 {
+		return ips
+	}
+
+	return cidrs.FilterIPSet(bindCIDRs, ips, errHandler)
+}
+
+// diffAddrs returns the sorted host IP addresses added to and removed from the previous ones.
+// An address which moved to another network interface is both.
+func diffAddrs(previous, current map[string]string) (added, removed []string) {
+	for addr, iface := range current {
+		if previousIface, ok := previous[addr]; !ok || previousIface != iface {
+			added = append(added, addr)
+		}
+	}
+
+	for addr, iface := range previous {
+		if currentIface, ok := current[addr]; !ok || currentIface != iface {
+			removed = append(removed, addr)
+		}
+	}
+
+	slices.Sort(added)
+	slices.Sort(removed)
+
+	return added, removed
 }
@@ -5,27 +5,36 @@
 package exposer_test
 
 import (
+	"cmp"
+	"net/netip"
 	"testing"
 
 	"github.com/siderolabs/gen/maps"
-	"github.com/siderolabs/gen/xslices"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
 
 	"github.com/siderolabs/kube-service-exposer/internal/exposer"
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
 )
 
 type mockProvider struct {
-	err error
-	ips []string
+	err    error
+	ifaces map[string]string
+	ips    []string
 }
 
-func (m *mockProvider) Get() (map[string]struct{}, error) {
-	return xslices.ToSet(m.ips), m.err
+func (m *mockProvider) Get() (map[string]string, error) {
+	addrs := make(map[string]string, len(m.ips))
+
+	for _, ip := range m.ips {
+		addrs[ip] = cmp.Or(m.ifaces[ip], "eth0")
+	}
+
+	return addrs, m.err
 }
 
-func (m *mockProvider) Refresh() (map[string]struct{}, error) {
+func (m *mockProvider) Refresh() (map[string]string, error) {
 	return m.Get()
 }
 
@@ -34,11 +43,17 @@ func TestFilteringIPSetProviderCreate(t *testing.T) {
 
 	logger := zaptest.NewLogger(t)
 
-	_, err := exposer.NewFilteringIPSetProvider([]string{}, nil, logger)
+	_, err := exposer.NewFilteringIPSetProvider([]string{}, nil, nil, 0, nil, logger)
 	assert.ErrorContains(t, err, "must not be nil")
 
-	_, err = exposer.NewFilteringIPSetProvider([]string{"172.20.0.0/24", "invalid-cidr", "192.168.2.42/32"}, &mockProvider{}, logger)
+	_, err = exposer.NewFilteringIPSetProvider([]string{"172.20.0.0/24", "invalid-cidr", "192.168.2.42/32"}, nil, nil, 0, &mockProvider{}, logger)
 	assert.ErrorContains(t, err, "failed to parse bindCIDR")
+
+	_, err = exposer.NewFilteringIPSetProvider(nil, []string{"bond0", "vlan["}, nil, 0, &mockProvider{}, logger)
+	assert.ErrorContains(t, err, "failed to parse bindInterfaces")
+
+	_, err = exposer.NewFilteringIPSetProvider(nil, nil, []string{"0.0.0.0"}, 0, &mockProvider{}, logger)
+	assert.ErrorContains(t, err, "failed to parse staticBindAddresses")
 }
 
 func TestFilteringIPSetProviderEmptyCIDRs(t *testing.T) {
@@ -51,13 +66,30 @@ func TestFilteringIPSetProviderEmptyCIDRs(t *testing.T) {
 
 	logger := zaptest.NewLogger(t)
 
-	filteringProvider, err := exposer.NewFilteringIPSetProvider([]string{}, &provider, logger)
+	filteringProvider, err := exposer.NewFilteringIPSetProvider([]string{}, nil, nil, 0, &provider, logger)
 	require.NoError(t, err)
 
 	ips, err := filteringProvider.Get()
 	require.NoError(t, err)
 
 	assert.ElementsMatch(t, maps.Keys(ips), []string{"0.0.0.0"})
+
+	for _, test := range []struct {
+		expected []string
+		families ip.Families
+	}{
+		{families: ip.FamilyIPv4, expected: []string{"0.0.0.0"}},
+		{families: ip.FamilyIPv6, expected: []string{"::"}},
+		{families: ip.FamiliesDualStack, expected: []string{"0.0.0.0", "::"}},
+	} {
+		filteringProvider, err = exposer.NewFilteringIPSetProvider(nil, nil, nil, test.families, &provider, logger)
+		require.NoError(t, err)
+
+		ips, err = filteringProvider.Get()
+		require.NoError(t, err)
+
+		assert.ElementsMatch(t, maps.Keys(ips), test.expected, test.families.String())
+	}
 }
 
 func TestFilteringIPSetProviderFilter(t *testing.T) {
@@ -70,7 +102,7 @@ func TestFilteringIPSetProviderFilter(t *testing.T) {
 
 	logger := zaptest.NewLogger(t)
 
-	filteringProvider, err := exposer.NewFilteringIPSetProvider([]string{"172.20.0.0/24", "192.168.3.0/24"}, &provider, logger)
+	filteringProvider, err := exposer.NewFilteringIPSetProvider([]string{"172.20.0.0/24", "192.168.3.0/24"}, nil, nil, 0, &provider, logger)
 	require.NoError(t, err)
 
 	ips, err := filteringProvider.Get()
@@ -78,7 +110,7 @@ func TestFilteringIPSetProviderFilter(t *testing.T) {
 
 	assert.ElementsMatch(t, maps.Keys(ips), []string{"172.20.0.42"})
 
-	filteringProvider, err = exposer.NewFilteringIPSetProvider([]string{"172.20.0.0/16", "192.168.2.0/24"}, &provider, logger)
+	filteringProvider, err = exposer.NewFilteringIPSetProvider([]string{"172.20.0.0/16", "192.168.2.0/24"}, nil, nil, 0, &provider, logger)
 	require.NoError(t, err)
 
 	ips, err = filteringProvider.Get()
@@ -86,3 +118,174 @@ func TestFilteringIPSetProviderFilter(t *testing.T) {
 
 	assert.ElementsMatch(t, maps.Keys(ips), []string{"172.20.0.42", "192.168.2.42"})
 }
+
+func TestFilteringIPSetProviderGetWithin(t *testing.T) {
+	t.Parallel()
+
+	provider := mockProvider{
+		ips: []string{"172.20.0.42", "192.168.2.42", "10.5.0.1"},
+	}
+
+	logger := zaptest.NewLogger(t)
+
+	filteringProvider, err := exposer.NewFilteringIPSetProvider(nil, nil, nil, 0, &provider, logger)
+	require.NoError(t, err)
+
+	ips, err := filteringProvider.GetWithin([]netip.Prefix{netip.MustParsePrefix("192.168.0.0/16"), netip.MustParsePrefix("10.5.0.0/16")}, nil)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"192.168.2.42", "10.5.0.1"})
+
+	// narrowed down from the global bind CIDRs
+	filteringProvider, err = exposer.NewFilteringIPSetProvider([]string{"172.20.0.0/16", "192.168.2.0/24"}, nil, nil, 0, &provider, logger)
+	require.NoError(t, err)
+
+	ips, err = filteringProvider.GetWithin([]netip.Prefix{netip.MustParsePrefix("192.168.0.0/16"), netip.MustParsePrefix("10.5.0.0/16")}, nil)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"192.168.2.42"})
+}
+
+func TestFilteringIPSetProviderInterfaces(t *testing.T) {
+	t.Parallel()
+
+	provider := mockProvider{
+		ips:    []string{"172.20.0.42", "192.168.2.42", "10.5.0.1", "10.6.0.1"},
+		ifaces: map[string]string{"192.168.2.42": "bond0", "10.5.0.1": "vlan5", "10.6.0.1": "vlan6"},
+	}
+
+	logger := zaptest.NewLogger(t)
+
+	filteringProvider, err := exposer.NewFilteringIPSetProvider(nil, []string{"bond0", "vlan*"}, nil, 0, &provider, logger)
+	require.NoError(t, err)
+
+	ips, err := filteringProvider.Get()
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"192.168.2.42", "10.5.0.1", "10.6.0.1"})
+
+	ips, err = filteringProvider.GetWithin(nil, []string{"vlan6"})
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"10.6.0.1"})
+
+	// on the interfaces, and within the CIDRs
+	filteringProvider, err = exposer.NewFilteringIPSetProvider([]string{"10.0.0.0/8"}, []string{"bond0", "vlan*"}, nil, 0, &provider, logger)
+	require.NoError(t, err)
+
+	ips, err = filteringProvider.Get()
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"10.5.0.1", "10.6.0.1"})
+
+	ips, err = filteringProvider.GetWithin([]netip.Prefix{netip.MustParsePrefix("10.5.0.0/16")}, []string{"vlan*"})
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"10.5.0.1"})
+}
+
+func TestFilteringIPSetProviderStaticBindAddresses(t *testing.T) {
+	t.Parallel()
+
+	provider := mockProvider{
+		ips:    []string{"10.5.0.1", "10.6.0.1", "192.168.2.100"},
+		ifaces: map[string]string{"10.5.0.1": "vlan5", "10.6.0.1": "vlan6", "192.168.2.100": "bond0"},
+	}
+
+	logger := zaptest.NewLogger(t)
+
+	// the static bind addresses are not filtered, and the assigned ones are on their interfaces
+	filteringProvider, err := exposer.NewFilteringIPSetProvider([]string{"10.5.0.0/16"}, nil, []string{"192.168.2.100", "192.168.2.200"}, 0,
+		&provider, logger)
+	require.NoError(t, err)
+
+	ips, err := filteringProvider.Get()
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"10.5.0.1", "192.168.2.100", "192.168.2.200"})
+
+	ips, err = filteringProvider.GetWithin([]netip.Prefix{netip.MustParsePrefix("192.168.2.0/24")}, nil)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"192.168.2.100", "192.168.2.200"})
+
+	ips, err = filteringProvider.GetWithin(nil, []string{"bond0"})
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"192.168.2.100"})
+
+	// the static bind addresses of the Services are allowed within the bind CIDRs, or if they are host IP addresses
+	ips, err = filteringProvider.GetStatic([]netip.Addr{
+		netip.MustParseAddr("10.5.0.42"),
+		netip.MustParseAddr("10.6.0.42"),
+		netip.MustParseAddr("192.168.2.200"),
+	})
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"10.5.0.42", "192.168.2.200"})
+
+	// with bind interfaces, only the host IP addresses on them are allowed
+	filteringProvider, err = exposer.NewFilteringIPSetProvider([]string{"10.0.0.0/8"}, []string{"vlan*"}, nil, 0, &provider, logger)
+	require.NoError(t, err)
+
+	ips, err = filteringProvider.GetStatic([]netip.Addr{netip.MustParseAddr("10.5.0.1"), netip.MustParseAddr("10.5.0.42")})
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"10.5.0.1"})
+
+	// the wildcard addresses cover the static bind addresses of their families
+	filteringProvider, err = exposer.NewFilteringIPSetProvider(nil, nil, []string{"192.168.2.200", "fd00::1"}, 0, &provider, logger)
+	require.NoError(t, err)
+
+	ips, err = filteringProvider.Get()
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"0.0.0.0", "fd00::1"})
+
+	ips, err = filteringProvider.GetWithin([]netip.Prefix{netip.MustParsePrefix("192.168.2.0/24")}, nil)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"192.168.2.100", "192.168.2.200"})
+
+	// all the static bind addresses of the Services are allowed
+	ips, err = filteringProvider.GetStatic([]netip.Addr{netip.MustParseAddr("10.6.0.42")})
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, maps.Keys(ips), []string{"10.6.0.42"})
+}
+
+func TestFilteringIPSetProviderIPv6(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name      string
+		ips       []string
+		bindCIDRs []string
+		expected  []string
+	}{
+		{
+			name:      "v6-only",
+			ips:       []string{"fd00:1::42", "2001:db8::42", "fe80::1%eth0"},
+			bindCIDRs: []string{"fd00::/8", "fe80::/10"},
+			expected:  []string{"fd00:1::42", "fe80::1%eth0"},
+		},
+		{
+			name:      "dual-stack",
+			ips:       []string{"172.20.0.42", "192.168.2.42", "fd00:1::42", "2001:db8::42"},
+			bindCIDRs: []string{"172.20.0.0/16", "fd00::/8"},
+			expected:  []string{"172.20.0.42", "fd00:1::42"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			filteringProvider, err := exposer.NewFilteringIPSetProvider(test.bindCIDRs, nil, nil, 0, &mockProvider{ips: test.ips}, zaptest.NewLogger(t))
+			require.NoError(t, err)
+
+			ips, err := filteringProvider.Get()
+			require.NoError(t, err)
+
+			assert.ElementsMatch(t, maps.Keys(ips), test.expected)
+		})
+	}
+}
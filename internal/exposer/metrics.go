@@ -0,0 +1,132 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package exposer
+
+import (
+	"errors"
+	"strconv"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+// metricsNamespace prefixes the names of the metrics.
+const metricsNamespace = "kube_service_exposer"
+
+// ConnectionStatsSource provides the connection counts of the mappings.
+type ConnectionStatsSource interface {
+	ConnectionStats() []ip.MappingConnectionStats
+}
+
+// ConnectionCollector is a prometheus.Collector of the connection counts of the mappings.
+type ConnectionCollector struct {
+	source ConnectionStatsSource
+
+	active      *prometheus.Desc
+	limit       *prometheus.Desc
+	rejected    *prometheus.Desc
+	rateLimited *prometheus.Desc
+	denied      *prometheus.Desc
+}
+
+// NewConnectionCollector returns a new ConnectionCollector.
+func NewConnectionCollector(source ConnectionStatsSource) *ConnectionCollector {
+	labels := []string{"namespace", "service", "host_port", "protocol", "route"}
+
+	return &ConnectionCollector{
+		source: source,
+		active: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "mapping", "connections"),
+			"Number of connections being proxied, or of requests in the http mode.", labels, nil),
+		limit: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "mapping", "connections_limit"),
+			"Maximum number of connections proxied concurrently, 0 if unlimited.", labels, nil),
+		rejected: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "mapping", "connections_rejected_total"),
+			"Number of connections rejected because of the maximum.", labels, nil),
+		rateLimited: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "mapping", "connections_rate_limited_total"),
+			"Number of connections, or of requests in the http mode, rejected because of the rate limit of their client.", labels, nil),
+		denied: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "mapping", "connections_denied_total"),
+			"Number of connections, or of requests in the http mode, rejected because their client is not in the source ranges.", labels, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *ConnectionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.active
+	ch <- c.limit
+	ch <- c.rejected
+	ch <- c.rateLimited
+	ch <- c.denied
+}
+
+// Collect implements prometheus.Collector.
+func (c *ConnectionCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, stats := range c.source.ConnectionStats() {
+		labels := []string{
+			stats.ServiceKey.Namespace,
+			stats.ServiceKey.Name,
+			strconv.Itoa(stats.Mapping.HostPort),
+			stats.Mapping.Protocol.String(),
+			stats.Mapping.Route(),
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(stats.Active), labels...)
+		ch <- prometheus.MustNewConstMetric(c.limit, prometheus.GaugeValue, float64(stats.Limit), labels...)
+		ch <- prometheus.MustNewConstMetric(c.rejected, prometheus.CounterValue, float64(stats.Rejected), labels...)
+		ch <- prometheus.MustNewConstMetric(c.rateLimited, prometheus.CounterValue, float64(stats.RateLimited), labels...)
+		ch <- prometheus.MustNewConstMetric(c.denied, prometheus.CounterValue, float64(stats.Denied), labels...)
+	}
+}
+
+// BindFailureSource provides the host IPs the host ports could not be listened on.
+type BindFailureSource interface {
+	BindFailures() []ip.BindFailure
+}
+
+// BindFailureCollector is a prometheus.Collector of the host IPs the host ports could not be
+// listened on.
+type BindFailureCollector struct {
+	source BindFailureSource
+
+	failures *prometheus.Desc
+}
+
+// NewBindFailureCollector returns a new BindFailureCollector.
+func NewBindFailureCollector(source BindFailureSource) *BindFailureCollector {
+	return &BindFailureCollector{
+		source: source,
+		failures: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "host_ip", "bind_failures"),
+			"Number of consecutive failures to listen on the host port on the host IP, which is retried.",
+			[]string{"host_port", "protocol", "ip", "reason"}, nil),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *BindFailureCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.failures
+}
+
+// Collect implements prometheus.Collector.
+func (c *BindFailureCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, failure := range c.source.BindFailures() {
+		ch <- prometheus.MustNewConstMetric(c.failures, prometheus.GaugeValue, float64(failure.Attempts),
+			strconv.Itoa(failure.HostPort), failure.Protocol.String(), failure.IP, bindFailureReason(failure.Err))
+	}
+}
+
+// bindFailureReason returns the reason of the error of listening on a host IP, in a label
+// value of few values.
+func bindFailureReason(err error) string {
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		return "address_in_use"
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return "address_not_available"
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return "permission_denied"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package exposer_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/siderolabs/kube-service-exposer/internal/exposer"
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+type mockConnectionStatsSource []ip.MappingConnectionStats
+
+func (m mockConnectionStatsSource) ConnectionStats() []ip.MappingConnectionStats {
+	return m
+}
+
+func TestConnectionCollector(t *testing.T) {
+	t.Parallel()
+
+	collector := exposer.NewConnectionCollector(mockConnectionStatsSource{
+		{
+			ServiceKey:      types.NamespacedName{Namespace: "default", Name: "ssh"},
+			Mapping:         ip.Mapping{HostPort: 2222, ServicePort: 22, MaxConnections: 10},
+			ConnectionStats: ip.ConnectionStats{Active: 3, Limit: 10, Rejected: 7, RateLimited: 42, Denied: 5},
+		},
+		{
+			ServiceKey:      types.NamespacedName{Namespace: "monitoring", Name: "grafana"},
+			Mapping:         ip.Mapping{HostPort: 80, ServicePort: 3000, Mode: ip.ModeHTTP, Host: "dash.example.com", PathPrefix: "/grafana"},
+			ConnectionStats: ip.ConnectionStats{Active: 1},
+		},
+	})
+
+	expected := `
+# HELP kube_service_exposer_mapping_connections Number of connections being proxied, or of requests in the http mode.
+# TYPE kube_service_exposer_mapping_connections gauge
+kube_service_exposer_mapping_connections{host_port="2222",namespace="default",protocol="tcp",route="",service="ssh"} 3
+kube_service_exposer_mapping_connections{host_port="80",namespace="monitoring",protocol="tcp",route="dash.example.com/grafana",service="grafana"} 1
+# HELP kube_service_exposer_mapping_connections_denied_total Number of connections, or of requests in the http mode, rejected because their client is not in the source ranges.
+# TYPE kube_service_exposer_mapping_connections_denied_total counter
+kube_service_exposer_mapping_connections_denied_total{host_port="2222",namespace="default",protocol="tcp",route="",service="ssh"} 5
+kube_service_exposer_mapping_connections_denied_total{host_port="80",namespace="monitoring",protocol="tcp",route="dash.example.com/grafana",service="grafana"} 0
+# HELP kube_service_exposer_mapping_connections_limit Maximum number of connections proxied concurrently, 0 if unlimited.
+# TYPE kube_service_exposer_mapping_connections_limit gauge
+kube_service_exposer_mapping_connections_limit{host_port="2222",namespace="default",protocol="tcp",route="",service="ssh"} 10
+kube_service_exposer_mapping_connections_limit{host_port="80",namespace="monitoring",protocol="tcp",route="dash.example.com/grafana",service="grafana"} 0
+# HELP kube_service_exposer_mapping_connections_rejected_total Number of connections rejected because of the maximum.
+# TYPE kube_service_exposer_mapping_connections_rejected_total counter
+kube_service_exposer_mapping_connections_rejected_total{host_port="2222",namespace="default",protocol="tcp",route="",service="ssh"} 7
+kube_service_exposer_mapping_connections_rejected_total{host_port="80",namespace="monitoring",protocol="tcp",route="dash.example.com/grafana",service="grafana"} 0
+# HELP kube_service_exposer_mapping_connections_rate_limited_total Number of connections, or of requests in the http mode, rejected because of the rate limit of their client.
+# TYPE kube_service_exposer_mapping_connections_rate_limited_total counter
+kube_service_exposer_mapping_connections_rate_limited_total{host_port="2222",namespace="default",protocol="tcp",route="",service="ssh"} 42
+kube_service_exposer_mapping_connections_rate_limited_total{host_port="80",namespace="monitoring",protocol="tcp",route="dash.example.com/grafana",service="grafana"} 0
+`
+
+	require.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+}
+
+type mockBindFailureSource []ip.BindFailure
+
+func (m mockBindFailureSource) BindFailures() []ip.BindFailure {
+	return m
+}
+
+func TestBindFailureCollector(t *testing.T) {
+	t.Parallel()
+
+	collector := exposer.NewBindFailureCollector(mockBindFailureSource{
+		{HostPort: 443, Protocol: ip.ProtocolTCP, IP: "192.168.2.42", Err: fmt.Errorf("failed to listen: %w", syscall.EADDRINUSE), Attempts: 3},
+		{HostPort: 53, Protocol: ip.ProtocolUDP, IP: "fd00::1", Err: errors.New("unknown"), Attempts: 1},
+	})
+
+	expected := `
+# HELP kube_service_exposer_host_ip_bind_failures Number of consecutive failures to listen on the host port on the host IP, which is retried.
+# TYPE kube_service_exposer_host_ip_bind_failures gauge
+kube_service_exposer_host_ip_bind_failures{host_port="443",ip="192.168.2.42",protocol="tcp",reason="address_in_use"} 3
+kube_service_exposer_host_ip_bind_failures{host_port="53",ip="fd00::1",protocol="udp",reason="other"} 1
+`
+
+	require.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+}
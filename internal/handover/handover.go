@@ -0,0 +1,237 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package handover passes the listening sockets from a running process to the process
+// replacing it over a Unix socket.
+//
+// The new process connects to the socket of the running one, which sends each of its
+// sockets as a message with the name of the socket and its file descriptor (SCM_RIGHTS),
+// followed by a message without a file descriptor which ends the list. The running process
+// then stops, and closes the connection once the resources the new process needs, e.g. the
+// metrics port, are released.
+package handover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// maxNameLength is the longest socket name which can be handed over.
+const maxNameLength = 1024
+
+// endOfSockets is the payload of the message ending the list of sockets.
+const endOfSockets = "."
+
+// FileSource returns the duplicates of the sockets to hand over, keyed by their names.
+type FileSource interface {
+	Files() (map[string]*os.File, error)
+}
+
+// Request receives the sockets from the process listening on the path, keyed by their names,
+// and waits for it to stop.
+//
+// It returns no sockets if there is no such process. Once the sockets are received, they are
+// returned also if the process does not stop before the context is done.
+func Request(ctx context.Context, path string, logger *zap.Logger) (map[string]*os.File, error) {
+	var d net.Dialer
+
+	c, err := d.DialContext(ctx, "unixpacket", path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			logger.Debug("no process to take over the sockets from", zap.Error(err))
+
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to connect to %s: %w", path, err)
+	}
+
+	conn := c.(*net.UnixConn) //nolint:forcetypeassert,errcheck
+
+	defer conn.Close() //nolint:errcheck
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close() //nolint:errcheck
+	})
+	defer stop()
+
+	files, err := receive(conn)
+	if err != nil {
+		for _, f := range files {
+			f.Close() //nolint:errcheck
+		}
+
+		return nil, errors.Join(fmt.Errorf("failed to receive the sockets: %w", err), ctx.Err())
+	}
+
+	logger.Info("received the sockets", zap.Strings("sockets", slices.Sorted(maps.Keys(files))))
+
+	// the other process closes the connection once it has stopped
+	if _, err = conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		logger.Warn("the process handing over the sockets did not stop in time", zap.Error(err))
+	}
+
+	return files, nil
+}
+
+func receive(conn *net.UnixConn) (map[string]*os.File, error) {
+	files := map[string]*os.File{}
+	name := make([]byte, maxNameLength)
+	oob := make([]byte, syscall.CmsgSpace(4))
+
+	for {
+		n, oobn, flags, _, err := conn.ReadMsgUnix(name, oob)
+		if err != nil {
+			return files, err
+		}
+
+		if flags&(syscall.MSG_TRUNC|syscall.MSG_CTRUNC) != 0 {
+			return files, errors.New("truncated message")
+		}
+
+		if oobn == 0 {
+			if string(name[:n]) != endOfSockets {
+				return files, errors.New("unexpected message")
+			}
+
+			return files, nil
+		}
+
+		fd, err := parseRights(oob[:oobn])
+		if err != nil {
+			return files, err
+		}
+
+		if previous, ok := files[string(name[:n])]; ok {
+			previous.Close() //nolint:errcheck
+		}
+
+		files[string(name[:n])] = os.NewFile(uintptr(fd), string(name[:n]))
+	}
+}
+
+func parseRights(oob []byte) (int, error) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return -1, err
+	}
+
+	if len(messages) != 1 {
+		return -1, fmt.Errorf("unexpected number of control messages: %d", len(messages))
+	}
+
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil {
+		return -1, err
+	}
+
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd) //nolint:errcheck
+		}
+
+		return -1, fmt.Errorf("unexpected number of file descriptors: %d", len(fds))
+	}
+
+	return fds[0], nil
+}
+
+// Server hands the sockets over to the process replacing this one.
+type Server struct {
+	listener *net.UnixListener
+	logger   *zap.Logger
+}
+
+// Listen listens on the path for a process to hand the sockets over to, replacing the socket
+// of a previous process.
+func Listen(path string, logger *zap.Logger) (*Server, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+
+	listener, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+
+	// the path is taken over by the next process, which removes it itself
+	listener.SetUnlinkOnClose(false)
+
+	return &Server{listener: listener, logger: logger}, nil
+}
+
+// Serve waits for a process to connect, and sends it the sockets. It returns the connection,
+// which is to be closed once this process has stopped, or nil once the context is done.
+//
+// A process which fails to receive the sockets is logged, and the next one is waited for. The
+// server is closed when Serve returns.
+func (s *Server) Serve(ctx context.Context, source FileSource) (io.Closer, error) {
+	defer s.listener.Close() //nolint:errcheck
+
+	stop := context.AfterFunc(ctx, func() {
+		s.listener.Close() //nolint:errcheck
+	})
+	defer stop()
+
+	for {
+		conn, err := s.listener.AcceptUnix()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil //nolint:nilnil
+			}
+
+			return nil, fmt.Errorf("failed to accept: %w", err)
+		}
+
+		files, err := source.Files()
+		if err == nil {
+			err = send(conn, files)
+		}
+
+		if err != nil {
+			s.logger.Warn("failed to hand the sockets over", zap.Error(err))
+
+			conn.Close() //nolint:errcheck
+
+			continue
+		}
+
+		s.logger.Info("handed the sockets over", zap.Strings("sockets", slices.Sorted(maps.Keys(files))))
+
+		return conn, nil
+	}
+}
+
+// send sends the files and closes them.
+func send(conn *net.UnixConn, files map[string]*os.File) error {
+	defer func() {
+		for _, f := range files {
+			f.Close() //nolint:errcheck
+		}
+	}()
+
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		if len(name) > maxNameLength {
+			return fmt.Errorf("socket name is too long: %s", name)
+		}
+
+		if _, _, err := conn.WriteMsgUnix([]byte(name), syscall.UnixRights(int(files[name].Fd())), nil); err != nil {
+			return err
+		}
+	}
+
+	_, _, err := conn.WriteMsgUnix([]byte(endOfSockets), nil, nil)
+
+	return err
+}
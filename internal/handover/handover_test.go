@@ -0,0 +1,185 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package handover_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/kube-service-exposer/internal/handover"
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+func startTCPEcho(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { ln.Close() }) //nolint:errcheck
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close() //nolint:errcheck
+
+				io.Copy(conn, conn) //nolint:errcheck
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// instance is an exposer process: its load balancers listen through its registry.
+type instance struct {
+	registry *ip.HandoverRegistry
+	lb       *ip.TCP
+}
+
+func startInstance(t *testing.T, listenAddr, upstreamAddr string) *instance {
+	t.Helper()
+
+	registry := &ip.HandoverRegistry{}
+	// connections are proxied in the background, and may outlive the test, so the
+	// per-connection debug logs are left out
+	lb := &ip.TCP{Logger: zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel)), Listeners: registry}
+
+	require.NoError(t, lb.AddRoute(listenAddr, slices.Values([]string{upstreamAddr})))
+
+	return &instance{registry: registry, lb: lb}
+}
+
+func (i *instance) stop() error {
+	return errors.Join(i.lb.Close(), i.lb.Wait())
+}
+
+func TestHandover(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	path := filepath.Join(t.TempDir(), "handover.sock")
+	upstreamAddr := startTCPEcho(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	listenAddr := ln.Addr().String()
+
+	require.NoError(t, ln.Close())
+
+	previous := startInstance(t, listenAddr, upstreamAddr)
+	require.NoError(t, previous.lb.Start())
+
+	server, err := handover.Listen(path, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		successor, err := server.Serve(ctx, previous.registry)
+		if err != nil {
+			errCh <- err
+
+			return
+		}
+
+		// the previous instance stops once it has handed over its listeners
+		errCh <- errors.Join(previous.stop(), successor.Close())
+	}()
+
+	files, err := handover.Request(ctx, path, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	require.NoError(t, <-errCh)
+
+	next := startInstance(t, listenAddr, upstreamAddr)
+	require.NoError(t, next.registry.Adopt(files))
+
+	// neither instance accepts connections now, but the listener is still open
+	conn, err := net.Dial("tcp", listenAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	require.NoError(t, next.lb.Start())
+	t.Cleanup(func() { require.NoError(t, next.stop()) })
+
+	buf := make([]byte, len("ping"))
+
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	// the next instance hands the listeners over on the same path in turn
+	server, err = handover.Listen(path, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	go func() {
+		successor, err := server.Serve(ctx, next.registry)
+		if err == nil {
+			err = successor.Close()
+		}
+
+		errCh <- err
+	}()
+
+	files, err = handover.Request(ctx, path, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	require.NoError(t, <-errCh)
+
+	assert.Len(t, files, 1)
+
+	for _, f := range files {
+		require.NoError(t, f.Close())
+	}
+}
+
+func TestRequestWithoutServer(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "handover.sock")
+
+	files, err := handover.Request(t.Context(), path, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	// the socket of a process which is gone
+	server, err := handover.Listen(path, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	successor, err := server.Serve(ctx, &ip.HandoverRegistry{})
+	require.NoError(t, err)
+	assert.Nil(t, successor)
+
+	files, err = handover.Request(t.Context(), path, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
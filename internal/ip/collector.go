@@ -7,6 +7,10 @@ package ip
 import (
 	"fmt"
 	"net"
+	"net/netip"
+	"path"
+	"slices"
+	"strings"
 )
 
 // Collector collects IP addresses on all network interfaces.
@@ -17,14 +21,18 @@ func NewCollector() *Collector {
 	return &Collector{}
 }
 
-// Get returns a set of IP addresses on all network interfaces.
-func (c *Collector) Get() (map[string]struct{}, error) {
+// Get returns the IP addresses on all network interfaces, mapped to the names of their
+// interfaces.
+//
+// The IPv6 link-local addresses have the zone of their interface, e.g. "fe80::1%eth0", as
+// they can only be listened on with it.
+func (c *Collector) Get() (map[string]string, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get interfaces: %w", err)
 	}
 
-	ips := make(map[string]struct{}, len(ifaces)*2)
+	ips := make(map[string]string, len(ifaces)*2)
 
 	for _, iface := range ifaces {
 		addrs, err := iface.Addrs()
@@ -42,9 +50,122 @@ func (c *Collector) Get() (map[string]struct{}, error) {
 				ip = v.IP
 			}
 
-			ips[ip.String()] = struct{}{}
+			if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+				ips[ip.String()+"%"+iface.Name] = iface.Name
+
+				continue
+			}
+
+			ips[ip.String()] = iface.Name
 		}
 	}
 
 	return ips, nil
 }
+
+// InterfaceList is a list of network interface name patterns in a comparable form, like
+// cidrs.List. The patterns have the syntax of path.Match, e.g. "bond0" or "vlan*".
+//
+// The zero value is an empty list.
+type InterfaceList string
+
+// ParseInterfaceList parses the interface name patterns.
+func ParseInterfaceList(patterns []string) (InterfaceList, error) {
+	for _, pattern := range patterns {
+		if pattern == "" || strings.Contains(pattern, ",") {
+			return "", fmt.Errorf("invalid interface name pattern %q", pattern)
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return "", fmt.Errorf("invalid interface name pattern %q: %w", pattern, err)
+		}
+	}
+
+	return InterfaceList(strings.Join(patterns, ",")), nil
+}
+
+// Patterns returns the interface name patterns of the list.
+func (l InterfaceList) Patterns() []string {
+	if l == "" {
+		return nil
+	}
+
+	return strings.Split(string(l), ",")
+}
+
+// MatchInterface reports whether the interface name matches any of the patterns.
+func MatchInterface(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		// the patterns are validated by ParseInterfaceList
+		matched, _ := path.Match(pattern, name) //nolint:errcheck
+
+		return matched
+	})
+}
+
+// AddressList is a list of IP addresses in a comparable form, like cidrs.List. The addresses
+// are sorted, so that the lists of the same addresses are equal.
+//
+// The zero value is an empty list.
+type AddressList string
+
+// ParseAddressList parses the IP addresses, which cannot be the wildcard addresses.
+func ParseAddressList(addrs []string) (AddressList, error) {
+	parsed, err := ParseAddresses(addrs)
+	if err != nil {
+		return "", err
+	}
+
+	strs := make([]string, 0, len(parsed))
+
+	for _, addr := range parsed {
+		strs = append(strs, addr.String())
+	}
+
+	return AddressList(strings.Join(slices.Compact(strs), ",")), nil
+}
+
+// ParseAddresses parses the IP addresses, which cannot be the wildcard addresses, and sorts them.
+func ParseAddresses(addrs []string) ([]netip.Addr, error) {
+	parsed := make([]netip.Addr, 0, len(addrs))
+
+	for _, s := range addrs {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q: %w", s, err)
+		}
+
+		if addr.IsUnspecified() {
+			return nil, fmt.Errorf("invalid IP address %q: wildcard address", s)
+		}
+
+		parsed = append(parsed, addr.Unmap())
+	}
+
+	slices.SortFunc(parsed, netip.Addr.Compare)
+
+	return parsed, nil
+}
+
+// Addrs returns the IP addresses of the list.
+func (l AddressList) Addrs() []netip.Addr {
+	if l == "" {
+		return nil
+	}
+
+	addrs := make([]netip.Addr, 0, strings.Count(string(l), ",")+1)
+
+	for s := range strings.SplitSeq(string(l), ",") {
+		// the addresses are validated by ParseAddressList
+		addr, _ := netip.ParseAddr(s) //nolint:errcheck
+
+		addrs = append(addrs, addr)
+	}
+
+	return addrs
+}
+
+// Contains reports whether the address, formatted like netip.Addr.String, is in the list.
+func (l AddressList) Contains(addr string) bool {
+	return l != "" && slices.Contains(strings.Split(string(l), ","), addr)
+}
@@ -0,0 +1,90 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Drainer is implemented by the load balancers which can wait for the connections they are
+// proxying to finish.
+type Drainer interface {
+	// Drain waits for the connections being proxied to finish after Close. Once the context
+	// is done, it closes the remaining ones, and returns the error of the context.
+	Drain(ctx context.Context) error
+}
+
+// connTracker tracks the connections being proxied, so that they can be drained.
+//
+// Zero value of connTracker is ready to use.
+type connTracker struct {
+	lock  sync.Mutex
+	conns map[io.Closer]struct{}
+
+	// drained is closed once there are no connections left, while drain is waiting for it.
+	drained chan struct{}
+}
+
+// track adds the connection, closing it closes the connection for good. The returned
+// function removes it once it is done.
+func (t *connTracker) track(conn io.Closer) (untrack func()) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.conns == nil {
+		t.conns = map[io.Closer]struct{}{}
+	}
+
+	t.conns[conn] = struct{}{}
+
+	return func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+
+		delete(t.conns, conn)
+
+		if len(t.conns) == 0 && t.drained != nil {
+			close(t.drained)
+			t.drained = nil
+		}
+	}
+}
+
+// drain waits for the tracked connections to be done. Once the context is done, it closes
+// them, waits for them to be done anyway, and returns the error of the context.
+func (t *connTracker) drain(ctx context.Context) error {
+	t.lock.Lock()
+
+	if len(t.conns) == 0 {
+		t.lock.Unlock()
+
+		return nil
+	}
+
+	drained := make(chan struct{})
+	t.drained = drained
+
+	t.lock.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	t.lock.Lock()
+
+	for conn := range t.conns {
+		conn.Close() //nolint:errcheck
+	}
+
+	t.lock.Unlock()
+
+	<-drained
+
+	return ctx.Err()
+}
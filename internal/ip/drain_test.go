@@ -0,0 +1,177 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+func TestTCPDrain(t *testing.T) {
+	t.Parallel()
+
+	lb := &ip.TCP{Logger: tcpTestLogger(t)}
+	listenAddr := freeTCPAddr(t)
+
+	require.NoError(t, lb.AddRoute(listenAddr, slices.Values([]string{startTCPEcho(t)})))
+	require.NoError(t, lb.Start())
+
+	conn, err := dialEcho(t, listenAddr)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.Close())
+	require.NoError(t, lb.Wait())
+
+	// no new connections are accepted
+	_, err = net.Dial("tcp", listenAddr)
+	require.Error(t, err)
+
+	drainErrCh := make(chan error, 1)
+
+	go func() {
+		drainErrCh <- lb.Drain(t.Context())
+	}()
+
+	// the connection being proxied keeps working until it is done
+	_, err = conn.Write([]byte("pong"))
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(conn, make([]byte, len("pong")))
+	require.NoError(t, err)
+
+	select {
+	case err = <-drainErrCh:
+		require.Failf(t, "drain returned with a connection being proxied", "error: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, conn.Close())
+	require.NoError(t, <-drainErrCh)
+}
+
+func TestTCPDrainTimeout(t *testing.T) {
+	t.Parallel()
+
+	lb := &ip.TCP{Logger: tcpTestLogger(t)}
+	listenAddr := freeTCPAddr(t)
+
+	require.NoError(t, lb.AddRoute(listenAddr, slices.Values([]string{startTCPEcho(t)})))
+	require.NoError(t, lb.Start())
+
+	conn, err := dialEcho(t, listenAddr)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.Close())
+	require.NoError(t, lb.Wait())
+
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	t.Cleanup(cancel)
+
+	require.ErrorIs(t, lb.Drain(ctx), context.DeadlineExceeded)
+
+	// the connection was closed
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHTTPDrain(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name       string
+		timeout    time.Duration
+		statusCode int
+	}{
+		{name: "finished", timeout: time.Minute, statusCode: http.StatusNoContent},
+		{name: "forced", timeout: 100 * time.Millisecond},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			requested := make(chan struct{})
+			release := make(chan struct{})
+
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/slow" {
+					close(requested)
+
+					select {
+					case <-release:
+					case <-r.Context().Done():
+						return
+					}
+				}
+
+				w.WriteHeader(http.StatusNoContent)
+			}))
+
+			t.Cleanup(upstream.Close)
+
+			lb := &ip.HTTP{Logger: tcpTestLogger(t)}
+			listenAddr := freeTCPAddr(t)
+
+			require.NoError(t, lb.AddRoute(listenAddr, nil))
+			require.NoError(t, lb.SetBackends([]ip.Backend{{Upstreams: []string{upstream.Listener.Addr().String()}, Mapping: ip.Mapping{Mode: ip.ModeHTTP}}}))
+			require.NoError(t, lb.Start())
+
+			client := &http.Client{Timeout: 5 * time.Second}
+			t.Cleanup(client.CloseIdleConnections)
+
+			statusCodeCh := make(chan int, 1)
+
+			go func() {
+				resp, err := client.Get("http://" + listenAddr + "/slow") //nolint:noctx
+				if err != nil {
+					statusCodeCh <- 0
+
+					return
+				}
+
+				resp.Body.Close() //nolint:errcheck
+
+				statusCodeCh <- resp.StatusCode
+			}()
+
+			<-requested
+
+			require.NoError(t, lb.Close())
+			require.NoError(t, lb.Wait())
+
+			ctx, cancel := context.WithTimeout(t.Context(), test.timeout)
+			t.Cleanup(cancel)
+
+			drainErrCh := make(chan error, 1)
+
+			go func() {
+				drainErrCh <- lb.Drain(ctx)
+			}()
+
+			if test.statusCode == 0 {
+				require.ErrorIs(t, <-drainErrCh, context.DeadlineExceeded)
+			} else {
+				close(release)
+				require.NoError(t, <-drainErrCh)
+			}
+
+			// a forced request is answered by the error handler of the proxy, or not at all
+			if statusCode := <-statusCodeCh; test.statusCode != 0 {
+				assert.Equal(t, test.statusCode, statusCode)
+			} else {
+				assert.NotEqual(t, http.StatusNoContent, statusCode)
+			}
+		})
+	}
+}
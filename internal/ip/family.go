@@ -0,0 +1,104 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Families is a set of IP address families.
+//
+// The zero value is the set of all families in the context of a Mapping.
+type Families uint8
+
+// Families values.
+const (
+	FamilyIPv4 Families = 1 << iota
+	FamilyIPv6
+
+	// FamiliesDualStack is the set of both IPv4 and IPv6.
+	FamiliesDualStack = FamilyIPv4 | FamilyIPv6
+)
+
+// ParseFamilies parses a case-insensitive set of families name ("ipv4", "ipv6" or
+// "dual-stack").
+func ParseFamilies(s string) (Families, error) {
+	switch strings.ToLower(s) {
+	case "ipv4":
+		return FamilyIPv4, nil
+	case "ipv6":
+		return FamilyIPv6, nil
+	case "dual-stack":
+		return FamiliesDualStack, nil
+	default:
+		return 0, fmt.Errorf("unsupported IP families %q", s)
+	}
+}
+
+// String returns the lowercase name of the set of families.
+func (f Families) String() string {
+	switch f {
+	case FamilyIPv4:
+		return "ipv4"
+	case FamilyIPv6:
+		return "ipv6"
+	case FamiliesDualStack:
+		return "dual-stack"
+	default:
+		return "unknown(" + strconv.Itoa(int(f)) + ")"
+	}
+}
+
+// Contains reports whether the family of the address is in the set, or the set is empty.
+//
+// IPv4-mapped IPv6 addresses are of IPv4.
+func (f Families) Contains(addr netip.Addr) bool {
+	if f == 0 {
+		return true
+	}
+
+	if addr.Unmap().Is4() {
+		return f&FamilyIPv4 != 0
+	}
+
+	return f&FamilyIPv6 != 0
+}
+
+// Wildcards returns the unspecified addresses of the families, which listen on all the
+// addresses of the host: "0.0.0.0" for IPv4, "::" for IPv6.
+func (f Families) Wildcards() map[string]struct{} {
+	wildcards := make(map[string]struct{}, 2)
+
+	if f&FamilyIPv4 != 0 {
+		wildcards[netip.IPv4Unspecified().String()] = struct{}{}
+	}
+
+	if f&FamilyIPv6 != 0 {
+		wildcards[netip.IPv6Unspecified().String()] = struct{}{}
+	}
+
+	return wildcards
+}
+
+// filterFamilies returns the IP addresses of the set which are of the families, the ones which
+// do not parse are left out unless the set of families is empty.
+func filterFamilies(ips ipSet, families Families) ipSet {
+	if families == 0 {
+		return ips
+	}
+
+	filtered := make(ipSet, len(ips))
+
+	for ip := range ips {
+		if addr, err := netip.ParseAddr(ip); err == nil && families.Contains(addr) {
+			filtered[ip] = struct{}{}
+		}
+	}
+
+	return filtered
+}
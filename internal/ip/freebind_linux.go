@@ -0,0 +1,28 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// setFreeBind has the socket bind its address whether it is assigned to the host or not
+// (IP_FREEBIND), which also applies to the IPv6 sockets.
+func setFreeBind(_, _ string, conn syscall.RawConn) error {
+	var sockErr error
+
+	if err := conn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND, 1)
+	}); err != nil {
+		return err
+	}
+
+	if sockErr != nil {
+		return fmt.Errorf("failed to set IP_FREEBIND: %w", sockErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,15 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux
+
+package ip
+
+import "syscall"
+
+// setFreeBind does nothing, as the addresses can only be bound before they are assigned to the
+// host on Linux.
+func setFreeBind(_, _ string, _ syscall.RawConn) error {
+	return nil
+}
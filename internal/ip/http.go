@@ -0,0 +1,724 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siderolabs/gen/xiter"
+	"github.com/siderolabs/go-loadbalancer/upstream"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/siderolabs/kube-service-exposer/internal/proxyproto"
+)
+
+const (
+	// httpReadHeaderTimeout is how long a client has to send the headers of a request.
+	httpReadHeaderTimeout = 30 * time.Second
+
+	// httpIdleTimeout is how long a client connection is kept open between requests.
+	httpIdleTimeout = 2 * time.Minute
+)
+
+// HTTP is a load balancer for HTTP/1.1 requests, which routes each request to one of its
+// backends by the Host header and the path. It allows mappings of several Services to share
+// a host port.
+//
+// The host of a request is matched against the backends like the server name by SNI. Among
+// the backends of the matching host, the one with the longest path prefix matching the path
+// wins; if there is none, the next less specific host is tried. Requests matching no backend
+// get a 404 response.
+//
+// Requests are forwarded with their original Host header, and with X-Forwarded-For,
+// X-Forwarded-Host and X-Forwarded-Proto headers describing the client request. Protocol
+// upgrades, e.g. to WebSocket, are passed through.
+//
+// Zero value of HTTP is a valid proxy, use AddRoute to install listen addresses and
+// SetBackends to install backends.
+type HTTP struct {
+	Logger *zap.Logger
+
+	routes   map[string]*httpRoute
+	backends map[string]*httpBackend
+	// hosts are the backends by their host, sorted from the longest to the shortest path prefix
+	hosts map[string][]*httpBackend
+
+	server   *http.Server
+	conns    *connListener
+	requests connTracker
+
+	errs serveErrors
+	wg   sync.WaitGroup
+
+	// AcceptProxyProtocol requires connections to start with a PROXY protocol header.
+	AcceptProxyProtocol bool
+
+	// ProxyProtocolTrustedCIDRs are the source CIDRs which are allowed to send a PROXY
+	// protocol header when AcceptProxyProtocol is set. When empty, no source is trusted.
+	ProxyProtocolTrustedCIDRs []netip.Prefix
+
+	// Listeners opens the listeners of the routes. They are opened directly when it is nil.
+	Listeners ListenerRegistry
+
+	// StaticBindAddresses are the host IPs of the routes which are bound whether they are
+	// assigned to the host or not, see Mapping.StaticBindAddresses.
+	StaticBindAddresses AddressList
+
+	lock         sync.Mutex
+	backendsLock sync.RWMutex
+	started      bool
+	closed       bool
+}
+
+type httpRoute struct {
+	listener   net.Listener
+	logger     *zap.Logger
+	listenAddr string
+}
+
+type httpBackend struct {
+	list      *upstream.List[tcpNode]
+	limiter   *connLimiter
+	transport *http.Transport
+	proxy     *httputil.ReverseProxy
+
+	upstreams  []string // host:port
+	host       string
+	pathPrefix string
+	mapping    Mapping
+}
+
+// httpConn is a client connection prepared for the HTTP server.
+type httpConn struct {
+	net.Conn
+
+	header proxyproto.Header
+}
+
+// RemoteAddr returns the address of the client, which is the one reported by a downstream
+// load balancer if the connection was accepted with a PROXY protocol header.
+func (c *httpConn) RemoteAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.header.Source)
+}
+
+// httpConnKey is the context key of the *httpConn a request was received on.
+type httpConnKey struct{}
+
+// AddRoute installs the listen address ipPort.
+//
+// Upstreams are set per backend with SetBackends, so upstreamAddrs must be empty. A route
+// added after Start is listened on right away, see RouteRemover.
+func (h *HTTP) AddRoute(ipPort string, upstreamAddrs iter.Seq[string], _ ...upstream.ListOption) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed {
+		return net.ErrClosed
+	}
+
+	if _, ok := h.routes[ipPort]; ok && h.started {
+		return fmt.Errorf("route %s already exists", ipPort)
+	}
+
+	if upstreamAddrs != nil {
+		for range upstreamAddrs {
+			return errors.New("upstreams are set per backend")
+		}
+	}
+
+	if h.Logger == nil {
+		h.Logger = zap.NewNop()
+	}
+
+	if h.routes == nil {
+		h.routes = map[string]*httpRoute{}
+	}
+
+	route := &httpRoute{
+		logger:     h.Logger.With(zap.String("listen-addr", ipPort)),
+		listenAddr: ipPort,
+	}
+
+	if h.started {
+		ln, err := listen(h.Listeners, ipPort, h.StaticBindAddresses)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", ipPort, err)
+		}
+
+		route.listener = ln
+
+		h.wg.Go(func() {
+			h.errs.record(h.serve(route))
+		})
+	}
+
+	h.routes[ipPort] = route
+
+	return nil
+}
+
+// RemoveRoute implements RouteRemover.
+func (h *HTTP) RemoveRoute(ipPort string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed {
+		return net.ErrClosed
+	}
+
+	route, ok := h.routes[ipPort]
+	if !ok {
+		return fmt.Errorf("route %s does not exist", ipPort)
+	}
+
+	delete(h.routes, ipPort)
+
+	if route.listener != nil {
+		route.listener.Close() //nolint:errcheck
+	}
+
+	return nil
+}
+
+// SetBackends implements BackendSetter.
+//
+// The backends are keyed by the host and path prefix of their mapping, which must be in
+// ModeHTTP. Backends whose upstream does not change keep their upstream health state.
+func (h *HTTP) SetBackends(backends []Backend, options ...upstream.ListOption) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed {
+		return net.ErrClosed
+	}
+
+	if h.Logger == nil {
+		h.Logger = zap.NewNop()
+	}
+
+	h.backendsLock.RLock()
+	current := h.backends
+	h.backendsLock.RUnlock()
+
+	updated := make(map[string]*httpBackend, len(backends))
+
+	for _, backend := range backends {
+		route := backend.Mapping.Route()
+
+		if backend.Mapping.Mode != ModeHTTP {
+			return fmt.Errorf("backend for route %q is not in %s mode", route, ModeHTTP)
+		}
+
+		if _, ok := updated[route]; ok {
+			return fmt.Errorf("duplicate backend for route %q", route)
+		}
+
+		if backend.Mapping.TLSSecret != (types.NamespacedName{}) {
+			return fmt.Errorf("backend for route %q terminates TLS, which is not supported in %s mode", route, ModeHTTP)
+		}
+
+		updated[route] = &httpBackend{
+			upstreams:  backend.Upstreams,
+			host:       strings.ToLower(cmp.Or(backend.Mapping.Host, DefaultServerName)),
+			pathPrefix: cmp.Or(backend.Mapping.PathPrefix, "/"),
+			mapping:    backend.Mapping,
+		}
+	}
+
+	var created []*upstream.List[tcpNode]
+
+	for route, backend := range updated {
+		existing, ok := current[route]
+		if ok && slices.Equal(existing.upstreams, backend.upstreams) && existing.mapping == backend.mapping {
+			updated[route] = existing
+
+			continue
+		}
+
+		var existingLimiter *connLimiter
+
+		if ok {
+			existingLimiter = existing.limiter
+		}
+
+		backend.limiter = reuseConnLimiter(existingLimiter, backend.mapping)
+
+		nodes := xiter.Map(func(addr string) tcpNode { return tcpNode{address: addr} }, slices.Values(backend.upstreams))
+
+		if ok && existing.mapping.Timeouts == backend.mapping.Timeouts {
+			backend.list = existing.list
+
+			if !slices.Equal(existing.upstreams, backend.upstreams) {
+				backend.list.Reconcile(nodes)
+			}
+		} else {
+			list, err := upstream.NewListWithCmp(
+				nodes,
+				func(a, b tcpNode) bool { return a.address == b.address },
+				append(slices.Clone(options), backend.mapping.Timeouts.listOptions()...)...,
+			)
+			if err != nil {
+				for _, list := range created {
+					list.Shutdown()
+				}
+
+				return err
+			}
+
+			backend.list = list
+			created = append(created, list)
+		}
+
+		h.setupProxy(backend)
+	}
+
+	hosts := map[string][]*httpBackend{}
+
+	for _, backend := range updated {
+		hosts[backend.host] = append(hosts[backend.host], backend)
+	}
+
+	for _, hostBackends := range hosts {
+		slices.SortFunc(hostBackends, func(a, b *httpBackend) int {
+			return cmp.Compare(len(b.pathPrefix), len(a.pathPrefix))
+		})
+	}
+
+	h.backendsLock.Lock()
+	h.backends = updated
+	h.hosts = hosts
+	h.backendsLock.Unlock()
+
+	for route, backend := range current {
+		kept, ok := updated[route]
+
+		if !ok || kept != backend {
+			backend.transport.CloseIdleConnections()
+		}
+
+		if !ok || kept.list != backend.list {
+			backend.list.Shutdown()
+		}
+	}
+
+	return nil
+}
+
+// setupProxy creates the reverse proxy of the backend.
+func (h *HTTP) setupProxy(backend *httpBackend) {
+	logger := h.Logger.With(zap.String("route", backend.mapping.Route()))
+
+	backend.transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return h.dial(ctx, backend)
+		},
+		// a PROXY protocol header describes a single client, so upstream connections can't
+		// be reused for other clients
+		DisableKeepAlives: backend.mapping.ProxyProtocol != proxyproto.VersionNone,
+		IdleConnTimeout:   httpIdleTimeout,
+	}
+
+	backend.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			// the upstream is picked when dialing, the host only keys the idle connections
+			r.SetURL(&url.URL{Scheme: "http", Host: "upstream"})
+			r.Out.Host = r.In.Host
+			r.SetXForwarded()
+		},
+		Transport: backend.transport,
+		ErrorLog:  zap.NewStdLog(logger),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Warn("error proxying request",
+				zap.String("client-addr", r.RemoteAddr),
+				zap.Strings("upstream-addrs", backend.upstreams),
+				zap.Error(err),
+			)
+
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// dial connects to an upstream of the backend, sending it a PROXY protocol header describing
+// the client of the request if the backend is configured to.
+func (h *HTTP) dial(ctx context.Context, backend *httpBackend) (net.Conn, error) {
+	upstreamNode, err := backend.list.Pick()
+	if err != nil {
+		return nil, errors.New("no upstreams available")
+	}
+
+	conn, err := backend.mapping.Timeouts.dialUpstream(upstreamNode.address)
+	if err != nil {
+		backend.list.Down(upstreamNode)
+
+		return nil, err
+	}
+
+	if backend.mapping.ProxyProtocol == proxyproto.VersionNone {
+		return conn, nil
+	}
+
+	client, ok := ctx.Value(httpConnKey{}).(*httpConn)
+	if !ok {
+		conn.Close() //nolint:errcheck
+
+		return nil, errors.New("no client connection to send the PROXY protocol header for")
+	}
+
+	header, err := client.header.Format(backend.mapping.ProxyProtocol)
+	if err != nil {
+		conn.Close() //nolint:errcheck
+
+		return nil, err
+	}
+
+	if _, err = conn.Write(header); err != nil {
+		conn.Close() //nolint:errcheck
+
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Start opens a listener for each route and starts proxying.
+//
+// If it returns a non-nil error, any successfully opened listeners are closed.
+func (h *HTTP) Start() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.started {
+		return errors.New("already started")
+	}
+
+	if h.Logger == nil {
+		h.Logger = zap.NewNop()
+	}
+
+	h.started = true
+
+	for _, route := range h.routes {
+		ln, err := listen(h.Listeners, route.listenAddr, h.StaticBindAddresses)
+		if err != nil {
+			h.closeNoLock()
+
+			return fmt.Errorf("failed to listen on %s: %w", route.listenAddr, err)
+		}
+
+		route.listener = ln
+	}
+
+	h.conns = newConnListener()
+	h.server = &http.Server{
+		Handler:           http.HandlerFunc(h.serveHTTP),
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		IdleTimeout:       httpIdleTimeout,
+		ErrorLog:          zap.NewStdLog(h.Logger),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, httpConnKey{}, conn)
+		},
+	}
+
+	for _, route := range h.routes {
+		h.wg.Go(func() {
+			h.errs.record(h.serve(route))
+		})
+	}
+
+	h.wg.Go(func() {
+		h.errs.record(h.server.Serve(h.conns))
+	})
+
+	return nil
+}
+
+// Close closes the listeners and stops health checks on upstreams.
+//
+// Requests which are already being proxied, and connections which were upgraded to another
+// protocol, are not interrupted, see Drain.
+func (h *HTTP) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.closeNoLock()
+
+	return nil
+}
+
+// Wait waits for all routes to stop accepting connections.
+//
+// It returns the first error which caused a route to stop, other than the one caused by Close.
+func (h *HTTP) Wait() error {
+	h.wg.Wait()
+
+	return h.errs.get()
+}
+
+func (h *HTTP) closeNoLock() {
+	if h.closed {
+		return
+	}
+
+	h.closed = true
+
+	for _, route := range h.routes {
+		if route.listener != nil {
+			route.listener.Close() //nolint:errcheck
+		}
+	}
+
+	if h.conns != nil {
+		h.conns.Close() //nolint:errcheck
+	}
+
+	if h.server != nil {
+		// closes the idle connections, and the active ones once their request is done
+		h.server.SetKeepAlivesEnabled(false)
+	}
+
+	h.backendsLock.Lock()
+	defer h.backendsLock.Unlock()
+
+	for _, backend := range h.backends {
+		backend.transport.CloseIdleConnections()
+		backend.list.Shutdown()
+	}
+
+	h.backends = nil
+	h.hosts = nil
+}
+
+func (h *HTTP) serve(route *httpRoute) error {
+	for {
+		conn, err := route.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go h.handle(route, conn)
+	}
+}
+
+// handle prepares the accepted connection and hands it over to the HTTP server.
+func (h *HTTP) handle(route *httpRoute, conn net.Conn) {
+	client, err := acceptClient(conn, h.AcceptProxyProtocol, h.ProxyProtocolTrustedCIDRs)
+	if err != nil {
+		route.logger.Info("rejected connection", zap.Stringer("remote-addr", conn.RemoteAddr()), zap.Error(err))
+
+		conn.Close() //nolint:errcheck
+
+		return
+	}
+
+	h.conns.deliver(&httpConn{
+		Conn:   &prefixConn{Conn: client.Conn, prefix: client.peeked},
+		header: client.header,
+	})
+}
+
+// ConnectionStats implements ConnectionStatsProvider.
+//
+// The connections of a backend are the requests being proxied to it, including the ones
+// upgraded to another protocol.
+func (h *HTTP) ConnectionStats() map[string]ConnectionStats {
+	h.backendsLock.RLock()
+	defer h.backendsLock.RUnlock()
+
+	stats := make(map[string]ConnectionStats, len(h.backends))
+
+	for route, backend := range h.backends {
+		stats[route] = backend.limiter.stats()
+	}
+
+	return stats
+}
+
+func (h *HTTP) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	backend := h.backend(requestHost(r), r.URL.Path)
+	if backend == nil {
+		h.Logger.Debug("no backend for request",
+			zap.String("client-addr", r.RemoteAddr),
+			zap.String("host", r.Host),
+			zap.String("path", r.URL.Path),
+		)
+
+		http.Error(w, "no backend for the request", http.StatusNotFound)
+
+		return
+	}
+
+	// the remote address is the one of the client, see httpConn
+	clientAddr, _ := netip.ParseAddrPort(r.RemoteAddr) //nolint:errcheck
+
+	if !backend.limiter.allowSource(clientAddr.Addr()) {
+		h.Logger.Info("rejected request",
+			zap.String("client-addr", r.RemoteAddr),
+			zap.String("route", backend.mapping.Route()),
+			zap.Error(errSourceNotAllowed),
+		)
+
+		http.Error(w, errSourceNotAllowed.Error(), http.StatusForbidden)
+
+		return
+	}
+
+	if !backend.limiter.allowClient(clientAddr.Addr()) {
+		h.Logger.Debug("rejected request",
+			zap.String("client-addr", r.RemoteAddr),
+			zap.String("route", backend.mapping.Route()),
+			zap.Error(errRateLimited),
+		)
+
+		http.Error(w, errRateLimited.Error(), http.StatusTooManyRequests)
+
+		return
+	}
+
+	if !backend.limiter.acquire() {
+		h.Logger.Debug("rejected request",
+			zap.String("client-addr", r.RemoteAddr),
+			zap.String("route", backend.mapping.Route()),
+			zap.Error(errTooManyConnections),
+		)
+
+		http.Error(w, errTooManyConnections.Error(), http.StatusServiceUnavailable)
+
+		return
+	}
+
+	defer backend.limiter.release()
+
+	// a request is canceled when it is drained for too long, which also closes the upstream
+	// connection of an upgraded one
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	defer h.requests.track(&requestCanceler{cancel: cancel})()
+
+	backend.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// Drain implements Drainer.
+//
+// The requests being proxied are drained, including the upgraded ones, while the idle
+// connections of clients are closed right away.
+func (h *HTTP) Drain(ctx context.Context) error {
+	err := h.requests.drain(ctx)
+
+	h.lock.Lock()
+	server := h.server
+	h.lock.Unlock()
+
+	if server != nil {
+		server.Close() //nolint:errcheck
+	}
+
+	return err
+}
+
+// requestCanceler is an io.Closer canceling a request.
+type requestCanceler struct {
+	cancel context.CancelFunc
+}
+
+func (c *requestCanceler) Close() error {
+	c.cancel()
+
+	return nil
+}
+
+// backend returns the backend for the host and path, or nil if none matches.
+func (h *HTTP) backend(host, path string) *httpBackend {
+	h.backendsLock.RLock()
+	defer h.backendsLock.RUnlock()
+
+	for _, candidate := range matchingServerNames(host) {
+		for _, backend := range h.hosts[candidate] {
+			if hasPathPrefix(path, backend.pathPrefix) {
+				return backend
+			}
+		}
+	}
+
+	return nil
+}
+
+// requestHost returns the host of the request without the port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	return strings.TrimSuffix(host, ".")
+}
+
+// hasPathPrefix reports whether the path is the prefix or below it: "/app" matches "/app"
+// and "/app/index.html", but not "/application".
+func hasPathPrefix(path, prefix string) bool {
+	if prefix == "/" || path == prefix {
+		return true
+	}
+
+	return strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// connListener is a net.Listener which accepts the connections delivered to it.
+type connListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// deliver passes the connection to Accept, or closes it if the listener is closed.
+func (l *connListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close() //nolint:errcheck
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
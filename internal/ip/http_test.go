@@ -0,0 +1,309 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+	"github.com/siderolabs/kube-service-exposer/internal/proxyproto"
+)
+
+// startHTTPUpstream starts an HTTP server which responds with its name and the request details.
+func startHTTPUpstream(t *testing.T, name string) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s host=%s path=%s xff=%s proto=%s",
+			name, r.Host, r.URL.Path, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"))
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server.Listener.Addr().String()
+}
+
+func startHTTP(t *testing.T, lb *ip.HTTP, backends []ip.Backend) string {
+	t.Helper()
+
+	listenAddr := freeTCPAddr(t)
+
+	require.NoError(t, lb.AddRoute(listenAddr, nil))
+	require.NoError(t, lb.SetBackends(backends))
+	require.NoError(t, lb.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	})
+
+	return listenAddr
+}
+
+func httpGet(t *testing.T, client *http.Client, listenAddr, host, path string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "http://"+listenAddr+path, nil)
+	require.NoError(t, err)
+
+	req.Host = host
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+
+	defer resp.Body.Close() //nolint:errcheck
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp.StatusCode, string(body)
+}
+
+func TestHTTP(t *testing.T) {
+	t.Parallel()
+
+	grafana := ip.Mapping{Mode: ip.ModeHTTP, Host: "dash.example.com", PathPrefix: "/grafana"}
+	dash := ip.Mapping{Mode: ip.ModeHTTP, Host: "dash.example.com"}
+	wildcard := ip.Mapping{Mode: ip.ModeHTTP, Host: "*.example.com", PathPrefix: "/api"}
+
+	lb := &ip.HTTP{Logger: tcpTestLogger(t)}
+	listenAddr := startHTTP(t, lb, []ip.Backend{
+		{Upstreams: []string{startHTTPUpstream(t, "grafana")}, Mapping: grafana},
+		{Upstreams: []string{startHTTPUpstream(t, "dash")}, Mapping: dash},
+		{Upstreams: []string{startHTTPUpstream(t, "wildcard")}, Mapping: wildcard},
+	})
+
+	assert.ErrorContains(t, lb.AddRoute(freeTCPAddr(t), func(yield func(string) bool) { yield("127.0.0.1:80") }), "upstreams are set per backend")
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	t.Cleanup(client.CloseIdleConnections)
+
+	for _, test := range []struct {
+		host       string
+		path       string
+		expected   string
+		statusCode int
+	}{
+		{host: "dash.example.com", path: "/grafana", expected: "grafana host=dash.example.com path=/grafana"},
+		{host: "DASH.example.com:8080", path: "/grafana/d/home", expected: "grafana host=DASH.example.com:8080 path=/grafana/d/home"},
+		{host: "dash.example.com", path: "/grafana-other", expected: "dash host=dash.example.com path=/grafana-other"},
+		{host: "dash.example.com", path: "/", expected: "dash host=dash.example.com path=/"},
+		// the less specific host is used when no path prefix of the host matches
+		{host: "dash.example.com", path: "/api/v1", expected: "dash host=dash.example.com path=/api/v1"},
+		{host: "wiki.example.com", path: "/api/v1", expected: "wildcard host=wiki.example.com path=/api/v1"},
+		{host: "wiki.example.com", path: "/", statusCode: http.StatusNotFound},
+		{host: "example.org", path: "/", statusCode: http.StatusNotFound},
+	} {
+		statusCode, body := httpGet(t, client, listenAddr, test.host, test.path)
+
+		if test.statusCode != 0 {
+			assert.Equal(t, test.statusCode, statusCode, test.host+test.path)
+
+			continue
+		}
+
+		assert.Equal(t, http.StatusOK, statusCode, test.host+test.path)
+		assert.Equal(t, test.expected+" xff=127.0.0.1 proto=http", body, test.host+test.path)
+	}
+
+	// backends are replaced without restarting the listeners
+	require.NoError(t, lb.SetBackends([]ip.Backend{
+		{Upstreams: []string{startHTTPUpstream(t, "default")}, Mapping: ip.Mapping{Mode: ip.ModeHTTP}},
+	}))
+
+	statusCode, body := httpGet(t, client, listenAddr, "example.org", "/")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "default host=example.org path=/ xff=127.0.0.1 proto=http", body)
+
+	assert.ErrorContains(t, lb.SetBackends([]ip.Backend{{Upstreams: []string{"127.0.0.1:80"}, Mapping: ip.Mapping{ServerName: "example.org"}}}), "is not in http mode")
+}
+
+func TestHTTPUpstreamDown(t *testing.T) {
+	t.Parallel()
+
+	listenAddr := startHTTP(t, &ip.HTTP{Logger: tcpTestLogger(t)}, []ip.Backend{
+		{Upstreams: []string{freeTCPAddr(t)}, Mapping: ip.Mapping{Mode: ip.ModeHTTP}},
+	})
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	t.Cleanup(client.CloseIdleConnections)
+
+	statusCode, _ := httpGet(t, client, listenAddr, "example.org", "/")
+	assert.Equal(t, http.StatusBadGateway, statusCode)
+}
+
+func TestHTTPUpgrade(t *testing.T) {
+	t.Parallel()
+
+	// the upstream switches to an echo protocol on request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close() //nolint:errcheck
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n") //nolint:errcheck
+		brw.Flush()                                                                                         //nolint:errcheck
+
+		io.Copy(conn, brw) //nolint:errcheck
+	}))
+
+	t.Cleanup(upstream.Close)
+
+	listenAddr := startHTTP(t, &ip.HTTP{Logger: tcpTestLogger(t)}, []ip.Backend{
+		{Upstreams: []string{upstream.Listener.Addr().String()}, Mapping: ip.Mapping{Mode: ip.ModeHTTP}},
+	})
+
+	conn, err := net.Dial("tcp", listenAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.org\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	for _, message := range []string{"hello", "there"} {
+		_, err = conn.Write([]byte(message))
+		require.NoError(t, err)
+
+		received := make([]byte, len(message))
+
+		_, err = io.ReadFull(br, received)
+		require.NoError(t, err)
+
+		assert.Equal(t, message, string(received))
+	}
+}
+
+func TestHTTPProxyProtocol(t *testing.T) {
+	t.Parallel()
+
+	// the upstream responds with the PROXY protocol header it received
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { ln.Close() }) //nolint:errcheck
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close() //nolint:errcheck
+
+				br := bufio.NewReader(conn)
+
+				header, err := proxyproto.Read(br)
+				if err != nil {
+					return
+				}
+
+				if _, err = http.ReadRequest(br); err != nil {
+					return
+				}
+
+				body := header.Source.Addr().String()
+
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+			}()
+		}
+	}()
+
+	listenAddr := startHTTP(t, &ip.HTTP{Logger: tcpTestLogger(t)}, []ip.Backend{
+		{Upstreams: []string{ln.Addr().String()}, Mapping: ip.Mapping{Mode: ip.ModeHTTP, ProxyProtocol: proxyproto.Version2}},
+	})
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	t.Cleanup(client.CloseIdleConnections)
+
+	// every request gets its own upstream connection with a header
+	for range 2 {
+		statusCode, body := httpGet(t, client, listenAddr, "example.org", "/")
+		assert.Equal(t, http.StatusOK, statusCode)
+		assert.Equal(t, "127.0.0.1", strings.TrimSpace(body))
+	}
+}
+
+func TestHTTPMaxConnections(t *testing.T) {
+	t.Parallel()
+
+	requested := make(chan struct{})
+	release := make(chan struct{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(requested)
+			<-release
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	t.Cleanup(upstream.Close)
+
+	lb := &ip.HTTP{Logger: tcpTestLogger(t)}
+	listenAddr := startHTTP(t, lb, []ip.Backend{
+		{Upstreams: []string{upstream.Listener.Addr().String()}, Mapping: ip.Mapping{Mode: ip.ModeHTTP, MaxConnections: 1}},
+	})
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	t.Cleanup(client.CloseIdleConnections)
+
+	slowDone := make(chan struct{})
+
+	go func() {
+		defer close(slowDone)
+
+		resp, err := client.Get("http://" + listenAddr + "/slow") //nolint:noctx
+		if err == nil {
+			resp.Body.Close() //nolint:errcheck
+		}
+	}()
+
+	<-requested
+
+	// the limit applies to the requests being proxied
+	statusCode, _ := httpGet(t, client, listenAddr, "example.org", "/")
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+
+	assert.Equal(t, map[string]ip.ConnectionStats{"*/": {Active: 1, Limit: 1, Rejected: 1}}, lb.ConnectionStats())
+
+	close(release)
+	<-slowDone
+
+	statusCode, _ = httpGet(t, client, listenAddr, "example.org", "/")
+	assert.Equal(t, http.StatusNoContent, statusCode)
+}
@@ -0,0 +1,197 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/siderolabs/kube-service-exposer/internal/cidrs"
+)
+
+var (
+	// errTooManyConnections rejects a connection over the limit of its mapping.
+	errTooManyConnections = errors.New("too many connections")
+
+	// errSourceNotAllowed rejects a connection from outside the source ranges of its mapping.
+	errSourceNotAllowed = errors.New("source is not in the allowed source ranges")
+)
+
+// ConnectionStats are the connection counts of a mapping.
+type ConnectionStats struct {
+	// Active is the number of connections being proxied.
+	Active int
+
+	// Limit is the maximum number of concurrent connections, zero if unlimited.
+	Limit int
+
+	// Rejected is the number of connections rejected because of the limit.
+	Rejected uint64
+
+	// RateLimited is the number of connections rejected because of the rate limit of their
+	// client.
+	RateLimited uint64
+
+	// Denied is the number of connections rejected because their client is not in the
+	// source ranges.
+	Denied uint64
+}
+
+// ConnectionStatsProvider is implemented by the load balancers which count the connections
+// of their mappings.
+type ConnectionStatsProvider interface {
+	// ConnectionStats returns the connection counts keyed by the route of the mappings, see
+	// Mapping.Route.
+	ConnectionStats() map[string]ConnectionStats
+}
+
+// rejectionLevel returns the level to log a rejected connection at. The rejections by the
+// limits are logged at the debug level only, as the clients hitting them would flood the log.
+func rejectionLevel(err error) zapcore.Level {
+	if errors.Is(err, errTooManyConnections) || errors.Is(err, errRateLimited) {
+		return zapcore.DebugLevel
+	}
+
+	return zapcore.InfoLevel
+}
+
+// connLimiter counts the connections of a mapping, and limits which clients can connect, how
+// often each of them can, and how many connections are proxied concurrently.
+type connLimiter struct {
+	// slots has a buffered element for each connection being proxied, it is nil when the
+	// number of connections is unlimited.
+	slots chan struct{}
+	wait  time.Duration
+
+	// rate is nil when the rate of the clients is unlimited.
+	rate *rateLimiter
+
+	// sourceRanges are the CIDRs of the allowed clients, all clients are allowed when empty.
+	sourceRanges     []netip.Prefix
+	sourceRangesList cidrs.List
+
+	active   atomic.Int64
+	rejected atomic.Uint64
+	denied   atomic.Uint64
+}
+
+// newConnLimiter returns a limiter of the connections to the mapping.
+func newConnLimiter(mapping Mapping) *connLimiter {
+	l := &connLimiter{
+		wait: mapping.MaxConnectionsWait,
+		rate: newRateLimiter(mapping.RateLimit),
+
+		sourceRanges:     mapping.SourceRanges.Prefixes(),
+		sourceRangesList: mapping.SourceRanges,
+	}
+
+	if mapping.MaxConnections > 0 {
+		l.slots = make(chan struct{}, mapping.MaxConnections)
+	}
+
+	return l
+}
+
+// reuseConnLimiter returns the limiter if it applies the limits of the mapping, so that the
+// connections it counts keep counting against them, or a new one.
+func reuseConnLimiter(l *connLimiter, mapping Mapping) *connLimiter {
+	if l != nil && cap(l.slots) == mapping.MaxConnections && l.wait == mapping.MaxConnectionsWait && l.rateLimit() == mapping.RateLimit &&
+		l.sourceRangesList == mapping.SourceRanges {
+		return l
+	}
+
+	return newConnLimiter(mapping)
+}
+
+// acquire counts a new connection. If the limit is reached, it waits for up to the wait time
+// of the mapping for another connection to be released.
+//
+// It returns false if the connection is rejected, otherwise release must be called once the
+// connection is done.
+func (l *connLimiter) acquire() bool {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if !l.waitForSlot() {
+				l.rejected.Add(1)
+
+				return false
+			}
+		}
+	}
+
+	l.active.Add(1)
+
+	return true
+}
+
+func (l *connLimiter) waitForSlot() bool {
+	if l.wait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// allowSource returns false if the client is not in the source ranges of the mapping.
+func (l *connLimiter) allowSource(addr netip.Addr) bool {
+	if len(l.sourceRanges) == 0 || cidrs.Contains(l.sourceRanges, addr) {
+		return true
+	}
+
+	l.denied.Add(1)
+
+	return false
+}
+
+// allowClient returns false if the client is over the rate limit of the mapping.
+func (l *connLimiter) allowClient(addr netip.Addr) bool {
+	return l.rate.allow(addr)
+}
+
+func (l *connLimiter) rateLimit() RateLimit {
+	if l.rate == nil {
+		return RateLimit{}
+	}
+
+	return l.rate.limit
+}
+
+// release is the reverse of a successful acquire.
+func (l *connLimiter) release() {
+	l.active.Add(-1)
+
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *connLimiter) stats() ConnectionStats {
+	stats := ConnectionStats{
+		Active:   int(l.active.Load()),
+		Limit:    cap(l.slots),
+		Rejected: l.rejected.Load(),
+		Denied:   l.denied.Load(),
+	}
+
+	if l.rate != nil {
+		stats.RateLimited = l.rate.limited.Load()
+	}
+
+	return stats
+}
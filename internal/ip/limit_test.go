@@ -0,0 +1,233 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+	"github.com/siderolabs/kube-service-exposer/internal/proxyproto"
+)
+
+// dialEcho connects to the address, and returns the connection once a message made it to an
+// echo upstream and back.
+func dialEcho(t *testing.T, addr string) (net.Conn, error) {
+	t.Helper()
+
+	return dialEchoFrom(t, addr, nil)
+}
+
+// dialEchoFrom is dialEcho from the local IP.
+func dialEchoFrom(t *testing.T, addr string, localIP net.IP) (net.Conn, error) {
+	t.Helper()
+
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: localIP}}
+
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+	if err = conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(conn, make([]byte, len("ping"))); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func TestTCPMaxConnections(t *testing.T) {
+	t.Parallel()
+
+	upstreamAddr := startTCPEcho(t)
+	lb := &ip.TCP{Logger: tcpTestLogger(t), MaxConnections: 2}
+
+	// the limit applies to the connections of all routes together
+	listenAddrs := []string{freeTCPAddr(t), freeTCPAddr(t)}
+
+	for _, listenAddr := range listenAddrs {
+		require.NoError(t, lb.AddRoute(listenAddr, slices.Values([]string{upstreamAddr})))
+	}
+
+	require.NoError(t, lb.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	})
+
+	first, err := dialEcho(t, listenAddrs[0])
+	require.NoError(t, err)
+
+	_, err = dialEcho(t, listenAddrs[1])
+	require.NoError(t, err)
+
+	_, err = dialEcho(t, listenAddrs[0])
+	assert.Error(t, err)
+
+	assert.Equal(t, map[string]ip.ConnectionStats{"": {Active: 2, Limit: 2, Rejected: 1}}, lb.ConnectionStats())
+
+	require.NoError(t, first.Close())
+
+	require.Eventually(t, func() bool {
+		return lb.ConnectionStats()[""].Active == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = dialEcho(t, listenAddrs[1])
+	require.NoError(t, err)
+}
+
+func TestTCPMaxConnectionsWait(t *testing.T) {
+	t.Parallel()
+
+	listenAddr := startTCP(t, &ip.TCP{Logger: tcpTestLogger(t), MaxConnections: 1, MaxConnectionsWait: 10 * time.Second}, startTCPEcho(t))
+
+	first, err := dialEcho(t, listenAddr)
+	require.NoError(t, err)
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		_, err := dialEcho(t, listenAddr)
+		errCh <- err
+	}()
+
+	// the second connection waits for the first one to finish
+	select {
+	case err = <-errCh:
+		require.Failf(t, "connection over the limit was not queued", "error: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, first.Close())
+	require.NoError(t, <-errCh)
+}
+
+func TestTCPMaxConnectionsSlowClients(t *testing.T) {
+	t.Parallel()
+
+	listenAddr := startTCP(t, &ip.TCP{
+		Logger:                    tcpTestLogger(t),
+		MaxConnections:            1,
+		AcceptProxyProtocol:       true,
+		ProxyProtocolTrustedCIDRs: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	}, startTCPEcho(t))
+
+	// a client which does not send its PROXY protocol header does not take the only slot
+	slow, err := net.Dial("tcp", listenAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { slow.Close() }) //nolint:errcheck
+
+	header, err := proxyproto.Header{
+		Source:      netip.MustParseAddrPort("203.0.113.7:40000"),
+		Destination: netip.MustParseAddrPort("198.51.100.1:443"),
+	}.Format(proxyproto.Version1)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", listenAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write(append(header, "ping"...))
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(conn, make([]byte, len("ping")))
+	require.NoError(t, err)
+}
+
+func TestTCPSourceRanges(t *testing.T) {
+	t.Parallel()
+
+	lb := &ip.TCP{Logger: tcpTestLogger(t), SourceRanges: []netip.Prefix{netip.MustParsePrefix("127.0.0.2/32")}}
+	listenAddr := startTCP(t, lb, startTCPEcho(t))
+
+	_, err := dialEchoFrom(t, listenAddr, net.IPv4(127, 0, 0, 2))
+	require.NoError(t, err)
+
+	_, err = dialEchoFrom(t, listenAddr, net.IPv4(127, 0, 0, 3))
+	assert.Error(t, err)
+
+	assert.Equal(t, uint64(1), lb.ConnectionStats()[""].Denied)
+}
+
+func TestTCPSourceRangesBeforeMaxConnections(t *testing.T) {
+	t.Parallel()
+
+	lb := &ip.TCP{
+		Logger:             tcpTestLogger(t),
+		MaxConnections:     1,
+		MaxConnectionsWait: 10 * time.Second,
+		SourceRanges:       []netip.Prefix{netip.MustParsePrefix("127.0.0.2/32")},
+	}
+	listenAddr := startTCP(t, lb, startTCPEcho(t))
+
+	_, err := dialEchoFrom(t, listenAddr, net.IPv4(127, 0, 0, 2))
+	require.NoError(t, err)
+
+	// the client outside the source ranges is rejected right away, instead of waiting for a slot
+	start := time.Now()
+
+	_, err = dialEchoFrom(t, listenAddr, net.IPv4(127, 0, 0, 3))
+	assert.Error(t, err)
+
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, ip.ConnectionStats{Active: 1, Limit: 1, Denied: 1}, lb.ConnectionStats()[""])
+}
+
+func TestHTTPSourceRanges(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	t.Cleanup(upstream.Close)
+
+	lb := &ip.HTTP{Logger: tcpTestLogger(t)}
+	listenAddr := startHTTP(t, lb, []ip.Backend{
+		{
+			Upstreams: []string{upstream.Listener.Addr().String()},
+			Mapping:   ip.Mapping{Mode: ip.ModeHTTP, PathPrefix: "/admin", SourceRanges: "10.0.0.0/8,192.168.0.0/16"},
+		},
+		{
+			Upstreams: []string{upstream.Listener.Addr().String()},
+			Mapping:   ip.Mapping{Mode: ip.ModeHTTP, SourceRanges: "127.0.0.0/8"},
+		},
+	})
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	t.Cleanup(client.CloseIdleConnections)
+
+	statusCode, _ := httpGet(t, client, listenAddr, "example.org", "/")
+	assert.Equal(t, http.StatusNoContent, statusCode)
+
+	statusCode, _ = httpGet(t, client, listenAddr, "example.org", "/admin")
+	assert.Equal(t, http.StatusForbidden, statusCode)
+
+	assert.Equal(t, uint64(1), lb.ConnectionStats()["*/admin"].Denied)
+}
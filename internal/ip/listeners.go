@@ -0,0 +1,362 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ListenerRegistry opens the sockets the load balancers listen on.
+//
+// With freeBind, the address is bound whether it is assigned to the host or not, see
+// Mapping.StaticBindAddresses.
+//
+// The load balancers listen on their own when they have no registry.
+type ListenerRegistry interface {
+	Listen(network, address string, freeBind bool) (net.Listener, error)
+	ListenPacket(network, address string, freeBind bool) (net.PacketConn, error)
+}
+
+// listen listens on the address, binding it whether it is assigned to the host or not if it
+// is one of the static bind addresses.
+func listen(registry ListenerRegistry, address string, static AddressList) (net.Listener, error) {
+	freeBind := isStaticAddress(static, address)
+
+	if registry == nil {
+		return listenConfig(freeBind).Listen(context.Background(), listenNetwork("tcp", address), address)
+	}
+
+	return registry.Listen("tcp", address, freeBind)
+}
+
+// listenPacket is listen for the UDP sockets.
+func listenPacket(registry ListenerRegistry, address string, static AddressList) (net.PacketConn, error) {
+	freeBind := isStaticAddress(static, address)
+
+	if registry == nil {
+		return listenConfig(freeBind).ListenPacket(context.Background(), listenNetwork("udp", address), address)
+	}
+
+	return registry.ListenPacket("udp", address, freeBind)
+}
+
+// isStaticAddress reports whether the host of the listen address is one of the static bind
+// addresses.
+func isStaticAddress(static AddressList, address string) bool {
+	host, _, err := net.SplitHostPort(address)
+
+	return err == nil && static.Contains(host)
+}
+
+// listenNetwork returns the network the address is listened on with, of its family for the
+// wildcard addresses: "0.0.0.0" would otherwise be listened on as a dual-stack "::", so that
+// the IPv4 and the IPv6 wildcard addresses could not be listened on together.
+func listenNetwork(network, address string) string {
+	addr, ok := wildcardAddress(address)
+	if !ok {
+		return network
+	}
+
+	if addr.Is4() {
+		return network + "4"
+	}
+
+	return network + "6"
+}
+
+// listenConfig returns the ListenConfig an address is listened on with. With freeBind, the
+// address is bound whether it is assigned to the host or not, so that the static bind addresses
+// are listened on before they are, see Mapping.StaticBindAddresses.
+func listenConfig(freeBind bool) *net.ListenConfig {
+	if !freeBind {
+		return &net.ListenConfig{}
+	}
+
+	return &net.ListenConfig{Control: setFreeBind}
+}
+
+// wildcardAddress returns the host of the address if it is a wildcard address.
+func wildcardAddress(address string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !addr.IsUnspecified() {
+		return netip.Addr{}, false
+	}
+
+	return addr, true
+}
+
+// HandoverRegistry is a ListenerRegistry whose sockets can be handed over to another process,
+// so that the host ports keep accepting connections while the process is replaced.
+//
+// The sockets handed over by the previous process are adopted by the load balancers which
+// listen on the same address, instead of binding it again.
+//
+// Zero value of HandoverRegistry is ready to use.
+type HandoverRegistry struct {
+	// inherited are the sockets handed over by the previous process, which no load balancer
+	// has adopted yet
+	inherited map[string]any
+
+	// active are the sockets the load balancers listen on
+	active map[string]socket
+
+	lock sync.Mutex
+}
+
+// socket is a listener or a packet conn which can be duplicated.
+type socket interface {
+	File() (*os.File, error)
+}
+
+// socketName is the name a socket is handed over by, e.g. "tcp/10.0.0.1:80".
+func socketName(network, address string) string {
+	return network + "/" + address
+}
+
+// Listen adopts the inherited listener of the address, or listens on it.
+func (r *HandoverRegistry) Listen(network, address string, freeBind bool) (net.Listener, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	name := socketName(network, address)
+
+	ln, ok := r.inherited[name].(net.Listener)
+	if ok {
+		delete(r.inherited, name)
+	} else {
+		var err error
+
+		if ln, err = listenConfig(freeBind).Listen(context.Background(), listenNetwork(network, address), address); err != nil {
+			return nil, err
+		}
+	}
+
+	s, ok := ln.(socket)
+	if !ok {
+		return ln, nil
+	}
+
+	registered := &registeredListener{Listener: ln}
+	registered.unregister = r.register(name, s)
+
+	return registered, nil
+}
+
+// ListenPacket adopts the inherited packet conn of the address, or listens on it.
+func (r *HandoverRegistry) ListenPacket(network, address string, freeBind bool) (net.PacketConn, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	name := socketName(network, address)
+
+	conn, ok := r.inherited[name].(net.PacketConn)
+	if ok {
+		delete(r.inherited, name)
+	} else {
+		var err error
+
+		if conn, err = listenConfig(freeBind).ListenPacket(context.Background(), listenNetwork(network, address), address); err != nil {
+			return nil, err
+		}
+	}
+
+	s, ok := conn.(socket)
+	if !ok {
+		return conn, nil
+	}
+
+	registered := &registeredPacketConn{PacketConn: conn}
+	registered.unregister = r.register(name, s)
+
+	return registered, nil
+}
+
+// register records the active socket, the returned function removes it once it is closed.
+func (r *HandoverRegistry) register(name string, s socket) (unregister func()) {
+	if r.active == nil {
+		r.active = map[string]socket{}
+	}
+
+	r.active[name] = s
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+
+			if r.active[name] == s {
+				delete(r.active, name)
+			}
+		})
+	}
+}
+
+// Adopt takes the sockets handed over by the previous process, keyed by their names. The
+// files are closed, whether they are adopted or not.
+func (r *HandoverRegistry) Adopt(files map[string]*os.File) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.inherited == nil {
+		r.inherited = map[string]any{}
+	}
+
+	var errs []error
+
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		if err := r.adopt(name, files[name]); err != nil {
+			errs = append(errs, fmt.Errorf("failed to adopt %s: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (r *HandoverRegistry) adopt(name string, file *os.File) error {
+	defer file.Close() //nolint:errcheck
+
+	network, _, ok := strings.Cut(name, "/")
+	if !ok {
+		return errors.New("invalid socket name")
+	}
+
+	var (
+		s   any
+		err error
+	)
+
+	switch network {
+	case "tcp":
+		s, err = net.FileListener(file)
+	case "udp":
+		s, err = net.FilePacketConn(file)
+	default:
+		err = fmt.Errorf("unsupported network %q", network)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if previous, ok := r.inherited[name].(interface{ Close() error }); ok {
+		previous.Close() //nolint:errcheck
+	}
+
+	r.inherited[name] = s
+
+	return nil
+}
+
+// Files returns duplicates of the sockets the load balancers listen on, keyed by their names,
+// to hand them over to another process. The caller closes them.
+func (r *HandoverRegistry) Files() (map[string]*os.File, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	files := make(map[string]*os.File, len(r.active))
+
+	for name, s := range r.active {
+		file, err := s.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close() //nolint:errcheck
+			}
+
+			return nil, fmt.Errorf("failed to duplicate %s: %w", name, err)
+		}
+
+		files[name] = file
+	}
+
+	return files, nil
+}
+
+// CloseUnclaimed closes the inherited sockets which no load balancer has adopted, and returns
+// their names.
+func (r *HandoverRegistry) CloseUnclaimed() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	names := slices.Sorted(maps.Keys(r.inherited))
+
+	for _, name := range names {
+		if closer, ok := r.inherited[name].(interface{ Close() error }); ok {
+			closer.Close() //nolint:errcheck
+		}
+
+		delete(r.inherited, name)
+	}
+
+	return names
+}
+
+type registeredListener struct {
+	net.Listener
+
+	unregister func()
+}
+
+func (l *registeredListener) Close() error {
+	l.unregister()
+
+	return l.Listener.Close()
+}
+
+type registeredPacketConn struct {
+	net.PacketConn
+
+	unregister func()
+}
+
+func (c *registeredPacketConn) Close() error {
+	c.unregister()
+
+	return c.PacketConn.Close()
+}
+
+// serveErrors keeps the first error which stopped a route of a load balancer from serving,
+// other than the one caused by closing it, for Wait to return.
+//
+// Zero value of serveErrors is ready to use.
+type serveErrors struct {
+	lock sync.Mutex
+	err  error
+}
+
+func (e *serveErrors) record(err error) {
+	if err == nil || errors.Is(err, net.ErrClosed) {
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *serveErrors) get() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.err
+}
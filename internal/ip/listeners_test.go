@@ -0,0 +1,277 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip_test
+
+import (
+	"io"
+	"maps"
+	"net"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+// fakeListenerRegistry listens on its own, and records the addresses it listened on.
+type fakeListenerRegistry struct {
+	addresses []string
+	lock      sync.Mutex
+}
+
+func (r *fakeListenerRegistry) Listen(network, address string, _ bool) (net.Listener, error) {
+	r.record(network, address)
+
+	return net.Listen(network, address)
+}
+
+func (r *fakeListenerRegistry) ListenPacket(network, address string, _ bool) (net.PacketConn, error) {
+	r.record(network, address)
+
+	return net.ListenPacket(network, address)
+}
+
+func (r *fakeListenerRegistry) record(network, address string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.addresses = append(r.addresses, network+"/"+address)
+}
+
+func TestLoadBalancersUseListenerRegistry(t *testing.T) {
+	t.Parallel()
+
+	registry := &fakeListenerRegistry{}
+
+	provider := &ip.ProtocolLoadBalancerProvider{
+		TCP: &ip.TCPLoadBalancerProvider{Listeners: registry},
+		UDP: &ip.UDPLoadBalancerProvider{Listeners: registry},
+	}
+
+	var expected []string
+
+	for _, mapping := range []ip.Mapping{
+		{},
+		{ServerName: "example.com"},
+		{Mode: ip.ModeHTTP},
+		{Protocol: ip.ProtocolUDP},
+	} {
+		listenAddr := freeTCPAddr(t)
+		if mapping.Protocol == ip.ProtocolUDP {
+			listenAddr = freeUDPAddr(t)
+		}
+
+		expected = append(expected, mapping.Protocol.String()+"/"+listenAddr)
+
+		lb, err := provider.New(mapping, zaptest.NewLogger(t))
+		require.NoError(t, err)
+
+		require.NoError(t, lb.AddRoute(listenAddr, nil))
+		require.NoError(t, lb.Start())
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	}
+
+	assert.Equal(t, expected, registry.addresses)
+}
+
+func TestHandoverRegistry(t *testing.T) {
+	t.Parallel()
+
+	tcpUpstream := startTCPEcho(t)
+	udpUpstream := startUDPEcho(t)
+	tcpAddr := freeTCPAddr(t)
+	udpAddr := freeUDPAddr(t)
+
+	previous := &ip.HandoverRegistry{}
+
+	previousTCP := &ip.TCP{Logger: tcpTestLogger(t), Listeners: previous}
+	require.NoError(t, previousTCP.AddRoute(tcpAddr, slices.Values([]string{tcpUpstream})))
+	require.NoError(t, previousTCP.Start())
+
+	previousUDP := &ip.UDP{Logger: zaptest.NewLogger(t), Listeners: previous}
+	require.NoError(t, previousUDP.AddRoute(udpAddr, slices.Values([]string{udpUpstream})))
+	require.NoError(t, previousUDP.Start())
+
+	files, err := previous.Files()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tcp/" + tcpAddr, "udp/" + udpAddr}, slices.Sorted(maps.Keys(files)))
+
+	registry := &ip.HandoverRegistry{}
+	require.NoError(t, registry.Adopt(files))
+
+	require.NoError(t, previousTCP.Close())
+	require.NoError(t, previousTCP.Wait())
+	require.NoError(t, previousUDP.Close())
+	require.NoError(t, previousUDP.Wait())
+
+	// the closed listeners are not handed over anymore
+	files, err = previous.Files()
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	// the listener is still open, so the connection waits to be accepted
+	conn, err := net.Dial("tcp", tcpAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	lb := &ip.TCP{Logger: tcpTestLogger(t), Listeners: registry}
+	require.NoError(t, lb.AddRoute(tcpAddr, slices.Values([]string{tcpUpstream})))
+	require.NoError(t, lb.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	})
+
+	buf := make([]byte, len("ping"))
+
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	udpLB := &ip.UDP{Logger: zaptest.NewLogger(t), Listeners: registry}
+	require.NoError(t, udpLB.AddRoute(udpAddr, slices.Values([]string{udpUpstream})))
+	require.NoError(t, udpLB.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, udpLB.Close())
+		require.NoError(t, udpLB.Wait())
+	})
+
+	client, err := net.Dial("udp", udpAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { client.Close() }) //nolint:errcheck
+
+	assert.Contains(t, roundTrip(t, client, "ping"), "ping@127.0.0.1:")
+
+	// both adopted sockets can be handed over again
+	assert.Empty(t, registry.CloseUnclaimed())
+
+	files, err = registry.Files()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tcp/" + tcpAddr, "udp/" + udpAddr}, slices.Sorted(maps.Keys(files)))
+
+	for _, f := range files {
+		require.NoError(t, f.Close())
+	}
+}
+
+func TestHandoverRegistryCloseUnclaimed(t *testing.T) {
+	t.Parallel()
+
+	listenAddr := freeTCPAddr(t)
+
+	previous := &ip.HandoverRegistry{}
+
+	ln, err := previous.Listen("tcp", listenAddr, false)
+	require.NoError(t, err)
+
+	files, err := previous.Files()
+	require.NoError(t, err)
+
+	registry := &ip.HandoverRegistry{}
+	require.NoError(t, registry.Adopt(files))
+	require.NoError(t, ln.Close())
+
+	assert.Equal(t, []string{"tcp/" + listenAddr}, registry.CloseUnclaimed())
+
+	// the address is released once no process holds the listener
+	ln, err = registry.Listen("tcp", listenAddr, false)
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+}
+
+func TestHandoverRegistryWildcards(t *testing.T) {
+	t.Parallel()
+
+	probe, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+
+	port := probe.Addr().(*net.TCPAddr).Port
+
+	require.NoError(t, probe.Close())
+
+	registry := &ip.HandoverRegistry{}
+
+	// the wildcard addresses of both families are listened on separately
+	for _, address := range []string{net.JoinHostPort("0.0.0.0", strconv.Itoa(port)), net.JoinHostPort("::", strconv.Itoa(port))} {
+		ln, err := registry.Listen("tcp", address, false)
+		require.NoError(t, err)
+
+		t.Cleanup(func() { ln.Close() }) //nolint:errcheck
+	}
+}
+
+func TestHandoverRegistryUnassignedAddresses(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("the addresses can only be listened on before they are assigned on Linux")
+	}
+
+	registry := &ip.HandoverRegistry{}
+
+	// an address of TEST-NET-1 is not assigned to the host, it is only bound with freeBind
+	_, err := registry.Listen("tcp", "192.0.2.1:0", false)
+	require.ErrorIs(t, err, syscall.EADDRNOTAVAIL)
+
+	_, err = registry.ListenPacket("udp", "192.0.2.1:0", false)
+	require.ErrorIs(t, err, syscall.EADDRNOTAVAIL)
+
+	ln, err := registry.Listen("tcp", "192.0.2.1:0", true)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { ln.Close() }) //nolint:errcheck
+
+	conn, err := registry.ListenPacket("udp", "192.0.2.1:0", true)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+}
+
+func TestLoadBalancersFreeBindStaticAddresses(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("the addresses can only be listened on before they are assigned on Linux")
+	}
+
+	// only the static bind addresses are bound before they are assigned to the host
+	lb := &ip.TCP{Logger: tcpTestLogger(t), StaticBindAddresses: "198.51.100.1"}
+
+	require.NoError(t, lb.AddRoute("198.51.100.1:0", nil))
+	require.NoError(t, lb.AddRoute("198.51.100.2:0", nil))
+
+	require.ErrorIs(t, lb.Start(), syscall.EADDRNOTAVAIL)
+	require.NoError(t, lb.Wait())
+
+	udpLB := &ip.UDP{Logger: zaptest.NewLogger(t), StaticBindAddresses: "198.51.100.1"}
+
+	require.NoError(t, udpLB.AddRoute("198.51.100.1:0", nil))
+	require.NoError(t, udpLB.Start())
+
+	assert.ErrorIs(t, udpLB.AddRoute("198.51.100.2:0", nil), syscall.EADDRNOTAVAIL)
+
+	require.NoError(t, udpLB.Close())
+	require.NoError(t, udpLB.Wait())
+}
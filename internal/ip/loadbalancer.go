@@ -5,9 +5,10 @@
 package ip
 
 import (
+	"fmt"
 	"iter"
+	"net/netip"
 
-	"github.com/siderolabs/go-loadbalancer/loadbalancer"
 	"github.com/siderolabs/go-loadbalancer/upstream"
 	"go.uber.org/zap"
 )
@@ -20,20 +21,165 @@ type LoadBalancer interface {
 	Wait() error
 }
 
+// Backend is one of the destinations of a host port shared by several mappings.
+type Backend struct {
+	// Upstreams are the host:port addresses of the upstreams.
+	Upstreams []string
+	Mapping   Mapping
+}
+
+// BackendSetter is implemented by the load balancers of host ports shared by several
+// mappings, which route each connection to one of their backends.
+type BackendSetter interface {
+	// SetBackends replaces the backends, also while the load balancer is running.
+	SetBackends(backends []Backend, options ...upstream.ListOption) error
+}
+
+// UpstreamSetter is implemented by the load balancers whose upstreams can be replaced while
+// they are running.
+type UpstreamSetter interface {
+	// SetUpstreams replaces the upstreams of all routes. The upstreams which are kept keep
+	// their health state.
+	SetUpstreams(upstreamAddrs []string) error
+}
+
+// RouteRemover is implemented by the load balancers whose routes can be added and removed
+// while they are running, so that the host IPs of a host port come and go without recreating
+// the listeners of the other ones: a route added with AddRoute after Start is listened on
+// right away.
+type RouteRemover interface {
+	// RemoveRoute stops listening on the listen address ipPort. The connections accepted on
+	// it are not interrupted.
+	RemoveRoute(ipPort string) error
+}
+
 // LoadBalancerProvider is a factory for LoadBalancer instances.
+//
+// The mapping the load balancer is created for is passed in, so that providers can pick
+// the implementation and its settings per mapping.
 type LoadBalancerProvider interface {
-	New(logger *zap.Logger) (LoadBalancer, error)
+	New(mapping Mapping, logger *zap.Logger) (LoadBalancer, error)
+}
+
+// TCPLoadBalancerProvider is a LoadBalancerProvider that creates and returns TCP instances.
+type TCPLoadBalancerProvider struct {
+	// Certificates provides the certificates for mappings terminating TLS.
+	Certificates CertificateProvider
+
+	// ProxyProtocolTrustedCIDRs are the source CIDRs which are allowed to send a PROXY
+	// protocol header to mappings accepting it. When empty, no source is trusted.
+	ProxyProtocolTrustedCIDRs []netip.Prefix
+
+	// Listeners opens the listeners of the load balancers. They are opened directly when it
+	// is nil.
+	Listeners ListenerRegistry
+}
+
+// New returns a new TCP instance applying the connection handling configured in the mapping.
+//
+// For a mapping in ModeHTTP or with a server name, it returns an HTTP or SNI instance
+// instead, which is shared with the other mappings on the host port.
+func (t *TCPLoadBalancerProvider) New(mapping Mapping, logger *zap.Logger) (LoadBalancer, error) {
+	if mapping.Protocol != ProtocolTCP {
+		return nil, fmt.Errorf("unsupported protocol %s", mapping.Protocol)
+	}
+
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	if mapping.Mode == ModeHTTP {
+		return &HTTP{
+			Logger:                    logger,
+			AcceptProxyProtocol:       mapping.AcceptProxyProtocol,
+			ProxyProtocolTrustedCIDRs: t.ProxyProtocolTrustedCIDRs,
+			Listeners:                 t.Listeners,
+			StaticBindAddresses:       mapping.StaticBindAddresses,
+		}, nil
+	}
+
+	if mapping.ServerName != "" {
+		return &SNI{
+			Logger:                    logger,
+			AcceptProxyProtocol:       mapping.AcceptProxyProtocol,
+			ProxyProtocolTrustedCIDRs: t.ProxyProtocolTrustedCIDRs,
+			Certificates:              t.Certificates,
+			Listeners:                 t.Listeners,
+			StaticBindAddresses:       mapping.StaticBindAddresses,
+		}, nil
+	}
+
+	if mapping.TLSSecret.Name != "" && t.Certificates == nil {
+		return nil, fmt.Errorf("TLS termination is not available")
+	}
+
+	return &TCP{
+		Logger:                    logger,
+		AcceptProxyProtocol:       mapping.AcceptProxyProtocol,
+		ProxyProtocolTrustedCIDRs: t.ProxyProtocolTrustedCIDRs,
+		TLSSecret:                 mapping.TLSSecret,
+		Certificates:              t.Certificates,
+		ProxyProtocol:             mapping.ProxyProtocol,
+		MaxConnections:            mapping.MaxConnections,
+		MaxConnectionsWait:        mapping.MaxConnectionsWait,
+		RateLimit:                 mapping.RateLimit,
+		SourceRanges:              mapping.SourceRanges.Prefixes(),
+		Timeouts:                  mapping.Timeouts,
+		Listeners:                 t.Listeners,
+		StaticBindAddresses:       mapping.StaticBindAddresses,
+	}, nil
 }
 
-// TCPLoadBalancerProvider is a LoadBalancerProvider that creates and returns loadbalancer.TCP instances.
-type TCPLoadBalancerProvider struct{}
+// UDPLoadBalancerProvider is a LoadBalancerProvider that creates and returns UDP instances.
+type UDPLoadBalancerProvider struct {
+	// Listeners opens the sockets of the load balancers. They are opened directly when it is
+	// nil.
+	Listeners ListenerRegistry
+}
+
+// New returns a new UDP instance.
+func (u *UDPLoadBalancerProvider) New(mapping Mapping, logger *zap.Logger) (LoadBalancer, error) {
+	if mapping.Protocol != ProtocolUDP {
+		return nil, fmt.Errorf("unsupported protocol %s", mapping.Protocol)
+	}
 
-// New returns a new loadbalancer.TCP instance.
-// New returns a new loadbalancer.TCP instance.
-func (t *TCPLoadBalancerProvider) New(logger *zap.Logger) (LoadBalancer, error) {
 	if logger == nil {
 		logger = zap.NewNop()
 	}
 
-	return &loadbalancer.TCP{Logger: logger}, nil
+	return &UDP{Logger: logger, Listeners: u.Listeners, StaticBindAddresses: mapping.StaticBindAddresses}, nil
+}
+
+// ProtocolLoadBalancerProvider is a LoadBalancerProvider that delegates to a per-protocol provider.
+type ProtocolLoadBalancerProvider struct {
+	TCP LoadBalancerProvider
+	UDP LoadBalancerProvider
+
+	// NAT provides the load balancers of the mappings in ModeNAT, of either protocol.
+	NAT LoadBalancerProvider
+}
+
+// New returns a new LoadBalancer from the provider configured for the mapping protocol, or
+// mode.
+func (p *ProtocolLoadBalancerProvider) New(mapping Mapping, logger *zap.Logger) (LoadBalancer, error) {
+	var provider LoadBalancerProvider
+
+	switch {
+	case mapping.Mode == ModeNAT:
+		if p.NAT == nil {
+			return nil, fmt.Errorf("no load balancer provider for mode %s", mapping.Mode)
+		}
+
+		return p.NAT.New(mapping, logger)
+	case mapping.Protocol == ProtocolTCP:
+		provider = p.TCP
+	case mapping.Protocol == ProtocolUDP:
+		provider = p.UDP
+	}
+
+	if provider == nil {
+		return nil, fmt.Errorf("no load balancer provider for protocol %s", mapping.Protocol)
+	}
+
+	return provider.New(mapping, logger)
 }
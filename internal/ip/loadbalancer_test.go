@@ -0,0 +1,210 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip_test
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+	"github.com/siderolabs/kube-service-exposer/internal/proxyproto"
+)
+
+// startTCPEcho starts a TCP server which echoes back everything it receives.
+func startTCPEcho(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { ln.Close() }) //nolint:errcheck
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close() //nolint:errcheck
+
+				io.Copy(conn, conn) //nolint:errcheck
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func freeTCPAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := ln.Addr().String()
+
+	require.NoError(t, ln.Close())
+
+	return addr
+}
+
+// startTCPLoadBalancer starts a load balancer for the mapping from a free local port to the upstream.
+func startTCPLoadBalancer(t *testing.T, provider *ip.TCPLoadBalancerProvider, mapping ip.Mapping, upstreamAddr string) string {
+	t.Helper()
+
+	listenAddr := freeTCPAddr(t)
+
+	lb, err := provider.New(mapping, tcpTestLogger(t))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.AddRoute(listenAddr, slices.Values([]string{upstreamAddr})))
+	require.NoError(t, lb.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	})
+
+	return listenAddr
+}
+
+func TestTCPLoadBalancerProviderRejectsUDP(t *testing.T) {
+	t.Parallel()
+
+	_, err := (&ip.TCPLoadBalancerProvider{}).New(ip.Mapping{Protocol: ip.ProtocolUDP}, zaptest.NewLogger(t))
+	assert.ErrorContains(t, err, "unsupported protocol udp")
+}
+
+func TestTCPLoadBalancerProviderRequiresCertificates(t *testing.T) {
+	t.Parallel()
+
+	_, err := (&ip.TCPLoadBalancerProvider{}).New(ip.Mapping{TLSSecret: types.NamespacedName{Namespace: "default", Name: "tls"}}, zaptest.NewLogger(t))
+	assert.ErrorContains(t, err, "TLS termination is not available")
+}
+
+func TestTCPLoadBalancerProxyProtocol(t *testing.T) {
+	t.Parallel()
+
+	upstreamAddr := startTCPEcho(t)
+
+	for _, version := range []proxyproto.Version{proxyproto.VersionNone, proxyproto.Version1, proxyproto.Version2} {
+		t.Run(version.String(), func(t *testing.T) {
+			t.Parallel()
+
+			listenAddr := startTCPLoadBalancer(t, &ip.TCPLoadBalancerProvider{}, ip.Mapping{ProxyProtocol: version}, upstreamAddr)
+
+			conn, err := net.Dial("tcp", listenAddr)
+			require.NoError(t, err)
+
+			t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err)
+
+			expectedHeader, err := proxyproto.Header{
+				Source:      netip.MustParseAddrPort(conn.LocalAddr().String()),
+				Destination: netip.MustParseAddrPort(listenAddr),
+			}.Format(version)
+			require.NoError(t, err)
+
+			received := make([]byte, len(expectedHeader)+len("hello"))
+
+			_, err = io.ReadFull(conn, received)
+			require.NoError(t, err)
+
+			assert.Equal(t, string(expectedHeader), string(received[:len(expectedHeader)]))
+			assert.Equal(t, "hello", string(received[len(expectedHeader):]))
+		})
+	}
+}
+
+func TestTCPLoadBalancerAcceptProxyProtocol(t *testing.T) {
+	t.Parallel()
+
+	upstreamAddr := startTCPEcho(t)
+
+	incoming, err := proxyproto.Header{
+		Source:      netip.MustParseAddrPort("203.0.113.7:40000"),
+		Destination: netip.MustParseAddrPort("198.51.100.1:443"),
+	}.Format(proxyproto.Version2)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name         string
+		trustedCIDRs []netip.Prefix
+		send         []byte
+		expected     string
+	}{
+		{
+			name:         "trusted",
+			trustedCIDRs: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+			send:         append(incoming, "hello"...),
+			// the client address from the incoming header is passed on to the upstream
+			expected: "PROXY TCP4 203.0.113.7 198.51.100.1 40000 443\r\nhello",
+		},
+		{
+			// the client cannot claim another address without trusted CIDRs
+			name: "none trusted",
+			send: append(incoming, "hello"...),
+		},
+		{
+			name:         "untrusted",
+			trustedCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			send:         append(incoming, "hello"...),
+		},
+		{
+			name: "missing header",
+			send: []byte("hello, there is no header"),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			listenAddr := startTCPLoadBalancer(t,
+				&ip.TCPLoadBalancerProvider{ProxyProtocolTrustedCIDRs: test.trustedCIDRs},
+				ip.Mapping{AcceptProxyProtocol: true, ProxyProtocol: proxyproto.Version1},
+				upstreamAddr,
+			)
+
+			conn, err := net.Dial("tcp", listenAddr)
+			require.NoError(t, err)
+
+			t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+			_, err = conn.Write(test.send)
+			require.NoError(t, err)
+
+			if test.expected == "" {
+				// the connection is rejected
+				_, err = conn.Read(make([]byte, 1))
+				assert.Error(t, err)
+
+				return
+			}
+
+			received := make([]byte, len(test.expected))
+
+			_, err = io.ReadFull(conn, received)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, string(received))
+		})
+	}
+}
@@ -6,18 +6,23 @@ package ip
 
 import (
 	"cmp"
+	"context"
 	"errors"
 	"fmt"
 	"maps"
 	"net"
+	"net/netip"
 	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/siderolabs/go-loadbalancer/upstream"
 	"go.uber.org/zap"
 	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/siderolabs/kube-service-exposer/internal/cidrs"
+	"github.com/siderolabs/kube-service-exposer/internal/proxyproto"
 )
 
 // SetProvider is an interface for getting a set of IP addresses.
@@ -29,33 +34,463 @@ type SetProvider interface {
 	Refresh() (map[string]struct{}, error)
 }
 
-type hostPort int
+// NarrowingSetProvider is a SetProvider which narrows the set down to the IP addresses within
+// the bind CIDRs of a mapping, and on its bind interfaces, see Mapping.BindCIDRs and
+// Mapping.BindInterfaces. Either of them is not narrowed down by when it is empty.
+//
+// A SetProvider which does not implement it has its set filtered by the CIDRs instead, which
+// leaves nothing of a wildcard address, and nothing at all with bind interfaces.
+type NarrowingSetProvider interface {
+	SetProvider
+	GetWithin(cidrs []netip.Prefix, interfaces []string) (map[string]struct{}, error)
+}
+
+// StaticSetProvider is a SetProvider which narrows the static bind addresses of a mapping
+// down to the ones it allows to be listened on, see Mapping.StaticBindAddresses.
+//
+// All the static bind addresses of a SetProvider which does not implement it are listened on.
+type StaticSetProvider interface {
+	SetProvider
+	GetStatic(addrs []netip.Addr) (map[string]struct{}, error)
+}
+
+// bindFilter is what the host IP set of a mapping is narrowed down by.
+type bindFilter struct {
+	cidrs      cidrs.List
+	interfaces InterfaceList
+	static     AddressList
+	families   Families
+}
+
+func bindFilterOf(mapping Mapping) bindFilter {
+	return bindFilter{
+		cidrs:      mapping.BindCIDRs,
+		interfaces: mapping.BindInterfaces,
+		static:     mapping.StaticBindAddresses,
+		families:   mapping.Families,
+	}
+}
+
+// hostPort identifies a listener on the host: TCP and UDP mappings on the same port number
+// are independent of each other.
+type hostPort struct {
+	protocol Protocol
+	port     int
+}
+
+func (p hostPort) String() string {
+	return strconv.Itoa(p.port) + "/" + p.protocol.String()
+}
+
+func compareHostPorts(a, b hostPort) int {
+	if c := cmp.Compare(a.port, b.port); c != 0 {
+		return c
+	}
+
+	return cmp.Compare(a.protocol, b.protocol)
+}
+
+func compareServiceKeys(a, b types.NamespacedName) int {
+	if c := cmp.Compare(a.Namespace, b.Namespace); c != 0 {
+		return c
+	}
+
+	return cmp.Compare(a.Name, b.Name)
+}
 
 type ipSet map[string]struct{}
 
+// without returns the sorted IPs of the set which are not in the other one.
+func (s ipSet) without(other ipSet) []string {
+	var ips []string
+
+	for ip := range s {
+		if _, ok := other[ip]; !ok {
+			ips = append(ips, ip)
+		}
+	}
+
+	slices.Sort(ips)
+
+	return ips
+}
+
 type portMappings map[hostPort]*portMapping
 
+// portMapping is the load balancer of a host port and the mappings it serves.
+//
+// A host port is either owned by the single mapping of a Service, or shared by the mappings
+// of any number of Services which have a route, see Mapping.Route.
 type portMapping struct {
-	hostIPSet  ipSet
-	lb         LoadBalancer
+	// hostIPSet are the host IPs the host port is listened on, with a route of lb each but the
+	// failed ones. It is replaced rather than modified, as it may be shared with other host
+	// ports.
+	hostIPSet ipSet
+	lb        LoadBalancer
+
+	// failedIPs are the host IPs of hostIPSet whose route could not be added to lb, which is
+	// retried with a backoff by the retry timer, see Mapper.retryRoutes.
+	failedIPs map[string]*bindFailure
+	retry     *time.Timer
+
+	// mappings are keyed by their route, which is empty for a host port which is not shared.
+	mappings map[string]serviceMapping
+}
+
+// bindFailure is why the route of a host IP could not be added, and when it is retried.
+type bindFailure struct {
+	err      error
+	retryAt  time.Time
+	attempts int
+}
+
+type serviceMapping struct {
 	serviceKey types.NamespacedName
 	mapping    Mapping
 }
 
+func (sm serviceMapping) equal(other serviceMapping) bool {
+	return sm.serviceKey == other.serviceKey && sm.mapping.Equal(other.mapping)
+}
+
+// equalOptions is equal, ignoring the endpoints of the mappings.
+func (sm serviceMapping) equalOptions(other serviceMapping) bool {
+	return sm.serviceKey == other.serviceKey && sm.mapping.withoutEndpoints() == other.mapping.withoutEndpoints()
+}
+
+// shared reports whether the mappings share a host port by their routes.
+func shared(mappings map[string]serviceMapping) bool {
+	_, exclusive := mappings[""]
+
+	return !exclusive
+}
+
+// listenerMapping returns the mapping whose settings the listeners of the host port take:
+// the only one of a host port which is not shared, and any of a shared one, as they agree.
+func listenerMapping(mappings map[string]serviceMapping) serviceMapping {
+	return mappings[slices.Sorted(maps.Keys(mappings))[0]]
+}
+
+// canReplaceBackends reports whether the mappings of a host port can be replaced without
+// recreating its listeners.
+func canReplaceBackends(current, updated map[string]serviceMapping) bool {
+	return shared(current) && shared(updated) &&
+		listenerConflict(listenerMapping(current).mapping, listenerMapping(updated).mapping) == ""
+}
+
+// canReplaceRoutes reports whether the host IPs the host port is listened on can be replaced
+// without recreating the listeners on the other ones: its load balancer supports it, and it
+// keeps its listeners for the mappings.
+func canReplaceRoutes(pm *portMapping, mappings map[string]serviceMapping) bool {
+	if _, ok := pm.lb.(RouteRemover); !ok {
+		return false
+	}
+
+	return maps.EqualFunc(pm.mappings, mappings, serviceMapping.equal) ||
+		canReplaceBackends(pm.mappings, mappings) ||
+		canReplaceUpstreams(pm.mappings, mappings)
+}
+
+// canReplaceUpstreams reports whether the mappings of a host port which is not shared differ
+// only in their endpoints, so that the upstreams of its listeners can be replaced.
+func canReplaceUpstreams(current, updated map[string]serviceMapping) bool {
+	return !shared(current) && !shared(updated) && current[""].equalOptions(updated[""])
+}
+
+// listenerConflict returns the option which two mappings of a shared host port differ in,
+// but which its listeners can only be served with one way, or an empty string.
+func listenerConflict(a, b Mapping) string {
+	switch {
+	case a.Mode != b.Mode:
+		return "mode"
+	case a.AcceptProxyProtocol != b.AcceptProxyProtocol:
+		return "accept-proxy-protocol"
+	case a.BindCIDRs != b.BindCIDRs:
+		return "bind-cidrs"
+	case a.BindInterfaces != b.BindInterfaces:
+		return "bind-interfaces"
+	case a.StaticBindAddresses != b.StaticBindAddresses:
+		return "static-bind-addresses"
+	case a.Families != b.Families:
+		return "ip-families"
+	default:
+		return ""
+	}
+}
+
+// Protocol is the transport protocol of a Mapping.
+type Protocol int
+
+// Protocol values.
+const (
+	ProtocolTCP Protocol = iota
+	ProtocolUDP
+)
+
+// ParseProtocol parses a case-insensitive protocol name ("tcp" or "udp").
+func ParseProtocol(s string) (Protocol, error) {
+	switch strings.ToLower(s) {
+	case "tcp":
+		return ProtocolTCP, nil
+	case "udp":
+		return ProtocolUDP, nil
+	default:
+		return 0, fmt.Errorf("unsupported protocol %q", s)
+	}
+}
+
+// String returns the lowercase protocol name.
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolTCP:
+		return "tcp"
+	case ProtocolUDP:
+		return "udp"
+	default:
+		return "unknown(" + strconv.Itoa(int(p)) + ")"
+	}
+}
+
+// Mode is how the connections of a mapping are proxied.
+type Mode int
+
+// Mode values.
+const (
+	// ModeTCP proxies the connections as opaque streams.
+	ModeTCP Mode = iota
+
+	// ModeHTTP proxies HTTP/1.1 requests, see HTTP.
+	ModeHTTP
+
+	// ModeNAT has the kernel forward the connections, see NAT. Also supported for UDP.
+	ModeNAT
+)
+
+// ParseMode parses a case-insensitive mode name ("tcp", "http" or "nat").
+func ParseMode(s string) (Mode, error) {
+	switch strings.ToLower(s) {
+	case "tcp":
+		return ModeTCP, nil
+	case "http":
+		return ModeHTTP, nil
+	case "nat":
+		return ModeNAT, nil
+	default:
+		return 0, fmt.Errorf("unsupported mode %q", s)
+	}
+}
+
+// String returns the lowercase mode name.
+func (m Mode) String() string {
+	switch m {
+	case ModeTCP:
+		return "tcp"
+	case ModeHTTP:
+		return "http"
+	case ModeNAT:
+		return "nat"
+	default:
+		return "unknown(" + strconv.Itoa(int(m)) + ")"
+	}
+}
+
 // Mapping is one host-port-to-service-port pair.
+//
+// The zero Protocol is TCP. UDP mappings support only the Mode, the host IPs to listen on,
+// and the upstreams, the other options apply to TCP mappings.
 type Mapping struct {
 	HostPort    int
 	ServicePort int
+	Protocol    Protocol
+
+	// ProxyProtocol is the version of the PROXY protocol header sent to the upstream on
+	// each connection.
+	ProxyProtocol proxyproto.Version
+
+	// AcceptProxyProtocol requires connections to start with a PROXY protocol header from a
+	// downstream load balancer, whose client address is used instead of the connection's
+	// remote address.
+	AcceptProxyProtocol bool
+
+	// TLSSecret is the kubernetes.io/tls Secret to terminate TLS with, in the namespace of
+	// the Service. TLS is not terminated when it is empty.
+	TLSSecret types.NamespacedName
+
+	// ServerName shares the host port with the mappings of other Services: TLS connections
+	// are routed by the server name in their ClientHello, see SNI. It can be a wildcard for
+	// the subdomains of a domain ("*.example.com"), or DefaultServerName.
+	ServerName string
+
+	// Mode is how the connections are proxied. Only ModeTCP and ModeNAT are supported for UDP.
+	Mode Mode
+
+	// Host and PathPrefix share the host port of a ModeHTTP mapping with the mappings of
+	// other Services: requests are routed by their Host header and path, see HTTP. Host is
+	// matched like ServerName, and defaults to DefaultServerName; PathPrefix defaults to "/".
+	Host       string
+	PathPrefix string
+
+	// MaxConnections limits the number of connections proxied concurrently, across all the
+	// host IPs. It is unlimited when zero.
+	MaxConnections int
+
+	// MaxConnectionsWait is how long a connection over MaxConnections waits for another one
+	// to finish before it is rejected. It is rejected immediately when zero.
+	MaxConnectionsWait time.Duration
+
+	// RateLimit limits how often each client can connect, or send a request in ModeHTTP.
+	RateLimit RateLimit
+
+	// SourceRanges are the CIDRs of the clients allowed to connect, all clients are allowed
+	// when it is empty.
+	SourceRanges cidrs.List
+
+	// BindCIDRs narrow the host IPs the host port is listened on down to the ones within
+	// them, see NarrowingSetProvider. All the host IPs of the SetProvider are listened on
+	// when it is empty.
+	BindCIDRs cidrs.List
+
+	// BindInterfaces narrow the host IPs the host port is listened on down to the ones on the
+	// network interfaces matching them, see NarrowingSetProvider. All the host IPs of the
+	// SetProvider are listened on when it is empty.
+	BindInterfaces InterfaceList
+
+	// StaticBindAddresses are the host IPs the host port is listened on instead of the ones
+	// of the SetProvider, whether they are assigned to the host yet or not, see
+	// StaticSetProvider. They cannot be narrowed down by BindCIDRs and BindInterfaces.
+	StaticBindAddresses AddressList
+
+	// Families narrow the host IPs the host port is listened on down to the ones of the
+	// families, including the wildcard addresses. The host IPs of all families are listened
+	// on when it is zero.
+	Families Families
+
+	// Timeouts are the timeouts of the connections, and of the upstream health checks. The
+	// idle timeouts are not applied in ModeHTTP.
+	Timeouts Timeouts
+
+	// DrainTimeout is how long the connections being proxied can take to finish once the
+	// mapping is removed or recycled, before they are closed. When zero, they are closed
+	// right away.
+	DrainTimeout time.Duration
+
+	// Upstream is how the upstreams are addressed.
+	Upstream UpstreamMode
+
+	// Endpoints are the ready endpoints of the Service port, which are the upstreams in
+	// UpstreamEndpoints. They are replaced without recreating the listeners.
+	Endpoints Endpoints
+
+	// UpstreamHost is the ClusterIP of the Service in UpstreamClusterIP. The DNS name of the
+	// Service is used when it is empty, e.g. for a headless Service.
+	UpstreamHost string
 }
 
 // Equal reports whether two Mappings are identical.
 func (m Mapping) Equal(other Mapping) bool {
-	return m.HostPort == other.HostPort && m.ServicePort == other.ServicePort
+	return m == other
+}
+
+// Route returns the key which a shared host port routes connections to the mapping by: the
+// server name, or the host and path prefix of a ModeHTTP mapping. It is empty for a mapping
+// which does not share its host port.
+func (m Mapping) Route() string {
+	if m.Mode == ModeHTTP {
+		return cmp.Or(m.Host, DefaultServerName) + cmp.Or(m.PathPrefix, "/")
+	}
+
+	return m.ServerName
 }
 
-// String formats a Mapping as "host->service".
+// String formats a Mapping as "host->service/protocol", followed by its options.
 func (m Mapping) String() string {
-	return fmt.Sprintf("%d->%d", m.HostPort, m.ServicePort)
+	s := fmt.Sprintf("%d->%d/%s", m.HostPort, m.ServicePort, m.Protocol)
+
+	if m.ProxyProtocol != proxyproto.VersionNone {
+		s += " proxy-protocol=" + m.ProxyProtocol.String()
+	}
+
+	if m.AcceptProxyProtocol {
+		s += " accept-proxy-protocol"
+	}
+
+	if m.TLSSecret.Name != "" {
+		s += " tls-secret=" + m.TLSSecret.Name
+	}
+
+	if m.ServerName != "" {
+		s += " sni=" + m.ServerName
+	}
+
+	if m.Mode != ModeTCP {
+		s += " mode=" + m.Mode.String()
+	}
+
+	if m.Host != "" {
+		s += " host=" + m.Host
+	}
+
+	if m.PathPrefix != "" {
+		s += " path=" + m.PathPrefix
+	}
+
+	if m.MaxConnections > 0 {
+		s += " max-connections=" + strconv.Itoa(m.MaxConnections)
+	}
+
+	if m.MaxConnectionsWait > 0 {
+		s += " max-connections-wait=" + m.MaxConnectionsWait.String()
+	}
+
+	if m.RateLimit.Enabled() {
+		s += " rate-limit=" + m.RateLimit.String()
+	}
+
+	if m.SourceRanges != "" {
+		s += " source-ranges=" + string(m.SourceRanges)
+	}
+
+	if m.BindCIDRs != "" {
+		s += " bind-cidrs=" + string(m.BindCIDRs)
+	}
+
+	if m.BindInterfaces != "" {
+		s += " bind-interfaces=" + string(m.BindInterfaces)
+	}
+
+	if m.StaticBindAddresses != "" {
+		s += " static-bind-addresses=" + string(m.StaticBindAddresses)
+	}
+
+	if m.Families != 0 {
+		s += " ip-families=" + m.Families.String()
+	}
+
+	s += m.Timeouts.String()
+
+	if m.DrainTimeout > 0 {
+		s += " drain-timeout=" + m.DrainTimeout.String()
+	}
+
+	if m.Upstream != UpstreamDNS {
+		s += " upstream=" + m.Upstream.String()
+	}
+
+	if m.UpstreamHost != "" {
+		s += " upstream-host=" + m.UpstreamHost
+	}
+
+	return s
+}
+
+func (m Mapping) withoutEndpoints() Mapping {
+	m.Endpoints = ""
+
+	return m
+}
+
+func (m Mapping) hostPort() hostPort {
+	return hostPort{protocol: m.Protocol, port: m.HostPort}
 }
 
 // MappingSet is the desired set of port mappings for a single Service.
@@ -72,8 +507,26 @@ type Mapper struct {
 	serviceKeyToMappings   map[types.NamespacedName]portMappings
 	logger                 *zap.Logger
 	lock                   sync.Mutex
+
+	// draining counts the load balancers draining the connections of each service on a host
+	// port, the host port is not released to other services until they are done
+	draining map[hostPort]map[types.NamespacedName]int
+	drains   sync.WaitGroup
+
+	// MinBindRetryDelay is how long after the first failure the route of a host IP is added
+	// again, doubled after each failure up to MaxBindRetryDelay. They default to
+	// DefaultMinBindRetryDelay and DefaultMaxBindRetryDelay when zero, and are not changed
+	// once the Mapper is in use.
+	MinBindRetryDelay time.Duration
+	MaxBindRetryDelay time.Duration
 }
 
+// Default bind retry delays of the Mapper.
+const (
+	DefaultMinBindRetryDelay = time.Second
+	DefaultMaxBindRetryDelay = 2 * time.Minute
+)
+
 // NewMapper returns a new Mapper.
 func NewMapper(ipSetProvider SetProvider, loadBalancerController LoadBalancerProvider, logger *zap.Logger) (*Mapper, error) {
 	if ipSetProvider == nil {
@@ -87,6 +540,7 @@ func NewMapper(ipSetProvider SetProvider, loadBalancerController LoadBalancerPro
 	return &Mapper{
 		hostPortToMapping:      make(map[hostPort]*portMapping),
 		serviceKeyToMappings:   make(map[types.NamespacedName]portMappings),
+		draining:               make(map[hostPort]map[types.NamespacedName]int),
 		ipSetProvider:          ipSetProvider,
 		loadBalancerController: loadBalancerController,
 		logger:                 logger,
@@ -98,7 +552,7 @@ func NewMapper(ipSetProvider SetProvider, loadBalancerController LoadBalancerPro
 // It diffs the request against current state, removes mappings that are no longer wanted,
 // and adds new ones. Mappings whose host port, service port, and host IP set are
 // unchanged are left alone. A host port that is currently owned by a different service
-// is a hard error.
+// is a hard error, unless it is shared, see checkConflicts.
 //
 // Pure-removal calls (empty desired set) do not depend on the IP set provider. That
 // matters because Service deletions and annotation removals must succeed even when host
@@ -111,75 +565,256 @@ func (m *Mapper) Reconcile(set MappingSet) error {
 	logger := m.logger.With(zap.Stringer("svc-key", set.ServiceKey))
 	logger.Debug("reconcile mappings", zap.Int("mapping-count", len(set.Mappings)))
 
-	desired := make(map[hostPort]Mapping, len(set.Mappings))
+	desired := make(map[hostPort]map[string]Mapping, len(set.Mappings))
+
 	for _, mapping := range set.Mappings {
-		desired[hostPort(mapping.HostPort)] = mapping
+		port := mapping.hostPort()
+
+		if desired[port] == nil {
+			desired[port] = make(map[string]Mapping, 1)
+		}
+
+		desired[port][mapping.Route()] = mapping
 	}
 
-	var hostIPSet ipSet
+	hostIPSets := make(map[bindFilter]ipSet, 1)
+
+	for _, mapping := range set.Mappings {
+		filter := bindFilterOf(mapping)
+
+		if _, ok := hostIPSets[filter]; ok {
+			continue
+		}
 
-	if len(desired) > 0 {
-		ips, err := m.ipSetProvider.Get()
+		ips, err := m.hostIPSet(filter)
 		if err != nil {
 			return fmt.Errorf("failed to get matching IP set: %w", err)
 		}
 
-		hostIPSet = ips
+		hostIPSets[filter] = ips
 	}
 
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	// any desired host port already owned by a different service is a hard error.
-	for port := range desired {
-		if existing, ok := m.hostPortToMapping[port]; ok && existing.serviceKey != set.ServiceKey {
-			return fmt.Errorf("host port %d is already registered to another service: %s", port, existing.serviceKey)
+	for port, mappings := range desired {
+		if err := m.checkConflicts(set.ServiceKey, port, mappings); err != nil {
+			return err
 		}
 	}
 
-	var (
-		toRemove []hostPort
-		toAdd    []Mapping
-	)
+	ports := slices.Collect(maps.Keys(desired))
 
-	// remove anything we previously owned that's no longer in the desired set.
+	// also visit anything we previously owned that's no longer in the desired set.
 	for port := range m.serviceKeyToMappings[set.ServiceKey] {
 		if _, ok := desired[port]; !ok {
-			toRemove = append(toRemove, port)
+			ports = append(ports, port)
 		}
 	}
 
-	// classify each desired entry: unchanged (skip), changed (recycle), or new (add).
-	for port, mapping := range desired {
-		existing, ok := m.hostPortToMapping[port]
-		if !ok {
-			toAdd = append(toAdd, mapping)
+	slices.SortFunc(ports, compareHostPorts)
 
-			continue
+	for _, port := range ports {
+		var hostIPSet ipSet
+
+		// the mappings of a host port agree on their bind filters, see listenerConflict
+		for _, mapping := range desired[port] {
+			hostIPSet = hostIPSets[bindFilterOf(mapping)]
+		}
+
+		if err := m.update(set.ServiceKey, port, desired[port], hostIPSet, logger); err != nil {
+			return fmt.Errorf("failed to update mappings for host port %s: %w", port, err)
+		}
+	}
+
+	return nil
+}
+
+// hostIPSet returns the host IP set narrowed down by the bind filter: to the bind CIDRs, the
+// bind interfaces, and the IP families of the mappings, or to their static bind addresses.
+func (m *Mapper) hostIPSet(filter bindFilter) (ipSet, error) {
+	var (
+		ips ipSet
+		err error
+	)
+
+	if filter.static != "" {
+		ips, err = m.staticHostIPSet(filter.static)
+	} else {
+		ips, err = m.narrowedHostIPSet(filter.cidrs, filter.interfaces)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return filterFamilies(ips, filter.families), nil
+}
+
+// staticHostIPSet returns the static bind addresses which can be listened on. They do not need
+// to be assigned to the host yet, so that their mappings are not pending until then.
+func (m *Mapper) staticHostIPSet(addrs AddressList) (ipSet, error) {
+	if provider, ok := m.ipSetProvider.(StaticSetProvider); ok {
+		return provider.GetStatic(addrs.Addrs())
+	}
+
+	ips := make(ipSet)
+
+	for _, addr := range addrs.Addrs() {
+		ips[addr.String()] = struct{}{}
+	}
+
+	return ips, nil
+}
+
+func (m *Mapper) narrowedHostIPSet(bindCIDRs cidrs.List, bindInterfaces InterfaceList) (ipSet, error) {
+	if bindCIDRs == "" && bindInterfaces == "" {
+		return m.ipSetProvider.Get()
+	}
+
+	if provider, ok := m.ipSetProvider.(NarrowingSetProvider); ok {
+		return provider.GetWithin(bindCIDRs.Prefixes(), bindInterfaces.Patterns())
+	}
+
+	ips, err := m.ipSetProvider.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	if bindInterfaces != "" {
+		// the interfaces of the addresses are unknown
+		return ipSet{}, nil
+	}
+
+	return cidrs.FilterIPSet(bindCIDRs.Prefixes(), ips, nil), nil
+}
+
+// checkConflicts returns an error if the desired mappings of the service on the host port
+// cannot be served together, or together with the mappings of other services on it.
+//
+// The mappings of several services can share a host port when all of them have distinct
+// routes, the backends of its load balancer are then updated in place.
+func (m *Mapper) checkConflicts(serviceKey types.NamespacedName, port hostPort, desired map[string]Mapping) error {
+	_, exclusive := desired[""]
+
+	if exclusive && len(desired) > 1 {
+		return fmt.Errorf("host port %s has both exclusive and shared mappings", port)
+	}
+
+	// all the mappings on a shared host port are served by the same listeners
+	var listenerMapping *Mapping
+
+	for _, mapping := range desired {
+		if listenerMapping != nil {
+			if option := listenerConflict(mapping, *listenerMapping); option != "" {
+				return fmt.Errorf("host port %s has mappings with different %s options", port, option)
+			}
+		}
+
+		listenerMapping = &mapping
+	}
+
+	existing, ok := m.hostPortToMapping[port]
+	if !ok {
+		for _, other := range slices.SortedFunc(maps.Keys(m.draining[port]), compareServiceKeys) {
+			if other != serviceKey {
+				return fmt.Errorf("host port %s is draining the connections of another service: %s", port, other)
+			}
 		}
 
-		if existing.mapping.Equal(mapping) && maps.Equal(existing.hostIPSet, hostIPSet) {
+		return nil
+	}
+
+	for _, route := range slices.Sorted(maps.Keys(existing.mappings)) {
+		other := existing.mappings[route]
+		if other.serviceKey == serviceKey {
 			continue
 		}
 
-		toRemove = append(toRemove, port)
-		toAdd = append(toAdd, mapping)
+		if exclusive || route == "" {
+			return fmt.Errorf("host port %s is already registered to another service: %s", port, other.serviceKey)
+		}
+
+		if _, ok = desired[route]; ok {
+			return fmt.Errorf("route %q on host port %s is already registered to another service: %s", route, port, other.serviceKey)
+		}
+
+		if option := listenerConflict(other.mapping, *listenerMapping); option != "" {
+			return fmt.Errorf("host port %s is shared with another service with a different %s option: %s", port, option, other.serviceKey)
+		}
+	}
+
+	return nil
+}
+
+// update applies the desired mappings of the service on the host port, keeping the mappings
+// of the other services sharing it.
+//
+// When the host IP set changes, the routes of the host IPs are replaced without interrupting
+// the connections on the other host IPs if the load balancer is a RouteRemover, see
+// replaceRoutes. Otherwise, the load balancer is recycled.
+func (m *Mapper) update(serviceKey types.NamespacedName, port hostPort, desired map[string]Mapping, hostIPSet ipSet, logger *zap.Logger) error {
+	existing := m.hostPortToMapping[port]
+
+	mappings := make(map[string]serviceMapping, len(desired))
+
+	if existing != nil {
+		for route, sm := range existing.mappings {
+			if sm.serviceKey != serviceKey {
+				mappings[route] = sm
+			}
+		}
+
+		if len(desired) == 0 {
+			// the other services keep the host port on the IPs it is listened on
+			hostIPSet = existing.hostIPSet
+		}
 	}
 
-	slices.Sort(toRemove)
-	slices.SortFunc(toAdd, func(a, b Mapping) int { return cmp.Compare(a.HostPort, b.HostPort) })
+	for route, mapping := range desired {
+		mappings[route] = serviceMapping{serviceKey: serviceKey, mapping: mapping}
+	}
+
+	if existing == nil {
+		return m.add(port, mappings, hostIPSet, logger)
+	}
 
-	for _, port := range toRemove {
+	if len(mappings) == 0 {
 		m.remove(port)
+
+		return nil
 	}
 
-	for _, mapping := range toAdd {
-		if err := m.add(set.ServiceKey, mapping, hostIPSet, logger); err != nil {
-			return fmt.Errorf("failed to add mapping for host port %d: %w", mapping.HostPort, err)
+	if !maps.Equal(existing.hostIPSet, hostIPSet) {
+		// a host port without host IPs left is pending
+		if len(hostIPSet) == 0 || !canReplaceRoutes(existing, mappings) {
+			m.remove(port)
+
+			return m.add(port, mappings, hostIPSet, logger)
+		}
+
+		if err := m.replaceRoutes(port, existing, hostIPSet); err != nil {
+			return err
 		}
 	}
 
-	return nil
+	if maps.EqualFunc(existing.mappings, mappings, serviceMapping.equal) {
+		return nil
+	}
+
+	// pending host ports have no listeners, and the shared ones keep theirs for the other
+	// services
+	if existing.lb == nil || canReplaceBackends(existing.mappings, mappings) {
+		return m.replaceMappings(port, existing, mappings, logger)
+	}
+
+	if canReplaceUpstreams(existing.mappings, mappings) {
+		return m.replaceUpstreams(port, existing, mappings[""], logger)
+	}
+
+	m.remove(port)
+
+	return m.add(port, mappings, hostIPSet, logger)
 }
 
 // KnownServices returns a sorted snapshot of the service keys this mapper currently
@@ -193,15 +828,103 @@ func (m *Mapper) KnownServices() []types.NamespacedName {
 		keys = append(keys, key)
 	}
 
-	slices.SortFunc(keys, func(a, b types.NamespacedName) int {
-		if c := cmp.Compare(a.Namespace, b.Namespace); c != 0 {
-			return c
+	slices.SortFunc(keys, compareServiceKeys)
+
+	return keys
+}
+
+// MappingConnectionStats are the connection counts of a mapping of a Service.
+type MappingConnectionStats struct {
+	ServiceKey types.NamespacedName
+	Mapping    Mapping
+
+	ConnectionStats
+}
+
+// ConnectionStats returns a snapshot of the connection counts of the mappings whose load
+// balancers count them, sorted by host port and route.
+func (m *Mapper) ConnectionStats() []MappingConnectionStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var result []MappingConnectionStats
+
+	for _, port := range slices.SortedFunc(maps.Keys(m.hostPortToMapping), compareHostPorts) {
+		pm := m.hostPortToMapping[port]
+
+		provider, ok := pm.lb.(ConnectionStatsProvider)
+		if !ok {
+			continue
 		}
 
-		return cmp.Compare(a.Name, b.Name)
-	})
+		stats := provider.ConnectionStats()
 
-	return keys
+		for _, route := range slices.Sorted(maps.Keys(pm.mappings)) {
+			result = append(result, MappingConnectionStats{
+				ServiceKey:      pm.mappings[route].serviceKey,
+				Mapping:         pm.mappings[route].mapping,
+				ConnectionStats: stats[route],
+			})
+		}
+	}
+
+	return result
+}
+
+// BindFailure is a host IP which a host port could not be listened on, whose route is
+// retried.
+type BindFailure struct {
+	// ServiceKeys are the Services with a mapping on the host port, sorted.
+	ServiceKeys []types.NamespacedName
+	HostPort    int
+	Protocol    Protocol
+	IP          string
+
+	// Err is the error of the last attempt.
+	Err error
+
+	// Attempts is the number of failed attempts, and NextRetry when the next one is made.
+	Attempts  int
+	NextRetry time.Time
+}
+
+// BindFailures returns a snapshot of the host IPs which the host ports could not be listened
+// on, sorted by host port and IP.
+func (m *Mapper) BindFailures() []BindFailure {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var result []BindFailure
+
+	for _, port := range slices.SortedFunc(maps.Keys(m.hostPortToMapping), compareHostPorts) {
+		pm := m.hostPortToMapping[port]
+
+		if len(pm.failedIPs) == 0 {
+			continue
+		}
+
+		serviceKeys := map[types.NamespacedName]struct{}{}
+
+		for _, sm := range pm.mappings {
+			serviceKeys[sm.serviceKey] = struct{}{}
+		}
+
+		for _, ip := range slices.Sorted(maps.Keys(pm.failedIPs)) {
+			failure := pm.failedIPs[ip]
+
+			result = append(result, BindFailure{
+				ServiceKeys: slices.SortedFunc(maps.Keys(serviceKeys), compareServiceKeys),
+				HostPort:    port.port,
+				Protocol:    port.protocol,
+				IP:          ip,
+				Err:         failure.err,
+				Attempts:    failure.attempts,
+				NextRetry:   failure.retryAt,
+			})
+		}
+	}
+
+	return result
 }
 
 // RefreshIPSet invalidates the underlying IP set cache. The next Reconcile call will see
@@ -215,76 +938,265 @@ func (m *Mapper) RefreshIPSet() error {
 }
 
 // Close tears down all active load balancers. Safe to call multiple times.
+//
+// The connections being proxied are drained as when their mappings are removed, Close returns
+// once they are done.
 func (m *Mapper) Close() {
+	m.CloseListeners()
+
+	m.drains.Wait()
+}
+
+// CloseListeners tears down all active load balancers, so that the host ports stop accepting
+// connections, without waiting for the connections being proxied to drain. See Close.
+func (m *Mapper) CloseListeners() {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	for _, port := range slices.Sorted(maps.Keys(m.hostPortToMapping)) {
+	for _, port := range slices.SortedFunc(maps.Keys(m.hostPortToMapping), compareHostPorts) {
 		m.remove(port)
 	}
 }
 
-func (m *Mapper) add(serviceKey types.NamespacedName, mapping Mapping, hostIPSet ipSet, logger *zap.Logger) error {
+func (m *Mapper) add(port hostPort, mappings map[string]serviceMapping, hostIPSet ipSet, logger *zap.Logger) error {
 	pm := &portMapping{
-		hostIPSet:  hostIPSet,
-		serviceKey: serviceKey,
-		mapping:    mapping,
+		hostIPSet: hostIPSet,
+		mappings:  mappings,
 	}
 
 	if len(hostIPSet) > 0 {
-		lb, err := m.startLoadBalancer(serviceKey, mapping, hostIPSet, logger)
+		lb, err := m.startLoadBalancer(port, pm)
 		if err != nil {
 			return err
 		}
 
 		pm.lb = lb
+
+		m.scheduleRetry(port, pm)
 	} else {
 		logger.Info("no host IPs match bind CIDRs, mapping is pending until IPs become available",
-			zap.Stringer("mapping", mapping),
+			zap.Stringer("host-port", port),
 		)
 	}
 
-	port := hostPort(mapping.HostPort)
 	m.hostPortToMapping[port] = pm
+	m.index(port, pm)
+
+	for _, route := range slices.Sorted(maps.Keys(mappings)) {
+		m.logger.Info("added mapping",
+			zap.Stringer("svc-key", mappings[route].serviceKey),
+			zap.Stringer("mapping", mappings[route].mapping),
+			zap.Strings("ips", slices.Sorted(maps.Keys(hostIPSet))),
+		)
+	}
+
+	return nil
+}
+
+// replaceMappings replaces the mappings of a host port without recreating its listeners.
+func (m *Mapper) replaceMappings(port hostPort, pm *portMapping, mappings map[string]serviceMapping, logger *zap.Logger) error {
+	if pm.lb != nil {
+		setter, ok := pm.lb.(BackendSetter)
+		if !ok {
+			return fmt.Errorf("load balancer of host port %s does not support backends", port)
+		}
+
+		if err := setter.SetBackends(backends(mappings)); err != nil {
+			return fmt.Errorf("failed to set loadbalancer backends: %w", err)
+		}
+	}
+
+	logger.Debug("replacing mappings", zap.Stringer("host-port", port))
+
+	// the endpoints of the mappings change with the pods of their Services, so only the changes
+	// of their options are worth logging
+	for _, route := range slices.Sorted(maps.Keys(pm.mappings)) {
+		if sm, ok := mappings[route]; !ok || !sm.equalOptions(pm.mappings[route]) {
+			m.logger.Info("removed mapping",
+				zap.Stringer("host-port", port),
+				zap.Stringer("svc-key", pm.mappings[route].serviceKey),
+				zap.Stringer("mapping", pm.mappings[route].mapping),
+			)
+		}
+	}
+
+	for _, route := range slices.Sorted(maps.Keys(mappings)) {
+		if sm, ok := pm.mappings[route]; !ok || !sm.equalOptions(mappings[route]) {
+			m.logger.Info("added mapping",
+				zap.Stringer("svc-key", mappings[route].serviceKey),
+				zap.Stringer("mapping", mappings[route].mapping),
+				zap.Strings("ips", slices.Sorted(maps.Keys(pm.hostIPSet))),
+			)
+		}
+	}
+
+	m.unindex(port, pm)
+	pm.mappings = mappings
+	m.index(port, pm)
+
+	return nil
+}
 
-	mappings, ok := m.serviceKeyToMappings[serviceKey]
+// replaceUpstreams replaces the upstreams of a host port which is not shared without recreating
+// its listeners.
+func (m *Mapper) replaceUpstreams(port hostPort, pm *portMapping, sm serviceMapping, logger *zap.Logger) error {
+	setter, ok := pm.lb.(UpstreamSetter)
 	if !ok {
-		mappings = make(portMappings)
-		m.serviceKeyToMappings[serviceKey] = mappings
+		return fmt.Errorf("load balancer of host port %s does not support replacing upstreams", port)
 	}
 
-	mappings[port] = pm
+	addrs := upstreamAddrs(sm.serviceKey, sm.mapping)
+
+	if err := setter.SetUpstreams(addrs); err != nil {
+		return fmt.Errorf("failed to set loadbalancer upstreams: %w", err)
+	}
+
+	logger.Debug("replaced upstreams", zap.Stringer("host-port", port), zap.Strings("upstream-addrs", addrs))
+
+	pm.mappings = map[string]serviceMapping{"": sm}
+
+	return nil
+}
+
+// replaceRoutes listens on the host port on the host IPs added to the set, and no longer on
+// the removed ones, keeping the listeners on the other ones.
+//
+// The host IPs are replaced one by one: on error, the host port is left listened on the
+// host IPs replaced so far, and the next Reconcile replaces the rest. The added host IPs
+// which cannot be listened on are retried, see retryRoutes.
+func (m *Mapper) replaceRoutes(port hostPort, pm *portMapping, hostIPSet ipSet) error {
+	remover, ok := pm.lb.(RouteRemover)
+	if !ok {
+		return fmt.Errorf("load balancer of host port %s does not support removing routes", port)
+	}
+
+	logger := m.loadBalancerLogger(port, pm.mappings)
+
+	added := hostIPSet.without(pm.hostIPSet)
+	removed := pm.hostIPSet.without(hostIPSet)
+
+	current := maps.Clone(pm.hostIPSet)
 
-	logger.Info("added mapping",
-		zap.Stringer("mapping", mapping),
+	defer func() {
+		pm.hostIPSet = current
+	}()
+
+	defer m.scheduleRetry(port, pm)
+
+	for _, ip := range removed {
+		if _, ok := pm.failedIPs[ip]; ok {
+			// the host port is not listened on it
+			delete(pm.failedIPs, ip)
+			delete(current, ip)
+
+			continue
+		}
+
+		listenAddr := net.JoinHostPort(ip, strconv.Itoa(port.port))
+
+		logger.Debug("remove loadbalancer route", zap.String("listen-addr", listenAddr))
+
+		if err := remover.RemoveRoute(listenAddr); err != nil {
+			return fmt.Errorf("failed to remove loadbalancer route (listen=%s): %w", listenAddr, err)
+		}
+
+		delete(current, ip)
+	}
+
+	for _, ip := range added {
+		if err := addRoute(pm.lb, port, pm.mappings, ip, logger); err != nil {
+			m.recordBindFailure(pm, ip, err, logger)
+		}
+
+		current[ip] = struct{}{}
+	}
+
+	logger.Info("replaced host IPs",
+		zap.Strings("added-ips", added),
+		zap.Strings("removed-ips", removed),
 		zap.Strings("ips", slices.Sorted(maps.Keys(hostIPSet))),
 	)
 
 	return nil
 }
 
-func (m *Mapper) startLoadBalancer(serviceKey types.NamespacedName, mapping Mapping, hostIPSet ipSet, logger *zap.Logger) (LoadBalancer, error) {
-	// use an error level logger to avoid spamming the logs with upstream health check failure warnings
-	lbLogger := logger.Named("loadbalancer").WithOptions(zap.IncreaseLevel(zap.ErrorLevel))
+// index records the host port for each service with a mapping on it.
+func (m *Mapper) index(port hostPort, pm *portMapping) {
+	for _, sm := range pm.mappings {
+		mappings, ok := m.serviceKeyToMappings[sm.serviceKey]
+		if !ok {
+			mappings = make(portMappings)
+			m.serviceKeyToMappings[sm.serviceKey] = mappings
+		}
+
+		mappings[port] = pm
+	}
+}
+
+// unindex is the reverse of index.
+func (m *Mapper) unindex(port hostPort, pm *portMapping) {
+	for _, sm := range pm.mappings {
+		mappings := m.serviceKeyToMappings[sm.serviceKey]
+
+		delete(mappings, port)
+
+		if len(mappings) == 0 {
+			delete(m.serviceKeyToMappings, sm.serviceKey)
+		}
+	}
+}
+
+func backends(mappings map[string]serviceMapping) []Backend {
+	result := make([]Backend, 0, len(mappings))
+
+	for _, route := range slices.Sorted(maps.Keys(mappings)) {
+		sm := mappings[route]
+
+		result = append(result, Backend{Upstreams: upstreamAddrs(sm.serviceKey, sm.mapping), Mapping: sm.mapping})
+	}
+
+	return result
+}
+
+// startLoadBalancer starts a load balancer listening on the host port on its host IPs.
+//
+// A host IP which cannot be listened on, e.g. as its address is in use, does not fail a
+// RouteRemover, see startRoutes. Other load balancers fail, and are started again by the next
+// Reconcile.
+func (m *Mapper) startLoadBalancer(port hostPort, pm *portMapping) (LoadBalancer, error) {
+	logger := m.loadBalancerLogger(port, pm.mappings)
+
+	first := listenerMapping(pm.mappings)
 
-	lb, err := m.loadBalancerController.New(lbLogger)
+	lb, err := m.loadBalancerController.New(first.mapping, logger.Named("loadbalancer"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create loadbalancer: %w", err)
 	}
 
-	svcName := serviceKey.Name + "." + serviceKey.Namespace
+	if shared(pm.mappings) {
+		setter, ok := lb.(BackendSetter)
+		if !ok {
+			return nil, fmt.Errorf("load balancer of host port %s does not support backends", port)
+		}
+
+		if err = setter.SetBackends(backends(pm.mappings)); err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to set loadbalancer backends: %w", err), lb.Close())
+		}
+	}
 
-	for ip := range hostIPSet {
-		listenAddr := net.JoinHostPort(ip, strconv.Itoa(mapping.HostPort))
-		upstreamAddr := net.JoinHostPort(svcName, strconv.Itoa(mapping.ServicePort))
+	if _, ok := lb.(RouteRemover); ok {
+		// the routes can be added one by one once it is started, so that the host IPs which
+		// cannot be listened on do not fail the others
+		if err = m.startRoutes(lb, port, pm, logger); err != nil {
+			return nil, err
+		}
 
-		logger.Debug("add loadbalancer route", zap.String("listen-addr", listenAddr), zap.String("upstream-addr", upstreamAddr))
+		return lb, nil
+	}
 
-		if err = lb.AddRoute(listenAddr,
-			slices.Values([]string{upstreamAddr}),
-			upstream.WithHealthcheckTimeout(time.Second),
-		); err != nil {
-			return nil, fmt.Errorf("failed to add loadbalancer route (listen=%s upstream=%s): %w", listenAddr, upstreamAddr, err)
+	for ip := range pm.hostIPSet {
+		if err = addRoute(lb, port, pm.mappings, ip, logger); err != nil {
+			return nil, errors.Join(err, lb.Close())
 		}
 	}
 
@@ -302,8 +1214,157 @@ func (m *Mapper) startLoadBalancer(serviceKey types.NamespacedName, mapping Mapp
 	return lb, nil
 }
 
+// startRoutes starts the load balancer, and adds the routes of the host IPs of the host port
+// to it, recording the ones which fail to be retried.
+//
+// The failed routes are added again with an exponential backoff until they succeed, while
+// the host port is listened on the other host IPs, see BindFailures.
+func (m *Mapper) startRoutes(lb LoadBalancer, port hostPort, pm *portMapping, logger *zap.Logger) error {
+	logger.Debug("start loadbalancer")
+
+	if err := lb.Start(); err != nil {
+		return errors.Join(fmt.Errorf("failed to start loadbalancer: %w", err), lb.Close())
+	}
+
+	for _, ip := range slices.Sorted(maps.Keys(pm.hostIPSet)) {
+		if err := addRoute(lb, port, pm.mappings, ip, logger); err != nil {
+			m.recordBindFailure(pm, ip, err, logger)
+		}
+	}
+
+	return nil
+}
+
+// recordBindFailure records that the route of the host IP could not be added, and when it is
+// retried.
+func (m *Mapper) recordBindFailure(pm *portMapping, ip string, err error, logger *zap.Logger) {
+	if pm.failedIPs == nil {
+		pm.failedIPs = map[string]*bindFailure{}
+	}
+
+	failure, ok := pm.failedIPs[ip]
+	if !ok {
+		failure = &bindFailure{}
+		pm.failedIPs[ip] = failure
+	}
+
+	failure.err = err
+	failure.attempts++
+
+	delay := cmp.Or(m.MinBindRetryDelay, DefaultMinBindRetryDelay)
+	maxDelay := cmp.Or(m.MaxBindRetryDelay, DefaultMaxBindRetryDelay)
+
+	for range failure.attempts - 1 {
+		if delay >= maxDelay {
+			break
+		}
+
+		delay *= 2
+	}
+
+	delay = min(delay, maxDelay)
+	failure.retryAt = time.Now().Add(delay)
+
+	logger.Warn("failed to listen on host IP, retrying",
+		zap.String("ip", ip),
+		zap.Int("attempts", failure.attempts),
+		zap.Duration("retry-in", delay),
+		zap.Error(err),
+	)
+}
+
+// scheduleRetry sets the retry timer of the host port to the earliest retry of its failed
+// host IPs, or stops it without any.
+func (m *Mapper) scheduleRetry(port hostPort, pm *portMapping) {
+	if pm.retry != nil {
+		pm.retry.Stop()
+		pm.retry = nil
+	}
+
+	if len(pm.failedIPs) == 0 {
+		return
+	}
+
+	var retryAt time.Time
+
+	for _, failure := range pm.failedIPs {
+		if retryAt.IsZero() || failure.retryAt.Before(retryAt) {
+			retryAt = failure.retryAt
+		}
+	}
+
+	pm.retry = time.AfterFunc(time.Until(retryAt), func() { m.retryRoutes(port, pm) })
+}
+
+// retryRoutes adds the routes of the failed host IPs of the host port which are due again.
+func (m *Mapper) retryRoutes(port hostPort, pm *portMapping) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.hostPortToMapping[port] != pm || pm.lb == nil {
+		// the host port was removed or recycled since
+		return
+	}
+
+	logger := m.loadBalancerLogger(port, pm.mappings)
+	now := time.Now()
+
+	for _, ip := range slices.Sorted(maps.Keys(pm.failedIPs)) {
+		failure := pm.failedIPs[ip]
+		if failure.retryAt.After(now) {
+			continue
+		}
+
+		if err := addRoute(pm.lb, port, pm.mappings, ip, logger); err != nil {
+			m.recordBindFailure(pm, ip, err, logger)
+
+			continue
+		}
+
+		delete(pm.failedIPs, ip)
+
+		logger.Info("listening on host IP after failures", zap.String("ip", ip), zap.Int("attempts", failure.attempts))
+	}
+
+	m.scheduleRetry(port, pm)
+}
+
+// loadBalancerLogger returns the logger of the load balancer of the mappings on the host port.
+func (m *Mapper) loadBalancerLogger(port hostPort, mappings map[string]serviceMapping) *zap.Logger {
+	logger := m.logger.With(zap.Stringer("host-port", port))
+
+	if !shared(mappings) {
+		logger = logger.With(zap.Stringer("svc-key", mappings[""].serviceKey))
+	}
+
+	return logger
+}
+
+// addRoute adds the route of the host IP to the load balancer of the mappings on the host
+// port: to the upstreams of the mapping of a host port which is not shared, and to none of a
+// shared one, whose upstreams are set per backend.
+func addRoute(lb LoadBalancer, port hostPort, mappings map[string]serviceMapping, ip string, logger *zap.Logger) error {
+	first := listenerMapping(mappings)
+
+	var addrs []string
+
+	if !shared(mappings) {
+		addrs = upstreamAddrs(first.serviceKey, first.mapping)
+	}
+
+	listenAddr := net.JoinHostPort(ip, strconv.Itoa(port.port))
+
+	logger.Debug("add loadbalancer route", zap.String("listen-addr", listenAddr), zap.Strings("upstream-addrs", addrs))
+
+	if err := lb.AddRoute(listenAddr, slices.Values(addrs), first.mapping.Timeouts.listOptions()...); err != nil {
+		return fmt.Errorf("failed to add loadbalancer route (listen=%s upstream=%s): %w", listenAddr, strings.Join(addrs, ","), err)
+	}
+
+	return nil
+}
+
 func (m *Mapper) remove(port hostPort) {
-	logger := m.logger.With(zap.Int("host-port", int(port)))
+	logger := m.logger.With(zap.Stringer("host-port", port))
 
 	existing, ok := m.hostPortToMapping[port]
 	if !ok {
@@ -312,14 +1373,10 @@ func (m *Mapper) remove(port hostPort) {
 		return
 	}
 
-	serviceKey := existing.serviceKey
-	logger = logger.With(zap.Stringer("svc-key", serviceKey))
+	logger.Debug("host port found, removing", zap.Strings("ips", slices.Sorted(maps.Keys(existing.hostIPSet))))
 
-	if ce := logger.Check(zap.DebugLevel, "mapping found, removing"); ce != nil {
-		ce.Write(
-			zap.Stringer("mapping", existing.mapping),
-			zap.Strings("ips", slices.Sorted(maps.Keys(existing.hostIPSet))),
-		)
+	if existing.retry != nil {
+		existing.retry.Stop()
 	}
 
 	if existing.lb != nil {
@@ -330,28 +1387,75 @@ func (m *Mapper) remove(port hostPort) {
 			// via Close above; anything else is worth logging.
 			logger.Info("error on waiting for load balancer to close", zap.Error(err))
 		}
+
+		if drainer, ok := existing.lb.(Drainer); ok {
+			m.drain(port, drainer, existing.mappings, logger)
+		}
 	}
 
 	delete(m.hostPortToMapping, port)
+	m.unindex(port, existing)
 
-	mappings, ok := m.serviceKeyToMappings[serviceKey]
-	if !ok {
-		logger.Warn("per-service entry missing for known host port, this should not happen")
+	for _, route := range slices.Sorted(maps.Keys(existing.mappings)) {
+		logger.Info("removed mapping",
+			zap.Stringer("svc-key", existing.mappings[route].serviceKey),
+			zap.Stringer("mapping", existing.mappings[route].mapping),
+		)
+	}
+}
 
-		return
+// drain waits in the background for the connections of the removed mappings to finish, for
+// up to the longest of their drain timeouts. Until then, the host port is not released to
+// other services. Without a drain timeout, the connections are closed right away.
+func (m *Mapper) drain(port hostPort, drainer Drainer, mappings map[string]serviceMapping, logger *zap.Logger) {
+	var timeout time.Duration
+
+	serviceKeys := map[types.NamespacedName]struct{}{}
+
+	for _, sm := range mappings {
+		timeout = max(timeout, sm.mapping.DrainTimeout)
+		serviceKeys[sm.serviceKey] = struct{}{}
 	}
 
-	if _, ok = mappings[port]; !ok {
-		logger.Warn("per-service entry missing host port for known mapping, this should not happen")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+	if timeout <= 0 {
+		defer cancel()
+
+		// the connections are closed right away
+		drainer.Drain(ctx) //nolint:errcheck
 
 		return
 	}
 
-	delete(mappings, port)
+	if m.draining[port] == nil {
+		m.draining[port] = map[types.NamespacedName]int{}
+	}
 
-	if len(mappings) == 0 {
-		delete(m.serviceKeyToMappings, serviceKey)
+	for serviceKey := range serviceKeys {
+		m.draining[port][serviceKey]++
 	}
 
-	logger.Info("removed mapping")
+	m.drains.Go(func() {
+		defer cancel()
+
+		if err := drainer.Drain(ctx); err != nil {
+			logger.Info("closed connections which did not finish in time", zap.Duration("drain-timeout", timeout))
+		} else {
+			logger.Debug("drained connections")
+		}
+
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		for serviceKey := range serviceKeys {
+			if m.draining[port][serviceKey]--; m.draining[port][serviceKey] == 0 {
+				delete(m.draining[port], serviceKey)
+			}
+		}
+
+		if len(m.draining[port]) == 0 {
+			delete(m.draining, port)
+		}
+	})
 }
@@ -5,10 +5,17 @@
 package ip_test
 
 import (
+	"context"
 	"errors"
 	"iter"
+	"maps"
+	"net"
 	"slices"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/siderolabs/gen/xslices"
 	"github.com/siderolabs/go-loadbalancer/upstream"
@@ -39,9 +46,36 @@ func (m *mockIPSetProvider) Refresh() (map[string]struct{}, error) {
 }
 
 type mockLoadBalancer struct {
-	routes  map[string][]string
-	started bool
-	closed  bool
+	routes   map[string][]string
+	backends []ip.Backend
+	protocol ip.Protocol
+	started  bool
+	closed   bool
+
+	// drained blocks Drain until it is closed, if set
+	drained chan struct{}
+	drains  atomic.Int32
+}
+
+func (m *mockLoadBalancer) SetBackends(backends []ip.Backend, _ ...upstream.ListOption) error {
+	m.backends = backends
+
+	return nil
+}
+
+// ConnectionStats reports a connection for each backend, or for the single upstream.
+func (m *mockLoadBalancer) ConnectionStats() map[string]ip.ConnectionStats {
+	if m.backends == nil {
+		return map[string]ip.ConnectionStats{"": {Active: 1}}
+	}
+
+	stats := make(map[string]ip.ConnectionStats, len(m.backends))
+
+	for _, backend := range m.backends {
+		stats[backend.Mapping.Route()] = ip.ConnectionStats{Active: 1, Limit: backend.Mapping.MaxConnections}
+	}
+
+	return stats
 }
 
 func (m *mockLoadBalancer) Wait() error {
@@ -58,6 +92,14 @@ func (m *mockLoadBalancer) AddRoute(ipPort string, upstreamAddrs iter.Seq[string
 	return nil
 }
 
+func (m *mockLoadBalancer) SetUpstreams(upstreamAddrs []string) error {
+	for ipPort := range m.routes {
+		m.routes[ipPort] = upstreamAddrs
+	}
+
+	return nil
+}
+
 func (m *mockLoadBalancer) Start() error {
 	m.started = true
 
@@ -70,15 +112,53 @@ func (m *mockLoadBalancer) Close() error {
 	return nil
 }
 
+func (m *mockLoadBalancer) Drain(ctx context.Context) error {
+	m.drains.Add(1)
+
+	if m.drained == nil {
+		return nil
+	}
+
+	select {
+	case <-m.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// mockRouteRemover is a mockLoadBalancer whose routes can be removed while it is running.
+type mockRouteRemover struct {
+	*mockLoadBalancer
+}
+
+func (m mockRouteRemover) RemoveRoute(ipPort string) error {
+	if _, ok := m.routes[ipPort]; !ok {
+		return errors.New("no such route")
+	}
+
+	delete(m.routes, ipPort)
+
+	return nil
+}
+
 type mockLoadBalancerProvider struct {
-	lbs []*mockLoadBalancer
+	lbs     []*mockLoadBalancer
+	drained chan struct{}
+
+	// removesRoutes makes the load balancers RouteRemovers
+	removesRoutes bool
 }
 
-func (m *mockLoadBalancerProvider) New(_ *zap.Logger) (ip.LoadBalancer, error) {
-	lb := &mockLoadBalancer{}
+func (m *mockLoadBalancerProvider) New(mapping ip.Mapping, _ *zap.Logger) (ip.LoadBalancer, error) {
+	lb := &mockLoadBalancer{protocol: mapping.Protocol, drained: m.drained}
 
 	m.lbs = append(m.lbs, lb)
 
+	if m.removesRoutes {
+		return mockRouteRemover{lb}, nil
+	}
+
 	return lb, nil
 }
 
@@ -121,6 +201,107 @@ func TestMapperReconcile_AddsAndRoutes(t *testing.T) {
 	assert.Equal(t, []string{"svc1.ns1:80"}, lbs.lbs[0].routes["172.20.0.42:12345"])
 }
 
+func TestMapperReconcile_BindCIDRs(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"192.168.2.42", "172.20.0.42"}}
+	lbs := &mockLoadBalancerProvider{}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("svc1", "ns1"),
+		Mappings: []ip.Mapping{
+			{HostPort: 12345, ServicePort: 80, BindCIDRs: "172.20.0.0/16"},
+			{HostPort: 12346, ServicePort: 80, BindCIDRs: "10.0.0.0/8"},
+		},
+	}))
+
+	// nothing within the CIDRs of the second mapping, so it is pending
+	require.Len(t, lbs.lbs, 1)
+	assert.Equal(t, map[string][]string{"172.20.0.42:12345": {"svc1.ns1:80"}}, lbs.lbs[0].routes)
+
+	provider.ips = append(provider.ips, "10.0.0.1")
+
+	require.NoError(t, mapper.RefreshIPSet())
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("svc1", "ns1"),
+		Mappings: []ip.Mapping{
+			{HostPort: 12345, ServicePort: 80, BindCIDRs: "172.20.0.0/16"},
+			{HostPort: 12346, ServicePort: 80, BindCIDRs: "10.0.0.0/8"},
+		},
+	}))
+
+	require.Len(t, lbs.lbs, 2)
+	assert.False(t, lbs.lbs[0].closed)
+	assert.Equal(t, map[string][]string{"10.0.0.1:12346": {"svc1.ns1:80"}}, lbs.lbs[1].routes)
+}
+
+func TestMapperReconcile_Families(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name     string
+		ips      []string
+		expected map[ip.Families][]string
+	}{
+		{
+			name: "dual-stack",
+			ips:  []string{"172.20.0.42", "fd00::42"},
+			expected: map[ip.Families][]string{
+				0:             {"172.20.0.42:30080", "[fd00::42]:30080"},
+				ip.FamilyIPv4: {"172.20.0.42:30080"},
+				ip.FamilyIPv6: {"[fd00::42]:30080"},
+			},
+		},
+		{
+			name: "v6-only",
+			ips:  []string{"fd00::42", "fe80::1%eth0"},
+			expected: map[ip.Families][]string{
+				0:             {"[fd00::42]:30080", "[fe80::1%eth0]:30080"},
+				ip.FamilyIPv4: nil,
+				ip.FamilyIPv6: {"[fd00::42]:30080", "[fe80::1%eth0]:30080"},
+			},
+		},
+		{
+			name: "dual-stack wildcards",
+			ips:  []string{"0.0.0.0", "::"},
+			expected: map[ip.Families][]string{
+				0:             {"0.0.0.0:30080", "[::]:30080"},
+				ip.FamilyIPv4: {"0.0.0.0:30080"},
+				ip.FamilyIPv6: {"[::]:30080"},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			for families, expected := range test.expected {
+				lbs := &mockLoadBalancerProvider{}
+
+				mapper, err := ip.NewMapper(&mockIPSetProvider{ips: test.ips}, lbs, zaptest.NewLogger(t))
+				require.NoError(t, err)
+
+				require.NoError(t, mapper.Reconcile(ip.MappingSet{
+					ServiceKey: key("svc", "ns"),
+					Mappings:   []ip.Mapping{{HostPort: 30080, ServicePort: 80, Families: families}},
+				}))
+
+				if expected == nil {
+					// pending until there is a host IP of the family
+					assert.Empty(t, lbs.lbs)
+
+					continue
+				}
+
+				require.Len(t, lbs.lbs, 1)
+				assert.ElementsMatch(t, expected, slices.Collect(maps.Keys(lbs.lbs[0].routes)), families.String())
+			}
+		})
+	}
+}
+
 func TestMapperReconcile_IsIdempotent(t *testing.T) {
 	t.Parallel()
 
@@ -170,6 +351,314 @@ func TestMapperReconcile_ChangeRecyclesLB(t *testing.T) {
 	assert.Equal(t, []string{"svc.ns:8080"}, lbs.lbs[1].routes["10.0.0.1:30080"])
 }
 
+func TestMapperReconcile_TimeoutsChangeRecyclesLB(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"10.0.0.1"}}
+	lbs := &mockLoadBalancerProvider{}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	mapping := ip.Mapping{HostPort: 30080, ServicePort: 80, Timeouts: ip.Timeouts{ClientIdle: time.Hour}}
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("svc", "ns"), Mappings: []ip.Mapping{mapping}}))
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("svc", "ns"), Mappings: []ip.Mapping{mapping}}))
+	require.Len(t, lbs.lbs, 1)
+
+	mapping.Timeouts.HealthCheckInterval = 5 * time.Second
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("svc", "ns"), Mappings: []ip.Mapping{mapping}}))
+
+	require.Len(t, lbs.lbs, 2)
+	assert.True(t, lbs.lbs[0].closed)
+	assert.True(t, lbs.lbs[1].started)
+}
+
+func TestMapperReconcile_EndpointsChangeReplacesUpstreams(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"10.0.0.1"}}
+	lbs := &mockLoadBalancerProvider{}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	mapping := ip.Mapping{HostPort: 30080, ServicePort: 80, Upstream: ip.UpstreamEndpoints, Endpoints: "10.244.0.5:8080"}
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("svc", "ns"), Mappings: []ip.Mapping{mapping}}))
+	require.Len(t, lbs.lbs, 1)
+	assert.Equal(t, []string{"10.244.0.5:8080"}, lbs.lbs[0].routes["10.0.0.1:30080"])
+
+	// the endpoints are replaced on the running load balancer
+	mapping.Endpoints = ip.NewEndpoints([]string{"10.244.1.7:8080", "10.244.0.5:8080"})
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("svc", "ns"), Mappings: []ip.Mapping{mapping}}))
+	require.Len(t, lbs.lbs, 1)
+	assert.False(t, lbs.lbs[0].closed)
+	assert.Equal(t, []string{"10.244.0.5:8080", "10.244.1.7:8080"}, lbs.lbs[0].routes["10.0.0.1:30080"])
+
+	// other options still recycle it
+	mapping.MaxConnections = 10
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("svc", "ns"), Mappings: []ip.Mapping{mapping}}))
+	require.Len(t, lbs.lbs, 2)
+	assert.True(t, lbs.lbs[0].closed)
+	assert.Equal(t, []string{"10.244.0.5:8080", "10.244.1.7:8080"}, lbs.lbs[1].routes["10.0.0.1:30080"])
+}
+
+func TestMapperReconcile_ClusterIPChangeRecyclesLB(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"10.0.0.1"}}
+	lbs := &mockLoadBalancerProvider{}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	mapping := ip.Mapping{HostPort: 30080, ServicePort: 80, Upstream: ip.UpstreamClusterIP, UpstreamHost: "10.96.0.10"}
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("svc", "ns"), Mappings: []ip.Mapping{mapping}}))
+	require.Len(t, lbs.lbs, 1)
+	assert.Equal(t, []string{"10.96.0.10:80"}, lbs.lbs[0].routes["10.0.0.1:30080"])
+
+	mapping.UpstreamHost = "fd00:10:96::a"
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("svc", "ns"), Mappings: []ip.Mapping{mapping}}))
+	require.Len(t, lbs.lbs, 2)
+	assert.True(t, lbs.lbs[0].closed)
+	assert.Equal(t, []string{"[fd00:10:96::a]:80"}, lbs.lbs[1].routes["10.0.0.1:30080"])
+
+	// without a ClusterIP, the DNS name is used
+	mapping.UpstreamHost = ""
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("svc", "ns"), Mappings: []ip.Mapping{mapping}}))
+	require.Len(t, lbs.lbs, 3)
+	assert.Equal(t, []string{"svc.ns:80"}, lbs.lbs[2].routes["10.0.0.1:30080"])
+}
+
+func TestMapperReconcile_HostIPChangeReplacesRoutes(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"192.168.2.42", "172.20.0.42"}}
+	lbs := &mockLoadBalancerProvider{removesRoutes: true}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	set := ip.MappingSet{
+		ServiceKey: key("svc1", "ns1"),
+		Mappings: []ip.Mapping{{
+			HostPort:    12345,
+			ServicePort: 80,
+			Upstream:    ip.UpstreamEndpoints,
+			Endpoints:   ip.NewEndpoints([]string{"10.244.0.4:8080"}),
+		}},
+	}
+
+	require.NoError(t, mapper.Reconcile(set))
+
+	provider.ips = []string{"172.20.0.42", "10.0.0.1"}
+
+	require.NoError(t, mapper.RefreshIPSet())
+	require.NoError(t, mapper.Reconcile(set))
+
+	// only the routes of the added and removed host IPs change
+	require.Len(t, lbs.lbs, 1)
+	assert.False(t, lbs.lbs[0].closed)
+	assert.Equal(t, map[string][]string{
+		"172.20.0.42:12345": {"10.244.0.4:8080"},
+		"10.0.0.1:12345":    {"10.244.0.4:8080"},
+	}, lbs.lbs[0].routes)
+
+	// the endpoints change along with the host IPs
+	set.Mappings[0].Endpoints = ip.NewEndpoints([]string{"10.244.0.5:8080"})
+	provider.ips = []string{"10.0.0.1"}
+
+	require.NoError(t, mapper.Reconcile(set))
+
+	require.Len(t, lbs.lbs, 1)
+	assert.Equal(t, map[string][]string{"10.0.0.1:12345": {"10.244.0.5:8080"}}, lbs.lbs[0].routes)
+
+	// without any host IPs left, the mapping is pending
+	provider.ips = nil
+
+	require.NoError(t, mapper.Reconcile(set))
+
+	require.Len(t, lbs.lbs, 1)
+	assert.True(t, lbs.lbs[0].closed)
+
+	provider.ips = []string{"10.0.0.2"}
+
+	require.NoError(t, mapper.Reconcile(set))
+
+	require.Len(t, lbs.lbs, 2)
+	assert.Equal(t, map[string][]string{"10.0.0.2:12345": {"10.244.0.5:8080"}}, lbs.lbs[1].routes)
+}
+
+func TestMapperReconcile_StaticBindAddresses(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"192.168.2.42"}}
+	lbs := &mockLoadBalancerProvider{}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	staticBindAddresses, err := ip.ParseAddressList([]string{"fd00::1", "192.168.2.200"})
+	require.NoError(t, err)
+
+	set := ip.MappingSet{
+		ServiceKey: key("svc1", "ns1"),
+		Mappings: []ip.Mapping{{
+			HostPort:            12345,
+			ServicePort:         80,
+			Upstream:            ip.UpstreamEndpoints,
+			Endpoints:           ip.NewEndpoints([]string{"10.244.0.4:8080"}),
+			StaticBindAddresses: staticBindAddresses,
+		}},
+	}
+
+	// the static bind addresses are listened on instead of the host IPs
+	require.NoError(t, mapper.Reconcile(set))
+
+	require.Len(t, lbs.lbs, 1)
+	assert.Equal(t, map[string][]string{
+		"192.168.2.200:12345": {"10.244.0.4:8080"},
+		"[fd00::1]:12345":     {"10.244.0.4:8080"},
+	}, lbs.lbs[0].routes)
+
+	// and they are narrowed down to the IP families
+	set.Mappings[0].Families = ip.FamilyIPv6
+
+	require.NoError(t, mapper.Reconcile(set))
+
+	require.Len(t, lbs.lbs, 2)
+	assert.Equal(t, map[string][]string{"[fd00::1]:12345": {"10.244.0.4:8080"}}, lbs.lbs[1].routes)
+}
+
+func TestMapperReconcile_HostIPChangeKeepsConnections(t *testing.T) {
+	t.Parallel()
+
+	probe, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 is not available: %v", err)
+	}
+
+	port := probe.Addr().(*net.TCPAddr).Port
+
+	require.NoError(t, probe.Close())
+
+	provider := &mockIPSetProvider{ips: []string{"127.0.0.1"}}
+
+	mapper, err := ip.NewMapper(provider, &ip.TCPLoadBalancerProvider{}, tcpTestLogger(t))
+	require.NoError(t, err)
+
+	t.Cleanup(mapper.Close)
+
+	set := ip.MappingSet{
+		ServiceKey: key("svc1", "ns1"),
+		Mappings: []ip.Mapping{{
+			HostPort:    port,
+			ServicePort: 80,
+			Upstream:    ip.UpstreamEndpoints,
+			Endpoints:   ip.NewEndpoints([]string{startTCPEcho(t)}),
+		}},
+	}
+
+	require.NoError(t, mapper.Reconcile(set))
+
+	first, err := dialEcho(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	require.NoError(t, err)
+
+	provider.ips = []string{"127.0.0.1", "127.0.0.2"}
+
+	require.NoError(t, mapper.Reconcile(set))
+
+	// the connection on the host IP which is kept is not interrupted
+	assert.Equal(t, "added", roundTrip(t, first, "added"))
+
+	second, err := dialEcho(t, net.JoinHostPort("127.0.0.2", strconv.Itoa(port)))
+	require.NoError(t, err)
+
+	provider.ips = []string{"127.0.0.2"}
+
+	require.NoError(t, mapper.Reconcile(set))
+
+	assert.Equal(t, "removed", roundTrip(t, second, "removed"))
+
+	// the connection accepted on the removed host IP is not interrupted either, but no new
+	// ones are accepted there
+	assert.Equal(t, "removed", roundTrip(t, first, "removed"))
+
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	assert.Error(t, err)
+}
+
+func TestMapperReconcile_BindFailureRetried(t *testing.T) {
+	t.Parallel()
+
+	// the host port is in use on one of the host IPs
+	occupied, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 is not available: %v", err)
+	}
+
+	t.Cleanup(func() { occupied.Close() }) //nolint:errcheck
+
+	port := occupied.Addr().(*net.TCPAddr).Port
+
+	mapper, err := ip.NewMapper(&mockIPSetProvider{ips: []string{"127.0.0.1", "127.0.0.2"}}, &ip.TCPLoadBalancerProvider{}, tcpTestLogger(t))
+	require.NoError(t, err)
+
+	mapper.MinBindRetryDelay = 10 * time.Millisecond
+	mapper.MaxBindRetryDelay = 50 * time.Millisecond
+
+	t.Cleanup(mapper.Close)
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("svc1", "ns1"),
+		Mappings: []ip.Mapping{{
+			HostPort:    port,
+			ServicePort: 80,
+			Upstream:    ip.UpstreamEndpoints,
+			Endpoints:   ip.NewEndpoints([]string{startTCPEcho(t)}),
+		}},
+	}))
+
+	// the other host IP is listened on
+	conn, err := dialEcho(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	require.NoError(t, err)
+
+	assert.Equal(t, "first", roundTrip(t, conn, "first"))
+
+	failures := mapper.BindFailures()
+	require.Len(t, failures, 1)
+
+	assert.Equal(t, []types.NamespacedName{key("svc1", "ns1")}, failures[0].ServiceKeys)
+	assert.Equal(t, port, failures[0].HostPort)
+	assert.Equal(t, ip.ProtocolTCP, failures[0].Protocol)
+	assert.Equal(t, "127.0.0.2", failures[0].IP)
+	assert.ErrorIs(t, failures[0].Err, syscall.EADDRINUSE)
+
+	// the failed host IP is retried with a backoff
+	assert.Eventually(t, func() bool {
+		failures = mapper.BindFailures()
+
+		return len(failures) == 1 && failures[0].Attempts > 2
+	}, time.Second, 10*time.Millisecond)
+
+	// until the address is released
+	require.NoError(t, occupied.Close())
+
+	assert.Eventually(t, func() bool { return len(mapper.BindFailures()) == 0 }, time.Second, 10*time.Millisecond)
+
+	conn, err = dialEcho(t, net.JoinHostPort("127.0.0.2", strconv.Itoa(port)))
+	require.NoError(t, err)
+
+	assert.Equal(t, "second", roundTrip(t, conn, "second"))
+}
+
 func TestMapperReconcile_RemovesEntriesNoLongerDesired(t *testing.T) {
 	t.Parallel()
 
@@ -237,6 +726,54 @@ func TestMapperReconcile_CrossServiceCollision(t *testing.T) {
 	assert.False(t, lbs.lbs[0].closed)
 }
 
+func TestMapperReconcile_TCPAndUDPShareHostPort(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"10.0.0.1"}}
+	lbs := &mockLoadBalancerProvider{}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("dns", "ns"),
+		Mappings: []ip.Mapping{
+			{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolTCP},
+			{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolUDP},
+		},
+	}))
+
+	require.Len(t, lbs.lbs, 2)
+	assert.ElementsMatch(t, []ip.Protocol{ip.ProtocolTCP, ip.ProtocolUDP}, []ip.Protocol{lbs.lbs[0].protocol, lbs.lbs[1].protocol})
+
+	for _, lb := range lbs.lbs {
+		assert.True(t, lb.started)
+		assert.Equal(t, []string{"dns.ns:53"}, lb.routes["10.0.0.1:30053"])
+	}
+
+	// ownership is tracked per protocol: the UDP port is taken until the first service drops it.
+	err = mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("other", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolUDP}},
+	})
+	assert.ErrorContains(t, err, "host port 30053/udp is already registered to another service")
+
+	// dropping the UDP mapping leaves the TCP one alone.
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("dns", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolTCP}},
+	}))
+
+	for _, lb := range lbs.lbs {
+		assert.Equal(t, lb.protocol == ip.ProtocolUDP, lb.closed)
+	}
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("other", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolUDP}},
+	}))
+}
+
 func TestMapperReconcile_EmptyIPSetIsPending(t *testing.T) {
 	t.Parallel()
 
@@ -377,3 +914,323 @@ func TestMapperClose(t *testing.T) {
 	// idempotent.
 	mapper.Close()
 }
+
+func TestMapperReconcile_DrainReservesHostPort(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"10.0.0.1"}}
+	lbs := &mockLoadBalancerProvider{drained: make(chan struct{})}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	mapping := ip.Mapping{HostPort: 30080, ServicePort: 80, DrainTimeout: time.Hour}
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("a", "ns"), Mappings: []ip.Mapping{mapping}}))
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("a", "ns")}))
+
+	assert.True(t, lbs.lbs[0].closed)
+
+	// the host port is not released to another service while the connections of "a" drain
+	assert.ErrorContains(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("b", "ns"), Mappings: []ip.Mapping{mapping}}),
+		"host port 30080/tcp is draining the connections of another service: ns/a")
+
+	// but the same service can take it back, e.g. when its mapping is recycled
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("a", "ns"), Mappings: []ip.Mapping{mapping}}))
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("a", "ns")}))
+
+	close(lbs.drained)
+
+	require.Eventually(t, func() bool {
+		return mapper.Reconcile(ip.MappingSet{ServiceKey: key("b", "ns"), Mappings: []ip.Mapping{mapping}}) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mapper.Close()
+}
+
+func TestMapperCloseDrains(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"10.0.0.1"}}
+	lbs := &mockLoadBalancerProvider{drained: make(chan struct{})}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("a", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 30080, ServicePort: 80, DrainTimeout: 100 * time.Millisecond}},
+	}))
+
+	// Close waits for the drain, which is forced after the drain timeout
+	start := time.Now()
+
+	mapper.Close()
+
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.True(t, lbs.lbs[0].closed)
+}
+
+func TestMapperCloseListeners(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"10.0.0.1"}}
+	lbs := &mockLoadBalancerProvider{drained: make(chan struct{})}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("a", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 30080, ServicePort: 80, DrainTimeout: time.Hour}},
+	}))
+
+	// the listeners are closed without waiting for the connections to drain
+	mapper.CloseListeners()
+
+	require.Len(t, lbs.lbs, 1)
+	assert.True(t, lbs.lbs[0].closed)
+
+	closed := make(chan struct{})
+
+	go func() {
+		mapper.Close()
+
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		require.Fail(t, "Close returned with connections draining")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(lbs.drained)
+
+	<-closed
+}
+
+func TestMapperReconcile_NoDrainTimeout(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"10.0.0.1"}}
+	lbs := &mockLoadBalancerProvider{drained: make(chan struct{})}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	mapping := ip.Mapping{HostPort: 30080, ServicePort: 80}
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("a", "ns"), Mappings: []ip.Mapping{mapping}}))
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("a", "ns")}))
+
+	// the connections of "a" are closed right away, so the host port is released
+	assert.Equal(t, int32(1), lbs.lbs[0].drains.Load())
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("b", "ns"), Mappings: []ip.Mapping{mapping}}))
+
+	// Close does not wait for the connections either
+	mapper.Close()
+
+	require.Len(t, lbs.lbs, 2)
+
+	for _, lb := range lbs.lbs {
+		assert.True(t, lb.closed)
+		assert.Equal(t, int32(1), lb.drains.Load())
+	}
+}
+
+func TestMapperReconcile_SharedHostPort(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"10.0.0.1"}}
+	lbs := &mockLoadBalancerProvider{}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	git := ip.Mapping{HostPort: 443, ServicePort: 8443, ServerName: "git.example.com"}
+	wiki := ip.Mapping{HostPort: 443, ServicePort: 443, ServerName: "wiki.example.com"}
+	fallback := ip.Mapping{HostPort: 443, ServicePort: 443, ServerName: ip.DefaultServerName}
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("git", "ns"), Mappings: []ip.Mapping{git}}))
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("wiki", "ns"), Mappings: []ip.Mapping{wiki, fallback}}))
+
+	// a single load balancer listens on the host port, and routes to the backends of both services.
+	require.Len(t, lbs.lbs, 1)
+	assert.True(t, lbs.lbs[0].started)
+	assert.Contains(t, lbs.lbs[0].routes, "10.0.0.1:443")
+	assert.Empty(t, lbs.lbs[0].routes["10.0.0.1:443"])
+	assert.Equal(t, []ip.Backend{
+		{Upstreams: []string{"wiki.ns:443"}, Mapping: fallback},
+		{Upstreams: []string{"git.ns:8443"}, Mapping: git},
+		{Upstreams: []string{"wiki.ns:443"}, Mapping: wiki},
+	}, lbs.lbs[0].backends)
+
+	assert.Equal(t, []types.NamespacedName{key("git", "ns"), key("wiki", "ns")}, mapper.KnownServices())
+
+	// a route can only be registered once.
+	err = mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("other", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 443, ServicePort: 443, ServerName: "git.example.com"}},
+	})
+	assert.ErrorContains(t, err, `route "git.example.com" on host port 443/tcp is already registered to another service: ns/git`)
+
+	// a shared host port can't be taken without a server name.
+	err = mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("other", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 443, ServicePort: 443}},
+	})
+	assert.ErrorContains(t, err, "host port 443/tcp is already registered to another service")
+
+	// the listeners of a shared host port are the same for all the services.
+	err = mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("other", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 443, ServicePort: 443, ServerName: "other.example.com", AcceptProxyProtocol: true}},
+	})
+	assert.ErrorContains(t, err, "different accept-proxy-protocol option")
+
+	// removing a service updates the backends in place.
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("wiki", "ns")}))
+
+	require.Len(t, lbs.lbs, 1)
+	assert.False(t, lbs.lbs[0].closed)
+	assert.Equal(t, []ip.Backend{{Upstreams: []string{"git.ns:8443"}, Mapping: git}}, lbs.lbs[0].backends)
+	assert.Equal(t, []types.NamespacedName{key("git", "ns")}, mapper.KnownServices())
+
+	// the last one closes the load balancer.
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("git", "ns")}))
+
+	assert.True(t, lbs.lbs[0].closed)
+	assert.Empty(t, mapper.KnownServices())
+}
+
+func TestMapperReconcile_SharedHostPortMixedWithExclusive(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"10.0.0.1"}}
+	lbs := &mockLoadBalancerProvider{}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	err = mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("svc", "ns"),
+		Mappings: []ip.Mapping{
+			{HostPort: 443, ServicePort: 443},
+			{HostPort: 443, ServicePort: 443, ServerName: "example.com"},
+		},
+	})
+	assert.ErrorContains(t, err, "host port 443/tcp has both exclusive and shared mappings")
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("svc", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 443, ServicePort: 443}},
+	}))
+
+	err = mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("other", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 443, ServicePort: 443, ServerName: "example.com"}},
+	})
+	assert.ErrorContains(t, err, "host port 443/tcp is already registered to another service: ns/svc")
+
+	// switching the owner to a server name recreates the load balancer as a shared one.
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("svc", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 443, ServicePort: 443, ServerName: "svc.example.com"}},
+	}))
+
+	require.Len(t, lbs.lbs, 2)
+	assert.True(t, lbs.lbs[0].closed)
+	assert.Len(t, lbs.lbs[1].backends, 1)
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("other", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 443, ServicePort: 443, ServerName: "example.com"}},
+	}))
+
+	require.Len(t, lbs.lbs, 2)
+	assert.Len(t, lbs.lbs[1].backends, 2)
+}
+
+func TestMapperReconcile_SharedHTTPHostPort(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"10.0.0.1"}}
+	lbs := &mockLoadBalancerProvider{}
+
+	mapper, err := ip.NewMapper(provider, lbs, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	grafana := ip.Mapping{HostPort: 80, ServicePort: 3000, Mode: ip.ModeHTTP, Host: "dash.example.com", PathPrefix: "/grafana"}
+	prometheus := ip.Mapping{HostPort: 80, ServicePort: 9090, Mode: ip.ModeHTTP, Host: "dash.example.com", PathPrefix: "/prometheus"}
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("grafana", "monitoring"), Mappings: []ip.Mapping{grafana}}))
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("prometheus", "monitoring"), Mappings: []ip.Mapping{prometheus}}))
+
+	// the same host is routed to both services by the path.
+	require.Len(t, lbs.lbs, 1)
+	assert.Equal(t, []ip.Backend{
+		{Upstreams: []string{"grafana.monitoring:3000"}, Mapping: grafana},
+		{Upstreams: []string{"prometheus.monitoring:9090"}, Mapping: prometheus},
+	}, lbs.lbs[0].backends)
+
+	err = mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("other", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 80, ServicePort: 80, Mode: ip.ModeHTTP, Host: "dash.example.com", PathPrefix: "/grafana"}},
+	})
+	assert.ErrorContains(t, err, `route "dash.example.com/grafana" on host port 80/tcp is already registered to another service: monitoring/grafana`)
+
+	// routing by server name and by HTTP host needs different listeners.
+	err = mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("other", "ns"),
+		Mappings:   []ip.Mapping{{HostPort: 80, ServicePort: 443, ServerName: "dash.example.com"}},
+	})
+	assert.ErrorContains(t, err, "host port 80/tcp is shared with another service with a different mode option: monitoring/grafana")
+
+	err = mapper.Reconcile(ip.MappingSet{
+		ServiceKey: key("other", "ns"),
+		Mappings: []ip.Mapping{
+			{HostPort: 8080, ServicePort: 80, Mode: ip.ModeHTTP},
+			{HostPort: 8080, ServicePort: 443, ServerName: "dash.example.com"},
+		},
+	})
+	assert.ErrorContains(t, err, "host port 8080/tcp has mappings with different mode options")
+
+	// a mapping without a host and path prefix takes all the other requests.
+	fallback := ip.Mapping{HostPort: 80, ServicePort: 80, Mode: ip.ModeHTTP}
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("other", "ns"), Mappings: []ip.Mapping{fallback}}))
+
+	require.Len(t, lbs.lbs, 1)
+	assert.Equal(t, []ip.Backend{
+		{Upstreams: []string{"other.ns:80"}, Mapping: fallback},
+		{Upstreams: []string{"grafana.monitoring:3000"}, Mapping: grafana},
+		{Upstreams: []string{"prometheus.monitoring:9090"}, Mapping: prometheus},
+	}, lbs.lbs[0].backends)
+}
+
+func TestMapperConnectionStats(t *testing.T) {
+	t.Parallel()
+
+	provider := &mockIPSetProvider{ips: []string{"10.0.0.1"}}
+
+	mapper, err := ip.NewMapper(provider, &mockLoadBalancerProvider{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	ssh := ip.Mapping{HostPort: 2222, ServicePort: 22}
+	git := ip.Mapping{HostPort: 443, ServicePort: 443, ServerName: "git.example.com", MaxConnections: 10}
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("ssh", "ns"), Mappings: []ip.Mapping{ssh}}))
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("git", "ns"), Mappings: []ip.Mapping{git}}))
+
+	// pending mappings have no connections to count.
+	provider.ips = nil
+
+	require.NoError(t, mapper.Reconcile(ip.MappingSet{ServiceKey: key("pending", "ns"), Mappings: []ip.Mapping{{HostPort: 8080, ServicePort: 80}}}))
+
+	assert.Equal(t, []ip.MappingConnectionStats{
+		{ServiceKey: key("git", "ns"), Mapping: git, ConnectionStats: ip.ConnectionStats{Active: 1, Limit: 10}},
+		{ServiceKey: key("ssh", "ns"), Mapping: ssh, ConnectionStats: ip.ConnectionStats{Active: 1}},
+	}, mapper.ConnectionStats())
+}
@@ -0,0 +1,100 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// netlinkBufferSize is the size of the buffer the netlink messages are received into.
+const netlinkBufferSize = 64 * 1024
+
+// netlinkAddressSource is an AddressSource subscribed to the RTM_NEWADDR and RTM_DELADDR
+// messages of rtnetlink.
+type netlinkAddressSource struct {
+	file *os.File
+	buf  []byte
+}
+
+// NewNetlinkAddressSource returns an AddressSource subscribed to the changes of the IPv4 and
+// IPv6 addresses of the host with rtnetlink. No privileges are needed.
+func NewNetlinkAddressSource() (AddressSource, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: netlinkGroup(syscall.RTNLGRP_IPV4_IFADDR) | netlinkGroup(syscall.RTNLGRP_IPV6_IFADDR),
+	}
+
+	if err = syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd) //nolint:errcheck
+
+		return nil, fmt.Errorf("failed to subscribe to address changes: %w", err)
+	}
+
+	// a non-blocking file is read through the runtime poller, so that Close unblocks Receive
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd) //nolint:errcheck
+
+		return nil, fmt.Errorf("failed to set netlink socket non-blocking: %w", err)
+	}
+
+	return &netlinkAddressSource{
+		file: os.NewFile(uintptr(fd), "netlink"),
+		buf:  make([]byte, netlinkBufferSize),
+	}, nil
+}
+
+// netlinkGroup returns the bit of the multicast group in the groups of a netlink address.
+func netlinkGroup(group uint32) uint32 {
+	return 1 << (group - 1)
+}
+
+// Receive implements AddressSource.
+//
+// The notifications which did not fit in the buffer of the socket are lost, so the addresses
+// are reported as changed then.
+func (s *netlinkAddressSource) Receive() (bool, error) {
+	n, err := s.file.Read(s.buf)
+
+	switch {
+	case errors.Is(err, syscall.ENOBUFS):
+		return true, nil
+	case errors.Is(err, os.ErrClosed):
+		return false, ErrAddressSourceClosed
+	case err != nil:
+		return false, fmt.Errorf("failed to receive netlink messages: %w", err)
+	}
+
+	messages, err := syscall.ParseNetlinkMessage(s.buf[:n])
+	if err != nil {
+		return false, fmt.Errorf("failed to parse netlink messages: %w", err)
+	}
+
+	return addressChanged(messages), nil
+}
+
+// Close implements AddressSource.
+func (s *netlinkAddressSource) Close() error {
+	return s.file.Close()
+}
+
+// addressChanged reports whether any of the messages is of an added or removed address.
+func addressChanged(messages []syscall.NetlinkMessage) bool {
+	for _, message := range messages {
+		switch message.Header.Type {
+		case syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+			return true
+		}
+	}
+
+	return false
+}
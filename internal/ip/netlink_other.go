@@ -0,0 +1,14 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux
+
+package ip
+
+import "errors"
+
+// NewNetlinkAddressSource returns an error, as rtnetlink is only available on Linux.
+func NewNetlinkAddressSource() (AddressSource, error) {
+	return nil, errors.New("address changes can only be watched on Linux")
+}
@@ -0,0 +1,498 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"net"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/siderolabs/go-loadbalancer/upstream"
+	"go.uber.org/zap"
+)
+
+// DefaultNFTablesTable is the name of the nftables table of the NAT load balancers.
+const DefaultNFTablesTable = "kube-service-exposer"
+
+// NFTablesRunner runs nft scripts.
+type NFTablesRunner interface {
+	Run(script string) error
+}
+
+// NFTCommand is an NFTablesRunner running the nft command.
+type NFTCommand struct {
+	// Path is the path of the nft binary, "nft" from the PATH when empty.
+	Path string
+}
+
+// Run implements NFTablesRunner.
+func (c NFTCommand) Run(script string) error {
+	cmd := exec.Command(cmp.Or(c.Path, "nft"), "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %w: %s", err, bytes.TrimSpace(output))
+	}
+
+	return nil
+}
+
+// NFTables is the nftables table the NAT load balancers program their rules into.
+//
+// The table is replaced as a whole in a single transaction whenever the rules change, and is
+// removed once there are no rules left.
+//
+// Zero value of NFTables is ready to use: it programs the DefaultNFTablesTable table with
+// the nft command.
+type NFTables struct {
+	Logger *zap.Logger
+
+	// Runner runs the scripts replacing the table, NFTCommand when nil.
+	Runner NFTablesRunner
+
+	rules map[*NAT][]natRule
+
+	// Table is the name of the table in the inet family, DefaultNFTablesTable when empty.
+	Table string
+
+	lock     sync.Mutex
+	detached bool
+}
+
+// natRule forwards the connections to a listen address to the upstreams.
+type natRule struct {
+	listen    netip.AddrPort
+	upstreams []netip.AddrPort
+	protocol  Protocol
+}
+
+// set replaces the rules of the load balancer, and applies the table. The rules are kept
+// unchanged if it fails.
+func (t *NFTables) set(lb *NAT, rules []natRule) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.rules == nil {
+		t.rules = map[*NAT][]natRule{}
+	}
+
+	previous, ok := t.rules[lb]
+
+	if rules == nil {
+		delete(t.rules, lb)
+	} else {
+		t.rules[lb] = rules
+	}
+
+	if err := t.applyNoLock(); err != nil {
+		if ok {
+			t.rules[lb] = previous
+		} else {
+			delete(t.rules, lb)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (t *NFTables) applyNoLock() error {
+	if t.detached {
+		return nil
+	}
+
+	if t.Logger == nil {
+		t.Logger = zap.NewNop()
+	}
+
+	runner := t.Runner
+	if runner == nil {
+		runner = NFTCommand{}
+	}
+
+	script := t.script()
+
+	if err := runner.Run(script); err != nil {
+		return fmt.Errorf("failed to apply nftables table: %w", err)
+	}
+
+	t.Logger.Debug("applied nftables table", zap.String("script", script))
+
+	return nil
+}
+
+// Detach stops programming the table, and leaves it as it is, e.g. for another process taking
+// it over.
+func (t *NFTables) Detach() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.detached = true
+}
+
+// script renders the nft script replacing the table with the one holding the current rules,
+// or removing it if there are none.
+func (t *NFTables) script() string {
+	table := "inet " + cmp.Or(t.Table, DefaultNFTablesTable)
+
+	rules := slices.Concat(slices.Collect(maps.Values(t.rules))...)
+
+	slices.SortFunc(rules, func(a, b natRule) int {
+		return cmp.Or(a.listen.Compare(b.listen), cmp.Compare(a.protocol, b.protocol))
+	})
+
+	var sb strings.Builder
+
+	// declaring the table first makes deleting it succeed when it does not exist yet
+	fmt.Fprintf(&sb, "table %s\ndelete table %s\n", table, table)
+
+	if len(rules) == 0 {
+		return sb.String()
+	}
+
+	fmt.Fprintf(&sb, "table %s {\n", table)
+
+	// the connections from other hosts, and from this one
+	for _, chain := range []struct {
+		name string
+		hook string
+	}{
+		{name: "prerouting", hook: "type nat hook prerouting priority dstnat; policy accept;"},
+		{name: "output", hook: "type nat hook output priority -100; policy accept;"},
+	} {
+		fmt.Fprintf(&sb, "\tchain %s {\n\t\t%s\n", chain.name, chain.hook)
+
+		for _, rule := range rules {
+			if len(rule.upstreams) > 0 {
+				fmt.Fprintf(&sb, "\t\t%s %s\n", rule.match(), rule.dnat())
+			}
+		}
+
+		sb.WriteString("\t}\n")
+	}
+
+	// the replies of the upstreams are to come back through this host to be translated back
+	sb.WriteString("\tchain postrouting {\n\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+
+	for _, rule := range rules {
+		if len(rule.upstreams) > 0 {
+			fmt.Fprintf(&sb, "\t\t%s masquerade\n", rule.originalMatch())
+		}
+	}
+
+	sb.WriteString("\t}\n}\n")
+
+	return sb.String()
+}
+
+// family returns the nftables family of the listen address.
+func (r natRule) family() string {
+	if r.listen.Addr().Is4() {
+		return "ip"
+	}
+
+	return "ip6"
+}
+
+// match matches the packets to the listen address.
+func (r natRule) match() string {
+	destination := r.family() + " daddr " + r.listen.Addr().String()
+
+	if r.listen.Addr().IsUnspecified() {
+		destination = "meta nfproto ipv4 fib daddr type local"
+		if r.family() == "ip6" {
+			destination = "meta nfproto ipv6 fib daddr type local"
+		}
+	}
+
+	return fmt.Sprintf("%s %s dport %d", destination, r.protocol, r.listen.Port())
+}
+
+// originalMatch matches the packets of the connections translated by the rule.
+func (r natRule) originalMatch() string {
+	nfproto := "ipv4"
+	if r.family() == "ip6" {
+		nfproto = "ipv6"
+	}
+
+	s := fmt.Sprintf("meta nfproto %s meta l4proto %s ct status dnat", nfproto, r.protocol)
+
+	if !r.listen.Addr().IsUnspecified() {
+		s += fmt.Sprintf(" ct original %s daddr %s", r.family(), r.listen.Addr())
+	}
+
+	return s + " ct original proto-dst " + strconv.Itoa(int(r.listen.Port()))
+}
+
+// dnat translates the destination to one of the upstreams, picked at random.
+func (r natRule) dnat() string {
+	if len(r.upstreams) == 1 {
+		return fmt.Sprintf("dnat %s to %s", r.family(), r.upstreams[0])
+	}
+
+	elements := make([]string, 0, len(r.upstreams))
+
+	for i, addr := range r.upstreams {
+		elements = append(elements, fmt.Sprintf("%d : %s . %d", i, addr.Addr(), addr.Port()))
+	}
+
+	return fmt.Sprintf("dnat %s addr . port to numgen random mod %d map { %s }", r.family(), len(r.upstreams), strings.Join(elements, ", "))
+}
+
+// NAT is a load balancer which has the kernel forward the connections to its upstreams, with
+// the DNAT rules of an nftables table.
+//
+// The upstreams need to be IP addresses of the family of the listen address. Nothing listens
+// on the listen addresses, and the connections are not proxied, so they are not limited,
+// health checked, or drained: the connections established before a rule is removed keep
+// being forwarded by the connection tracking of the kernel.
+//
+// Use NATLoadBalancerProvider to create it.
+type NAT struct {
+	table  *NFTables
+	routes map[netip.AddrPort][]netip.AddrPort
+
+	protocol Protocol
+
+	lock    sync.Mutex
+	started bool
+	closed  bool
+}
+
+// AddRoute installs a route from the listen address ipPort to the upstreams.
+//
+// The rule of a route added after Start is programmed right away, see RouteRemover.
+func (n *NAT) AddRoute(ipPort string, upstreamAddrs iter.Seq[string], _ ...upstream.ListOption) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		return net.ErrClosed
+	}
+
+	listen, err := parseNATListen(ipPort)
+	if err != nil {
+		return err
+	}
+
+	var addrs []string
+
+	if upstreamAddrs != nil {
+		addrs = slices.Collect(upstreamAddrs)
+	}
+
+	upstreams, err := parseNATUpstreams(listen, addrs)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := n.routes[listen]; ok && n.started {
+		return fmt.Errorf("route %s already exists", ipPort)
+	}
+
+	if n.routes == nil {
+		n.routes = map[netip.AddrPort][]netip.AddrPort{}
+	}
+
+	n.routes[listen] = upstreams
+
+	if !n.started {
+		return nil
+	}
+
+	if err = n.table.set(n, n.rulesNoLock()); err != nil {
+		delete(n.routes, listen)
+
+		return err
+	}
+
+	return nil
+}
+
+// RemoveRoute implements RouteRemover.
+//
+// The connections forwarded by the rule of the route keep being forwarded by the connection
+// tracking of the kernel.
+func (n *NAT) RemoveRoute(ipPort string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		return net.ErrClosed
+	}
+
+	listen, err := parseNATListen(ipPort)
+	if err != nil {
+		return err
+	}
+
+	upstreams, ok := n.routes[listen]
+	if !ok {
+		return fmt.Errorf("route %s does not exist", ipPort)
+	}
+
+	delete(n.routes, listen)
+
+	if !n.started {
+		return nil
+	}
+
+	if err = n.table.set(n, n.rulesNoLock()); err != nil {
+		n.routes[listen] = upstreams
+
+		return err
+	}
+
+	return nil
+}
+
+// parseNATListen parses the listen address of a route.
+func parseNATListen(ipPort string) (netip.AddrPort, error) {
+	listen, err := netip.ParseAddrPort(ipPort)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid listen address %q: %w", ipPort, err)
+	}
+
+	// the zone of a link-local address is implied by the address in the rules
+	return netip.AddrPortFrom(listen.Addr().Unmap().WithZone(""), listen.Port()), nil
+}
+
+// parseNATUpstreams parses the upstreams of the listen address.
+func parseNATUpstreams(listen netip.AddrPort, upstreamAddrs []string) ([]netip.AddrPort, error) {
+	upstreams := make([]netip.AddrPort, 0, len(upstreamAddrs))
+
+	for _, upstreamAddr := range upstreamAddrs {
+		addr, err := netip.ParseAddrPort(upstreamAddr)
+		if err != nil {
+			host, _, _ := net.SplitHostPort(upstreamAddr) //nolint:errcheck
+
+			return nil, fmt.Errorf("upstream %q is not an IP address, the connections can only be forwarded to IP addresses", host)
+		}
+
+		// the connections to a dual-stack Service are forwarded to the upstreams of their family
+		if addr.Addr().Unmap().Is4() != listen.Addr().Is4() {
+			continue
+		}
+
+		upstreams = append(upstreams, netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()))
+	}
+
+	slices.SortFunc(upstreams, netip.AddrPort.Compare)
+
+	return slices.Compact(upstreams), nil
+}
+
+// Start programs the rules of the routes.
+func (n *NAT) Start() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.started {
+		return errors.New("already started")
+	}
+
+	n.started = true
+
+	return n.table.set(n, n.rulesNoLock())
+}
+
+// SetUpstreams implements UpstreamSetter.
+func (n *NAT) SetUpstreams(upstreamAddrs []string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		return net.ErrClosed
+	}
+
+	routes := make(map[netip.AddrPort][]netip.AddrPort, len(n.routes))
+
+	for listen := range n.routes {
+		upstreams, err := parseNATUpstreams(listen, upstreamAddrs)
+		if err != nil {
+			return err
+		}
+
+		routes[listen] = upstreams
+	}
+
+	previous := n.routes
+	n.routes = routes
+
+	if !n.started {
+		return nil
+	}
+
+	if err := n.table.set(n, n.rulesNoLock()); err != nil {
+		n.routes = previous
+
+		return err
+	}
+
+	return nil
+}
+
+func (n *NAT) rulesNoLock() []natRule {
+	rules := make([]natRule, 0, len(n.routes))
+
+	for _, listen := range slices.SortedFunc(maps.Keys(n.routes), netip.AddrPort.Compare) {
+		rules = append(rules, natRule{listen: listen, upstreams: n.routes[listen], protocol: n.protocol})
+	}
+
+	return rules
+}
+
+// Close removes the rules of the routes.
+func (n *NAT) Close() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.closed {
+		return nil
+	}
+
+	n.closed = true
+
+	if !n.started {
+		return nil
+	}
+
+	return n.table.set(n, nil)
+}
+
+// Wait returns right away, as the connections are forwarded by the kernel.
+func (n *NAT) Wait() error {
+	return nil
+}
+
+// NATLoadBalancerProvider is a LoadBalancerProvider that creates NAT instances programming
+// their rules into the same table.
+type NATLoadBalancerProvider struct {
+	Table *NFTables
+}
+
+// New returns a new NAT instance for the protocol of the mapping.
+func (p *NATLoadBalancerProvider) New(mapping Mapping, _ *zap.Logger) (LoadBalancer, error) {
+	if mapping.Mode != ModeNAT {
+		return nil, fmt.Errorf("unsupported mode %s", mapping.Mode)
+	}
+
+	if p.Table == nil {
+		return nil, errors.New("no nftables table")
+	}
+
+	return &NAT{table: p.Table, protocol: mapping.Protocol}, nil
+}
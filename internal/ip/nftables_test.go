@@ -0,0 +1,347 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+// fakeNFTablesRunner records the scripts, and fails while err is set.
+type fakeNFTablesRunner struct {
+	err     error
+	scripts []string
+	lock    sync.Mutex
+}
+
+func (r *fakeNFTablesRunner) Run(script string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	r.scripts = append(r.scripts, script)
+
+	return nil
+}
+
+func (r *fakeNFTablesRunner) last() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.scripts) == 0 {
+		return ""
+	}
+
+	return r.scripts[len(r.scripts)-1]
+}
+
+const emptyNFTablesScript = `table inet kube-service-exposer
+delete table inet kube-service-exposer
+`
+
+func newNAT(t *testing.T, table *ip.NFTables, mapping ip.Mapping, listenAddr string, upstreamAddrs ...string) ip.LoadBalancer {
+	t.Helper()
+
+	provider := &ip.ProtocolLoadBalancerProvider{NAT: &ip.NATLoadBalancerProvider{Table: table}}
+
+	mapping.Mode = ip.ModeNAT
+
+	lb, err := provider.New(mapping, zaptest.NewLogger(t))
+	require.NoError(t, err)
+	require.IsType(t, &ip.NAT{}, lb)
+
+	require.NoError(t, lb.AddRoute(listenAddr, slices.Values(upstreamAddrs)))
+
+	return lb
+}
+
+func TestNATScript(t *testing.T) {
+	t.Parallel()
+
+	runner := &fakeNFTablesRunner{}
+	table := &ip.NFTables{Logger: zaptest.NewLogger(t), Runner: runner}
+
+	tcp := newNAT(t, table, ip.Mapping{}, "10.0.0.1:30080", "10.96.0.10:80")
+	require.NoError(t, tcp.Start())
+
+	udp := newNAT(t, table, ip.Mapping{Protocol: ip.ProtocolUDP}, "0.0.0.0:30053", "10.244.1.7:53", "10.244.0.5:53")
+	require.NoError(t, udp.Start())
+
+	assert.Equal(t, `table inet kube-service-exposer
+delete table inet kube-service-exposer
+table inet kube-service-exposer {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		meta nfproto ipv4 fib daddr type local udp dport 30053 dnat ip addr . port to numgen random mod 2 map { 0 : 10.244.0.5 . 53, 1 : 10.244.1.7 . 53 }
+		ip daddr 10.0.0.1 tcp dport 30080 dnat ip to 10.96.0.10:80
+	}
+	chain output {
+		type nat hook output priority -100; policy accept;
+		meta nfproto ipv4 fib daddr type local udp dport 30053 dnat ip addr . port to numgen random mod 2 map { 0 : 10.244.0.5 . 53, 1 : 10.244.1.7 . 53 }
+		ip daddr 10.0.0.1 tcp dport 30080 dnat ip to 10.96.0.10:80
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		meta nfproto ipv4 meta l4proto udp ct status dnat ct original proto-dst 30053 masquerade
+		meta nfproto ipv4 meta l4proto tcp ct status dnat ct original ip daddr 10.0.0.1 ct original proto-dst 30080 masquerade
+	}
+}
+`, runner.last())
+
+	// the upstreams are replaced in place, and a route without upstreams has no rules
+	require.NoError(t, udp.(ip.UpstreamSetter).SetUpstreams(nil))
+	require.NoError(t, tcp.(ip.UpstreamSetter).SetUpstreams([]string{"[::ffff:10.96.0.11]:80"}))
+
+	assert.Equal(t, `table inet kube-service-exposer
+delete table inet kube-service-exposer
+table inet kube-service-exposer {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		ip daddr 10.0.0.1 tcp dport 30080 dnat ip to 10.96.0.11:80
+	}
+	chain output {
+		type nat hook output priority -100; policy accept;
+		ip daddr 10.0.0.1 tcp dport 30080 dnat ip to 10.96.0.11:80
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		meta nfproto ipv4 meta l4proto tcp ct status dnat ct original ip daddr 10.0.0.1 ct original proto-dst 30080 masquerade
+	}
+}
+`, runner.last())
+
+	require.NoError(t, tcp.Close())
+	require.NoError(t, tcp.Wait())
+	require.NoError(t, udp.Close())
+	require.NoError(t, udp.Wait())
+
+	// the table is removed with the last rules
+	assert.Equal(t, emptyNFTablesScript, runner.last())
+}
+
+func TestNATScriptIPv6(t *testing.T) {
+	t.Parallel()
+
+	runner := &fakeNFTablesRunner{}
+	table := &ip.NFTables{Runner: runner, Table: "test"}
+
+	lb := newNAT(t, table, ip.Mapping{}, "[fd00::1]:30080", "[fd00:10:96::a]:80")
+	require.NoError(t, lb.Start())
+
+	assert.Equal(t, `table inet test
+delete table inet test
+table inet test {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		ip6 daddr fd00::1 tcp dport 30080 dnat ip6 to [fd00:10:96::a]:80
+	}
+	chain output {
+		type nat hook output priority -100; policy accept;
+		ip6 daddr fd00::1 tcp dport 30080 dnat ip6 to [fd00:10:96::a]:80
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		meta nfproto ipv6 meta l4proto tcp ct status dnat ct original ip6 daddr fd00::1 ct original proto-dst 30080 masquerade
+	}
+}
+`, runner.last())
+}
+
+func TestNATRoutesAfterStart(t *testing.T) {
+	t.Parallel()
+
+	runner := &fakeNFTablesRunner{}
+	table := &ip.NFTables{Runner: runner}
+
+	lb := newNAT(t, table, ip.Mapping{}, "10.0.0.1:30080", "10.96.0.10:80")
+	require.NoError(t, lb.Start())
+
+	// the rules of the routes added and removed after Start are programmed right away
+	require.NoError(t, lb.AddRoute("10.0.0.2:30080", slices.Values([]string{"10.96.0.10:80"})))
+	require.NoError(t, lb.(ip.RouteRemover).RemoveRoute("10.0.0.1:30080"))
+
+	assert.Equal(t, `table inet kube-service-exposer
+delete table inet kube-service-exposer
+table inet kube-service-exposer {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		ip daddr 10.0.0.2 tcp dport 30080 dnat ip to 10.96.0.10:80
+	}
+	chain output {
+		type nat hook output priority -100; policy accept;
+		ip daddr 10.0.0.2 tcp dport 30080 dnat ip to 10.96.0.10:80
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		meta nfproto ipv4 meta l4proto tcp ct status dnat ct original ip daddr 10.0.0.2 ct original proto-dst 30080 masquerade
+	}
+}
+`, runner.last())
+
+	assert.ErrorContains(t, lb.AddRoute("10.0.0.2:30080", nil), "already exists")
+	assert.ErrorContains(t, lb.(ip.RouteRemover).RemoveRoute("10.0.0.1:30080"), "does not exist")
+
+	// the routes which fail to be applied are not kept
+	runner.err = errors.New("nft failed")
+
+	require.Error(t, lb.(ip.RouteRemover).RemoveRoute("10.0.0.2:30080"))
+
+	runner.err = nil
+
+	require.NoError(t, lb.(ip.RouteRemover).RemoveRoute("10.0.0.2:30080"))
+	assert.Equal(t, emptyNFTablesScript, runner.last())
+}
+
+func TestNATScriptDualStack(t *testing.T) {
+	t.Parallel()
+
+	runner := &fakeNFTablesRunner{}
+	table := &ip.NFTables{Runner: runner, Table: "test"}
+
+	provider := &ip.NATLoadBalancerProvider{Table: table}
+
+	lb, err := provider.New(ip.Mapping{Mode: ip.ModeNAT}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	// the routes get the upstreams of their family, the zone of a link-local address is left out
+	for _, listenAddr := range []string{"0.0.0.0:30080", "[::]:30080", "[fe80::1%eth0]:30080"} {
+		require.NoError(t, lb.AddRoute(listenAddr, slices.Values([]string{"10.244.0.5:80", "[fd00:10:244::5]:80"})))
+	}
+
+	require.NoError(t, lb.Start())
+
+	assert.Equal(t, `table inet test
+delete table inet test
+table inet test {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		meta nfproto ipv4 fib daddr type local tcp dport 30080 dnat ip to 10.244.0.5:80
+		meta nfproto ipv6 fib daddr type local tcp dport 30080 dnat ip6 to [fd00:10:244::5]:80
+		ip6 daddr fe80::1 tcp dport 30080 dnat ip6 to [fd00:10:244::5]:80
+	}
+	chain output {
+		type nat hook output priority -100; policy accept;
+		meta nfproto ipv4 fib daddr type local tcp dport 30080 dnat ip to 10.244.0.5:80
+		meta nfproto ipv6 fib daddr type local tcp dport 30080 dnat ip6 to [fd00:10:244::5]:80
+		ip6 daddr fe80::1 tcp dport 30080 dnat ip6 to [fd00:10:244::5]:80
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		meta nfproto ipv4 meta l4proto tcp ct status dnat ct original proto-dst 30080 masquerade
+		meta nfproto ipv6 meta l4proto tcp ct status dnat ct original proto-dst 30080 masquerade
+		meta nfproto ipv6 meta l4proto tcp ct status dnat ct original ip6 daddr fe80::1 ct original proto-dst 30080 masquerade
+	}
+}
+`, runner.last())
+}
+
+func TestNATErrors(t *testing.T) {
+	t.Parallel()
+
+	runner := &fakeNFTablesRunner{}
+	table := &ip.NFTables{Runner: runner}
+	provider := &ip.NATLoadBalancerProvider{Table: table}
+
+	_, err := provider.New(ip.Mapping{}, nil)
+	require.Error(t, err)
+
+	lb, err := provider.New(ip.Mapping{Mode: ip.ModeNAT}, nil)
+	require.NoError(t, err)
+
+	assert.ErrorContains(t, lb.AddRoute("10.0.0.1:30080", slices.Values([]string{"svc.ns:80"})), "not an IP address")
+
+	require.NoError(t, lb.AddRoute("10.0.0.1:30080", slices.Values([]string{"10.96.0.10:80"})))
+
+	// the rules which fail to be applied are not kept
+	runner.err = errors.New("nft failed")
+
+	require.Error(t, lb.Start())
+
+	runner.err = nil
+
+	other := newNAT(t, table, ip.Mapping{}, "10.0.0.1:30081", "10.96.0.10:81")
+	require.NoError(t, other.Start())
+	assert.NotContains(t, runner.last(), "30080")
+
+	// a detached table is left as it is
+	table.Detach()
+
+	require.NoError(t, other.Close())
+	assert.Contains(t, runner.last(), "30081")
+}
+
+// netnsNFTablesRunner runs nft in a network namespace.
+type netnsNFTablesRunner struct {
+	netns string
+}
+
+func (r netnsNFTablesRunner) Run(script string) error {
+	cmd := exec.Command("ip", "netns", "exec", r.netns, "nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, output)
+	}
+
+	return nil
+}
+
+// TestNATNetns programs the rules in a network namespace, which needs root, and the nft and
+// ip commands.
+func TestNATNetns(t *testing.T) {
+	t.Parallel()
+
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	for _, command := range []string{"nft", "ip"} {
+		if _, err := exec.LookPath(command); err != nil {
+			t.Skipf("requires %s", command)
+		}
+	}
+
+	netns := fmt.Sprintf("kube-service-exposer-test-%d", os.Getpid())
+
+	require.NoError(t, exec.Command("ip", "netns", "add", netns).Run())
+	t.Cleanup(func() { exec.Command("ip", "netns", "delete", netns).Run() }) //nolint:errcheck
+
+	table := &ip.NFTables{Logger: zaptest.NewLogger(t), Runner: netnsNFTablesRunner{netns: netns}}
+
+	tcp := newNAT(t, table, ip.Mapping{}, "10.0.0.1:30080", "10.96.0.10:80")
+	require.NoError(t, tcp.Start())
+
+	udp := newNAT(t, table, ip.Mapping{Protocol: ip.ProtocolUDP}, "0.0.0.0:30053", "10.244.0.5:53", "10.244.1.7:53")
+	require.NoError(t, udp.Start())
+
+	ipv6 := newNAT(t, table, ip.Mapping{}, "[fd00::1]:30080", "[fd00:10:96::a]:80")
+	require.NoError(t, ipv6.Start())
+
+	output, err := exec.Command("ip", "netns", "exec", netns, "nft", "list", "table", "inet", ip.DefaultNFTablesTable).CombinedOutput()
+	require.NoError(t, err, string(output))
+	assert.Contains(t, string(output), "dnat ip to 10.96.0.10:80")
+
+	require.NoError(t, tcp.Close())
+	require.NoError(t, udp.Close())
+	require.NoError(t, ipv6.Close())
+
+	// the table is removed once the last load balancer is closed
+	assert.Error(t, exec.Command("ip", "netns", "exec", netns, "nft", "list", "table", "inet", ip.DefaultNFTablesTable).Run())
+}
@@ -0,0 +1,157 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"container/list"
+	"errors"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimitMaxClients is the number of clients whose connection rate is tracked per mapping.
+// Beyond it, the least recently seen clients are forgotten, so that a scan from many
+// addresses cannot exhaust the memory.
+const rateLimitMaxClients = 16384
+
+// errRateLimited rejects a connection of a client over the rate limit of its mapping.
+var errRateLimited = errors.New("connection rate limit exceeded")
+
+// RateLimit is a token bucket limit of how often each client can connect.
+type RateLimit struct {
+	// Rate is the number of connections a client can make per Interval. The limit is
+	// disabled when zero.
+	Rate     int
+	Interval time.Duration
+
+	// Burst is the number of connections a client can make at once. It defaults to Rate.
+	Burst int
+
+	// PerSubnet keys the clients by their /24 IPv4 or /64 IPv6 subnet instead of by their
+	// address.
+	PerSubnet bool
+}
+
+// Enabled returns true if the rate limit is set.
+func (l RateLimit) Enabled() bool {
+	return l.Rate > 0 && l.Interval > 0
+}
+
+func (l RateLimit) String() string {
+	s := strconv.Itoa(l.Rate) + "/" + l.Interval.String()
+
+	if l.Burst > 0 {
+		s += " rate-limit-burst=" + strconv.Itoa(l.Burst)
+	}
+
+	if l.PerSubnet {
+		s += " rate-limit-by=subnet"
+	}
+
+	return s
+}
+
+// rateLimiter tracks a token bucket for each of the recently seen clients of a mapping.
+type rateLimiter struct {
+	limit RateLimit
+
+	lock    sync.Mutex
+	clients map[netip.Addr]*list.Element
+	// recent has the *clientBucket of the clients, the most recently seen first
+	recent list.List
+
+	limited atomic.Uint64
+}
+
+type clientBucket struct {
+	key    netip.Addr
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter of the connection rate of the clients, or nil if the rate
+// limit is not enabled.
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if !limit.Enabled() {
+		return nil
+	}
+
+	return &rateLimiter{
+		limit:   limit,
+		clients: map[netip.Addr]*list.Element{},
+	}
+}
+
+// allow takes a token from the bucket of the client. It returns false if the bucket is empty.
+//
+// Connections without a client address, e.g. the health checks of a downstream load balancer,
+// are always allowed. A nil limiter allows all connections.
+func (l *rateLimiter) allow(addr netip.Addr) bool {
+	if l == nil || !addr.IsValid() {
+		return true
+	}
+
+	key := l.key(addr)
+	now := time.Now()
+	burst := float64(l.limit.Burst)
+
+	if burst <= 0 {
+		burst = float64(l.limit.Rate)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var bucket *clientBucket
+
+	if elem, ok := l.clients[key]; ok {
+		bucket = elem.Value.(*clientBucket) //nolint:forcetypeassert,errcheck
+		l.recent.MoveToFront(elem)
+
+		refill := now.Sub(bucket.last).Seconds() / l.limit.Interval.Seconds() * float64(l.limit.Rate)
+		bucket.tokens = min(burst, bucket.tokens+refill)
+		bucket.last = now
+	} else {
+		if l.recent.Len() >= rateLimitMaxClients {
+			oldest := l.recent.Back()
+
+			delete(l.clients, oldest.Value.(*clientBucket).key) //nolint:forcetypeassert,errcheck
+			l.recent.Remove(oldest)
+		}
+
+		bucket = &clientBucket{key: key, tokens: burst, last: now}
+		l.clients[key] = l.recent.PushFront(bucket)
+	}
+
+	if bucket.tokens < 1 {
+		l.limited.Add(1)
+
+		return false
+	}
+
+	bucket.tokens--
+
+	return true
+}
+
+// key returns the address the rate of the client is tracked by.
+func (l *rateLimiter) key(addr netip.Addr) netip.Addr {
+	addr = addr.Unmap().WithZone("")
+
+	if !l.limit.PerSubnet {
+		return addr
+	}
+
+	bits := 24
+
+	if addr.Is6() {
+		bits = 64
+	}
+
+	return netip.PrefixFrom(addr, bits).Masked().Addr()
+}
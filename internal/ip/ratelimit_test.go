@@ -0,0 +1,144 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+func TestTCPRateLimit(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name      string
+		perSubnet bool
+	}{
+		{name: "per address"},
+		{name: "per subnet", perSubnet: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			lb := &ip.TCP{
+				Logger:    tcpTestLogger(t),
+				RateLimit: ip.RateLimit{Rate: 1, Interval: time.Hour, Burst: 2, PerSubnet: test.perSubnet},
+			}
+			listenAddr := startTCP(t, lb, startTCPEcho(t))
+
+			for range 2 {
+				_, err := dialEchoFrom(t, listenAddr, net.IPv4(127, 0, 0, 2))
+				require.NoError(t, err)
+			}
+
+			_, err := dialEchoFrom(t, listenAddr, net.IPv4(127, 0, 0, 2))
+			assert.Error(t, err)
+
+			// another client in the same /24 has its own bucket, unless the rate is tracked per subnet
+			_, err = dialEchoFrom(t, listenAddr, net.IPv4(127, 0, 0, 3))
+
+			if test.perSubnet {
+				assert.Error(t, err)
+				assert.Equal(t, uint64(2), lb.ConnectionStats()[""].RateLimited)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, uint64(1), lb.ConnectionStats()[""].RateLimited)
+			}
+		})
+	}
+}
+
+func TestTCPRateLimitBeforeMaxConnections(t *testing.T) {
+	t.Parallel()
+
+	lb := &ip.TCP{
+		Logger:             tcpTestLogger(t),
+		MaxConnections:     1,
+		MaxConnectionsWait: 10 * time.Second,
+		RateLimit:          ip.RateLimit{Rate: 1, Interval: time.Hour},
+	}
+	listenAddr := startTCP(t, lb, startTCPEcho(t))
+
+	_, err := dialEchoFrom(t, listenAddr, net.IPv4(127, 0, 0, 2))
+	require.NoError(t, err)
+
+	// the client over the rate limit is rejected right away, instead of waiting for a slot
+	start := time.Now()
+
+	_, err = dialEchoFrom(t, listenAddr, net.IPv4(127, 0, 0, 2))
+	assert.Error(t, err)
+
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, ip.ConnectionStats{Active: 1, Limit: 1, RateLimited: 1}, lb.ConnectionStats()[""])
+}
+
+func TestTCPRateLimitRefill(t *testing.T) {
+	t.Parallel()
+
+	listenAddr := startTCP(t, &ip.TCP{
+		Logger:    tcpTestLogger(t),
+		RateLimit: ip.RateLimit{Rate: 1, Interval: time.Second},
+	}, startTCPEcho(t))
+
+	_, err := dialEcho(t, listenAddr)
+	require.NoError(t, err)
+
+	_, err = dialEcho(t, listenAddr)
+	require.Error(t, err)
+
+	// the token is back after a second
+	require.Eventually(t, func() bool {
+		_, err := dialEcho(t, listenAddr)
+
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestHTTPRateLimit(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	t.Cleanup(upstream.Close)
+
+	lb := &ip.HTTP{Logger: tcpTestLogger(t)}
+	listenAddr := startHTTP(t, lb, []ip.Backend{
+		{
+			Upstreams: []string{upstream.Listener.Addr().String()},
+			Mapping:   ip.Mapping{Mode: ip.ModeHTTP, RateLimit: ip.RateLimit{Rate: 2, Interval: time.Hour}},
+		},
+		{
+			Upstreams: []string{upstream.Listener.Addr().String()},
+			Mapping:   ip.Mapping{Mode: ip.ModeHTTP, PathPrefix: "/unlimited"},
+		},
+	})
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	t.Cleanup(client.CloseIdleConnections)
+
+	// the limit applies to the requests, also on the same connection
+	for range 2 {
+		statusCode, _ := httpGet(t, client, listenAddr, "example.org", "/")
+		assert.Equal(t, http.StatusNoContent, statusCode)
+	}
+
+	statusCode, _ := httpGet(t, client, listenAddr, "example.org", "/")
+	assert.Equal(t, http.StatusTooManyRequests, statusCode)
+
+	statusCode, _ = httpGet(t, client, listenAddr, "example.org", "/unlimited")
+	assert.Equal(t, http.StatusNoContent, statusCode)
+
+	assert.Equal(t, uint64(1), lb.ConnectionStats()["*/"].RateLimited)
+}
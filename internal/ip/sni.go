@@ -0,0 +1,521 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siderolabs/gen/xiter"
+	"github.com/siderolabs/go-loadbalancer/upstream"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// DefaultServerName is the server name of the backend which receives the connections of a
+// shared host port that match no other backend, including the ones without a server name.
+const DefaultServerName = "*"
+
+// SNI is a load balancer for TLS connections, which routes each connection to one of its
+// backends by the server name in the ClientHello. It allows mappings of several Services to
+// share a host port.
+//
+// A server name is matched against the backends by its exact name first, then by a wildcard
+// name for its parent domain ("*.example.com"), and then the DefaultServerName backend is
+// used. Connections matching no backend are closed.
+//
+// Every backend has its own upstream and connection handling. TLS is passed through to the
+// upstream, unless the backend terminates it.
+//
+// Zero value of SNI is a valid proxy, use AddRoute to install listen addresses and
+// SetBackends to install backends.
+type SNI struct {
+	Logger *zap.Logger
+
+	routes   map[string]*sniRoute
+	backends map[string]*sniBackend
+	conns    connTracker
+
+	errs serveErrors
+	wg   sync.WaitGroup
+
+	// AcceptProxyProtocol requires connections to start with a PROXY protocol header.
+	AcceptProxyProtocol bool
+
+	// ProxyProtocolTrustedCIDRs are the source CIDRs which are allowed to send a PROXY
+	// protocol header when AcceptProxyProtocol is set. When empty, no source is trusted.
+	ProxyProtocolTrustedCIDRs []netip.Prefix
+
+	// Certificates provides the certificates of the backends terminating TLS.
+	Certificates CertificateProvider
+
+	// Listeners opens the listeners of the routes. They are opened directly when it is nil.
+	Listeners ListenerRegistry
+
+	// StaticBindAddresses are the host IPs of the routes which are bound whether they are
+	// assigned to the host or not, see Mapping.StaticBindAddresses.
+	StaticBindAddresses AddressList
+
+	lock         sync.Mutex
+	backendsLock sync.RWMutex
+	started      bool
+	closed       bool
+}
+
+type sniRoute struct {
+	listener   net.Listener
+	logger     *zap.Logger
+	listenAddr string
+}
+
+type sniBackend struct {
+	list      *upstream.List[tcpNode]
+	limiter   *connLimiter
+	upstreams []string // host:port
+	mapping   Mapping
+}
+
+// AddRoute installs the listen address ipPort.
+//
+// Upstreams are set per backend with SetBackends, so upstreamAddrs must be empty. A route
+// added after Start is listened on right away, see RouteRemover.
+func (s *SNI) AddRoute(ipPort string, upstreamAddrs iter.Seq[string], _ ...upstream.ListOption) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return net.ErrClosed
+	}
+
+	if _, ok := s.routes[ipPort]; ok && s.started {
+		return fmt.Errorf("route %s already exists", ipPort)
+	}
+
+	if upstreamAddrs != nil {
+		for range upstreamAddrs {
+			return errors.New("upstreams are set per backend")
+		}
+	}
+
+	if s.Logger == nil {
+		s.Logger = zap.NewNop()
+	}
+
+	if s.routes == nil {
+		s.routes = map[string]*sniRoute{}
+	}
+
+	route := &sniRoute{
+		logger:     s.Logger.With(zap.String("listen-addr", ipPort)),
+		listenAddr: ipPort,
+	}
+
+	if s.started {
+		ln, err := listen(s.Listeners, ipPort, s.StaticBindAddresses)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", ipPort, err)
+		}
+
+		route.listener = ln
+
+		s.wg.Go(func() {
+			s.errs.record(s.serve(route))
+		})
+	}
+
+	s.routes[ipPort] = route
+
+	return nil
+}
+
+// RemoveRoute implements RouteRemover.
+func (s *SNI) RemoveRoute(ipPort string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return net.ErrClosed
+	}
+
+	route, ok := s.routes[ipPort]
+	if !ok {
+		return fmt.Errorf("route %s does not exist", ipPort)
+	}
+
+	delete(s.routes, ipPort)
+
+	if route.listener != nil {
+		route.listener.Close() //nolint:errcheck
+	}
+
+	return nil
+}
+
+// SetBackends implements BackendSetter.
+//
+// The backends are keyed by the server name of their mapping. Backends whose upstream does
+// not change keep their upstream health state.
+func (s *SNI) SetBackends(backends []Backend, options ...upstream.ListOption) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return net.ErrClosed
+	}
+
+	s.backendsLock.RLock()
+	current := s.backends
+	s.backendsLock.RUnlock()
+
+	updated := make(map[string]*sniBackend, len(backends))
+
+	for _, backend := range backends {
+		serverName := strings.ToLower(backend.Mapping.ServerName)
+
+		if serverName == "" {
+			return errors.New("backends must have a server name")
+		}
+
+		if _, ok := updated[serverName]; ok {
+			return fmt.Errorf("duplicate backend for server name %q", serverName)
+		}
+
+		if backend.Mapping.TLSSecret != (types.NamespacedName{}) && s.Certificates == nil {
+			return fmt.Errorf("backend for server name %q terminates TLS without a certificate provider", serverName)
+		}
+
+		updated[serverName] = &sniBackend{upstreams: backend.Upstreams, mapping: backend.Mapping}
+	}
+
+	var created []*upstream.List[tcpNode]
+
+	for serverName, backend := range updated {
+		var existingLimiter *connLimiter
+
+		existing, ok := current[serverName]
+		if ok {
+			existingLimiter = existing.limiter
+		}
+
+		backend.limiter = reuseConnLimiter(existingLimiter, backend.mapping)
+
+		nodes := xiter.Map(func(addr string) tcpNode { return tcpNode{address: addr} }, slices.Values(backend.upstreams))
+
+		if ok && existing.mapping.Timeouts == backend.mapping.Timeouts {
+			backend.list = existing.list
+
+			if !slices.Equal(existing.upstreams, backend.upstreams) {
+				backend.list.Reconcile(nodes)
+			}
+
+			continue
+		}
+
+		list, err := upstream.NewListWithCmp(
+			nodes,
+			func(a, b tcpNode) bool { return a.address == b.address },
+			append(slices.Clone(options), backend.mapping.Timeouts.listOptions()...)...,
+		)
+		if err != nil {
+			for _, list := range created {
+				list.Shutdown()
+			}
+
+			return err
+		}
+
+		backend.list = list
+		created = append(created, list)
+	}
+
+	s.backendsLock.Lock()
+	s.backends = updated
+	s.backendsLock.Unlock()
+
+	for serverName, backend := range current {
+		if kept, ok := updated[serverName]; !ok || kept.list != backend.list {
+			backend.list.Shutdown()
+		}
+	}
+
+	return nil
+}
+
+// Start opens a listener for each route and starts proxying.
+//
+// If it returns a non-nil error, any successfully opened listeners are closed.
+func (s *SNI) Start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.started {
+		return errors.New("already started")
+	}
+
+	s.started = true
+
+	for _, route := range s.routes {
+		ln, err := listen(s.Listeners, route.listenAddr, s.StaticBindAddresses)
+		if err != nil {
+			s.closeNoLock()
+
+			return fmt.Errorf("failed to listen on %s: %w", route.listenAddr, err)
+		}
+
+		route.listener = ln
+	}
+
+	for _, route := range s.routes {
+		s.wg.Go(func() {
+			s.errs.record(s.serve(route))
+		})
+	}
+
+	return nil
+}
+
+// Close closes the listeners and stops health checks on upstreams.
+//
+// Connections which are already being proxied are not interrupted, see Drain.
+func (s *SNI) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closeNoLock()
+
+	return nil
+}
+
+// Wait waits for all routes to stop accepting connections.
+//
+// It returns the first error which caused a route to stop, other than the one caused by Close.
+func (s *SNI) Wait() error {
+	s.wg.Wait()
+
+	return s.errs.get()
+}
+
+func (s *SNI) closeNoLock() {
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+
+	for _, route := range s.routes {
+		if route.listener != nil {
+			route.listener.Close() //nolint:errcheck
+		}
+	}
+
+	s.backendsLock.Lock()
+	defer s.backendsLock.Unlock()
+
+	for _, backend := range s.backends {
+		backend.list.Shutdown()
+	}
+
+	s.backends = nil
+}
+
+func (s *SNI) serve(route *sniRoute) error {
+	for {
+		conn, err := route.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		untrack := s.conns.track(conn)
+
+		go func() {
+			defer untrack()
+
+			s.handle(route, conn)
+		}()
+	}
+}
+
+// Drain implements Drainer.
+func (s *SNI) Drain(ctx context.Context) error {
+	return s.conns.drain(ctx)
+}
+
+// ConnectionStats implements ConnectionStatsProvider.
+func (s *SNI) ConnectionStats() map[string]ConnectionStats {
+	s.backendsLock.RLock()
+	defer s.backendsLock.RUnlock()
+
+	stats := make(map[string]ConnectionStats, len(s.backends))
+
+	for serverName, backend := range s.backends {
+		stats[serverName] = backend.limiter.stats()
+	}
+
+	return stats
+}
+
+func (s *SNI) handle(route *sniRoute, conn net.Conn) {
+	client, backend, err := s.prepare(conn)
+	if err != nil {
+		route.logger.Log(rejectionLevel(err), "rejected connection", zap.Stringer("remote-addr", conn.RemoteAddr()), zap.Error(err))
+
+		conn.Close() //nolint:errcheck
+
+		return
+	}
+
+	if !backend.limiter.acquire() {
+		route.logger.Debug("rejected connection",
+			zap.Stringer("remote-addr", conn.RemoteAddr()),
+			zap.String("server-name", backend.mapping.ServerName),
+			zap.Error(errTooManyConnections),
+		)
+
+		client.Close() //nolint:errcheck
+
+		return
+	}
+
+	defer backend.limiter.release()
+
+	if err = backend.mapping.Timeouts.setKeepAlive(conn); err != nil {
+		route.logger.Debug("failed to set keepalive", zap.Error(err))
+	}
+
+	proxyConn(route.logger.With(zap.String("server-name", backend.mapping.ServerName)), backend.list, backend.mapping.Timeouts, client)
+}
+
+// prepare routes the accepted connection to a backend and applies its connection handling.
+func (s *SNI) prepare(conn net.Conn) (*clientConn, *sniBackend, error) {
+	client, err := acceptClient(conn, s.AcceptProxyProtocol, s.ProxyProtocolTrustedCIDRs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serverName, err := client.peekServerName()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backend := s.backend(serverName)
+	if backend == nil {
+		return nil, nil, fmt.Errorf("no backend for server name %q", serverName)
+	}
+
+	if !backend.limiter.allowSource(client.header.Source.Addr()) {
+		return nil, nil, fmt.Errorf("server name %q: %w", serverName, errSourceNotAllowed)
+	}
+
+	if !backend.limiter.allowClient(client.header.Source.Addr()) {
+		return nil, nil, fmt.Errorf("server name %q: %w", serverName, errRateLimited)
+	}
+
+	if backend.mapping.TLSSecret != (types.NamespacedName{}) {
+		if err = client.terminateTLS(s.Certificates, backend.mapping.TLSSecret); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err = client.sendProxyHeader(backend.mapping.ProxyProtocol); err != nil {
+		return nil, nil, err
+	}
+
+	return client, backend, nil
+}
+
+// backend returns the backend for the server name, or nil if none matches.
+func (s *SNI) backend(serverName string) *sniBackend {
+	s.backendsLock.RLock()
+	defer s.backendsLock.RUnlock()
+
+	for _, candidate := range matchingServerNames(serverName) {
+		if backend, ok := s.backends[candidate]; ok {
+			return backend
+		}
+	}
+
+	return nil
+}
+
+// matchingServerNames returns the backend server names which match the server name, from the
+// most to the least specific one.
+func matchingServerNames(serverName string) []string {
+	serverName = strings.ToLower(serverName)
+
+	var candidates []string
+
+	if serverName != "" {
+		candidates = append(candidates, serverName)
+	}
+
+	if _, parent, ok := strings.Cut(serverName, "."); ok {
+		candidates = append(candidates, "*."+parent)
+	}
+
+	return append(candidates, DefaultServerName)
+}
+
+// errClientHelloRead stops the handshake used to parse the ClientHello.
+var errClientHelloRead = errors.New("ClientHello read")
+
+// peekServerName reads the ClientHello of the TLS connection and returns the server name
+// in it, which is empty if the client did not send one.
+//
+// The bytes read are kept to be sent on to the upstream, or to be fed into the TLS handshake.
+func (c *clientConn) peekServerName() (string, error) {
+	if err := c.SetReadDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return "", err
+	}
+
+	var (
+		recorded   bytes.Buffer
+		serverName string
+	)
+
+	// let crypto/tls parse the ClientHello, and abort the handshake once it has
+	err := tls.Server(&readOnlyConn{
+		Conn:   c.Conn,
+		reader: io.TeeReader(io.MultiReader(bytes.NewReader(c.peeked), c.Conn), &recorded),
+	}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errClientHelloRead) {
+		return "", fmt.Errorf("failed to read TLS ClientHello: %w", err)
+	}
+
+	if err = c.SetReadDeadline(time.Time{}); err != nil {
+		return "", err
+	}
+
+	c.peeked = recorded.Bytes()
+
+	return serverName, nil
+}
+
+// readOnlyConn is a net.Conn which reads from reader and discards the writes.
+type readOnlyConn struct {
+	net.Conn
+
+	reader io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error) { return c.reader.Read(p) }
+
+func (c *readOnlyConn) Write(p []byte) (int, error) { return len(p), nil }
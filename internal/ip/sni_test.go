@@ -0,0 +1,168 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+// startTLSGreeter starts a TLS server which sends a greeting and closes the connection.
+func startTLSGreeter(t *testing.T, cert *tls.Certificate, greeting string) string {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{*cert}})
+	require.NoError(t, err)
+
+	t.Cleanup(func() { ln.Close() }) //nolint:errcheck
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close() //nolint:errcheck
+
+				conn.Write([]byte(greeting)) //nolint:errcheck
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// readGreeting connects to the address with TLS for the server name, and returns what the
+// server sends.
+func readGreeting(t *testing.T, addr, serverName string, cert *tls.Certificate) (string, error) {
+	t.Helper()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, &tls.Config{
+		ServerName: serverName,
+		RootCAs:    roots,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	defer conn.Close() //nolint:errcheck
+
+	if err = conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return "", err
+	}
+
+	received, err := io.ReadAll(conn)
+
+	return string(received), err
+}
+
+func TestSNI(t *testing.T) {
+	t.Parallel()
+
+	cert := generateCertificate(t, "git.example.com", "*.example.com", "other.test", "example.org")
+	secretKey := types.NamespacedName{Namespace: "default", Name: "example-tls"}
+
+	lb := &ip.SNI{
+		Logger:       tcpTestLogger(t),
+		Certificates: &mockCertificateProvider{certificates: map[types.NamespacedName]*tls.Certificate{secretKey: cert}},
+	}
+
+	listenAddr := freeTCPAddr(t)
+
+	require.NoError(t, lb.AddRoute(listenAddr, nil))
+	assert.ErrorContains(t, lb.AddRoute(freeTCPAddr(t), func(yield func(string) bool) { yield("127.0.0.1:443") }), "upstreams are set per backend")
+
+	require.NoError(t, lb.SetBackends([]ip.Backend{
+		{Upstreams: []string{startTLSGreeter(t, cert, "git")}, Mapping: ip.Mapping{ServerName: "git.example.com"}},
+		{Upstreams: []string{startTLSGreeter(t, cert, "wildcard")}, Mapping: ip.Mapping{ServerName: "*.example.com"}},
+		// TLS is terminated, and the upstream gets plaintext
+		{Upstreams: []string{startTCPGreeter(t, "terminated")}, Mapping: ip.Mapping{ServerName: "other.test", TLSSecret: secretKey}},
+	}))
+
+	require.NoError(t, lb.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	})
+
+	for _, test := range []struct {
+		serverName string
+		expected   string
+	}{
+		{serverName: "git.example.com", expected: "git"},
+		{serverName: "GIT.example.com", expected: "git"},
+		{serverName: "wiki.example.com", expected: "wildcard"},
+		{serverName: "other.test", expected: "terminated"},
+	} {
+		greeting, err := readGreeting(t, listenAddr, test.serverName, cert)
+		require.NoError(t, err, test.serverName)
+
+		assert.Equal(t, test.expected, greeting, test.serverName)
+	}
+
+	// nothing matches, and there is no default backend
+	_, err := readGreeting(t, listenAddr, "example.org", cert)
+	assert.Error(t, err)
+
+	// backends are replaced without restarting the listeners
+	require.NoError(t, lb.SetBackends([]ip.Backend{
+		{Upstreams: []string{startTLSGreeter(t, cert, "default")}, Mapping: ip.Mapping{ServerName: ip.DefaultServerName}},
+	}))
+
+	for _, serverName := range []string{"git.example.com", "example.org"} {
+		greeting, err := readGreeting(t, listenAddr, serverName, cert)
+		require.NoError(t, err, serverName)
+
+		assert.Equal(t, "default", greeting, serverName)
+	}
+}
+
+func TestSNINotTLS(t *testing.T) {
+	t.Parallel()
+
+	lb := &ip.SNI{Logger: tcpTestLogger(t)}
+	listenAddr := freeTCPAddr(t)
+
+	require.NoError(t, lb.AddRoute(listenAddr, nil))
+	require.NoError(t, lb.SetBackends([]ip.Backend{
+		{Upstreams: []string{startTCPEcho(t)}, Mapping: ip.Mapping{ServerName: ip.DefaultServerName}},
+	}))
+	require.NoError(t, lb.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	})
+
+	conn, err := net.Dial("tcp", listenAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+
+	// the connection is closed without being proxied
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
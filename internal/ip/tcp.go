@@ -0,0 +1,610 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/siderolabs/gen/xiter"
+	"github.com/siderolabs/go-loadbalancer/upstream"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/siderolabs/kube-service-exposer/internal/cidrs"
+	"github.com/siderolabs/kube-service-exposer/internal/proxyproto"
+)
+
+const (
+	// proxyProtocolHeaderTimeout is how long a downstream load balancer has to send the PROXY
+	// protocol header after connecting.
+	proxyProtocolHeaderTimeout = 5 * time.Second
+
+	// tlsHandshakeTimeout is how long a client has to complete the TLS handshake.
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// CertificateProvider provides the current certificate stored in a kubernetes.io/tls Secret.
+type CertificateProvider interface {
+	GetCertificate(secretKey types.NamespacedName) (*tls.Certificate, error)
+}
+
+// TCP is a load balancer for TCP connections across a set of upstreams.
+//
+// Upstreams are health checked with a TCP dial attempt, and only the healthy ones are
+// picked. Before a connection is proxied, the configured connection handling is applied
+// to it: accepting a PROXY protocol header from a downstream load balancer, TLS
+// termination, and sending a PROXY protocol header to the upstream, in that order.
+//
+// Zero value of TCP is a valid proxy, use AddRoute to install routes before calling Start.
+type TCP struct {
+	Logger *zap.Logger
+
+	routes map[string]*tcpRoute
+
+	errs serveErrors
+	wg   sync.WaitGroup
+
+	// Timeouts are the timeouts of the connections.
+	Timeouts Timeouts
+
+	// AcceptProxyProtocol requires connections to start with a PROXY protocol header.
+	AcceptProxyProtocol bool
+
+	// ProxyProtocolTrustedCIDRs are the source CIDRs which are allowed to send a PROXY
+	// protocol header when AcceptProxyProtocol is set. When empty, no source is trusted.
+	ProxyProtocolTrustedCIDRs []netip.Prefix
+
+	// TLSSecret is the kubernetes.io/tls Secret to terminate TLS with. TLS is not
+	// terminated when it is empty.
+	TLSSecret types.NamespacedName
+
+	// Certificates provides the certificate of TLSSecret.
+	Certificates CertificateProvider
+
+	// ProxyProtocol is the version of the PROXY protocol header sent to the upstream.
+	ProxyProtocol proxyproto.Version
+
+	// MaxConnections limits the number of connections proxied concurrently across all
+	// routes. It is unlimited when zero.
+	MaxConnections int
+
+	// MaxConnectionsWait is how long a connection over MaxConnections waits before it is
+	// rejected.
+	MaxConnectionsWait time.Duration
+
+	// RateLimit limits how often each client can connect.
+	RateLimit RateLimit
+
+	// SourceRanges are the CIDRs of the clients allowed to connect. When empty, all clients
+	// are allowed.
+	SourceRanges []netip.Prefix
+
+	// Listeners opens the listeners of the routes. They are opened directly when it is nil.
+	Listeners ListenerRegistry
+
+	// StaticBindAddresses are the host IPs of the routes which are bound whether they are
+	// assigned to the host or not, see Mapping.StaticBindAddresses.
+	StaticBindAddresses AddressList
+
+	limiter *connLimiter
+	conns   connTracker
+
+	lock    sync.Mutex
+	started bool
+	closed  bool
+}
+
+type tcpRoute struct {
+	listener   net.Listener
+	list       *upstream.List[tcpNode]
+	logger     *zap.Logger
+	listenAddr string
+}
+
+// tcpNode is an upstream of the TCP load balancer.
+type tcpNode struct {
+	address string // host:port
+}
+
+// HealthCheck implements upstream.Backend.
+func (n tcpNode) HealthCheck(ctx context.Context) (upstream.Tier, error) {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", n.address)
+	if err != nil {
+		return -1, err
+	}
+
+	return 0, conn.Close()
+}
+
+// clientConn is an accepted connection prepared for proxying.
+type clientConn struct {
+	// Conn is the stream to proxy: the accepted connection, or the TLS one on top of it.
+	net.Conn
+
+	// header describes the client connection, either as accepted or as reported by a
+	// downstream load balancer.
+	header proxyproto.Header
+
+	// peeked is sent to the upstream before anything read from Conn: the bytes read from the
+	// client while preparing the connection, and the PROXY protocol header for the upstream.
+	peeked []byte
+}
+
+// prefixConn is a net.Conn whose reads return prefix first.
+type prefixConn struct {
+	net.Conn
+
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+
+		return n, nil
+	}
+
+	return c.Conn.Read(p)
+}
+
+// AddRoute installs a route from the listen address ipPort to the list of upstreams.
+//
+// A route added after Start is listened on right away, see RouteRemover.
+func (t *TCP) AddRoute(ipPort string, upstreamAddrs iter.Seq[string], options ...upstream.ListOption) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return net.ErrClosed
+	}
+
+	if _, ok := t.routes[ipPort]; ok && t.started {
+		return fmt.Errorf("route %s already exists", ipPort)
+	}
+
+	if t.Logger == nil {
+		t.Logger = zap.NewNop()
+	}
+
+	if t.routes == nil {
+		t.routes = map[string]*tcpRoute{}
+	}
+
+	if upstreamAddrs == nil {
+		upstreamAddrs = xiter.Empty[string]
+	}
+
+	list, err := upstream.NewListWithCmp(
+		xiter.Map(func(addr string) tcpNode { return tcpNode{address: addr} }, upstreamAddrs),
+		func(a, b tcpNode) bool { return a.address == b.address },
+		options...,
+	)
+	if err != nil {
+		return err
+	}
+
+	route := &tcpRoute{
+		list:       list,
+		logger:     t.Logger.With(zap.String("listen-addr", ipPort)),
+		listenAddr: ipPort,
+	}
+
+	if t.started {
+		if route.listener, err = listen(t.Listeners, ipPort, t.StaticBindAddresses); err != nil {
+			list.Shutdown()
+
+			return fmt.Errorf("failed to listen on %s: %w", ipPort, err)
+		}
+
+		t.wg.Go(func() {
+			t.errs.record(t.serve(route))
+		})
+	}
+
+	t.routes[ipPort] = route
+
+	return nil
+}
+
+// RemoveRoute implements RouteRemover.
+func (t *TCP) RemoveRoute(ipPort string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return net.ErrClosed
+	}
+
+	route, ok := t.routes[ipPort]
+	if !ok {
+		return fmt.Errorf("route %s does not exist", ipPort)
+	}
+
+	delete(t.routes, ipPort)
+
+	if route.listener != nil {
+		route.listener.Close() //nolint:errcheck
+	}
+
+	route.list.Shutdown()
+
+	return nil
+}
+
+// Start opens a listener for each route and starts proxying.
+//
+// If it returns a non-nil error, any successfully opened listeners are closed.
+func (t *TCP) Start() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.started {
+		return errors.New("already started")
+	}
+
+	t.started = true
+	t.limiter = newConnLimiter(Mapping{
+		MaxConnections:     t.MaxConnections,
+		MaxConnectionsWait: t.MaxConnectionsWait,
+		RateLimit:          t.RateLimit,
+		SourceRanges:       cidrs.NewList(t.SourceRanges),
+	})
+
+	for _, route := range t.routes {
+		ln, err := listen(t.Listeners, route.listenAddr, t.StaticBindAddresses)
+		if err != nil {
+			t.closeNoLock()
+
+			return fmt.Errorf("failed to listen on %s: %w", route.listenAddr, err)
+		}
+
+		route.listener = ln
+	}
+
+	for _, route := range t.routes {
+		t.wg.Go(func() {
+			t.errs.record(t.serve(route))
+		})
+	}
+
+	return nil
+}
+
+// Close closes the listeners and stops health checks on upstreams.
+//
+// Connections which are already being proxied are not interrupted, see Drain.
+func (t *TCP) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.closeNoLock()
+
+	return nil
+}
+
+// Wait waits for all routes to stop accepting connections.
+//
+// It returns the first error which caused a route to stop, other than the one caused by Close.
+func (t *TCP) Wait() error {
+	t.wg.Wait()
+
+	return t.errs.get()
+}
+
+// SetUpstreams implements UpstreamSetter.
+func (t *TCP) SetUpstreams(upstreamAddrs []string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return net.ErrClosed
+	}
+
+	for _, route := range t.routes {
+		route.list.Reconcile(xiter.Map(func(addr string) tcpNode { return tcpNode{address: addr} }, slices.Values(upstreamAddrs)))
+	}
+
+	return nil
+}
+
+func (t *TCP) closeNoLock() {
+	if t.closed {
+		return
+	}
+
+	t.closed = true
+
+	for _, route := range t.routes {
+		if route.listener != nil {
+			route.listener.Close() //nolint:errcheck
+		}
+
+		route.list.Shutdown()
+	}
+}
+
+func (t *TCP) serve(route *tcpRoute) error {
+	for {
+		conn, err := route.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		untrack := t.conns.track(conn)
+
+		// connections are handled in their own goroutines, so that a slow client (e.g. one
+		// which does not complete its TLS handshake) does not hold up accepting other ones
+		go func() {
+			defer untrack()
+
+			t.handle(route, conn)
+		}()
+	}
+}
+
+// Drain implements Drainer.
+func (t *TCP) Drain(ctx context.Context) error {
+	return t.conns.drain(ctx)
+}
+
+// ConnectionStats implements ConnectionStatsProvider.
+func (t *TCP) ConnectionStats() map[string]ConnectionStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.limiter == nil {
+		return map[string]ConnectionStats{"": {Limit: t.MaxConnections}}
+	}
+
+	return map[string]ConnectionStats{"": t.limiter.stats()}
+}
+
+func (t *TCP) handle(route *tcpRoute, conn net.Conn) {
+	if err := t.Timeouts.setKeepAlive(conn); err != nil {
+		route.logger.Debug("failed to set keepalive", zap.Error(err))
+	}
+
+	// the connections are admitted before they take a slot, so that the clients which are
+	// rejected, or slow to send their PROXY protocol header or to complete their TLS handshake,
+	// do not hold up the other ones
+	client, err := t.prepare(conn)
+	if err != nil {
+		route.logger.Log(rejectionLevel(err), "rejected connection", zap.Stringer("remote-addr", conn.RemoteAddr()), zap.Error(err))
+
+		conn.Close() //nolint:errcheck
+
+		return
+	}
+
+	if !t.limiter.acquire() {
+		route.logger.Debug("rejected connection", zap.Stringer("remote-addr", conn.RemoteAddr()), zap.Error(errTooManyConnections))
+
+		client.Close() //nolint:errcheck
+
+		return
+	}
+
+	defer t.limiter.release()
+
+	proxyConn(route.logger, route.list, t.Timeouts, client)
+}
+
+// prepare applies the connection handling to the accepted connection.
+func (t *TCP) prepare(conn net.Conn) (*clientConn, error) {
+	client, err := acceptClient(conn, t.AcceptProxyProtocol, t.ProxyProtocolTrustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	// the cheap checks are done as soon as the client address is known, before the TLS handshake
+	if !t.limiter.allowSource(client.header.Source.Addr()) {
+		return nil, errSourceNotAllowed
+	}
+
+	if !t.limiter.allowClient(client.header.Source.Addr()) {
+		return nil, errRateLimited
+	}
+
+	if t.TLSSecret != (types.NamespacedName{}) {
+		if err = client.terminateTLS(t.Certificates, t.TLSSecret); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = client.sendProxyHeader(t.ProxyProtocol); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// acceptClient wraps the accepted connection, reading the PROXY protocol header from a
+// downstream load balancer first if it is required.
+func acceptClient(conn net.Conn, acceptProxyProtocol bool, trustedCIDRs []netip.Prefix) (*clientConn, error) {
+	client := &clientConn{
+		Conn:   conn,
+		header: proxyproto.HeaderFromConn(conn),
+	}
+
+	if !acceptProxyProtocol {
+		return client, nil
+	}
+
+	// without trusted CIDRs, no source can claim another client address
+	if !cidrs.Contains(trustedCIDRs, client.header.Source.Addr()) {
+		return nil, errors.New("source is not trusted to send a PROXY protocol header")
+	}
+
+	received, buffered, err := readProxyHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// a header without addresses is e.g. a health check of the downstream load balancer
+	if !received.IsLocal() {
+		client.header = received
+	}
+
+	client.peeked = buffered
+
+	return client, nil
+}
+
+// terminateTLS replaces the stream with the decrypted one, using the certificate of the Secret.
+//
+// The bytes peeked so far are the start of the TLS stream, so they are fed into the handshake
+// instead of being sent to the upstream.
+func (c *clientConn) terminateTLS(certificates CertificateProvider, secretKey types.NamespacedName) error {
+	if certificates == nil {
+		return errors.New("TLS is configured without a certificate provider")
+	}
+
+	tlsConn := tls.Server(&prefixConn{Conn: c.Conn, prefix: c.peeked}, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certificates.GetCertificate(secretKey)
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+
+	c.Conn = tlsConn
+	c.peeked = nil
+
+	return nil
+}
+
+// sendProxyHeader prepends the PROXY protocol header describing the client to the bytes sent
+// to the upstream.
+func (c *clientConn) sendProxyHeader(version proxyproto.Version) error {
+	if version == proxyproto.VersionNone {
+		return nil
+	}
+
+	header, err := c.header.Format(version)
+	if err != nil {
+		return err
+	}
+
+	c.peeked = append(header, c.peeked...)
+
+	return nil
+}
+
+// proxyConn proxies the prepared client connection to an upstream picked from the list,
+// until both directions are done.
+func proxyConn(logger *zap.Logger, list *upstream.List[tcpNode], timeouts Timeouts, client *clientConn) {
+	defer client.Close() //nolint:errcheck
+
+	logger = logger.With(zap.Stringer("client-addr", client.header.Source))
+
+	upstreamNode, err := list.Pick()
+	if err != nil {
+		logger.Warn("no upstreams available, closing connection")
+
+		return
+	}
+
+	logger = logger.With(zap.String("upstream-addr", upstreamNode.address))
+
+	upstreamConn, err := timeouts.dialUpstream(upstreamNode.address)
+	if err != nil {
+		logger.Warn("error dialing upstream", zap.Error(err))
+
+		list.Down(upstreamNode)
+
+		return
+	}
+
+	defer upstreamConn.Close() //nolint:errcheck
+
+	logger.Debug("proxying connection")
+
+	if len(client.peeked) > 0 {
+		if _, err = upstreamConn.Write(client.peeked); err != nil {
+			logger.Debug("error writing to upstream", zap.Error(err))
+
+			return
+		}
+	}
+
+	errCh := make(chan error, 2)
+
+	go func() { errCh <- proxyCopy(upstreamConn, client.Conn, timeouts.ClientIdle) }()
+	go func() { errCh <- proxyCopy(client.Conn, upstreamConn, timeouts.UpstreamIdle) }()
+
+	for range 2 {
+		if err = <-errCh; err != nil {
+			break
+		}
+	}
+
+	logger.Debug("closing connection", zap.Error(err))
+}
+
+// readProxyHeader reads the PROXY protocol header from the start of the connection. It
+// returns the header and any bytes that were read past it.
+func readProxyHeader(conn net.Conn) (proxyproto.Header, []byte, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout)); err != nil {
+		return proxyproto.Header{}, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+
+	header, err := proxyproto.Read(br)
+	if err != nil {
+		return proxyproto.Header{}, nil, err
+	}
+
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		return proxyproto.Header{}, nil, err
+	}
+
+	buffered, err := br.Peek(br.Buffered())
+	if err != nil {
+		return proxyproto.Header{}, nil, err
+	}
+
+	return header, buffered, nil
+}
+
+// proxyCopy copies from src to dst until EOF, then half-closes dst, so that the peer sees
+// the end of the stream while the other direction can still be in use.
+//
+// If idleTimeout is non-zero, it fails once nothing was read from src for the timeout.
+func proxyCopy(dst, src net.Conn, idleTimeout time.Duration) error {
+	var reader io.Reader = src
+
+	if idleTimeout > 0 {
+		reader = &idleReader{conn: src, timeout: idleTimeout}
+	}
+
+	_, err := io.Copy(dst, reader)
+
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite() //nolint:errcheck
+	}
+
+	return err
+}
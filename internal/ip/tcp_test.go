@@ -0,0 +1,398 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/siderolabs/go-loadbalancer/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+// tcpTestLogger returns the logger for the TCP load balancers in tests.
+//
+// Connections are proxied in the background, and may finish after the client is done with
+// them and the test has returned, so the per-connection debug logs are left out.
+func tcpTestLogger(t *testing.T) *zap.Logger {
+	return zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+}
+
+// startTCPGreeter starts a TCP server which sends a greeting and closes the connection
+// without reading anything.
+func startTCPGreeter(t *testing.T, greeting string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { ln.Close() }) //nolint:errcheck
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.Write([]byte(greeting)) //nolint:errcheck
+			conn.Close()                 //nolint:errcheck
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// generateCertificate generates a self-signed certificate for the DNS names.
+func generateCertificate(t *testing.T, dnsNames ...string) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+type mockCertificateProvider struct {
+	certificates map[types.NamespacedName]*tls.Certificate
+	lock         sync.Mutex
+}
+
+func (m *mockCertificateProvider) GetCertificate(secretKey types.NamespacedName) (*tls.Certificate, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cert, ok := m.certificates[secretKey]
+	if !ok {
+		return nil, fmt.Errorf("no certificate for %s", secretKey)
+	}
+
+	return cert, nil
+}
+
+func (m *mockCertificateProvider) set(secretKey types.NamespacedName, cert *tls.Certificate) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.certificates[secretKey] = cert
+}
+
+func startTCP(t *testing.T, lb *ip.TCP, upstreamAddr string) string {
+	t.Helper()
+
+	listenAddr := freeTCPAddr(t)
+
+	require.NoError(t, lb.AddRoute(listenAddr, slices.Values([]string{upstreamAddr})))
+	require.NoError(t, lb.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	})
+
+	return listenAddr
+}
+
+func TestTCPHalfClose(t *testing.T) {
+	t.Parallel()
+
+	listenAddr := startTCP(t, &ip.TCP{Logger: tcpTestLogger(t)}, startTCPEcho(t))
+
+	conn, err := net.Dial("tcp", listenAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	// the end of the request reaches the upstream, while its reply still gets back
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+	received, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	assert.Equal(t, "hello", string(received))
+}
+
+func TestTCPNoUpstreams(t *testing.T) {
+	t.Parallel()
+
+	listenAddr := startTCP(t, &ip.TCP{Logger: tcpTestLogger(t)}, freeTCPAddr(t))
+
+	conn, err := net.Dial("tcp", listenAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+// readTCPGreeting reads what the upstream a new connection to the address is proxied to sends,
+// which is nothing if the connection is closed without being proxied.
+func readTCPGreeting(t *testing.T, addr string) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	defer conn.Close() //nolint:errcheck
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	greeting, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	return string(greeting)
+}
+
+func TestTCPSetUpstreams(t *testing.T) {
+	t.Parallel()
+
+	lb := &ip.TCP{Logger: tcpTestLogger(t)}
+	listenAddr := startTCP(t, lb, startTCPGreeter(t, "old"))
+
+	assert.Equal(t, "old", readTCPGreeting(t, listenAddr))
+
+	require.NoError(t, lb.SetUpstreams([]string{startTCPGreeter(t, "new")}))
+
+	assert.Equal(t, "new", readTCPGreeting(t, listenAddr))
+}
+
+func TestTCPUpstreams(t *testing.T) {
+	t.Parallel()
+
+	lb := &ip.TCP{Logger: tcpTestLogger(t)}
+	listenAddr := freeTCPAddr(t)
+
+	require.NoError(t, lb.AddRoute(listenAddr, slices.Values([]string{startTCPGreeter(t, "a"), startTCPGreeter(t, "b")})))
+	require.NoError(t, lb.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	})
+
+	// the connections are spread across the healthy upstreams
+	greetings := map[string]int{}
+
+	for range 10 {
+		greetings[readTCPGreeting(t, listenAddr)]++
+	}
+
+	assert.Equal(t, map[string]int{"a": 5, "b": 5}, greetings)
+}
+
+func TestTCPUpstreamHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	lb := &ip.TCP{Logger: tcpTestLogger(t)}
+	listenAddr := freeTCPAddr(t)
+
+	require.NoError(t, lb.AddRoute(listenAddr, slices.Values([]string{freeTCPAddr(t), startTCPGreeter(t, "up")}),
+		upstream.WithHealthcheckInterval(10*time.Millisecond),
+		upstream.WithHealthcheckTimeout(time.Second),
+	))
+	require.NoError(t, lb.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	})
+
+	// the upstream which is down is no longer picked once it fails its health checks
+	require.Eventually(t, func() bool {
+		for range 5 {
+			if readTCPGreeting(t, listenAddr) != "up" {
+				return false
+			}
+		}
+
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestTCPRoutesAfterStart(t *testing.T) {
+	t.Parallel()
+
+	lb := &ip.TCP{Logger: tcpTestLogger(t)}
+	upstreamAddr := startTCPGreeter(t, "hello")
+	listenAddr := startTCP(t, lb, upstreamAddr)
+
+	// a route added after Start is listened on right away, and no longer once it is removed
+	addedAddr := freeTCPAddr(t)
+
+	require.NoError(t, lb.AddRoute(addedAddr, slices.Values([]string{upstreamAddr})))
+	assert.ErrorContains(t, lb.AddRoute(addedAddr, nil), "already exists")
+
+	assert.Equal(t, "hello", readTCPGreeting(t, addedAddr))
+
+	require.NoError(t, lb.RemoveRoute(addedAddr))
+	assert.ErrorContains(t, lb.RemoveRoute(addedAddr), "does not exist")
+
+	_, err := net.Dial("tcp", addedAddr)
+	assert.Error(t, err)
+
+	assert.Equal(t, "hello", readTCPGreeting(t, listenAddr))
+}
+
+func TestTCPStartFailure(t *testing.T) {
+	t.Parallel()
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { busy.Close() }) //nolint:errcheck
+
+	lb := &ip.TCP{Logger: tcpTestLogger(t)}
+	freeAddr := freeTCPAddr(t)
+
+	require.NoError(t, lb.AddRoute(freeAddr, nil))
+	require.NoError(t, lb.AddRoute(busy.Addr().String(), nil))
+
+	assert.ErrorContains(t, lb.Start(), "failed to listen on "+busy.Addr().String())
+	require.NoError(t, lb.Wait())
+
+	// the listeners opened before the failure are closed
+	ln, err := net.Listen("tcp", freeAddr)
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+}
+
+func TestTCPTLS(t *testing.T) {
+	t.Parallel()
+
+	secretKey := types.NamespacedName{Namespace: "default", Name: "example-tls"}
+	certs := &mockCertificateProvider{certificates: map[types.NamespacedName]*tls.Certificate{}}
+
+	lb := &ip.TCP{
+		Logger:       tcpTestLogger(t),
+		TLSSecret:    secretKey,
+		Certificates: certs,
+	}
+
+	listenAddr := startTCP(t, lb, startTCPEcho(t))
+
+	dial := func(cert *tls.Certificate) (*tls.Conn, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(cert.Leaf)
+
+		return tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", listenAddr, &tls.Config{
+			ServerName: "example.com",
+			RootCAs:    roots,
+		})
+	}
+
+	cert1 := generateCertificate(t, "example.com")
+
+	// no certificate is loaded yet, so the handshake fails
+	_, err := dial(cert1)
+	require.Error(t, err)
+
+	certs.set(secretKey, cert1)
+
+	conn, err := dial(cert1)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.CloseWrite())
+
+	// the upstream receives the decrypted stream
+	received, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	assert.Equal(t, "hello", string(received))
+
+	// a renewed certificate is used for new connections without restarting the load balancer
+	cert2 := generateCertificate(t, "example.com")
+	certs.set(secretKey, cert2)
+
+	_, err = dial(cert1)
+	require.Error(t, err)
+
+	conn2, err := dial(cert2)
+	require.NoError(t, err)
+
+	assert.NoError(t, conn2.Close())
+}
+
+func TestTCPTLSUpstreamCloses(t *testing.T) {
+	t.Parallel()
+
+	secretKey := types.NamespacedName{Namespace: "default", Name: "example-tls"}
+	cert := generateCertificate(t, "example.com")
+
+	lb := &ip.TCP{
+		Logger:       tcpTestLogger(t),
+		TLSSecret:    secretKey,
+		Certificates: &mockCertificateProvider{certificates: map[types.NamespacedName]*tls.Certificate{secretKey: cert}},
+	}
+
+	listenAddr := startTCP(t, lb, startTCPGreeter(t, "bye"))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", listenAddr, &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    roots,
+	})
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	// the client sees the end of the stream as soon as the upstream closes its side
+	received, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	assert.Equal(t, "bye", string(received))
+}
@@ -0,0 +1,114 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"time"
+
+	"github.com/siderolabs/go-loadbalancer/upstream"
+)
+
+const (
+	// defaultDialTimeout is the default timeout for dialing an upstream.
+	defaultDialTimeout = 10 * time.Second
+
+	// defaultHealthCheckTimeout is the default timeout of an upstream health check.
+	defaultHealthCheckTimeout = time.Second
+)
+
+// Timeouts are the timeouts of the connections of a mapping.
+type Timeouts struct {
+	// Dial is the timeout for dialing an upstream. If zero, a default is used.
+	Dial time.Duration
+
+	// ClientIdle closes a connection once the client has sent nothing for the duration, and
+	// UpstreamIdle once the upstream has sent nothing. They are disabled when zero.
+	ClientIdle   time.Duration
+	UpstreamIdle time.Duration
+
+	// KeepAlive is the interval of the TCP keepalive probes on the client and upstream
+	// connections. If zero, the default of the net package is used; if negative, the probes
+	// are disabled.
+	KeepAlive time.Duration
+
+	// HealthCheckTimeout and HealthCheckInterval are the timeout and the interval of the
+	// upstream health checks. If zero, a default is used.
+	HealthCheckTimeout  time.Duration
+	HealthCheckInterval time.Duration
+}
+
+func (t Timeouts) String() string {
+	var s string
+
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"dial-timeout", t.Dial},
+		{"client-idle-timeout", t.ClientIdle},
+		{"upstream-idle-timeout", t.UpstreamIdle},
+		{"tcp-keepalive", t.KeepAlive},
+		{"health-check-timeout", t.HealthCheckTimeout},
+		{"health-check-interval", t.HealthCheckInterval},
+	} {
+		if timeout.value != 0 {
+			s += " " + timeout.name + "=" + timeout.value.String()
+		}
+	}
+
+	return s
+}
+
+// listOptions returns the options of the upstream list applying the health check settings.
+func (t Timeouts) listOptions() []upstream.ListOption {
+	options := []upstream.ListOption{upstream.WithHealthcheckTimeout(cmp.Or(t.HealthCheckTimeout, defaultHealthCheckTimeout))}
+
+	if t.HealthCheckInterval > 0 {
+		options = append(options, upstream.WithHealthcheckInterval(t.HealthCheckInterval))
+	}
+
+	return options
+}
+
+// dialUpstream connects to the upstream address.
+func (t Timeouts) dialUpstream(address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cmp.Or(t.Dial, defaultDialTimeout))
+	defer cancel()
+
+	d := net.Dialer{KeepAlive: t.KeepAlive}
+
+	return d.DialContext(ctx, "tcp", address)
+}
+
+// setKeepAlive applies the keepalive setting to an accepted client connection.
+func (t Timeouts) setKeepAlive(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || t.KeepAlive == 0 {
+		return nil
+	}
+
+	if t.KeepAlive < 0 {
+		return tcpConn.SetKeepAlive(false)
+	}
+
+	return tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: t.KeepAlive, Interval: t.KeepAlive})
+}
+
+// idleReader reads from a connection, failing once nothing has been read for the timeout.
+type idleReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return 0, err
+	}
+
+	return r.conn.Read(p)
+}
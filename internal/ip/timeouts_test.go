@@ -0,0 +1,54 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+func TestTCPIdleTimeouts(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name     string
+		timeouts ip.Timeouts
+	}{
+		{name: "client", timeouts: ip.Timeouts{ClientIdle: 300 * time.Millisecond}},
+		{name: "upstream", timeouts: ip.Timeouts{UpstreamIdle: 300 * time.Millisecond}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			listenAddr := startTCP(t, &ip.TCP{Logger: tcpTestLogger(t), Timeouts: test.timeouts}, startTCPEcho(t))
+
+			conn, err := dialEcho(t, listenAddr)
+			require.NoError(t, err)
+
+			// traffic in both directions keeps the connection open past the timeout
+			for range 5 {
+				time.Sleep(100 * time.Millisecond)
+
+				_, err = conn.Write([]byte("ping"))
+				require.NoError(t, err)
+
+				_, err = io.ReadFull(conn, make([]byte, len("ping")))
+				require.NoError(t, err)
+			}
+
+			start := time.Now()
+
+			_, err = conn.Read(make([]byte, 1))
+			assert.ErrorIs(t, err, io.EOF)
+			assert.Less(t, time.Since(start), 5*time.Second)
+		})
+	}
+}
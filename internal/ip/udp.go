@@ -0,0 +1,537 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/siderolabs/gen/xiter"
+	"github.com/siderolabs/go-loadbalancer/upstream"
+	"go.uber.org/zap"
+)
+
+// DefaultUDPIdleTimeout is the default time after which a UDP flow without any traffic in
+// either direction is expired.
+const DefaultUDPIdleTimeout = time.Minute
+
+// DefaultUDPMaxFlows is the default maximum number of flows of a route.
+const DefaultUDPMaxFlows = 4096
+
+// maxDatagramSize is the largest UDP payload that can be received.
+const maxDatagramSize = 65535
+
+// UDP is a datagram proxy that forwards UDP traffic from a set of listen addresses to
+// upstreams.
+//
+// Every client address gets its own flow: a dedicated connected socket towards the picked
+// upstream, so that replies can be relayed back to the right client. Flows without any
+// traffic for IdleTimeout are expired, and the least recently active flow of a route is
+// expired to make room for a new one when it has MaxFlows, so that a flood of datagrams from
+// spoofed client addresses cannot exhaust the sockets of the host.
+//
+// Zero value of UDP is a valid proxy, use AddRoute to install routes before calling Start.
+type UDP struct {
+	Logger *zap.Logger
+
+	routes map[string]*udpRoute
+
+	errs serveErrors
+	wg   sync.WaitGroup
+
+	IdleTimeout time.Duration
+
+	// MaxFlows is the maximum number of flows of each route, DefaultUDPMaxFlows when zero.
+	MaxFlows int
+
+	// Listeners opens the sockets of the routes. They are opened directly when it is nil.
+	Listeners ListenerRegistry
+
+	// StaticBindAddresses are the host IPs of the routes which are bound whether they are
+	// assigned to the host or not, see Mapping.StaticBindAddresses.
+	StaticBindAddresses AddressList
+
+	lock    sync.Mutex
+	started bool
+	closed  bool
+}
+
+type udpRoute struct {
+	conn  net.PacketConn
+	list  *upstream.List[udpNode]
+	flows map[string]*udpFlow
+
+	// recent orders the flows from the most to the least recently active one.
+	recent *list.List
+
+	logger     *zap.Logger
+	listenAddr string
+	lock       sync.Mutex
+	closed     bool
+}
+
+type udpFlow struct {
+	client     net.Addr
+	upstream   net.Conn
+	element    *list.Element
+	lastActive atomic.Int64
+}
+
+func (f *udpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *udpFlow) idleFor() time.Duration {
+	return time.Since(time.Unix(0, f.lastActive.Load()))
+}
+
+// udpNode is an upstream of the UDP proxy.
+type udpNode struct {
+	// resolved is the address the flows are dialed to, nil until the address is resolved.
+	resolved *atomic.Pointer[net.UDPAddr]
+	address  string // host:port
+}
+
+// newUDPNode returns the upstream of the address. An IP address is resolved right away,
+// a host name by the health checks.
+func newUDPNode(address string) udpNode {
+	node := udpNode{
+		resolved: &atomic.Pointer[net.UDPAddr]{},
+		address:  address,
+	}
+
+	if addrPort, err := netip.ParseAddrPort(address); err == nil {
+		node.resolved.Store(net.UDPAddrFromAddrPort(addrPort))
+	}
+
+	return node
+}
+
+// HealthCheck implements upstream.Backend.
+//
+// UDP has no handshake which could be probed, so the check only resolves the upstream
+// address, so that the flows are dialed without waiting for DNS.
+func (n udpNode) HealthCheck(ctx context.Context) (upstream.Tier, error) {
+	host, port, err := net.SplitHostPort(n.address)
+	if err != nil {
+		return -1, err
+	}
+
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return -1, fmt.Errorf("invalid port %q: %w", port, err)
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return -1, err
+	}
+
+	n.resolved.Store(net.UDPAddrFromAddrPort(netip.AddrPortFrom(addrs[0].Unmap(), uint16(portNum))))
+
+	return 0, nil
+}
+
+// AddRoute installs a route from the listen address ipPort to the list of upstreams.
+//
+// A route added after Start is listened on right away, see RouteRemover.
+func (u *UDP) AddRoute(ipPort string, upstreamAddrs iter.Seq[string], options ...upstream.ListOption) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.closed {
+		return net.ErrClosed
+	}
+
+	if _, ok := u.routes[ipPort]; ok && u.started {
+		return fmt.Errorf("route %s already exists", ipPort)
+	}
+
+	if u.Logger == nil {
+		u.Logger = zap.NewNop()
+	}
+
+	if u.routes == nil {
+		u.routes = map[string]*udpRoute{}
+	}
+
+	if upstreamAddrs == nil {
+		upstreamAddrs = xiter.Empty[string]
+	}
+
+	upstreams, err := upstream.NewListWithCmp(
+		xiter.Map(newUDPNode, upstreamAddrs),
+		func(a, b udpNode) bool { return a.address == b.address },
+		options...,
+	)
+	if err != nil {
+		return err
+	}
+
+	route := &udpRoute{
+		list:       upstreams,
+		flows:      map[string]*udpFlow{},
+		recent:     list.New(),
+		logger:     u.Logger.With(zap.String("listen-addr", ipPort)),
+		listenAddr: ipPort,
+	}
+
+	if u.started {
+		if route.conn, err = listenPacket(u.Listeners, ipPort, u.StaticBindAddresses); err != nil {
+			upstreams.Shutdown()
+
+			return fmt.Errorf("failed to listen on %s: %w", ipPort, err)
+		}
+
+		u.wg.Go(func() {
+			u.errs.record(u.serve(route))
+		})
+	}
+
+	u.routes[ipPort] = route
+
+	return nil
+}
+
+// RemoveRoute implements RouteRemover.
+//
+// The flows of the route are expired, as the replies of their upstreams are sent from its
+// socket.
+func (u *UDP) RemoveRoute(ipPort string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.closed {
+		return net.ErrClosed
+	}
+
+	route, ok := u.routes[ipPort]
+	if !ok {
+		return fmt.Errorf("route %s does not exist", ipPort)
+	}
+
+	delete(u.routes, ipPort)
+
+	route.close()
+
+	return nil
+}
+
+// Start opens a UDP socket for each route and starts proxying.
+//
+// If it returns a non-nil error, any successfully opened sockets are closed.
+func (u *UDP) Start() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.started {
+		return errors.New("already started")
+	}
+
+	u.started = true
+
+	for _, route := range u.routes {
+		conn, err := listenPacket(u.Listeners, route.listenAddr, u.StaticBindAddresses)
+		if err != nil {
+			u.closeNoLock()
+
+			return fmt.Errorf("failed to listen on %s: %w", route.listenAddr, err)
+		}
+
+		route.conn = conn
+	}
+
+	for _, route := range u.routes {
+		u.wg.Go(func() {
+			u.errs.record(u.serve(route))
+		})
+	}
+
+	return nil
+}
+
+// Close closes the sockets, expires all flows and stops health checks on upstreams.
+func (u *UDP) Close() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.closeNoLock()
+
+	return nil
+}
+
+// Wait waits for all routes to stop serving.
+//
+// It returns the first error which caused a route to stop, other than the one caused by Close.
+func (u *UDP) Wait() error {
+	u.wg.Wait()
+
+	return u.errs.get()
+}
+
+// SetUpstreams implements UpstreamSetter.
+//
+// The flows of the clients keep their upstreams.
+func (u *UDP) SetUpstreams(upstreamAddrs []string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.closed {
+		return net.ErrClosed
+	}
+
+	for _, route := range u.routes {
+		route.list.Reconcile(xiter.Map(newUDPNode, slices.Values(upstreamAddrs)))
+	}
+
+	return nil
+}
+
+func (u *UDP) closeNoLock() {
+	if u.closed {
+		return
+	}
+
+	u.closed = true
+
+	for _, route := range u.routes {
+		route.close()
+	}
+}
+
+// close closes the socket of the route, expires its flows and stops health checks on its
+// upstreams.
+func (r *udpRoute) close() {
+	if r.conn != nil {
+		r.conn.Close() //nolint:errcheck
+	}
+
+	r.lock.Lock()
+
+	r.closed = true
+
+	for _, flow := range r.flows {
+		flow.upstream.Close() //nolint:errcheck
+	}
+
+	r.lock.Unlock()
+
+	r.list.Shutdown()
+}
+
+func (u *UDP) idleTimeout() time.Duration {
+	if u.IdleTimeout > 0 {
+		return u.IdleTimeout
+	}
+
+	return DefaultUDPIdleTimeout
+}
+
+func (u *UDP) maxFlows() int {
+	if u.MaxFlows > 0 {
+		return u.MaxFlows
+	}
+
+	return DefaultUDPMaxFlows
+}
+
+func (u *UDP) serve(route *udpRoute) error {
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, clientAddr, err := route.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		flow, err := u.flowFor(route, clientAddr)
+		if err != nil {
+			route.logger.Warn("failed to establish flow, dropping datagram", zap.Stringer("client-addr", clientAddr), zap.Error(err))
+
+			continue
+		}
+
+		if _, err = flow.upstream.Write(buf[:n]); err != nil {
+			route.logger.Debug("failed to forward datagram to upstream", zap.Stringer("client-addr", clientAddr), zap.Error(err))
+		}
+	}
+}
+
+func (u *UDP) flowFor(route *udpRoute, clientAddr net.Addr) (*udpFlow, error) {
+	if flow, err := route.flow(clientAddr); flow != nil || err != nil {
+		return flow, err
+	}
+
+	upstreamNode, err := route.list.Pick()
+	if err != nil {
+		return nil, err
+	}
+
+	// the address is resolved by the health checks, so that new flows do not wait for DNS
+	upstreamAddr := upstreamNode.resolved.Load()
+	if upstreamAddr == nil {
+		return nil, fmt.Errorf("upstream %s is not resolved yet", upstreamNode.address)
+	}
+
+	upstreamConn, err := net.DialUDP("udp", nil, upstreamAddr)
+	if err != nil {
+		route.list.Down(upstreamNode)
+
+		return nil, fmt.Errorf("failed to dial upstream %s: %w", upstreamNode.address, err)
+	}
+
+	route.lock.Lock()
+	defer route.lock.Unlock()
+
+	if route.closed {
+		upstreamConn.Close() //nolint:errcheck
+
+		return nil, net.ErrClosed
+	}
+
+	if flow, ok := route.flows[clientAddr.String()]; ok {
+		upstreamConn.Close() //nolint:errcheck
+
+		return flow, nil
+	}
+
+	if len(route.flows) >= u.maxFlows() {
+		route.evictNoLock()
+	}
+
+	flow := &udpFlow{
+		client:   clientAddr,
+		upstream: upstreamConn,
+	}
+
+	flow.touch()
+
+	flow.element = route.recent.PushFront(flow)
+	route.flows[clientAddr.String()] = flow
+
+	route.logger.Debug("new flow", zap.Stringer("client-addr", clientAddr), zap.String("upstream-addr", upstreamNode.address))
+
+	u.wg.Go(func() {
+		u.relay(route, flow)
+	})
+
+	return flow, nil
+}
+
+// flow returns the flow of the client touched, or nil if it has none.
+func (r *udpRoute) flow(clientAddr net.Addr) (*udpFlow, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return nil, net.ErrClosed
+	}
+
+	flow := r.flows[clientAddr.String()]
+	if flow != nil {
+		r.touchNoLock(flow)
+	}
+
+	return flow, nil
+}
+
+// touch marks the flow as the most recently active one of the route.
+func (r *udpRoute) touch(flow *udpFlow) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.touchNoLock(flow)
+}
+
+func (r *udpRoute) touchNoLock(flow *udpFlow) {
+	flow.touch()
+
+	// the flow is not moved anymore once it is expired
+	r.recent.MoveToFront(flow.element)
+}
+
+// evictNoLock expires the least recently active flow of the route.
+func (r *udpRoute) evictNoLock() {
+	element := r.recent.Back()
+	if element == nil {
+		return
+	}
+
+	oldest := element.Value.(*udpFlow) //nolint:forcetypeassert,errcheck
+
+	r.logger.Debug("too many flows, expiring the least recently active one", zap.Stringer("client-addr", oldest.client))
+
+	r.recent.Remove(element)
+	delete(r.flows, oldest.client.String())
+
+	// its relay returns once the upstream socket is closed
+	oldest.upstream.Close() //nolint:errcheck
+}
+
+// relay copies upstream replies of a single flow back to its client until the flow is idle
+// for longer than the idle timeout or its upstream socket is closed.
+func (u *UDP) relay(route *udpRoute, flow *udpFlow) {
+	defer func() {
+		route.lock.Lock()
+
+		// the client may have a new flow already if this one was evicted
+		if route.flows[flow.client.String()] == flow {
+			route.recent.Remove(flow.element)
+			delete(route.flows, flow.client.String())
+		}
+
+		route.lock.Unlock()
+
+		flow.upstream.Close() //nolint:errcheck
+	}()
+
+	idleTimeout := u.idleTimeout()
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		if err := flow.upstream.SetReadDeadline(time.Now().Add(idleTimeout - flow.idleFor())); err != nil {
+			return
+		}
+
+		n, err := flow.upstream.Read(buf)
+		if err != nil {
+			var netErr net.Error
+
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if flow.idleFor() < idleTimeout {
+					// client sent something in the meantime, keep the flow
+					continue
+				}
+
+				route.logger.Debug("flow expired", zap.Stringer("client-addr", flow.client))
+
+				return
+			}
+
+			if !errors.Is(err, net.ErrClosed) {
+				// e.g. ICMP port unreachable from the upstream
+				route.logger.Debug("failed to read from upstream", zap.Stringer("client-addr", flow.client), zap.Error(err))
+			}
+
+			return
+		}
+
+		route.touch(flow)
+
+		if _, err = route.conn.WriteTo(buf[:n], flow.client); err != nil {
+			route.logger.Debug("failed to relay datagram to client", zap.Stringer("client-addr", flow.client), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip_test
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+// startUDPEcho starts a UDP server which replies to each datagram with "<payload>@<sender address>".
+func startUDPEcho(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+	go func() {
+		buf := make([]byte, 1024)
+
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			conn.WriteTo(append(buf[:n:n], "@"+addr.String()...), addr) //nolint:errcheck
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := conn.LocalAddr().String()
+
+	require.NoError(t, conn.Close())
+
+	return addr
+}
+
+func roundTrip(t *testing.T, conn net.Conn, payload string) string {
+	t.Helper()
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err := conn.Write([]byte(payload))
+	require.NoError(t, err)
+
+	buf := make([]byte, 1024)
+
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+
+	return string(buf[:n])
+}
+
+func TestUDP(t *testing.T) {
+	t.Parallel()
+
+	upstreamAddr := startUDPEcho(t)
+	listenAddr := freeUDPAddr(t)
+
+	lb := &ip.UDP{Logger: zaptest.NewLogger(t), IdleTimeout: 200 * time.Millisecond}
+
+	require.NoError(t, lb.AddRoute(listenAddr, slices.Values([]string{upstreamAddr})))
+	require.NoError(t, lb.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	})
+
+	client1, err := net.Dial("udp", listenAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { client1.Close() }) //nolint:errcheck
+
+	client2, err := net.Dial("udp", listenAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { client2.Close() }) //nolint:errcheck
+
+	reply1 := roundTrip(t, client1, "ping")
+	assert.Contains(t, reply1, "ping@127.0.0.1:")
+
+	// the same client keeps its flow, so the upstream sees the same source address.
+	assert.Equal(t, reply1, roundTrip(t, client1, "ping"))
+
+	// another client gets a flow of its own.
+	reply2 := roundTrip(t, client2, "ping")
+	assert.Contains(t, reply2, "ping@127.0.0.1:")
+	assert.NotEqual(t, reply1, reply2)
+
+	// after the flow expires, the next datagram opens a new upstream socket.
+	time.Sleep(time.Second)
+
+	assert.NotEqual(t, reply1, roundTrip(t, client1, "ping"))
+}
+
+func TestUDPMaxFlows(t *testing.T) {
+	t.Parallel()
+
+	upstreamAddr := startUDPEcho(t)
+	listenAddr := freeUDPAddr(t)
+
+	lb := &ip.UDP{Logger: zaptest.NewLogger(t), MaxFlows: 2}
+
+	require.NoError(t, lb.AddRoute(listenAddr, slices.Values([]string{upstreamAddr})))
+	require.NoError(t, lb.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	})
+
+	clients := make([]net.Conn, 3)
+
+	for i := range clients {
+		client, err := net.Dial("udp", listenAddr)
+		require.NoError(t, err)
+
+		t.Cleanup(func() { client.Close() }) //nolint:errcheck
+
+		clients[i] = client
+	}
+
+	reply1 := roundTrip(t, clients[0], "ping")
+	reply2 := roundTrip(t, clients[1], "ping")
+
+	// the second client keeps its flow while there is room
+	assert.Equal(t, reply2, roundTrip(t, clients[1], "ping"))
+
+	// the flow of the least recently active client is expired to make room for a new one
+	roundTrip(t, clients[2], "ping")
+
+	assert.Equal(t, reply2, roundTrip(t, clients[1], "ping"))
+	assert.NotEqual(t, reply1, roundTrip(t, clients[0], "ping"))
+}
+
+func TestUDPHostNameUpstream(t *testing.T) {
+	t.Parallel()
+
+	addrs, err := net.DefaultResolver.LookupNetIP(t.Context(), "ip", "localhost")
+	if err != nil || len(addrs) == 0 {
+		t.Skipf("localhost does not resolve: %v", err)
+	}
+
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(addrs[0].Unmap().String(), "0"))
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() }) //nolint:errcheck
+
+	go func() {
+		buf := make([]byte, 1024)
+
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			conn.WriteTo(buf[:n], addr) //nolint:errcheck
+		}
+	}()
+
+	_, port, err := net.SplitHostPort(conn.LocalAddr().String())
+	require.NoError(t, err)
+
+	listenAddr := freeUDPAddr(t)
+
+	lb := &ip.UDP{Logger: zaptest.NewLogger(t)}
+
+	require.NoError(t, lb.AddRoute(listenAddr, slices.Values([]string{net.JoinHostPort("localhost", port)})))
+	require.NoError(t, lb.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	})
+
+	client, err := net.Dial("udp", listenAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { client.Close() }) //nolint:errcheck
+
+	// the datagrams are dropped until the health check resolves the upstream
+	assert.Eventually(t, func() bool {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			return false
+		}
+
+		if err := client.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+			return false
+		}
+
+		buf := make([]byte, 1024)
+
+		n, err := client.Read(buf)
+
+		return err == nil && string(buf[:n]) == "ping"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestUDPStartFailure(t *testing.T) {
+	t.Parallel()
+
+	taken, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { taken.Close() }) //nolint:errcheck
+
+	lb := &ip.UDP{Logger: zaptest.NewLogger(t)}
+
+	require.NoError(t, lb.AddRoute(taken.LocalAddr().String(), slices.Values([]string{"127.0.0.1:53"})))
+	assert.ErrorContains(t, lb.Start(), "address already in use")
+
+	require.NoError(t, lb.Close())
+	require.NoError(t, lb.Wait())
+}
+
+func TestUDPRoutesAfterStart(t *testing.T) {
+	t.Parallel()
+
+	upstreamAddr := startUDPEcho(t)
+	listenAddr := freeUDPAddr(t)
+
+	lb := &ip.UDP{Logger: zaptest.NewLogger(t)}
+
+	require.NoError(t, lb.AddRoute(listenAddr, slices.Values([]string{upstreamAddr})))
+	require.NoError(t, lb.Start())
+
+	t.Cleanup(func() {
+		require.NoError(t, lb.Close())
+		require.NoError(t, lb.Wait())
+	})
+
+	client, err := net.Dial("udp", listenAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { client.Close() }) //nolint:errcheck
+
+	reply := roundTrip(t, client, "ping")
+
+	// a route added after Start is served right away, while the flows of the other ones are kept
+	addedAddr := freeUDPAddr(t)
+
+	require.NoError(t, lb.AddRoute(addedAddr, slices.Values([]string{upstreamAddr})))
+	assert.ErrorContains(t, lb.AddRoute(addedAddr, nil), "already exists")
+
+	added, err := net.Dial("udp", addedAddr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { added.Close() }) //nolint:errcheck
+
+	assert.Contains(t, roundTrip(t, added, "ping"), "ping@127.0.0.1:")
+
+	require.NoError(t, lb.RemoveRoute(addedAddr))
+	assert.ErrorContains(t, lb.RemoveRoute(addedAddr), "does not exist")
+
+	assert.Equal(t, reply, roundTrip(t, client, "ping"))
+}
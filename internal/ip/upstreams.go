@@ -0,0 +1,98 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// UpstreamMode is how the upstreams of a mapping are addressed.
+type UpstreamMode int
+
+// UpstreamMode values.
+const (
+	// UpstreamDNS connects to the DNS name of the Service, "name.namespace".
+	UpstreamDNS UpstreamMode = iota
+
+	// UpstreamEndpoints connects to the ready endpoints of the Service directly, see
+	// Mapping.Endpoints.
+	UpstreamEndpoints
+
+	// UpstreamClusterIP connects to the ClusterIP of the Service, see Mapping.UpstreamHost.
+	UpstreamClusterIP
+)
+
+// ParseUpstreamMode parses a case-insensitive upstream mode name ("dns", "endpoints" or
+// "cluster-ip").
+func ParseUpstreamMode(s string) (UpstreamMode, error) {
+	switch strings.ToLower(s) {
+	case "dns":
+		return UpstreamDNS, nil
+	case "endpoints":
+		return UpstreamEndpoints, nil
+	case "cluster-ip":
+		return UpstreamClusterIP, nil
+	default:
+		return 0, fmt.Errorf("unsupported upstream mode %q", s)
+	}
+}
+
+// String returns the lowercase upstream mode name.
+func (m UpstreamMode) String() string {
+	switch m {
+	case UpstreamDNS:
+		return "dns"
+	case UpstreamEndpoints:
+		return "endpoints"
+	case UpstreamClusterIP:
+		return "cluster-ip"
+	default:
+		return "unknown(" + strconv.Itoa(int(m)) + ")"
+	}
+}
+
+// Endpoints is a list of the host:port addresses of the endpoints of a Service.
+//
+// It is kept as a sorted comma-separated string, so that the mappings holding it stay
+// comparable.
+type Endpoints string
+
+// NewEndpoints returns the list of the addresses, sorted and without duplicates.
+func NewEndpoints(addresses []string) Endpoints {
+	addresses = slices.Clone(addresses)
+
+	slices.Sort(addresses)
+
+	return Endpoints(strings.Join(slices.Compact(addresses), ","))
+}
+
+// Addresses returns the addresses of the list.
+func (e Endpoints) Addresses() []string {
+	if e == "" {
+		return nil
+	}
+
+	return strings.Split(string(e), ",")
+}
+
+// upstreamAddrs returns the addresses of the upstreams of the mapping of the Service.
+func upstreamAddrs(serviceKey types.NamespacedName, mapping Mapping) []string {
+	if mapping.Upstream == UpstreamEndpoints {
+		return mapping.Endpoints.Addresses()
+	}
+
+	host := mapping.UpstreamHost
+	if host == "" {
+		host = serviceKey.Name + "." + serviceKey.Namespace
+	}
+
+	return []string{net.JoinHostPort(host, strconv.Itoa(mapping.ServicePort))}
+}
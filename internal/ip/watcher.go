@@ -0,0 +1,109 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AddressSource receives the notifications of the changes of the host IP addresses, see
+// NewNetlinkAddressSource.
+type AddressSource interface {
+	// Receive blocks until a notification is received. It returns whether the host IP
+	// addresses may have changed.
+	Receive() (bool, error)
+
+	// Close stops receiving the notifications, unblocking Receive.
+	Close() error
+}
+
+// ErrAddressSourceClosed is returned by the Receive of a closed AddressSource.
+var ErrAddressSourceClosed = errors.New("address source is closed")
+
+// AddressWatcher notifies of the changes of the host IP addresses as soon as the AddressSource
+// receives them, so that the host ports are listened on the new addresses without waiting for
+// the next refresh of the IP set.
+//
+// The changes received within Delay of each other are notified of once, as the addresses of
+// an interface usually change together.
+type AddressWatcher struct {
+	Source AddressSource
+	Logger *zap.Logger
+	Delay  time.Duration
+}
+
+// Run calls changed after the host IP addresses changed, until the context is done. The
+// AddressSource is closed when Run returns.
+//
+// It returns an error if the AddressSource fails.
+func (w *AddressWatcher) Run(ctx context.Context, changed func()) error {
+	logger := w.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	received := make(chan struct{}, 1)
+	done := make(chan struct{})
+
+	var receiveErr error
+
+	go func() {
+		defer close(done)
+
+		for {
+			ok, err := w.Source.Receive()
+			if err != nil {
+				receiveErr = err
+
+				return
+			}
+
+			if !ok {
+				continue
+			}
+
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	defer func() {
+		// Receive is unblocked by Close
+		w.Source.Close() //nolint:errcheck
+
+		<-done
+	}()
+
+	var (
+		timer  *time.Timer
+		timerC <-chan time.Time
+	)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-done:
+			return receiveErr
+		case <-received:
+			logger.Debug("host IP addresses changed")
+
+			if timer == nil {
+				timer = time.NewTimer(w.Delay)
+				timerC = timer.C
+			}
+		case <-timerC:
+			timer, timerC = nil, nil
+
+			changed()
+		}
+	}
+}
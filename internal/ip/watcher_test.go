@@ -0,0 +1,140 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ip_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+// fakeAddressSource receives the notifications sent to it, and fails with the errors sent to it.
+type fakeAddressSource struct {
+	notifications chan bool
+	errs          chan error
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func newFakeAddressSource() *fakeAddressSource {
+	return &fakeAddressSource{
+		notifications: make(chan bool),
+		errs:          make(chan error),
+		closed:        make(chan struct{}),
+	}
+}
+
+func (s *fakeAddressSource) Receive() (bool, error) {
+	select {
+	case changed := <-s.notifications:
+		return changed, nil
+	case err := <-s.errs:
+		return false, err
+	case <-s.closed:
+		return false, ip.ErrAddressSourceClosed
+	}
+}
+
+func (s *fakeAddressSource) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+
+	return nil
+}
+
+func TestAddressWatcher(t *testing.T) {
+	t.Parallel()
+
+	source := newFakeAddressSource()
+	watcher := &ip.AddressWatcher{Source: source, Logger: zaptest.NewLogger(t), Delay: 50 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(t.Context())
+
+	var changes atomic.Int32
+
+	errCh := make(chan error, 1)
+
+	go func() { errCh <- watcher.Run(ctx, func() { changes.Add(1) }) }()
+
+	// the notifications of other changes are ignored
+	source.notifications <- false
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Zero(t, changes.Load())
+
+	// the changes received together are notified of once
+	for range 3 {
+		source.notifications <- true
+	}
+
+	assert.Eventually(t, func() bool { return changes.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	source.notifications <- true
+
+	assert.Eventually(t, func() bool { return changes.Load() == 2 }, time.Second, 10*time.Millisecond)
+
+	cancel()
+
+	require.NoError(t, <-errCh)
+
+	select {
+	case <-source.closed:
+	default:
+		t.Fatal("source is not closed")
+	}
+}
+
+func TestAddressWatcherSourceError(t *testing.T) {
+	t.Parallel()
+
+	source := newFakeAddressSource()
+	watcher := &ip.AddressWatcher{Source: source, Logger: zaptest.NewLogger(t)}
+
+	errCh := make(chan error, 1)
+
+	go func() { errCh <- watcher.Run(t.Context(), func() {}) }()
+
+	source.errs <- errors.New("socket failed")
+
+	assert.EqualError(t, <-errCh, "socket failed")
+}
+
+func TestNetlinkAddressSourceClose(t *testing.T) {
+	t.Parallel()
+
+	source, err := ip.NewNetlinkAddressSource()
+	if err != nil {
+		t.Skipf("netlink is not available: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		for {
+			if _, err := source.Receive(); err != nil {
+				errCh <- err
+
+				return
+			}
+		}
+	}()
+
+	require.NoError(t, source.Close())
+
+	select {
+	case err = <-errCh:
+		assert.ErrorIs(t, err, ip.ErrAddressSourceClosed)
+	case <-time.After(time.Second):
+		t.Fatal("Receive is not unblocked by Close")
+	}
+}
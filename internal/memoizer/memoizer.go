@@ -7,15 +7,24 @@ package memoizer
 
 import (
 	"fmt"
+	"slices"
 	"sync"
 )
 
 // Memoizer is a container for a value that is initialized and cached lazily.
+//
+// A Memoizer returned by NewObservable notifies its subscribers of the changes of the value.
 type Memoizer[T any] struct {
 	cached      T
 	supplier    func() (T, error)
+	equal       func(a, b T) bool
+	subscribers []func(previous, current T)
 	lock        sync.Mutex
 	initialized bool
+
+	// fetched is set once a value is fetched: cached keeps the last one when it is invalidated,
+	// so that the next one is compared to it.
+	fetched bool
 }
 
 // New returns a new Memoizer with the given supplier and thread-safety.
@@ -29,38 +38,93 @@ func New[T any](supplier func() (T, error)) (*Memoizer[T], error) {
 	}, nil
 }
 
+// NewObservable returns a new Memoizer with the given supplier, which notifies its
+// subscribers when a fetched value is not equal to the previously fetched one.
+func NewObservable[T any](supplier func() (T, error), equal func(a, b T) bool) (*Memoizer[T], error) {
+	if equal == nil {
+		return nil, fmt.Errorf("equal must not be nil")
+	}
+
+	m, err := New(supplier)
+	if err != nil {
+		return nil, err
+	}
+
+	m.equal = equal
+
+	return m, nil
+}
+
+// Subscribe registers a function to be called with the previous and the current value when a
+// fetched value changes. The first value fetched is not a change.
+//
+// It is called by the Get or Refresh which fetched the value, once the value is cached. Only
+// the subscribers of a Memoizer returned by NewObservable are notified.
+func (m *Memoizer[T]) Subscribe(changed func(previous, current T)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.subscribers = append(m.subscribers, changed)
+}
+
 // Get returns the value from the memoizer.
 func (m *Memoizer[T]) Get() (T, error) {
 	m.lock.Lock()
-	defer m.lock.Unlock()
 
-	return m.getNoLock()
+	val, notify, err := m.getNoLock()
+
+	m.lock.Unlock()
+
+	notify()
+
+	return val, err
 }
 
 // Refresh refreshes the memoizer, it invalidates the existing value and re-initializes it.
 func (m *Memoizer[T]) Refresh() (T, error) {
 	m.lock.Lock()
-	defer m.lock.Unlock()
 
 	m.invalidateNoLock()
 
-	return m.getNoLock()
+	val, notify, err := m.getNoLock()
+
+	m.lock.Unlock()
+
+	notify()
+
+	return val, err
 }
 
-func (m *Memoizer[T]) getNoLock() (T, error) {
+// getNoLock returns the value, and the function notifying the subscribers if it changed,
+// which is called without the lock, so that they can get the value.
+func (m *Memoizer[T]) getNoLock() (T, func(), error) {
 	if m.initialized {
-		return m.cached, nil
+		return m.cached, func() {}, nil
 	}
 
 	val, err := m.supplier()
 	if err != nil {
-		return val, err
+		return val, func() {}, err
 	}
 
+	previous := m.cached
+	changed := m.fetched && m.equal != nil && !m.equal(previous, val)
+
 	m.cached = val
 	m.initialized = true
+	m.fetched = true
+
+	if !changed {
+		return val, func() {}, nil
+	}
+
+	subscribers := slices.Clone(m.subscribers)
 
-	return val, nil
+	return val, func() {
+		for _, subscriber := range subscribers {
+			subscriber(previous, val)
+		}
+	}, nil
 }
 
 func (m *Memoizer[T]) invalidateNoLock() {
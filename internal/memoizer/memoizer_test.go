@@ -81,3 +81,58 @@ func TestRefresh(t *testing.T) {
 	_, err = m.Refresh()
 	assert.ErrorContains(t, err, "unexpected call")
 }
+
+func TestObservable(t *testing.T) {
+	t.Parallel()
+
+	_, err := memoizer.NewObservable(func() (string, error) { return "", nil }, nil)
+	assert.ErrorContains(t, err, "equal must not be nil")
+
+	values := []string{"aaa", "aaa", "bbb", "", "ccc"}
+
+	m, err := memoizer.NewObservable(func() (string, error) {
+		val := values[0]
+		values = values[1:]
+
+		if val == "" {
+			return "", fmt.Errorf("fetch failed")
+		}
+
+		return val, nil
+	}, func(a, b string) bool { return a == b })
+	require.NoError(t, err)
+
+	var changes [][2]string
+
+	m.Subscribe(func(previous, current string) {
+		// the value is cached by the time the subscribers are notified
+		val, err := m.Get()
+		require.NoError(t, err)
+		assert.Equal(t, current, val)
+
+		changes = append(changes, [2]string{previous, current})
+	})
+
+	// the first value is not a change
+	_, err = m.Get()
+	require.NoError(t, err)
+
+	_, err = m.Refresh()
+	require.NoError(t, err)
+
+	assert.Empty(t, changes)
+
+	_, err = m.Refresh()
+	require.NoError(t, err)
+
+	assert.Equal(t, [][2]string{{"aaa", "bbb"}}, changes)
+
+	// the value fetched after a failure is compared to the last one fetched
+	_, err = m.Refresh()
+	require.Error(t, err)
+
+	_, err = m.Get()
+	require.NoError(t, err)
+
+	assert.Equal(t, [][2]string{{"aaa", "bbb"}, {"bbb", "ccc"}}, changes)
+}
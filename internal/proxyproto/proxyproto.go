@@ -0,0 +1,319 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package proxyproto implements the HAProxy PROXY protocol header, versions 1 and 2, for TCP.
+//
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Version is a PROXY protocol version. The zero value means PROXY protocol is disabled.
+type Version int
+
+// Version values.
+const (
+	VersionNone Version = iota
+	Version1
+	Version2
+)
+
+// ParseVersion parses a PROXY protocol version: "v1" or "1", "v2" or "2", and "none" or an
+// empty string for disabled.
+func ParseVersion(s string) (Version, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return VersionNone, nil
+	case "v1", "1":
+		return Version1, nil
+	case "v2", "2":
+		return Version2, nil
+	default:
+		return VersionNone, fmt.Errorf("unsupported PROXY protocol version %q", s)
+	}
+}
+
+// String returns the version as "v1", "v2" or "none".
+func (v Version) String() string {
+	switch v {
+	case VersionNone:
+		return "none"
+	case Version1:
+		return "v1"
+	case Version2:
+		return "v2"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(v))
+	}
+}
+
+// signatureV2 is the fixed prefix of every version 2 header.
+var signatureV2 = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	v2VersionCommandLocal = 0x20
+	v2VersionCommandProxy = 0x21
+	v2FamilyTCP4          = 0x11
+	v2FamilyTCP6          = 0x21
+	v2FamilyUnspec        = 0x00
+
+	// v1MaxLength is the maximum length of a version 1 header, including the CRLF.
+	v1MaxLength = 107
+
+	v1Prefix = "PROXY "
+)
+
+// ErrNoHeader is returned by Read when the stream does not start with a PROXY protocol header.
+var ErrNoHeader = errors.New("no PROXY protocol header")
+
+// Header is a PROXY protocol header of a TCP connection.
+//
+// A header with invalid source or destination carries no address information: it is
+// encoded as "UNKNOWN" in version 1 and as a LOCAL command in version 2.
+type Header struct {
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+}
+
+// HeaderFromConn returns the header describing the connection, with its remote address as the
+// source and its local address as the destination.
+func HeaderFromConn(conn net.Conn) Header {
+	return Header{
+		Source:      addrPortOf(conn.RemoteAddr()),
+		Destination: addrPortOf(conn.LocalAddr()),
+	}
+}
+
+func addrPortOf(addr net.Addr) netip.AddrPort {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.AddrPort()
+	}
+
+	return netip.AddrPort{}
+}
+
+// IsLocal reports whether the header carries no address information.
+func (h Header) IsLocal() bool {
+	return !h.Source.IsValid() || !h.Destination.IsValid()
+}
+
+// Format encodes the header in the given version.
+func (h Header) Format(version Version) ([]byte, error) {
+	switch version {
+	case Version1:
+		return h.formatV1(), nil
+	case Version2:
+		return h.formatV2(), nil
+	case VersionNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol version %s", version)
+	}
+}
+
+// addrs returns the source and destination addresses in the same family: if one of them is
+// IPv6, IPv4 addresses are converted to IPv4-mapped IPv6 ones.
+func (h Header) addrs() (src, dst netip.Addr, is4 bool) {
+	src, dst = h.Source.Addr().Unmap(), h.Destination.Addr().Unmap()
+
+	if src.Is4() && dst.Is4() {
+		return src, dst, true
+	}
+
+	return netip.AddrFrom16(src.As16()), netip.AddrFrom16(dst.As16()), false
+}
+
+func (h Header) formatV1() []byte {
+	if h.IsLocal() {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	src, dst, is4 := h.addrs()
+
+	family := "TCP6"
+	if is4 {
+		family = "TCP4"
+	}
+
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, src, dst, h.Source.Port(), h.Destination.Port())
+}
+
+func (h Header) formatV2() []byte {
+	buf := make([]byte, 0, len(signatureV2)+4+36)
+	buf = append(buf, signatureV2...)
+
+	if h.IsLocal() {
+		return append(buf, v2VersionCommandLocal, v2FamilyUnspec, 0, 0)
+	}
+
+	src, dst, is4 := h.addrs()
+
+	family := byte(v2FamilyTCP6)
+	if is4 {
+		family = v2FamilyTCP4
+	}
+
+	addrs := append(src.AsSlice(), dst.AsSlice()...)
+	addrs = binary.BigEndian.AppendUint16(addrs, h.Source.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, h.Destination.Port())
+
+	buf = append(buf, v2VersionCommandProxy, family)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(addrs)))
+
+	return append(buf, addrs...)
+}
+
+// Read reads a version 1 or 2 header from the start of the stream.
+//
+// Bytes following the header are left in the reader. Headers without address information,
+// and version 2 headers of a LOCAL command or an unspecified family, are returned as a
+// header without addresses, see Header.IsLocal.
+func Read(r *bufio.Reader) (Header, error) {
+	// a v1 header is at least 15 bytes long, so it is safe to peek the v2 signature length
+	prefix, err := r.Peek(len(signatureV2))
+	if err != nil {
+		return Header{}, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+
+	switch {
+	case bytes.Equal(prefix, signatureV2):
+		return readV2(r)
+	case bytes.HasPrefix(prefix, []byte(v1Prefix)):
+		return readV1(r)
+	default:
+		return Header{}, ErrNoHeader
+	}
+}
+
+func readV1(r *bufio.Reader) (Header, error) {
+	var line []byte
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return Header{}, fmt.Errorf("failed to read PROXY protocol v1 header: %w", err)
+		}
+
+		line = append(line, b)
+
+		if b == '\n' {
+			break
+		}
+
+		if len(line) >= v1MaxLength {
+			return Header{}, errors.New("PROXY protocol v1 header is too long")
+		}
+	}
+
+	fields, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return Header{}, errors.New("PROXY protocol v1 header does not end with CRLF")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(fields, v1Prefix), " ")
+
+	if parts[0] == "UNKNOWN" {
+		return Header{}, nil
+	}
+
+	if len(parts) != 5 {
+		return Header{}, fmt.Errorf("malformed PROXY protocol v1 header %q", fields)
+	}
+
+	if parts[0] != "TCP4" && parts[0] != "TCP6" {
+		return Header{}, fmt.Errorf("unsupported PROXY protocol v1 family %q", parts[0])
+	}
+
+	src, err := parseV1AddrPort(parts[1], parts[3], parts[0] == "TCP4")
+	if err != nil {
+		return Header{}, err
+	}
+
+	dst, err := parseV1AddrPort(parts[2], parts[4], parts[0] == "TCP4")
+	if err != nil {
+		return Header{}, err
+	}
+
+	return Header{Source: src, Destination: dst}, nil
+}
+
+func parseV1AddrPort(addrStr, portStr string, is4 bool) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(addrStr)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid PROXY protocol v1 address: %w", err)
+	}
+
+	if addr.Is4() != is4 {
+		return netip.AddrPort{}, fmt.Errorf("PROXY protocol v1 address %s does not match the family", addr)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid PROXY protocol v1 port: %w", err)
+	}
+
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+func readV2(r *bufio.Reader) (Header, error) {
+	fixed := make([]byte, len(signatureV2)+4)
+
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return Header{}, fmt.Errorf("failed to read PROXY protocol v2 header: %w", err)
+	}
+
+	versionCommand, family := fixed[12], fixed[13]
+
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Header{}, fmt.Errorf("failed to read PROXY protocol v2 addresses: %w", err)
+	}
+
+	switch versionCommand {
+	case v2VersionCommandLocal:
+		return Header{}, nil
+	case v2VersionCommandProxy:
+	default:
+		return Header{}, fmt.Errorf("unsupported PROXY protocol v2 version and command 0x%02x", versionCommand)
+	}
+
+	var addrLen int
+
+	switch family {
+	case v2FamilyUnspec:
+		return Header{}, nil
+	case v2FamilyTCP4:
+		addrLen = 4
+	case v2FamilyTCP6:
+		addrLen = 16
+	default:
+		return Header{}, fmt.Errorf("unsupported PROXY protocol v2 family 0x%02x", family)
+	}
+
+	// anything after the addresses is TLVs, which are ignored
+	if len(payload) < 2*addrLen+4 {
+		return Header{}, errors.New("PROXY protocol v2 address block is too short")
+	}
+
+	src, _ := netip.AddrFromSlice(payload[:addrLen])
+	dst, _ := netip.AddrFromSlice(payload[addrLen : 2*addrLen])
+	ports := payload[2*addrLen:]
+
+	return Header{
+		Source:      netip.AddrPortFrom(src, binary.BigEndian.Uint16(ports)),
+		Destination: netip.AddrPortFrom(dst, binary.BigEndian.Uint16(ports[2:])),
+	}, nil
+}
@@ -0,0 +1,231 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package proxyproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siderolabs/kube-service-exposer/internal/proxyproto"
+)
+
+func TestParseVersion(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		in       string
+		expected proxyproto.Version
+	}{
+		{"", proxyproto.VersionNone},
+		{"none", proxyproto.VersionNone},
+		{"v1", proxyproto.Version1},
+		{"1", proxyproto.Version1},
+		{"V2", proxyproto.Version2},
+		{"2", proxyproto.Version2},
+	} {
+		version, err := proxyproto.ParseVersion(test.in)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, version, test.in)
+	}
+
+	_, err := proxyproto.ParseVersion("v3")
+	assert.ErrorContains(t, err, "unsupported PROXY protocol version")
+}
+
+func TestFormatV1(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name     string
+		header   proxyproto.Header
+		expected string
+	}{
+		{
+			name: "tcp4",
+			header: proxyproto.Header{
+				Source:      netip.MustParseAddrPort("192.168.1.10:51234"),
+				Destination: netip.MustParseAddrPort("10.0.0.1:443"),
+			},
+			expected: "PROXY TCP4 192.168.1.10 10.0.0.1 51234 443\r\n",
+		},
+		{
+			name: "tcp6",
+			header: proxyproto.Header{
+				Source:      netip.MustParseAddrPort("[2001:db8::1]:51234"),
+				Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+			},
+			expected: "PROXY TCP6 2001:db8::1 2001:db8::2 51234 443\r\n",
+		},
+		{
+			name: "v4-mapped",
+			header: proxyproto.Header{
+				Source:      netip.MustParseAddrPort("[::ffff:192.168.1.10]:51234"),
+				Destination: netip.MustParseAddrPort("10.0.0.1:443"),
+			},
+			expected: "PROXY TCP4 192.168.1.10 10.0.0.1 51234 443\r\n",
+		},
+		{
+			name: "mixed",
+			header: proxyproto.Header{
+				Source:      netip.MustParseAddrPort("192.168.1.10:51234"),
+				Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+			},
+			expected: "PROXY TCP6 ::ffff:192.168.1.10 2001:db8::2 51234 443\r\n",
+		},
+		{
+			name:     "unknown",
+			expected: "PROXY UNKNOWN\r\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			header, err := test.header.Format(proxyproto.Version1)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, string(header))
+		})
+	}
+}
+
+func TestFormatV2(t *testing.T) {
+	t.Parallel()
+
+	signature := []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+	header, err := proxyproto.Header{
+		Source:      netip.MustParseAddrPort("192.168.1.10:51234"),
+		Destination: netip.MustParseAddrPort("10.0.0.1:443"),
+	}.Format(proxyproto.Version2)
+	require.NoError(t, err)
+
+	assert.Equal(t, append(signature,
+		0x21, 0x11, 0x00, 0x0C, // PROXY command, TCP over IPv4, 12 bytes of addresses
+		192, 168, 1, 10,
+		10, 0, 0, 1,
+		0xC8, 0x22, // 51234
+		0x01, 0xBB, // 443
+	), header)
+
+	header, err = proxyproto.Header{
+		Source:      netip.MustParseAddrPort("[2001:db8::1]:51234"),
+		Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+	}.Format(proxyproto.Version2)
+	require.NoError(t, err)
+
+	assert.Equal(t, append(signature, 0x21, 0x21, 0x00, 0x24), header[:16])
+	assert.Len(t, header, 16+36)
+	assert.Equal(t, []byte{0x20, 0x01, 0x0d, 0xb8}, header[16:20])
+	assert.Equal(t, []byte{0xC8, 0x22, 0x01, 0xBB}, header[48:])
+
+	header, err = proxyproto.Header{}.Format(proxyproto.Version2)
+	require.NoError(t, err)
+
+	assert.Equal(t, append(signature, 0x20, 0x00, 0x00, 0x00), header)
+}
+
+func TestFormatNone(t *testing.T) {
+	t.Parallel()
+
+	header, err := proxyproto.Header{}.Format(proxyproto.VersionNone)
+	require.NoError(t, err)
+	assert.Empty(t, header)
+
+	_, err = proxyproto.Header{}.Format(proxyproto.Version(42))
+	assert.ErrorContains(t, err, "unsupported PROXY protocol version unknown(42)")
+}
+
+func TestRead(t *testing.T) {
+	t.Parallel()
+
+	v4 := proxyproto.Header{
+		Source:      netip.MustParseAddrPort("192.168.1.10:51234"),
+		Destination: netip.MustParseAddrPort("10.0.0.1:443"),
+	}
+
+	v6 := proxyproto.Header{
+		Source:      netip.MustParseAddrPort("[2001:db8::1]:51234"),
+		Destination: netip.MustParseAddrPort("[2001:db8::2]:443"),
+	}
+
+	for _, version := range []proxyproto.Version{proxyproto.Version1, proxyproto.Version2} {
+		for _, header := range []proxyproto.Header{v4, v6, {}} {
+			encoded, err := header.Format(version)
+			require.NoError(t, err)
+
+			r := bufio.NewReader(bytes.NewReader(append(encoded, "payload"...)))
+
+			decoded, err := proxyproto.Read(r)
+			require.NoError(t, err)
+			assert.Equal(t, header, decoded)
+
+			rest, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, "payload", string(rest))
+		}
+	}
+}
+
+func TestReadV2IgnoresTLVs(t *testing.T) {
+	t.Parallel()
+
+	encoded := []byte{
+		0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+		0x21, 0x11, 0x00, 0x11, // 12 bytes of addresses and a 5 bytes long TLV
+		192, 168, 1, 10,
+		10, 0, 0, 1,
+		0xC8, 0x22,
+		0x01, 0xBB,
+		0x01, 0x00, 0x02, 'h', '2', // PP2_TYPE_ALPN
+	}
+
+	r := bufio.NewReader(bytes.NewReader(append(encoded, "payload"...)))
+
+	header, err := proxyproto.Read(r)
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddrPort("192.168.1.10:51234"), header.Source)
+	assert.Equal(t, netip.MustParseAddrPort("10.0.0.1:443"), header.Destination)
+
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(rest))
+}
+
+func TestReadErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name     string
+		in       string
+		expected string
+	}{
+		{"no header", "GET / HTTP/1.1\r\n\r\n", "no PROXY protocol header"},
+		{"short", "PROX", "EOF"},
+		{"no crlf", "PROXY TCP4 1.2.3.4 5.6.7.8 1 2\n", "does not end with CRLF"},
+		{"too long", "PROXY " + strings.Repeat("A", 200), "too long"},
+		{"family", "PROXY UDP4 1.2.3.4 5.6.7.8 1 2\r\n", "unsupported PROXY protocol v1 family"},
+		{"fields", "PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n", "malformed PROXY protocol v1 header"},
+		{"mismatch", "PROXY TCP4 2001:db8::1 5.6.7.8 1 2\r\n", "does not match the family"},
+		{"port", "PROXY TCP4 1.2.3.4 5.6.7.8 1 70000\r\n", "invalid PROXY protocol v1 port"},
+		{"v2 truncated", "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0C\x01\x02", "failed to read PROXY protocol v2 addresses"},
+		{"v2 udp", "\r\n\r\n\x00\r\nQUIT\n\x21\x12\x00\x00", "unsupported PROXY protocol v2 family 0x12"},
+		{"v2 version", "\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00", "unsupported PROXY protocol v2 version and command 0x11"},
+		{"v2 short addresses", "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x01\x02\x03\x04", "address block is too short"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := proxyproto.Read(bufio.NewReader(strings.NewReader(test.in)))
+			assert.ErrorContains(t, err, test.expected)
+		})
+	}
+}
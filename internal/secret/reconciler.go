@@ -0,0 +1,111 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package secret
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// ClientProvider is an interface for providing a Kubernetes client.
+type ClientProvider interface {
+	GetClient() client.Client
+}
+
+var _ reconcile.Reconciler = &Reconciler{}
+
+// Reconciler handles reconcile.Reconcile callbacks from controller-runtime for Secret
+// resources. It loads the certificate of each kubernetes.io/tls Secret into the Store, and
+// removes it when the Secret is deleted or no longer holds a valid certificate.
+type Reconciler struct {
+	clientProvider ClientProvider
+	store          *Store
+	logger         *zap.Logger
+}
+
+// NewReconciler returns a new Reconciler.
+func NewReconciler(clientProvider ClientProvider, store *Store, logger *zap.Logger) (*Reconciler, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	if clientProvider == nil {
+		return nil, fmt.Errorf("clientProvider must not be nil")
+	}
+
+	if store == nil {
+		return nil, fmt.Errorf("store must not be nil")
+	}
+
+	return &Reconciler{
+		clientProvider: clientProvider,
+		store:          store,
+		logger:         logger,
+	}, nil
+}
+
+// Reconcile implements reconcile.Reconciler.
+func (r *Reconciler) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	secretKey := types.NamespacedName{Name: request.Name, Namespace: request.Namespace}
+	logger := r.logger.With(zap.Stringer("secret-key", secretKey))
+
+	logger.Debug("reconcile request")
+
+	secret := &corev1.Secret{}
+
+	err := r.clientProvider.GetClient().Get(ctx, request.NamespacedName, secret)
+	if errors.IsNotFound(err) {
+		if r.store.delete(secretKey) {
+			logger.Info("secret deleted, certificate removed")
+		}
+
+		return reconcile.Result{}, nil
+	}
+
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("could not fetch Secret: %w", err)
+	}
+
+	cert, err := loadCertificate(secret)
+	if err != nil {
+		// the Secret is watched, so it is reconciled again once it is fixed
+		logger.Warn("invalid certificate, removing it", zap.Error(err))
+
+		r.store.delete(secretKey)
+
+		return reconcile.Result{}, nil
+	}
+
+	r.store.set(secretKey, cert)
+
+	logger.Info("certificate loaded",
+		zap.String("resource-version", secret.ResourceVersion),
+		zap.Strings("dns-names", cert.Leaf.DNSNames),
+		zap.Time("not-after", cert.Leaf.NotAfter),
+	)
+
+	return reconcile.Result{}, nil
+}
+
+func loadCertificate(secret *corev1.Secret) (*tls.Certificate, error) {
+	if secret.Type != corev1.SecretTypeTLS {
+		return nil, fmt.Errorf("secret type is %q, expected %q", secret.Type, corev1.SecretTypeTLS)
+	}
+
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key pair: %w", err)
+	}
+
+	return &cert, nil
+}
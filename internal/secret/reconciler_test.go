@@ -0,0 +1,163 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package secret_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/siderolabs/kube-service-exposer/internal/secret"
+)
+
+type mockClientProvider struct {
+	client client.Client
+}
+
+func (m *mockClientProvider) GetClient() client.Client {
+	return m.client
+}
+
+// generateKeyPair generates a PEM-encoded self-signed certificate and key for the DNS name.
+func generateKeyPair(t *testing.T, dnsName string) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func tlsSecret(name string, certPEM, keyPEM []byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       certPEM,
+			corev1.TLSPrivateKeyKey: keyPEM,
+		},
+	}
+}
+
+func TestReconcilerCreate(t *testing.T) {
+	t.Parallel()
+
+	_, err := secret.NewReconciler(nil, secret.NewStore(), zaptest.NewLogger(t))
+	assert.ErrorContains(t, err, "clientProvider must not be nil")
+
+	_, err = secret.NewReconciler(&mockClientProvider{}, nil, zaptest.NewLogger(t))
+	assert.ErrorContains(t, err, "store must not be nil")
+}
+
+func TestReconciler(t *testing.T) {
+	t.Parallel()
+
+	secretKey := types.NamespacedName{Namespace: "default", Name: "example-tls"}
+	certPEM, keyPEM := generateKeyPair(t, "example.com")
+
+	k8sClient := fake.NewClientBuilder().WithObjects(tlsSecret(secretKey.Name, certPEM, keyPEM)).Build()
+	store := secret.NewStore()
+
+	rec, err := secret.NewReconciler(&mockClientProvider{client: k8sClient}, store, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	reconcileSecret := func() {
+		_, err = rec.Reconcile(t.Context(), reconcile.Request{NamespacedName: secretKey})
+		require.NoError(t, err)
+	}
+
+	_, err = store.GetCertificate(secretKey)
+	require.ErrorContains(t, err, "no certificate loaded from Secret default/example-tls")
+
+	reconcileSecret()
+
+	cert, err := store.GetCertificate(secretKey)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, cert.Leaf.DNSNames)
+
+	// a renewed certificate replaces the previous one
+	certPEM, keyPEM = generateKeyPair(t, "renewed.example.com")
+	require.NoError(t, k8sClient.Update(t.Context(), tlsSecret(secretKey.Name, certPEM, keyPEM)))
+
+	reconcileSecret()
+
+	cert, err = store.GetCertificate(secretKey)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"renewed.example.com"}, cert.Leaf.DNSNames)
+
+	// an invalid certificate is not served
+	require.NoError(t, k8sClient.Update(t.Context(), tlsSecret(secretKey.Name, certPEM, []byte("invalid"))))
+
+	reconcileSecret()
+
+	_, err = store.GetCertificate(secretKey)
+	assert.Error(t, err)
+
+	// neither is the certificate of a deleted Secret
+	require.NoError(t, k8sClient.Update(t.Context(), tlsSecret(secretKey.Name, certPEM, keyPEM)))
+
+	reconcileSecret()
+
+	_, err = store.GetCertificate(secretKey)
+	require.NoError(t, err)
+
+	require.NoError(t, k8sClient.Delete(t.Context(), tlsSecret(secretKey.Name, nil, nil)))
+
+	reconcileSecret()
+
+	_, err = store.GetCertificate(secretKey)
+	assert.Error(t, err)
+}
+
+func TestReconcilerIgnoresOtherSecretTypes(t *testing.T) {
+	t.Parallel()
+
+	secretKey := types.NamespacedName{Namespace: "default", Name: "opaque"}
+	certPEM, keyPEM := generateKeyPair(t, "example.com")
+
+	opaque := tlsSecret(secretKey.Name, certPEM, keyPEM)
+	opaque.Type = corev1.SecretTypeOpaque
+
+	store := secret.NewStore()
+
+	rec, err := secret.NewReconciler(&mockClientProvider{client: fake.NewClientBuilder().WithObjects(opaque).Build()}, store, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(t.Context(), reconcile.Request{NamespacedName: secretKey})
+	require.NoError(t, err)
+
+	_, err = store.GetCertificate(secretKey)
+	assert.Error(t, err)
+}
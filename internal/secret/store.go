@@ -0,0 +1,64 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package secret
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+var _ ip.CertificateProvider = &Store{}
+
+// Store keeps the certificates loaded from kubernetes.io/tls Secrets.
+//
+// Load balancers look up the certificate on every TLS handshake, so a renewed certificate
+// is served to new connections as soon as the Store is updated.
+type Store struct {
+	certificates map[types.NamespacedName]*tls.Certificate
+	lock         sync.RWMutex
+}
+
+// NewStore returns a new, empty Store.
+func NewStore() *Store {
+	return &Store{
+		certificates: map[types.NamespacedName]*tls.Certificate{},
+	}
+}
+
+// GetCertificate implements ip.CertificateProvider.
+func (s *Store) GetCertificate(secretKey types.NamespacedName) (*tls.Certificate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	cert, ok := s.certificates[secretKey]
+	if !ok {
+		return nil, fmt.Errorf("no certificate loaded from Secret %s", secretKey)
+	}
+
+	return cert, nil
+}
+
+func (s *Store) set(secretKey types.NamespacedName, cert *tls.Certificate) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.certificates[secretKey] = cert
+}
+
+func (s *Store) delete(secretKey types.NamespacedName) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.certificates[secretKey]
+
+	delete(s.certificates, secretKey)
+
+	return ok
+}
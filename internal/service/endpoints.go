@@ -0,0 +1,111 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+)
+
+// resolveEndpoints sets the ready endpoints of the mappings which connect to them, from the
+// EndpointSlices of the Service. Only the endpoints on the node are set, unless the node name
+// is empty.
+func (r *Reconciler) resolveEndpoints(ctx context.Context, svc *corev1.Service, nodeName string, mappings []ip.Mapping) error {
+	if !slices.ContainsFunc(mappings, func(mapping ip.Mapping) bool { return mapping.Upstream == ip.UpstreamEndpoints }) {
+		return nil
+	}
+
+	if watcher, ok := r.clientProvider.(EndpointsWatcher); ok {
+		if err := watcher.WatchEndpoints(); err != nil {
+			return fmt.Errorf("could not watch EndpointSlices: %w", err)
+		}
+	}
+
+	var endpointSlices discoveryv1.EndpointSliceList
+
+	if err := r.clientProvider.GetClient().List(ctx, &endpointSlices,
+		client.InNamespace(svc.Namespace),
+		client.MatchingLabels{discoveryv1.LabelServiceName: svc.Name},
+	); err != nil {
+		return fmt.Errorf("could not list EndpointSlices: %w", err)
+	}
+
+	for i, mapping := range mappings {
+		if mapping.Upstream == ip.UpstreamEndpoints {
+			mappings[i].Endpoints = ip.NewEndpoints(endpointAddresses(svc, mapping, nodeName, endpointSlices.Items))
+		}
+	}
+
+	return nil
+}
+
+// endpointAddresses returns the host:port addresses of the ready endpoints of the Service port
+// of the mapping, on the node if the node name is not empty.
+func endpointAddresses(svc *corev1.Service, mapping ip.Mapping, nodeName string, endpointSlices []discoveryv1.EndpointSlice) []string {
+	protocol := protocols[mapping.Protocol]
+
+	i := slices.IndexFunc(svc.Spec.Ports, func(port corev1.ServicePort) bool {
+		return int(port.Port) == mapping.ServicePort && port.Protocol == protocol
+	})
+	if i < 0 {
+		return nil
+	}
+
+	// the ports of the EndpointSlices are the target ports, named after the Service ports
+	portName := svc.Spec.Ports[i].Name
+
+	var addresses []string
+
+	for _, endpointSlice := range endpointSlices {
+		if endpointSlice.AddressType == discoveryv1.AddressTypeFQDN {
+			continue
+		}
+
+		j := slices.IndexFunc(endpointSlice.Ports, func(port discoveryv1.EndpointPort) bool {
+			return port.Port != nil && ptrValue(port.Name, "") == portName && ptrValue(port.Protocol, corev1.ProtocolTCP) == protocol
+		})
+		if j < 0 {
+			continue
+		}
+
+		port := strconv.Itoa(int(*endpointSlice.Ports[j].Port))
+
+		for _, endpoint := range endpointSlice.Endpoints {
+			// a nil condition is an unknown state, which is to be interpreted as ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+
+			if nodeName != "" && ptrValue(endpoint.NodeName, "") != nodeName {
+				continue
+			}
+
+			// the addresses of an endpoint are fungible, the first one is used
+			if len(endpoint.Addresses) > 0 {
+				addresses = append(addresses, net.JoinHostPort(endpoint.Addresses[0], port))
+			}
+		}
+	}
+
+	return addresses
+}
+
+// ptrValue returns the value of the optional field, or its default when it is unset.
+func ptrValue[T any](p *T, defaultValue T) T {
+	if p == nil {
+		return defaultValue
+	}
+
+	return *p
+}
@@ -5,20 +5,35 @@
 package service
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/siderolabs/gen/xslices"
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/siderolabs/kube-service-exposer/internal/cidrs"
+	"github.com/siderolabs/kube-service-exposer/internal/ip"
+	"github.com/siderolabs/kube-service-exposer/internal/proxyproto"
 )
 
+// protocols maps the supported mapping protocols to their Service port protocol.
+var protocols = map[ip.Protocol]corev1.Protocol{
+	ip.ProtocolTCP: corev1.ProtocolTCP,
+	ip.ProtocolUDP: corev1.ProtocolUDP,
+}
+
 type portMapping struct {
-	err      error
-	val      string
-	hostPort int
-	svcPort  int
+	err     error
+	val     string
+	mapping ip.Mapping
 }
 
 func (r *Reconciler) parseAnnotation(svc *corev1.Service, logger *zap.Logger) []portMapping {
@@ -29,12 +44,46 @@ func (r *Reconciler) parseAnnotation(svc *corev1.Service, logger *zap.Logger) []
 
 	logger.Debug("found annotation", zap.String("key", r.annotationKey), zap.String("value", annotationVal))
 
-	hasTCPPort := slices.ContainsFunc(svc.Spec.Ports, func(port corev1.ServicePort) bool {
-		return port.Protocol == corev1.ProtocolTCP
+	hasSupportedPort := slices.ContainsFunc(svc.Spec.Ports, func(port corev1.ServicePort) bool {
+		return port.Protocol == corev1.ProtocolTCP || port.Protocol == corev1.ProtocolUDP
 	})
 
-	if !hasTCPPort {
-		logger.Debug("no TCP ports on Service")
+	if !hasSupportedPort {
+		logger.Debug("no TCP or UDP ports on Service")
+
+		return nil
+	}
+
+	sourceRanges, err := r.sourceRanges(svc)
+	if err != nil {
+		// do not expose the Service to more clients than intended
+		logger.Warn("invalid source ranges, skipping all mappings", zap.Error(err))
+
+		return nil
+	}
+
+	bindCIDRs, err := r.bindCIDRs(svc)
+	if err != nil {
+		// do not expose the Service on more host IPs than intended
+		logger.Warn("invalid bind CIDRs, skipping all mappings", zap.Error(err))
+
+		return nil
+	}
+
+	bindInterfaces, err := r.bindInterfaces(svc)
+	if err != nil {
+		logger.Warn("invalid bind interfaces, skipping all mappings", zap.Error(err))
+
+		return nil
+	}
+
+	staticBindAddresses, err := r.staticBindAddresses(svc)
+	if err == nil && staticBindAddresses != "" && (bindCIDRs != "" || bindInterfaces != "") {
+		err = errors.New("static bind addresses cannot be combined with bind CIDRs or bind interfaces")
+	}
+
+	if err != nil {
+		logger.Warn("invalid static bind addresses, skipping all mappings", zap.Error(err))
 
 		return nil
 	}
@@ -47,53 +96,593 @@ func (r *Reconciler) parseAnnotation(svc *corev1.Service, logger *zap.Logger) []
 			continue
 		}
 
-		hostPort, svcPort, err := parseMapping(mappingStr, svc.Spec.Ports)
+		entryMappings, err := parseMapping(mappingStr, svc, r.defaults)
+		if err == nil && sourceRanges != "" {
+			switch {
+			case entryMappings[0].Protocol != ip.ProtocolTCP:
+				err = errors.New("source ranges are only supported for TCP")
+			case entryMappings[0].Mode == ip.ModeNAT:
+				err = fmt.Errorf("source ranges are not supported in %s mode", ip.ModeNAT)
+			}
+
+			for i := range entryMappings {
+				entryMappings[i].SourceRanges = sourceRanges
+			}
+		}
+
+		if err != nil {
+			mappings = append(mappings, portMapping{val: mappingStr, err: err})
+
+			continue
+		}
 
-		mappings = append(mappings, portMapping{
-			val:      mappingStr,
-			hostPort: hostPort,
-			svcPort:  svcPort,
-			err:      err,
-		})
+		for _, mapping := range entryMappings {
+			mapping.BindCIDRs = bindCIDRs
+			mapping.BindInterfaces = bindInterfaces
+			mapping.StaticBindAddresses = staticBindAddresses
+			mappings = append(mappings, portMapping{val: mappingStr, mapping: mapping})
+		}
 	}
 
 	return mappings
 }
 
-// parseMapping parses a single annotation entry into a (host port, service port) pair.
+// sourceRanges returns the CIDRs of the clients allowed to connect to the Service: its
+// spec.loadBalancerSourceRanges, or the ones in the source ranges annotation if it has none.
+func (r *Reconciler) sourceRanges(svc *corev1.Service) (cidrs.List, error) {
+	ranges := svc.Spec.LoadBalancerSourceRanges
+
+	if annotationVal, ok := svc.Annotations[r.sourceRangesAnnotationKey]; ok && len(ranges) == 0 {
+		ranges = strings.Split(annotationVal, ",")
+	}
+
+	return parseCIDRList(ranges)
+}
+
+// bindCIDRs returns the CIDRs in the bind CIDRs annotation of the Service, which narrow down
+// the host IPs its mappings are listened on.
+func (r *Reconciler) bindCIDRs(svc *corev1.Service) (cidrs.List, error) {
+	annotationVal, ok := svc.Annotations[r.bindCIDRsAnnotationKey]
+	if !ok {
+		return "", nil
+	}
+
+	return parseCIDRList(strings.Split(annotationVal, ","))
+}
+
+// bindInterfaces returns the patterns in the bind interfaces annotation of the Service, which
+// narrow down the host IPs its mappings are listened on to the ones of the matching network
+// interfaces.
+func (r *Reconciler) bindInterfaces(svc *corev1.Service) (ip.InterfaceList, error) {
+	annotationVal, ok := svc.Annotations[r.bindIfacesAnnotationKey]
+	if !ok {
+		return "", nil
+	}
+
+	patterns := slices.DeleteFunc(xslices.Map(strings.Split(annotationVal, ","), strings.TrimSpace), func(s string) bool { return s == "" })
+
+	return ip.ParseInterfaceList(patterns)
+}
+
+// staticBindAddresses returns the addresses in the static bind addresses annotation of the
+// Service, which its mappings are listened on instead of the host IPs.
+func (r *Reconciler) staticBindAddresses(svc *corev1.Service) (ip.AddressList, error) {
+	annotationVal, ok := svc.Annotations[r.staticAddrsAnnotationKey]
+	if !ok {
+		return "", nil
+	}
+
+	addrs := slices.DeleteFunc(xslices.Map(strings.Split(annotationVal, ","), strings.TrimSpace), func(s string) bool { return s == "" })
+
+	return ip.ParseAddressList(addrs)
+}
+
+// parseCIDRList parses the CIDRs, ignoring the surrounding spaces and the empty ones.
+func parseCIDRList(values []string) (cidrs.List, error) {
+	values = slices.DeleteFunc(xslices.Map(values, strings.TrimSpace), func(s string) bool { return s == "" })
+
+	prefixes, err := cidrs.Parse(values)
+	if err != nil {
+		return "", err
+	}
+
+	return cidrs.NewList(prefixes), nil
+}
+
+// parseMapping parses a single annotation entry into its mappings, one for each host port.
+//
+// Accepted forms, each optionally followed by "/tcp" or "/udp" (TCP when omitted):
+//   - "<host-port>" — service port defaults to the first port of the protocol on the Service.
+//   - "<host-port>:<service-port-number>" — must match an existing port number of the protocol.
+//   - "<host-port>:<service-port-name>" — must match an existing port name of the protocol.
+//   - "<first>-<last>" — a range of host ports, each mapped to the service port of the same
+//     number, see parsePortRange.
+//   - "<first>-<last>:<first>-<last>" — a range of host ports, mapped to the range of service
+//     ports of the same size. A range has at most maxPortRangeSize ports.
 //
-// Accepted forms:
-//   - "<host-port>" — service port defaults to the first TCP port on the Service.
-//   - "<host-port>:<service-port-number>" — must match an existing TCP port number.
-//   - "<host-port>:<service-port-name>" — must match an existing TCP port name.
+// If a name or number matches a port of another protocol, the error names that protocol
+// explicitly so the user knows why their entry was rejected.
 //
-// Only TCP ports are eligible. If a name or number matches a non-TCP port (UDP/SCTP),
-// the error names that protocol explicitly so the user knows why their entry was
-// rejected.
-func parseMapping(mappingStr string, svcPorts []corev1.ServicePort) (hostPort, svcPort int, err error) {
-	hostPortStr, svcPortStr, hasSvcPort := strings.Cut(mappingStr, ":")
+// The entry can be followed by "@" and a ";"-separated list of "<key>=<value>" options,
+// see parseOptions. Options the entry does not set are taken from defaults, except for the
+// ones of the proxy in NAT mode.
+func parseMapping(mappingStr string, svc *corev1.Service, defaults MappingDefaults) ([]ip.Mapping, error) {
+	specStr, optionsStr, hasOptions := strings.Cut(mappingStr, "@")
+
+	ports, err := parsePorts(specStr, svc.Spec.Ports)
+	if err != nil {
+		return nil, err
+	}
 
-	hostPort, err = strconv.Atoi(hostPortStr)
+	mapping, err := parseEntryOptions(optionsStr, hasOptions, ports[0].Protocol, svc.Namespace, defaults)
 	if err != nil {
-		return 0, 0, fmt.Errorf("invalid host port %q: %w", hostPortStr, err)
+		return nil, err
+	}
+
+	mappings := make([]ip.Mapping, 0, len(ports))
+
+	for _, port := range ports {
+		mapping.HostPort = port.HostPort
+		mapping.ServicePort = port.ServicePort
+
+		mappings = append(mappings, mapping)
+	}
+
+	return mappings, nil
+}
+
+// parseEntryOptions returns the mapping of the protocol with the options of an entry, and the
+// defaults it does not set, except for the ones of the proxy in NAT mode.
+func parseEntryOptions(optionsStr string, hasOptions bool, protocol ip.Protocol, namespace string, defaults MappingDefaults) (ip.Mapping, error) {
+	mapping := ip.Mapping{Protocol: protocol}
+	defaults.apply(&mapping)
+
+	if !hasOptions {
+		return mapping, nil
+	}
+
+	if err := parseOptions(optionsStr, namespace, &mapping); err != nil {
+		return ip.Mapping{}, err
+	}
+
+	if mapping.Mode != ip.ModeNAT {
+		return mapping, nil
+	}
+
+	// the connections are not proxied, so only the options set on the entry are checked
+	mapping = ip.Mapping{Protocol: protocol, Upstream: defaults.Upstream}
+
+	if err := parseOptions(optionsStr, namespace, &mapping); err != nil {
+		return ip.Mapping{}, err
+	}
+
+	return mapping, validateNATOptions(mapping)
+}
+
+// setsOption reports whether the annotation entry sets the option itself.
+func setsOption(mappingStr, key string) bool {
+	_, optionsStr, _ := strings.Cut(mappingStr, "@")
+
+	for option := range strings.SplitSeq(optionsStr, ";") {
+		if optionKey, _, _ := strings.Cut(strings.TrimSpace(option), "="); optionKey == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateNATOptions checks that the mapping in NAT mode sets none of the options of the proxy.
+func validateNATOptions(mapping ip.Mapping) error {
+	for _, option := range []struct {
+		name string
+		set  bool
+	}{
+		{name: "proxy-protocol", set: mapping.ProxyProtocol != proxyproto.VersionNone},
+		{name: "accept-proxy-protocol", set: mapping.AcceptProxyProtocol},
+		{name: "tls-secret", set: mapping.TLSSecret.Name != ""},
+		{name: "sni", set: mapping.ServerName != ""},
+		{name: "max-connections", set: mapping.MaxConnections > 0},
+		{name: "max-connections-wait", set: mapping.MaxConnectionsWait > 0},
+		{name: "rate-limit", set: mapping.RateLimit.Enabled()},
+		{name: "dial-timeout", set: mapping.Timeouts.Dial > 0},
+		{name: "client-idle-timeout", set: mapping.Timeouts.ClientIdle > 0},
+		{name: "upstream-idle-timeout", set: mapping.Timeouts.UpstreamIdle > 0},
+		{name: "tcp-keepalive", set: mapping.Timeouts.KeepAlive != 0},
+		{name: "health-check-timeout", set: mapping.Timeouts.HealthCheckTimeout > 0},
+		{name: "health-check-interval", set: mapping.Timeouts.HealthCheckInterval > 0},
+		{name: "drain-timeout", set: mapping.DrainTimeout > 0},
+	} {
+		if option.set {
+			return fmt.Errorf("option %q is not supported in %s mode", option.name, ip.ModeNAT)
+		}
+	}
+
+	return nil
+}
+
+// parseOptions parses the options of an annotation entry into the mapping.
+//
+// Supported options:
+//   - "proxy-protocol=<v1|v2|none>" — send a PROXY protocol header to the upstream. TCP only.
+//   - "accept-proxy-protocol=<true|false>" — expect a PROXY protocol header from a downstream
+//     load balancer on each connection. TCP only.
+//   - "tls-secret=<name>" — terminate TLS with the certificate of the kubernetes.io/tls Secret
+//     in the namespace of the Service. TCP only.
+//   - "sni=<server-name>" — share the host port with other Services, routing TLS connections
+//     by their server name: an exact name, a "*.<domain>" wildcard, or "*" for the default. TCP only.
+//   - "mode=<tcp|http|nat>" — proxy HTTP/1.1 requests instead of TCP connections, sharing the
+//     host port with other Services in the same mode, or have the kernel forward the
+//     connections with nftables, without any of the options of the proxy. HTTP is TCP only.
+//   - "host=<host>" — the Host header of the requests routed to the mapping, matched like "sni".
+//     Defaults to "*". HTTP mode only.
+//   - "path=<prefix>" — the path prefix of the requests routed to the mapping. Defaults to "/".
+//     HTTP mode only.
+//   - "max-connections=<n>" — limit the number of connections proxied concurrently, or of
+//     requests in HTTP mode; 0 for no limit. TCP only.
+//   - "max-connections-wait=<duration>" — how long a connection over the limit waits for
+//     another one to finish before it is rejected. TCP only.
+//   - "rate-limit=<n>/<s|m|h|duration>" — limit each client to n connections, or requests in
+//     HTTP mode, per interval; 0 for no limit. TCP only.
+//   - "rate-limit-burst=<n>" — the number of connections a client can make at once. Defaults
+//     to the rate.
+//   - "rate-limit-by=<address|subnet>" — track the rate by client address, or by its /24 IPv4
+//     or /64 IPv6 subnet.
+//   - "dial-timeout=<duration>", "client-idle-timeout=<duration>", "upstream-idle-timeout=<duration>",
+//     "tcp-keepalive=<duration>", "health-check-timeout=<duration>", "health-check-interval=<duration>" —
+//     the timeouts of the connections and of the upstream health checks, see ip.Timeouts. The
+//     idle timeouts are not applied in HTTP mode. TCP only.
+//   - "drain-timeout=<duration>" — how long the connections, or requests in HTTP mode, can take
+//     to finish once the mapping is removed or recycled, before they are closed, right away
+//     when it is zero. TCP only.
+//   - "upstream=<dns|cluster-ip|endpoints>" — connect to the DNS name of the Service, to its
+//     ClusterIP, or directly to its ready endpoints.
+func parseOptions(optionsStr, namespace string, mapping *ip.Mapping) error {
+	for option := range strings.SplitSeq(optionsStr, ";") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+
+		key, value, _ := strings.Cut(option, "=")
+
+		switch key {
+		case "proxy-protocol":
+			version, err := proxyproto.ParseVersion(value)
+			if err != nil {
+				return err
+			}
+
+			if version != proxyproto.VersionNone && mapping.Protocol != ip.ProtocolTCP {
+				return fmt.Errorf("option %q is only supported for TCP", key)
+			}
+
+			mapping.ProxyProtocol = version
+		case "accept-proxy-protocol":
+			accept, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for option %q: %w", key, err)
+			}
+
+			if accept && mapping.Protocol != ip.ProtocolTCP {
+				return fmt.Errorf("option %q is only supported for TCP", key)
+			}
+
+			mapping.AcceptProxyProtocol = accept
+		case "tls-secret":
+			if errs := validation.IsDNS1123Subdomain(value); len(errs) > 0 {
+				return fmt.Errorf("invalid Secret name %q: %s", value, strings.Join(errs, ", "))
+			}
+
+			if mapping.Protocol != ip.ProtocolTCP {
+				return fmt.Errorf("option %q is only supported for TCP", key)
+			}
+
+			mapping.TLSSecret = types.NamespacedName{Namespace: namespace, Name: value}
+		case "sni":
+			serverName := strings.ToLower(value)
+
+			if err := validateServerName(serverName); err != nil {
+				return err
+			}
+
+			if mapping.Protocol != ip.ProtocolTCP {
+				return fmt.Errorf("option %q is only supported for TCP", key)
+			}
+
+			mapping.ServerName = serverName
+		case "mode":
+			mode, err := ip.ParseMode(value)
+			if err != nil {
+				return err
+			}
+
+			if mode == ip.ModeHTTP && mapping.Protocol != ip.ProtocolTCP {
+				return fmt.Errorf("option %q is only supported for TCP", key)
+			}
+
+			mapping.Mode = mode
+		case "host":
+			host := strings.ToLower(value)
+
+			if err := validateServerName(host); err != nil {
+				return err
+			}
+
+			mapping.Host = host
+		case "path":
+			pathPrefix, err := parsePathPrefix(value)
+			if err != nil {
+				return err
+			}
+
+			mapping.PathPrefix = pathPrefix
+		case "max-connections":
+			maxConnections, err := strconv.Atoi(value)
+			if err != nil || maxConnections < 0 {
+				return fmt.Errorf("invalid value for option %q: must be a non-negative integer", key)
+			}
+
+			if maxConnections > 0 && mapping.Protocol != ip.ProtocolTCP {
+				return fmt.Errorf("option %q is only supported for TCP", key)
+			}
+
+			mapping.MaxConnections = maxConnections
+		case "max-connections-wait":
+			wait, err := parseNonNegativeDuration(key, value)
+			if err != nil {
+				return err
+			}
+
+			if wait > 0 && mapping.Protocol != ip.ProtocolTCP {
+				return fmt.Errorf("option %q is only supported for TCP", key)
+			}
+
+			mapping.MaxConnectionsWait = wait
+		case "rate-limit":
+			rate, interval, err := parseRate(value)
+			if err != nil {
+				return err
+			}
+
+			if rate > 0 && mapping.Protocol != ip.ProtocolTCP {
+				return fmt.Errorf("option %q is only supported for TCP", key)
+			}
+
+			mapping.RateLimit.Rate = rate
+			mapping.RateLimit.Interval = interval
+		case "rate-limit-burst":
+			burst, err := strconv.Atoi(value)
+			if err != nil || burst < 1 {
+				return fmt.Errorf("invalid value for option %q: must be a positive integer", key)
+			}
+
+			mapping.RateLimit.Burst = burst
+		case "rate-limit-by":
+			switch value {
+			case "address":
+				mapping.RateLimit.PerSubnet = false
+			case "subnet":
+				mapping.RateLimit.PerSubnet = true
+			default:
+				return fmt.Errorf("invalid value for option %q: must be \"address\" or \"subnet\"", key)
+			}
+		case "dial-timeout", "client-idle-timeout", "upstream-idle-timeout", "health-check-timeout", "health-check-interval":
+			timeout, err := parseNonNegativeDuration(key, value)
+			if err != nil {
+				return err
+			}
+
+			if timeout > 0 && mapping.Protocol != ip.ProtocolTCP {
+				return fmt.Errorf("option %q is only supported for TCP", key)
+			}
+
+			*timeoutOptions(&mapping.Timeouts)[key] = timeout
+		case "drain-timeout":
+			timeout, err := parseNonNegativeDuration(key, value)
+			if err != nil {
+				return err
+			}
+
+			if timeout > 0 && mapping.Protocol != ip.ProtocolTCP {
+				return fmt.Errorf("option %q is only supported for TCP", key)
+			}
+
+			mapping.DrainTimeout = timeout
+		case "tcp-keepalive":
+			keepAlive, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for option %q: %w", key, err)
+			}
+
+			if keepAlive != 0 && mapping.Protocol != ip.ProtocolTCP {
+				return fmt.Errorf("option %q is only supported for TCP", key)
+			}
+
+			mapping.Timeouts.KeepAlive = keepAlive
+		case "upstream":
+			upstream, err := ip.ParseUpstreamMode(value)
+			if err != nil {
+				return err
+			}
+
+			mapping.Upstream = upstream
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+	}
+
+	if !mapping.RateLimit.Enabled() && (mapping.RateLimit.Burst > 0 || mapping.RateLimit.PerSubnet) {
+		return errors.New("options \"rate-limit-burst\" and \"rate-limit-by\" require \"rate-limit\"")
+	}
+
+	if mapping.Mode != ip.ModeHTTP {
+		if mapping.Host != "" || mapping.PathPrefix != "" {
+			return fmt.Errorf("options \"host\" and \"path\" are only supported in %s mode", ip.ModeHTTP)
+		}
+
+		return nil
+	}
+
+	// TLS is not terminated in HTTP mode, and requests are routed by their Host header instead
+	switch {
+	case mapping.TLSSecret.Name != "":
+		return fmt.Errorf("option \"tls-secret\" is not supported in %s mode", ip.ModeHTTP)
+	case mapping.ServerName != "":
+		return fmt.Errorf("option \"sni\" is not supported in %s mode", ip.ModeHTTP)
+	}
+
+	mapping.Host = cmp.Or(mapping.Host, ip.DefaultServerName)
+	mapping.PathPrefix = cmp.Or(mapping.PathPrefix, "/")
+
+	return nil
+}
+
+// timeoutOptions maps the names of the non-negative timeout options to their fields.
+func timeoutOptions(timeouts *ip.Timeouts) map[string]*time.Duration {
+	return map[string]*time.Duration{
+		"dial-timeout":          &timeouts.Dial,
+		"client-idle-timeout":   &timeouts.ClientIdle,
+		"upstream-idle-timeout": &timeouts.UpstreamIdle,
+		"health-check-timeout":  &timeouts.HealthCheckTimeout,
+		"health-check-interval": &timeouts.HealthCheckInterval,
+	}
+}
+
+func parseNonNegativeDuration(key, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid value for option %q: must be a non-negative duration", key)
+	}
+
+	return d, nil
+}
+
+// rateIntervals are the interval units accepted by parseRate besides Go durations.
+var rateIntervals = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// parseRate parses a rate like "10/m" or "5/30s" into the count and the interval.
+func parseRate(value string) (int, time.Duration, error) {
+	invalid := fmt.Errorf("invalid rate %q: must be \"<count>/<s|m|h|duration>\"", value)
+
+	countStr, intervalStr, ok := strings.Cut(value, "/")
+	if !ok {
+		if value == "0" {
+			return 0, 0, nil
+		}
+
+		return 0, 0, invalid
+	}
+
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count < 0 {
+		return 0, 0, invalid
+	}
+
+	interval, ok := rateIntervals[intervalStr]
+	if !ok {
+		if interval, err = time.ParseDuration(intervalStr); err != nil || interval <= 0 {
+			return 0, 0, invalid
+		}
+	}
+
+	if count == 0 {
+		return 0, 0, nil
+	}
+
+	return count, interval, nil
+}
+
+// parsePathPrefix validates an absolute URL path, and returns it without a trailing slash.
+func parsePathPrefix(value string) (string, error) {
+	if !strings.HasPrefix(value, "/") || strings.ContainsAny(value, "?# \t") {
+		return "", fmt.Errorf("invalid path prefix %q: must be an absolute path without a query or fragment", value)
+	}
+
+	if value == "/" {
+		return value, nil
+	}
+
+	return strings.TrimSuffix(value, "/"), nil
+}
+
+// validateServerName checks that the server name is a DNS name, a wildcard for the
+// subdomains of one, or the default server name.
+func validateServerName(serverName string) error {
+	if serverName == ip.DefaultServerName {
+		return nil
+	}
+
+	if errs := validation.IsDNS1123Subdomain(strings.TrimPrefix(serverName, "*.")); len(errs) > 0 {
+		return fmt.Errorf("invalid server name %q: %s", serverName, strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// parsePorts parses the host port, service port and protocol part of an annotation entry.
+//
+// It returns a mapping for each host port, with only the ports and the protocol set.
+func parsePorts(specStr string, svcPorts []corev1.ServicePort) ([]ip.Mapping, error) {
+	portsStr, protocolStr, hasProtocol := strings.Cut(specStr, "/")
+
+	protocol := ip.ProtocolTCP
+
+	if hasProtocol {
+		var err error
+
+		if protocol, err = ip.ParseProtocol(protocolStr); err != nil {
+			return nil, err
+		}
+	}
+
+	hostPortStr, svcPortStr, hasSvcPort := strings.Cut(portsStr, ":")
+
+	if strings.Contains(hostPortStr, "-") {
+		return parsePortRange(hostPortStr, svcPortStr, hasSvcPort, protocol, svcPorts)
+	}
+
+	mapping, err := parsePort(hostPortStr, svcPortStr, hasSvcPort, protocol, svcPorts)
+	if err != nil {
+		return nil, err
+	}
+
+	return []ip.Mapping{mapping}, nil
+}
+
+// parsePort parses a single host port, and the service port it is mapped to.
+func parsePort(hostPortStr, svcPortStr string, hasSvcPort bool, protocol ip.Protocol, svcPorts []corev1.ServicePort) (ip.Mapping, error) {
+	svcProtocol := protocols[protocol]
+
+	hostPort, err := strconv.Atoi(hostPortStr)
+	if err != nil {
+		return ip.Mapping{}, fmt.Errorf("invalid host port %q: %w", hostPortStr, err)
 	}
 
 	if hostPort < 1 || hostPort > 65535 {
-		return 0, 0, fmt.Errorf("host port %q out of range: must be between 1 and 65535", hostPortStr)
+		return ip.Mapping{}, fmt.Errorf("host port %q out of range: must be between 1 and 65535", hostPortStr)
 	}
 
+	mapping := ip.Mapping{HostPort: hostPort, Protocol: protocol}
+
 	if !hasSvcPort {
 		for _, p := range svcPorts {
-			if p.Protocol == corev1.ProtocolTCP {
-				return hostPort, int(p.Port), nil
+			if p.Protocol == svcProtocol {
+				mapping.ServicePort = int(p.Port)
+
+				return mapping, nil
 			}
 		}
 
-		return 0, 0, fmt.Errorf("no TCP port on this Service")
+		return ip.Mapping{}, fmt.Errorf("no %s port on this Service", svcProtocol)
 	}
 
 	if svcPortStr == "" {
-		return 0, 0, fmt.Errorf("empty service port in mapping %q", mappingStr)
+		return ip.Mapping{}, fmt.Errorf("empty service port for host port %d", hostPort)
 	}
 
 	svcPortNumber, atoiErr := strconv.Atoi(svcPortStr)
@@ -103,20 +692,87 @@ func parseMapping(mappingStr string, svcPorts []corev1.ServicePort) (hostPort, s
 		return (isNumericPort && int(p.Port) == svcPortNumber) || p.Name == svcPortStr
 	}
 
-	// prefer a TCP match.
+	// prefer a match of the requested protocol.
 	for _, p := range svcPorts {
-		if p.Protocol == corev1.ProtocolTCP && matches(p) {
-			return hostPort, int(p.Port), nil
+		if p.Protocol == svcProtocol && matches(p) {
+			mapping.ServicePort = int(p.Port)
+
+			return mapping, nil
 		}
 	}
 
-	// no TCP match; if the requested port exists with a different protocol, name it
+	// no match; if the requested port exists with a different protocol, name it
 	// explicitly so the error explains the rejection.
 	for _, p := range svcPorts {
-		if p.Protocol != corev1.ProtocolTCP && matches(p) {
-			return 0, 0, fmt.Errorf("port %q on this Service uses protocol %s, only TCP is supported", svcPortStr, p.Protocol)
+		if p.Protocol != svcProtocol && matches(p) {
+			return ip.Mapping{}, fmt.Errorf("port %q on this Service uses protocol %s, but the mapping requests %s", svcPortStr, p.Protocol, svcProtocol)
+		}
+	}
+
+	return ip.Mapping{}, fmt.Errorf("no %s port matching %q on this Service", svcProtocol, svcPortStr)
+}
+
+// maxPortRangeSize is the largest number of ports of a range.
+//
+// Each port of a range is a mapping of its own, with its own load balancer, listeners on each
+// host IP, and upstream health checks, so a range costs as much as the same number of separate
+// entries. The limit keeps a single annotation entry from opening thousands of them.
+const maxPortRangeSize = 100
+
+// parsePortRange parses a range of host ports, and the range of service ports of the same size
+// it is mapped to, or the service ports of the same numbers if there is none.
+//
+// All the service ports of the range need to exist on the Service.
+func parsePortRange(hostRangeStr, svcRangeStr string, hasSvcRange bool, protocol ip.Protocol, svcPorts []corev1.ServicePort) ([]ip.Mapping, error) {
+	hostFirst, hostLast, err := parseRange(hostRangeStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host port range: %w", err)
+	}
+
+	if size := hostLast - hostFirst + 1; size > maxPortRangeSize {
+		return nil, fmt.Errorf("host port range %q is too large: %d ports, at most %d are allowed", hostRangeStr, size, maxPortRangeSize)
+	}
+
+	svcFirst := hostFirst
+
+	if hasSvcRange {
+		var svcLast int
+
+		if svcFirst, svcLast, err = parseRange(svcRangeStr); err != nil {
+			return nil, fmt.Errorf("invalid service port range: %w", err)
+		}
+
+		if svcLast-svcFirst != hostLast-hostFirst {
+			return nil, fmt.Errorf("service port range %q is not of the size of host port range %q", svcRangeStr, hostRangeStr)
+		}
+	}
+
+	svcProtocol := protocols[protocol]
+	mappings := make([]ip.Mapping, 0, hostLast-hostFirst+1)
+
+	for hostPort := hostFirst; hostPort <= hostLast; hostPort++ {
+		svcPort := svcFirst + hostPort - hostFirst
+
+		if !slices.ContainsFunc(svcPorts, func(p corev1.ServicePort) bool { return p.Protocol == svcProtocol && int(p.Port) == svcPort }) {
+			return nil, fmt.Errorf("no %s port %d on this Service", svcProtocol, svcPort)
 		}
+
+		mappings = append(mappings, ip.Mapping{HostPort: hostPort, ServicePort: svcPort, Protocol: protocol})
+	}
+
+	return mappings, nil
+}
+
+// parseRange parses a port range like "30000-30099".
+func parseRange(s string) (first, last int, err error) {
+	firstStr, lastStr, _ := strings.Cut(s, "-")
+
+	first, firstErr := strconv.Atoi(firstStr)
+	last, lastErr := strconv.Atoi(lastStr)
+
+	if firstErr != nil || lastErr != nil || first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("%q must be \"<first>-<last>\" with ports between 1 and 65535", s)
 	}
 
-	return 0, 0, fmt.Errorf("no TCP port matching %q on this Service", svcPortStr)
+	return first, last, nil
 }
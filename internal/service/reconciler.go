@@ -7,6 +7,10 @@ package service
 import (
 	"context"
 	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
@@ -19,6 +23,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	"github.com/siderolabs/kube-service-exposer/internal/ip"
+	"github.com/siderolabs/kube-service-exposer/internal/proxyproto"
 )
 
 // IPMapper applies a desired set of port mappings for a Service.
@@ -31,21 +36,96 @@ type ClientProvider interface {
 	GetClient() client.Client
 }
 
+// EndpointsWatcher is implemented by the ClientProviders which watch the EndpointSlices only
+// once the endpoints of a Service are first resolved, so that they are not watched at all
+// while no mapping connects to the endpoints.
+type EndpointsWatcher interface {
+	WatchEndpoints() error
+}
+
 var _ reconcile.Reconciler = &Reconciler{}
 
+// MappingDefaults are the mapping options applied to the annotation entries which do not
+// set them explicitly.
+//
+// Upstream is applied to all mappings, the others to TCP mappings only.
+type MappingDefaults struct {
+	Upstream           ip.UpstreamMode
+	ProxyProtocol      proxyproto.Version
+	MaxConnections     int
+	MaxConnectionsWait time.Duration
+	Timeouts           ip.Timeouts
+	DrainTimeout       time.Duration
+}
+
+func (d MappingDefaults) apply(mapping *ip.Mapping) {
+	mapping.Upstream = d.Upstream
+
+	if mapping.Protocol == ip.ProtocolTCP {
+		mapping.ProxyProtocol = d.ProxyProtocol
+		mapping.MaxConnections = d.MaxConnections
+		mapping.MaxConnectionsWait = d.MaxConnectionsWait
+		mapping.Timeouts = d.Timeouts
+		mapping.DrainTimeout = d.DrainTimeout
+	}
+}
+
+// WithoutLocalEndpoints is what is done with the mappings of a Service with the Local external
+// traffic policy when it has no ready endpoints on the node.
+type WithoutLocalEndpoints int
+
+// WithoutLocalEndpoints values.
+const (
+	// WithoutLocalEndpointsStop removes the mappings, so that the host ports stop listening.
+	WithoutLocalEndpointsStop WithoutLocalEndpoints = iota
+
+	// WithoutLocalEndpointsReject keeps the mappings, which close the connections.
+	WithoutLocalEndpointsReject
+)
+
+// ParseWithoutLocalEndpoints parses a case-insensitive action name ("stop" or "reject").
+func ParseWithoutLocalEndpoints(s string) (WithoutLocalEndpoints, error) {
+	switch strings.ToLower(s) {
+	case "stop":
+		return WithoutLocalEndpointsStop, nil
+	case "reject":
+		return WithoutLocalEndpointsReject, nil
+	default:
+		return 0, fmt.Errorf("unsupported action without local endpoints %q", s)
+	}
+}
+
+// LocalTraffic configures the mappings of the Services with the Local external traffic policy,
+// which connect only to the ready endpoints on the node.
+type LocalTraffic struct {
+	// NodeName is the name of the node. The policy is ignored when it is empty.
+	NodeName string
+
+	// WithoutEndpoints is what is done with the mappings when the node has no ready endpoints.
+	WithoutEndpoints WithoutLocalEndpoints
+}
+
 // Reconciler handles reconcile.Reconcile callbacks from controller-runtime for Service
 // resources. It parses the configured annotation, filters out disallowed host ports, and
 // hands the resulting set of mappings to the IPMapper.
 type Reconciler struct {
-	clientProvider       ClientProvider
-	ipMapper             IPMapper
-	logger               *zap.Logger
-	annotationKey        string
-	disallowedPortRanges []*net.PortRange
+	clientProvider            ClientProvider
+	ipMapper                  IPMapper
+	logger                    *zap.Logger
+	annotationKey             string
+	sourceRangesAnnotationKey string
+	bindCIDRsAnnotationKey    string
+	bindIfacesAnnotationKey   string
+	staticAddrsAnnotationKey  string
+	disallowedPortRanges      []*net.PortRange
+	defaults                  MappingDefaults
+	localTraffic              LocalTraffic
 }
 
 // NewReconciler returns a new Reconciler.
-func NewReconciler(annotationKey string, clientProvider ClientProvider, ipMapper IPMapper, disallowedHostPortRanges []string, logger *zap.Logger) (*Reconciler, error) {
+func NewReconciler(annotationKey string, clientProvider ClientProvider, ipMapper IPMapper, disallowedHostPortRanges []string, defaults MappingDefaults,
+	localTraffic LocalTraffic, logger *zap.Logger,
+) (*Reconciler, error) {
 	if logger == nil {
 		logger = zap.NewNop()
 	}
@@ -75,14 +155,58 @@ func NewReconciler(annotationKey string, clientProvider ClientProvider, ipMapper
 	}
 
 	return &Reconciler{
-		annotationKey:        annotationKey,
-		clientProvider:       clientProvider,
-		ipMapper:             ipMapper,
-		disallowedPortRanges: portRanges,
-		logger:               logger,
+		annotationKey:             annotationKey,
+		sourceRangesAnnotationKey: SourceRangesAnnotationKey(annotationKey),
+		bindCIDRsAnnotationKey:    BindCIDRsAnnotationKey(annotationKey),
+		bindIfacesAnnotationKey:   BindInterfacesAnnotationKey(annotationKey),
+		staticAddrsAnnotationKey:  StaticBindAddressesAnnotationKey(annotationKey),
+		clientProvider:            clientProvider,
+		ipMapper:                  ipMapper,
+		disallowedPortRanges:      portRanges,
+		defaults:                  defaults,
+		localTraffic:              localTraffic,
+		logger:                    logger,
 	}, nil
 }
 
+// SourceRangesAnnotationKey returns the key of the annotation with the CIDRs of the clients
+// allowed to connect to the Service, next to the annotation key of the mappings: e.g.
+// "example.com/source-ranges" for "example.com/port".
+func SourceRangesAnnotationKey(annotationKey string) string {
+	return siblingAnnotationKey(annotationKey, "source-ranges")
+}
+
+// BindCIDRsAnnotationKey returns the key of the annotation with the CIDRs narrowing down the
+// host IPs the Service is exposed on, next to the annotation key of the mappings: e.g.
+// "example.com/bind-cidrs" for "example.com/port".
+func BindCIDRsAnnotationKey(annotationKey string) string {
+	return siblingAnnotationKey(annotationKey, "bind-cidrs")
+}
+
+// BindInterfacesAnnotationKey returns the key of the annotation with the name patterns of the
+// network interfaces narrowing down the host IPs the Service is exposed on, next to the
+// annotation key of the mappings: e.g. "example.com/bind-interfaces" for "example.com/port".
+func BindInterfacesAnnotationKey(annotationKey string) string {
+	return siblingAnnotationKey(annotationKey, "bind-interfaces")
+}
+
+// StaticBindAddressesAnnotationKey returns the key of the annotation with the host IPs the
+// Service is exposed on whether they are assigned to the host or not, next to the annotation
+// key of the mappings: e.g. "example.com/static-bind-addresses" for "example.com/port".
+func StaticBindAddressesAnnotationKey(annotationKey string) string {
+	return siblingAnnotationKey(annotationKey, "static-bind-addresses")
+}
+
+// siblingAnnotationKey returns the key of the annotation with the name, with the prefix of the
+// annotation key of the mappings.
+func siblingAnnotationKey(annotationKey, name string) string {
+	if prefix, _, ok := strings.Cut(annotationKey, "/"); ok {
+		return prefix + "/" + name
+	}
+
+	return name
+}
+
 // Reconcile implements reconcile.Reconciler.
 func (r *Reconciler) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
 	serviceKey := types.NamespacedName{Name: request.Name, Namespace: request.Namespace}
@@ -114,7 +238,10 @@ func (r *Reconciler) Reconcile(ctx context.Context, request reconcile.Request) (
 		zap.Int("port-count", len(svc.Spec.Ports)),
 	)
 
-	desired := r.buildDesiredMappings(svc, logger)
+	desired, err := r.buildDesiredMappings(ctx, svc, logger)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
 
 	if err = r.ipMapper.Reconcile(ip.MappingSet{ServiceKey: serviceKey, Mappings: desired}); err != nil {
 		return reconcile.Result{}, fmt.Errorf("failed to reconcile mappings: %w", err)
@@ -125,13 +252,29 @@ func (r *Reconciler) Reconcile(ctx context.Context, request reconcile.Request) (
 	return reconcile.Result{}, nil
 }
 
-func (r *Reconciler) buildDesiredMappings(svc *corev1.Service, logger *zap.Logger) []ip.Mapping {
+func (r *Reconciler) buildDesiredMappings(ctx context.Context, svc *corev1.Service, logger *zap.Logger) ([]ip.Mapping, error) {
 	parsed := r.parseAnnotation(svc, logger)
 	if len(parsed) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	seen := make(map[int]string, len(parsed))
+	nodeName := r.localNodeName(svc, logger)
+	families := ipFamilies(svc)
+
+	type hostPortKey struct {
+		protocol ip.Protocol
+		port     int
+	}
+
+	type mappingKey struct {
+		hostPortKey
+
+		route string
+	}
+
+	seen := make(map[mappingKey]string, len(parsed))
+	// sharing records how the host port is shared, as decided by its first entry
+	sharing := make(map[hostPortKey]string, len(parsed))
 	desired := make([]ip.Mapping, 0, len(parsed))
 
 	for _, entry := range parsed {
@@ -143,29 +286,163 @@ func (r *Reconciler) buildDesiredMappings(svc *corev1.Service, logger *zap.Logge
 			continue
 		}
 
-		if firstSeen, dup := seen[entry.hostPort]; dup {
+		portKey := hostPortKey{protocol: entry.mapping.Protocol, port: entry.mapping.HostPort}
+		key := mappingKey{hostPortKey: portKey, route: entry.mapping.Route()}
+
+		if firstSeen, dup := seen[key]; dup {
 			entryLogger.Warn("duplicate host port in annotation, skipping",
-				zap.Int("host-port", entry.hostPort),
+				zap.Int("host-port", entry.mapping.HostPort),
+				zap.Stringer("protocol", entry.mapping.Protocol),
 				zap.String("first-mapping", firstSeen),
 			)
 
 			continue
 		}
 
-		if disallowed := r.firstDisallowedRange(entry.hostPort); disallowed != nil {
+		if firstSharing, ok := sharing[portKey]; ok && firstSharing != sharingOf(entry.mapping) {
+			entryLogger.Warn("host port is shared in different ways in annotation, skipping",
+				zap.Int("host-port", entry.mapping.HostPort),
+				zap.String("sharing", sharingOf(entry.mapping)),
+				zap.String("first-sharing", firstSharing),
+			)
+
+			continue
+		}
+
+		if disallowed := r.firstDisallowedRange(entry.mapping.HostPort); disallowed != nil {
 			entryLogger.Warn("disallowed host port, skipping",
-				zap.Int("host-port", entry.hostPort),
+				zap.Int("host-port", entry.mapping.HostPort),
 				zap.String("disallowed-port-range", disallowed.String()),
 			)
 
 			continue
 		}
 
-		seen[entry.hostPort] = entry.val
-		desired = append(desired, ip.Mapping{HostPort: entry.hostPort, ServicePort: entry.svcPort})
+		if nodeName != "" {
+			if entry.mapping.Upstream != ip.UpstreamEndpoints && setsOption(entry.val, "upstream") {
+				entryLogger.Warn("upstream option is overridden by the Local external traffic policy, connecting to the endpoints on the node",
+					zap.Stringer("upstream", entry.mapping.Upstream),
+				)
+			}
+
+			// only the endpoints tell which node the pods are on
+			entry.mapping.Upstream = ip.UpstreamEndpoints
+		}
+
+		if entry.mapping.Mode == ip.ModeNAT && entry.mapping.Upstream == ip.UpstreamDNS {
+			// the kernel forwards the connections to IP addresses only
+			entry.mapping.Upstream = ip.UpstreamClusterIP
+		}
+
+		if entry.mapping.Upstream == ip.UpstreamClusterIP {
+			entry.mapping.UpstreamHost = clusterIP(svc)
+		}
+
+		entry.mapping.Families = families
+
+		if entry.mapping.Mode == ip.ModeNAT && entry.mapping.UpstreamHost != "" {
+			// the kernel forwards the connections to the ClusterIP of their family only
+			entry.mapping.Families = familyOf(entry.mapping.UpstreamHost)
+		}
+
+		seen[key] = entry.val
+		sharing[portKey] = sharingOf(entry.mapping)
+		desired = append(desired, entry.mapping)
 	}
 
-	return desired
+	if err := r.resolveEndpoints(ctx, svc, nodeName, desired); err != nil {
+		return nil, err
+	}
+
+	if nodeName != "" && r.localTraffic.WithoutEndpoints == WithoutLocalEndpointsStop {
+		desired = slices.DeleteFunc(desired, func(mapping ip.Mapping) bool {
+			if mapping.Endpoints != "" {
+				return false
+			}
+
+			logger.Debug("no local endpoints, skipping", zap.Stringer("mapping", mapping))
+
+			return true
+		})
+	}
+
+	return desired, nil
+}
+
+// clusterIP returns the primary ClusterIP of the Service, or empty if it has none, e.g. if it
+// is headless.
+func clusterIP(svc *corev1.Service) string {
+	clusterIP := svc.Spec.ClusterIP
+	if clusterIP == "" && len(svc.Spec.ClusterIPs) > 0 {
+		clusterIP = svc.Spec.ClusterIPs[0]
+	}
+
+	if clusterIP == corev1.ClusterIPNone {
+		return ""
+	}
+
+	return clusterIP
+}
+
+// ipFamilies returns the IP families of the host IPs the Service is exposed on: the families of
+// its spec.ipFamilies, or all of them if it prefers or requires dual-stack, or has none.
+func ipFamilies(svc *corev1.Service) ip.Families {
+	if policy := svc.Spec.IPFamilyPolicy; policy != nil && *policy != corev1.IPFamilyPolicySingleStack {
+		return 0
+	}
+
+	var families ip.Families
+
+	for _, family := range svc.Spec.IPFamilies {
+		switch family {
+		case corev1.IPv4Protocol:
+			families |= ip.FamilyIPv4
+		case corev1.IPv6Protocol:
+			families |= ip.FamilyIPv6
+		}
+	}
+
+	return families
+}
+
+// familyOf returns the IP family of the address, or all of them if it does not parse.
+func familyOf(address string) ip.Families {
+	addr, err := netip.ParseAddr(address)
+
+	switch {
+	case err != nil:
+		return 0
+	case addr.Unmap().Is4():
+		return ip.FamilyIPv4
+	default:
+		return ip.FamilyIPv6
+	}
+}
+
+// localNodeName returns the name of the node the endpoints of the Service are limited to, or
+// empty if they are not.
+func (r *Reconciler) localNodeName(svc *corev1.Service, logger *zap.Logger) string {
+	if svc.Spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyLocal {
+		return ""
+	}
+
+	if r.localTraffic.NodeName == "" {
+		logger.Warn("node name is not set, ignoring the Local external traffic policy")
+	}
+
+	return r.localTraffic.NodeName
+}
+
+// sharingOf returns how the mapping shares its host port with other mappings.
+func sharingOf(mapping ip.Mapping) string {
+	switch {
+	case mapping.Mode == ip.ModeHTTP:
+		return "http"
+	case mapping.ServerName != "":
+		return "sni"
+	default:
+		return "none"
+	}
 }
 
 func (r *Reconciler) firstDisallowedRange(hostPort int) *net.PortRange {
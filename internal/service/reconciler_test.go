@@ -6,13 +6,18 @@ package service_test
 
 import (
 	"context"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -20,6 +25,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	"github.com/siderolabs/kube-service-exposer/internal/ip"
+	"github.com/siderolabs/kube-service-exposer/internal/proxyproto"
 	"github.com/siderolabs/kube-service-exposer/internal/service"
 )
 
@@ -31,6 +37,19 @@ func (m *mockClientProvider) GetClient() client.Client {
 	return fake.NewClientBuilder().WithObjects(m.objects...).Build()
 }
 
+// mockEndpointsWatcher counts the times the EndpointSlices are to be watched.
+type mockEndpointsWatcher struct {
+	mockClientProvider
+
+	watches int
+}
+
+func (m *mockEndpointsWatcher) WatchEndpoints() error {
+	m.watches++
+
+	return nil
+}
+
 type mockIPMapper struct {
 	calls []ip.MappingSet
 
@@ -58,19 +77,19 @@ func TestReconcilerCreate(t *testing.T) {
 
 	logger := zaptest.NewLogger(t)
 
-	_, err := service.NewReconciler("test", nil, &mockIPMapper{}, nil, logger)
+	_, err := service.NewReconciler("test", nil, &mockIPMapper{}, nil, service.MappingDefaults{}, service.LocalTraffic{}, logger)
 	assert.ErrorContains(t, err, "clientProvider must not be nil")
 
-	_, err = service.NewReconciler("test", &mockClientProvider{}, nil, nil, logger)
+	_, err = service.NewReconciler("test", &mockClientProvider{}, nil, nil, service.MappingDefaults{}, service.LocalTraffic{}, logger)
 	assert.ErrorContains(t, err, "ipMapper must not be nil")
 
-	_, err = service.NewReconciler("", &mockClientProvider{}, &mockIPMapper{}, nil, logger)
+	_, err = service.NewReconciler("", &mockClientProvider{}, &mockIPMapper{}, nil, service.MappingDefaults{}, service.LocalTraffic{}, logger)
 	assert.ErrorContains(t, err, "invalid annotation key")
 
-	_, err = service.NewReconciler("invalid key 1", &mockClientProvider{}, &mockIPMapper{}, nil, logger)
+	_, err = service.NewReconciler("invalid key 1", &mockClientProvider{}, &mockIPMapper{}, nil, service.MappingDefaults{}, service.LocalTraffic{}, logger)
 	assert.ErrorContains(t, err, "invalid annotation key")
 
-	rec, err := service.NewReconciler("valid-key", &mockClientProvider{}, &mockIPMapper{}, nil, logger)
+	rec, err := service.NewReconciler("valid-key", &mockClientProvider{}, &mockIPMapper{}, nil, service.MappingDefaults{}, service.LocalTraffic{}, logger)
 	require.NoError(t, err)
 	assert.NotNil(t, rec)
 }
@@ -80,7 +99,7 @@ func TestReconcilerNotFoundRemovesMappings(t *testing.T) {
 
 	mapper := &mockIPMapper{}
 
-	rec, err := service.NewReconciler("test", &mockClientProvider{}, mapper, nil, zaptest.NewLogger(t))
+	rec, err := service.NewReconciler("test", &mockClientProvider{}, mapper, nil, service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
 	require.NoError(t, err)
 
 	_, err = rec.Reconcile(context.Background(), reconcile.Request{
@@ -114,7 +133,7 @@ func TestReconcilerHappyPath(t *testing.T) {
 
 	mapper := &mockIPMapper{}
 
-	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, zaptest.NewLogger(t))
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
 	require.NoError(t, err)
 
 	_, err = rec.Reconcile(context.Background(), reconcile.Request{
@@ -151,7 +170,7 @@ func TestReconcilerMultipleMappings(t *testing.T) {
 
 	mapper := &mockIPMapper{}
 
-	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, zaptest.NewLogger(t))
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
 	require.NoError(t, err)
 
 	_, err = rec.Reconcile(context.Background(), reconcile.Request{
@@ -188,7 +207,7 @@ func TestReconcilerSkipsBadEntriesAndDuplicates(t *testing.T) {
 
 	mapper := &mockIPMapper{}
 
-	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, zaptest.NewLogger(t))
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
 	require.NoError(t, err)
 
 	_, err = rec.Reconcile(context.Background(), reconcile.Request{
@@ -227,7 +246,7 @@ func TestReconcilerIgnoresUDPPorts(t *testing.T) {
 
 	mapper := &mockIPMapper{}
 
-	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, zaptest.NewLogger(t))
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
 	require.NoError(t, err)
 
 	_, err = rec.Reconcile(context.Background(), reconcile.Request{
@@ -262,7 +281,7 @@ func TestReconcilerRejectsEmptyServicePortSelector(t *testing.T) {
 
 	mapper := &mockIPMapper{}
 
-	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, zaptest.NewLogger(t))
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
 	require.NoError(t, err)
 
 	_, err = rec.Reconcile(context.Background(), reconcile.Request{
@@ -296,7 +315,7 @@ func TestReconcilerDisallowedRanges(t *testing.T) {
 
 	mapper := &mockIPMapper{}
 
-	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, []string{"0-1024", "50000"}, zaptest.NewLogger(t))
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, []string{"0-1024", "50000"}, service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
 	require.NoError(t, err)
 
 	_, err = rec.Reconcile(context.Background(), reconcile.Request{
@@ -308,3 +327,1171 @@ func TestReconcilerDisallowedRanges(t *testing.T) {
 		{HostPort: 30080, ServicePort: 80},
 	})
 }
+
+func TestReconcilerUDPMappings(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30053:dns/udp,30053:dns-tcp,30053/UDP,30054/udp,30055:dns,30056/sctp",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "dns-tcp", Port: 5353, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// "30053/UDP" — duplicate of the first UDP entry; "30055:dns" — TCP requested but "dns"
+	// is a UDP port; "30056/sctp" — unsupported protocol. TCP and UDP on 30053 coexist, and a
+	// bare "/udp" entry picks the first UDP port.
+	assert.ElementsMatch(t, mapper.Calls()[0].Mappings, []ip.Mapping{
+		{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolUDP},
+		{HostPort: 30053, ServicePort: 5353, Protocol: ip.ProtocolTCP},
+		{HostPort: 30054, ServicePort: 53, Protocol: ip.ProtocolUDP},
+	})
+}
+
+func TestReconcilerProxyProtocolOption(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30080,30081@proxy-protocol=v2,30082@proxy-protocol=none,30053/udp,30054/udp@proxy-protocol=v1,30083@proxy-protocol=v9,30084@bogus=1," +
+					"30085@accept-proxy-protocol=true;proxy-protocol=v2,30086@accept-proxy-protocol=maybe,30055/udp@accept-proxy-protocol=true",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil,
+		service.MappingDefaults{ProxyProtocol: proxyproto.Version1}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// the default applies to TCP entries without the option only; "30054" and "30055" are
+	// rejected as UDP, "30083" and "30086" have invalid values and "30084" an unknown option.
+	assert.ElementsMatch(t, mapper.Calls()[0].Mappings, []ip.Mapping{
+		{HostPort: 30080, ServicePort: 80, ProxyProtocol: proxyproto.Version1},
+		{HostPort: 30081, ServicePort: 80, ProxyProtocol: proxyproto.Version2},
+		{HostPort: 30082, ServicePort: 80},
+		{HostPort: 30085, ServicePort: 80, ProxyProtocol: proxyproto.Version2, AcceptProxyProtocol: true},
+		{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolUDP},
+	})
+}
+
+func TestReconcilerTLSSecretOption(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30443:http@tls-secret=example-tls,30444:http@tls-secret=Invalid_Name,30053/udp@tls-secret=example-tls",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// the Secret is looked up in the namespace of the Service; "30444" has an invalid Secret
+	// name and "30053" is rejected as UDP.
+	assert.Equal(t, []ip.Mapping{
+		{HostPort: 30443, ServicePort: 80, TLSSecret: types.NamespacedName{Namespace: "ns", Name: "example-tls"}},
+	}, mapper.Calls()[0].Mappings)
+}
+
+func TestReconcilerSNIOption(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30443:https@sni=git.example.com,30443:https@sni=*.Example.com,30443:https@sni=*,30443:https@sni=bad_name," +
+					"30053/udp@sni=git.example.com,30444:https@sni=git.example.com,30444:https",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// server names are lowercased; "bad_name" is invalid, "30053" is rejected as UDP, and the
+	// entry without a server name on "30444" conflicts with the first one on that port.
+	assert.Equal(t, []ip.Mapping{
+		{HostPort: 30443, ServicePort: 443, ServerName: "git.example.com"},
+		{HostPort: 30443, ServicePort: 443, ServerName: "*.example.com"},
+		{HostPort: 30443, ServicePort: 443, ServerName: "*"},
+		{HostPort: 30444, ServicePort: 443, ServerName: "git.example.com"},
+	}, mapper.Calls()[0].Mappings)
+}
+
+func TestReconcilerHTTPMode(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30080:http@mode=http;host=Dash.example.com;path=/grafana/,30080:http@mode=http;host=*.example.com," +
+					"30080:http@mode=http;path=relative,30080:http@host=example.com,30080:http@mode=http;tls-secret=example-tls," +
+					"30080:http@sni=example.com,30081:http@mode=http",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// hosts are lowercased and path prefixes lose their trailing slash; the relative path is
+	// invalid, "host" requires the http mode, TLS termination is not supported in it, and the
+	// port can't be shared by server name at the same time.
+	assert.Equal(t, []ip.Mapping{
+		{HostPort: 30080, ServicePort: 80, Mode: ip.ModeHTTP, Host: "dash.example.com", PathPrefix: "/grafana"},
+		{HostPort: 30080, ServicePort: 80, Mode: ip.ModeHTTP, Host: "*.example.com", PathPrefix: "/"},
+		{HostPort: 30081, ServicePort: 80, Mode: ip.ModeHTTP, Host: "*", PathPrefix: "/"},
+	}, mapper.Calls()[0].Mappings)
+}
+
+func TestReconcilerMaxConnectionsOption(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30080,30081@max-connections=10,30082@max-connections=0;max-connections-wait=0s,30083@max-connections-wait=500ms,30053/udp," +
+					"30054/udp@max-connections=1,30084@max-connections=-1,30085@max-connections-wait=soon",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil,
+		service.MappingDefaults{MaxConnections: 100, MaxConnectionsWait: time.Second}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// the defaults apply to TCP entries without the options only; "30054" is rejected as UDP,
+	// "30084" and "30085" have invalid values.
+	assert.Equal(t, []ip.Mapping{
+		{HostPort: 30080, ServicePort: 80, MaxConnections: 100, MaxConnectionsWait: time.Second},
+		{HostPort: 30081, ServicePort: 80, MaxConnections: 10, MaxConnectionsWait: time.Second},
+		{HostPort: 30082, ServicePort: 80},
+		{HostPort: 30083, ServicePort: 80, MaxConnections: 100, MaxConnectionsWait: 500 * time.Millisecond},
+		{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolUDP},
+	}, mapper.Calls()[0].Mappings)
+}
+
+func TestReconcilerRateLimitOption(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30022@rate-limit=10/m,30023@rate-limit=5/30s;rate-limit-burst=20;rate-limit-by=subnet,30024@rate-limit=0,30053/udp," +
+					"30054/udp@rate-limit=1/s,30025@rate-limit=10,30026@rate-limit=10/fortnight,30027@rate-limit-burst=5," +
+					"30028@rate-limit=1/h;rate-limit-by=network",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil, service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// "30054" is rejected as UDP, "30025", "30026" and "30028" have invalid values, and "30027"
+	// sets a burst without a rate.
+	assert.Equal(t, []ip.Mapping{
+		{HostPort: 30022, ServicePort: 22, RateLimit: ip.RateLimit{Rate: 10, Interval: time.Minute}},
+		{HostPort: 30023, ServicePort: 22, RateLimit: ip.RateLimit{Rate: 5, Interval: 30 * time.Second, Burst: 20, PerSubnet: true}},
+		{HostPort: 30024, ServicePort: 22},
+		{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolUDP},
+	}, mapper.Calls()[0].Mappings)
+}
+
+func TestReconcilerSourceRanges(t *testing.T) {
+	t.Parallel()
+
+	ports := []corev1.ServicePort{
+		{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	}
+
+	for _, test := range []struct {
+		name         string
+		annotations  map[string]string
+		sourceRanges []string
+		expected     []ip.Mapping
+	}{
+		{
+			name:        "none",
+			annotations: map[string]string{"example.com/port": "30022"},
+			expected:    []ip.Mapping{{HostPort: 30022, ServicePort: 22}},
+		},
+		{
+			name:         "spec",
+			annotations:  map[string]string{"example.com/port": "30022,30023@mode=http"},
+			sourceRanges: []string{"10.0.0.0/8", " 2001:db8::/32"},
+			expected: []ip.Mapping{
+				{HostPort: 30022, ServicePort: 22, SourceRanges: "10.0.0.0/8,2001:db8::/32"},
+				{HostPort: 30023, ServicePort: 22, Mode: ip.ModeHTTP, Host: "*", PathPrefix: "/", SourceRanges: "10.0.0.0/8,2001:db8::/32"},
+			},
+		},
+		{
+			name:        "annotation",
+			annotations: map[string]string{"example.com/port": "30022", "example.com/source-ranges": "192.168.0.0/16, 172.16.0.0/12"},
+			expected:    []ip.Mapping{{HostPort: 30022, ServicePort: 22, SourceRanges: "192.168.0.0/16,172.16.0.0/12"}},
+		},
+		{
+			name:         "spec over annotation",
+			annotations:  map[string]string{"example.com/port": "30022", "example.com/source-ranges": "192.168.0.0/16"},
+			sourceRanges: []string{"10.0.0.0/8"},
+			expected:     []ip.Mapping{{HostPort: 30022, ServicePort: 22, SourceRanges: "10.0.0.0/8"}},
+		},
+		{
+			name:        "invalid",
+			annotations: map[string]string{"example.com/port": "30022", "example.com/source-ranges": "192.168.0.0/16,10.0.0.1"},
+		},
+		{
+			name:        "udp",
+			annotations: map[string]string{"example.com/port": "30022,30053/udp", "example.com/source-ranges": "10.0.0.0/8"},
+			expected:    []ip.Mapping{{HostPort: 30022, ServicePort: 22, SourceRanges: "10.0.0.0/8"}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "svc", Namespace: "ns", Annotations: test.annotations},
+				Spec:       corev1.ServiceSpec{Ports: ports, LoadBalancerSourceRanges: test.sourceRanges},
+			}
+
+			mapper := &mockIPMapper{}
+
+			rec, err := service.NewReconciler("example.com/port", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil,
+				service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+			require.NoError(t, err)
+
+			_, err = rec.Reconcile(context.Background(), reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, mapper.Calls()[0].Mappings)
+		})
+	}
+}
+
+func TestSourceRangesAnnotationKey(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "kube-service-exposer.sidero.dev/source-ranges", service.SourceRangesAnnotationKey("kube-service-exposer.sidero.dev/port"))
+	assert.Equal(t, "source-ranges", service.SourceRangesAnnotationKey("port"))
+}
+
+func TestReconcilerBindCIDRs(t *testing.T) {
+	t.Parallel()
+
+	ports := []corev1.ServicePort{
+		{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+	}
+
+	for _, test := range []struct {
+		name        string
+		annotations map[string]string
+		expected    []ip.Mapping
+	}{
+		{
+			name:        "none",
+			annotations: map[string]string{"example.com/port": "30022"},
+			expected:    []ip.Mapping{{HostPort: 30022, ServicePort: 22}},
+		},
+		{
+			name:        "annotation",
+			annotations: map[string]string{"example.com/port": "30022,30053/udp", "example.com/bind-cidrs": "10.5.0.0/16, fd00::/8"},
+			expected: []ip.Mapping{
+				{HostPort: 30022, ServicePort: 22, BindCIDRs: "10.5.0.0/16,fd00::/8"},
+				{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolUDP, BindCIDRs: "10.5.0.0/16,fd00::/8"},
+			},
+		},
+		{
+			name:        "invalid",
+			annotations: map[string]string{"example.com/port": "30022", "example.com/bind-cidrs": "10.5.0.0/16,eth0"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "svc", Namespace: "ns", Annotations: test.annotations},
+				Spec:       corev1.ServiceSpec{Ports: ports},
+			}
+
+			mapper := &mockIPMapper{}
+
+			rec, err := service.NewReconciler("example.com/port", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil,
+				service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+			require.NoError(t, err)
+
+			_, err = rec.Reconcile(context.Background(), reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, mapper.Calls()[0].Mappings)
+		})
+	}
+}
+
+func TestReconcilerBindInterfaces(t *testing.T) {
+	t.Parallel()
+
+	ports := []corev1.ServicePort{{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP}}
+
+	for _, test := range []struct {
+		name        string
+		annotations map[string]string
+		expected    []ip.Mapping
+	}{
+		{
+			name:        "annotation",
+			annotations: map[string]string{"example.com/port": "30022", "example.com/bind-interfaces": "bond0, vlan*"},
+			expected:    []ip.Mapping{{HostPort: 30022, ServicePort: 22, BindInterfaces: "bond0,vlan*"}},
+		},
+		{
+			name: "with bind CIDRs",
+			annotations: map[string]string{
+				"example.com/port":            "30022",
+				"example.com/bind-interfaces": "vlan*",
+				"example.com/bind-cidrs":      "10.5.0.0/16",
+			},
+			expected: []ip.Mapping{{HostPort: 30022, ServicePort: 22, BindCIDRs: "10.5.0.0/16", BindInterfaces: "vlan*"}},
+		},
+		{
+			name:        "invalid",
+			annotations: map[string]string{"example.com/port": "30022", "example.com/bind-interfaces": "vlan["},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "svc", Namespace: "ns", Annotations: test.annotations},
+				Spec:       corev1.ServiceSpec{Ports: ports},
+			}
+
+			mapper := &mockIPMapper{}
+
+			rec, err := service.NewReconciler("example.com/port", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil,
+				service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+			require.NoError(t, err)
+
+			_, err = rec.Reconcile(context.Background(), reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, mapper.Calls()[0].Mappings)
+		})
+	}
+}
+
+func TestReconcilerStaticBindAddresses(t *testing.T) {
+	t.Parallel()
+
+	ports := []corev1.ServicePort{{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP}}
+
+	for _, test := range []struct {
+		name        string
+		annotations map[string]string
+		expected    []ip.Mapping
+	}{
+		{
+			name:        "annotation",
+			annotations: map[string]string{"example.com/port": "30022", "example.com/static-bind-addresses": "192.168.2.200, fd00::1,192.168.2.100"},
+			expected:    []ip.Mapping{{HostPort: 30022, ServicePort: 22, StaticBindAddresses: "192.168.2.100,192.168.2.200,fd00::1"}},
+		},
+		{
+			name: "with bind CIDRs",
+			annotations: map[string]string{
+				"example.com/port":                  "30022",
+				"example.com/static-bind-addresses": "192.168.2.200",
+				"example.com/bind-cidrs":            "192.168.2.0/24",
+			},
+		},
+		{
+			name:        "wildcard",
+			annotations: map[string]string{"example.com/port": "30022", "example.com/static-bind-addresses": "0.0.0.0"},
+		},
+		{
+			name:        "invalid",
+			annotations: map[string]string{"example.com/port": "30022", "example.com/static-bind-addresses": "192.168.2.0/24"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "svc", Namespace: "ns", Annotations: test.annotations},
+				Spec:       corev1.ServiceSpec{Ports: ports},
+			}
+
+			mapper := &mockIPMapper{}
+
+			rec, err := service.NewReconciler("example.com/port", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil,
+				service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+			require.NoError(t, err)
+
+			_, err = rec.Reconcile(context.Background(), reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, mapper.Calls()[0].Mappings)
+		})
+	}
+}
+
+func TestReconcilerIPFamilies(t *testing.T) {
+	t.Parallel()
+
+	ports := []corev1.ServicePort{{Name: "ssh", Port: 22, Protocol: corev1.ProtocolTCP}}
+
+	for _, test := range []struct {
+		policy   *corev1.IPFamilyPolicy
+		name     string
+		families []corev1.IPFamily
+		expected ip.Families
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:     "ipv4",
+			policy:   new(corev1.IPFamilyPolicySingleStack),
+			families: []corev1.IPFamily{corev1.IPv4Protocol},
+			expected: ip.FamilyIPv4,
+		},
+		{
+			name:     "ipv6",
+			policy:   new(corev1.IPFamilyPolicySingleStack),
+			families: []corev1.IPFamily{corev1.IPv6Protocol},
+			expected: ip.FamilyIPv6,
+		},
+		{
+			name:     "prefer dual-stack",
+			policy:   new(corev1.IPFamilyPolicyPreferDualStack),
+			families: []corev1.IPFamily{corev1.IPv6Protocol},
+		},
+		{
+			name:     "require dual-stack",
+			policy:   new(corev1.IPFamilyPolicyRequireDualStack),
+			families: []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "svc", Namespace: "ns", Annotations: map[string]string{"example.com/port": "30022"}},
+				Spec:       corev1.ServiceSpec{Ports: ports, IPFamilyPolicy: test.policy, IPFamilies: test.families},
+			}
+
+			mapper := &mockIPMapper{}
+
+			rec, err := service.NewReconciler("example.com/port", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil,
+				service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+			require.NoError(t, err)
+
+			_, err = rec.Reconcile(context.Background(), reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, []ip.Mapping{{HostPort: 30022, ServicePort: 22, Families: test.expected}}, mapper.Calls()[0].Mappings)
+		})
+	}
+}
+
+func TestReconcilerIPFamiliesNATMode(t *testing.T) {
+	t.Parallel()
+
+	// the kernel forwards the connections to the primary ClusterIP only
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "svc", Namespace: "ns", Annotations: map[string]string{"example.com/port": "30080@mode=nat"}},
+		Spec: corev1.ServiceSpec{
+			Ports:          []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+			IPFamilyPolicy: new(corev1.IPFamilyPolicyRequireDualStack),
+			IPFamilies:     []corev1.IPFamily{corev1.IPv6Protocol, corev1.IPv4Protocol},
+			ClusterIP:      "fd00:10:96::a",
+			ClusterIPs:     []string{"fd00:10:96::a", "10.96.0.10"},
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	rec, err := service.NewReconciler("example.com/port", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil,
+		service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []ip.Mapping{
+		{HostPort: 30080, ServicePort: 80, Mode: ip.ModeNAT, Upstream: ip.UpstreamClusterIP, UpstreamHost: "fd00:10:96::a", Families: ip.FamilyIPv6},
+	}, mapper.Calls()[0].Mappings)
+}
+
+func TestBindCIDRsAnnotationKey(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "kube-service-exposer.sidero.dev/bind-cidrs", service.BindCIDRsAnnotationKey("kube-service-exposer.sidero.dev/port"))
+	assert.Equal(t, "bind-cidrs", service.BindCIDRsAnnotationKey("port"))
+	assert.Equal(t, "kube-service-exposer.sidero.dev/bind-interfaces", service.BindInterfacesAnnotationKey("kube-service-exposer.sidero.dev/port"))
+	assert.Equal(t, "kube-service-exposer.sidero.dev/static-bind-addresses",
+		service.StaticBindAddressesAnnotationKey("kube-service-exposer.sidero.dev/port"))
+}
+
+func TestReconcilerTimeoutOptions(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30080,5432@client-idle-timeout=1h;upstream-idle-timeout=2h;tcp-keepalive=-1s," +
+					"30081@dial-timeout=3s;health-check-timeout=500ms;health-check-interval=10s,30053/udp," +
+					"30054/udp@client-idle-timeout=1m,30082@dial-timeout=-1s,30083@tcp-keepalive=often",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "postgres", Port: 5432, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	defaults := ip.Timeouts{Dial: 10 * time.Second, KeepAlive: 15 * time.Second, HealthCheckTimeout: time.Second}
+
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil,
+		service.MappingDefaults{Timeouts: defaults}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// the defaults apply to TCP entries only; "30054" is rejected as UDP, "30082" and "30083"
+	// have invalid values.
+	assert.Equal(t, []ip.Mapping{
+		{HostPort: 30080, ServicePort: 5432, Timeouts: defaults},
+		{HostPort: 5432, ServicePort: 5432, Timeouts: ip.Timeouts{
+			Dial: 10 * time.Second, ClientIdle: time.Hour, UpstreamIdle: 2 * time.Hour, KeepAlive: -time.Second, HealthCheckTimeout: time.Second,
+		}},
+		{HostPort: 30081, ServicePort: 5432, Timeouts: ip.Timeouts{
+			Dial: 3 * time.Second, KeepAlive: 15 * time.Second, HealthCheckTimeout: 500 * time.Millisecond, HealthCheckInterval: 10 * time.Second,
+		}},
+		{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolUDP},
+	}, mapper.Calls()[0].Mappings)
+}
+
+func TestReconcilerDrainTimeoutOption(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30080,30081@drain-timeout=1m,30082@drain-timeout=0s,30053/udp,30054/udp@drain-timeout=1m,30083@drain-timeout=-1s",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "postgres", Port: 5432, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil,
+		service.MappingDefaults{DrainTimeout: 10 * time.Second}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// the default applies to TCP entries only; "30054" is rejected as UDP, "30083" is negative.
+	assert.Equal(t, []ip.Mapping{
+		{HostPort: 30080, ServicePort: 5432, DrainTimeout: 10 * time.Second},
+		{HostPort: 30081, ServicePort: 5432, DrainTimeout: time.Minute},
+		{HostPort: 30082, ServicePort: 5432},
+		{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolUDP},
+	}, mapper.Calls()[0].Mappings)
+}
+
+func TestReconcilerEndpointsUpstream(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30080:http,30443:https@upstream=dns,30053/udp@upstream=endpoints,30081:http@upstream=invalid",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+
+	endpointSlice := func(name string, addressType discoveryv1.AddressType, ports []discoveryv1.EndpointPort, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "ns",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "svc"},
+			},
+			AddressType: addressType,
+			Ports:       ports,
+			Endpoints:   endpoints,
+		}
+	}
+
+	ports := []discoveryv1.EndpointPort{
+		{Name: new("http"), Port: new(int32(8080))},
+		{Name: new("https"), Port: new(int32(8443))},
+		{Name: new("dns"), Port: new(int32(5353)), Protocol: new(corev1.ProtocolUDP)},
+	}
+
+	objects := []client.Object{
+		svc,
+		endpointSlice("svc-ipv4", discoveryv1.AddressTypeIPv4, ports,
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.2"}},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: new(true)}},
+			discoveryv1.Endpoint{Addresses: []string{"10.0.0.3"}, Conditions: discoveryv1.EndpointConditions{Ready: new(false)}},
+		),
+		endpointSlice("svc-ipv6", discoveryv1.AddressTypeIPv6, ports,
+			discoveryv1.Endpoint{Addresses: []string{"fd00::1"}},
+		),
+		endpointSlice("svc-fqdn", discoveryv1.AddressTypeFQDN, ports,
+			discoveryv1.Endpoint{Addresses: []string{"example.com"}},
+		),
+		// the slice of another Service
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "other",
+				Namespace: "ns",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "other"},
+			},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Ports:       ports,
+			Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"10.0.1.1"}}},
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: objects}, mapper, nil,
+		service.MappingDefaults{Upstream: ip.UpstreamEndpoints}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// not ready endpoints, FQDN slices and the slices of other Services are skipped; "30081" is
+	// rejected for the invalid upstream.
+	assert.Equal(t, []ip.Mapping{
+		{HostPort: 30080, ServicePort: 80, Upstream: ip.UpstreamEndpoints, Endpoints: "10.0.0.1:8080,10.0.0.2:8080,[fd00::1]:8080"},
+		{HostPort: 30443, ServicePort: 443},
+		{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolUDP, Upstream: ip.UpstreamEndpoints, Endpoints: "10.0.0.1:5353,10.0.0.2:5353,[fd00::1]:5353"},
+	}, mapper.Calls()[0].Mappings)
+}
+
+func TestReconcilerWatchesEndpoints(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30080",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+
+	watcher := &mockEndpointsWatcher{mockClientProvider: mockClientProvider{objects: []client.Object{svc}}}
+
+	rec, err := service.NewReconciler("test", watcher, &mockIPMapper{}, nil, service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"}}
+
+	// the EndpointSlices are not watched while no mapping connects to the endpoints
+	_, err = rec.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.Zero(t, watcher.watches)
+
+	svc.Annotations["test"] = "30080@upstream=endpoints"
+
+	_, err = rec.Reconcile(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, 1, watcher.watches)
+}
+
+func TestReconcilerClusterIPUpstream(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name       string
+		clusterIPs []string
+		expected   []ip.Mapping
+	}{
+		{
+			name:       "cluster IP",
+			clusterIPs: []string{"10.96.0.10", "fd00:10:96::a"},
+			expected: []ip.Mapping{
+				{HostPort: 30080, ServicePort: 80, Upstream: ip.UpstreamClusterIP, UpstreamHost: "10.96.0.10"},
+				{HostPort: 30081, ServicePort: 80},
+			},
+		},
+		{
+			name:       "headless",
+			clusterIPs: []string{corev1.ClusterIPNone},
+			expected: []ip.Mapping{
+				{HostPort: 30080, ServicePort: 80, Upstream: ip.UpstreamClusterIP},
+				{HostPort: 30081, ServicePort: 80},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			svc := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "svc",
+					Namespace: "ns",
+					Annotations: map[string]string{
+						"test": "30080,30081@upstream=dns",
+					},
+				},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{
+						{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+					},
+					ClusterIP:  test.clusterIPs[0],
+					ClusterIPs: test.clusterIPs,
+				},
+			}
+
+			mapper := &mockIPMapper{}
+
+			rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil,
+				service.MappingDefaults{Upstream: ip.UpstreamClusterIP}, service.LocalTraffic{}, zaptest.NewLogger(t))
+			require.NoError(t, err)
+
+			_, err = rec.Reconcile(context.Background(), reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, mapper.Calls()[0].Mappings)
+		})
+	}
+}
+
+func TestReconcilerLocalTrafficPolicy(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30080:http,30443:https@upstream=dns",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+			},
+			ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyLocal,
+		},
+	}
+
+	endpointSlice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc-ipv4",
+			Namespace: "ns",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "svc"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports: []discoveryv1.EndpointPort{
+			{Name: new("http"), Port: new(int32(8080))},
+			{Name: new("https"), Port: new(int32(8443))},
+		},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.0.0.1"}, NodeName: new("node-1")},
+			{Addresses: []string{"10.0.0.2"}, NodeName: new("node-2")},
+			{Addresses: []string{"10.0.0.3"}, NodeName: new("node-2"), Conditions: discoveryv1.EndpointConditions{Ready: new(false)}},
+			{Addresses: []string{"10.0.0.4"}},
+		},
+	}
+
+	for _, test := range []struct {
+		name         string
+		localTraffic service.LocalTraffic
+		expected     []ip.Mapping
+	}{
+		{
+			name:         "local endpoints",
+			localTraffic: service.LocalTraffic{NodeName: "node-1"},
+			// the policy overrides the upstream option
+			expected: []ip.Mapping{
+				{HostPort: 30080, ServicePort: 80, Upstream: ip.UpstreamEndpoints, Endpoints: "10.0.0.1:8080"},
+				{HostPort: 30443, ServicePort: 443, Upstream: ip.UpstreamEndpoints, Endpoints: "10.0.0.1:8443"},
+			},
+		},
+		{
+			name:         "stop without local endpoints",
+			localTraffic: service.LocalTraffic{NodeName: "node-3"},
+			expected:     []ip.Mapping{},
+		},
+		{
+			name:         "reject without local endpoints",
+			localTraffic: service.LocalTraffic{NodeName: "node-3", WithoutEndpoints: service.WithoutLocalEndpointsReject},
+			expected: []ip.Mapping{
+				{HostPort: 30080, ServicePort: 80, Upstream: ip.UpstreamEndpoints},
+				{HostPort: 30443, ServicePort: 443, Upstream: ip.UpstreamEndpoints},
+			},
+		},
+		{
+			name: "unknown node",
+			expected: []ip.Mapping{
+				{HostPort: 30080, ServicePort: 80},
+				{HostPort: 30443, ServicePort: 443},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			mapper := &mockIPMapper{}
+
+			rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc, endpointSlice}}, mapper, nil,
+				service.MappingDefaults{}, test.localTraffic, zaptest.NewLogger(t))
+			require.NoError(t, err)
+
+			_, err = rec.Reconcile(context.Background(), reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, mapper.Calls()[0].Mappings)
+		})
+	}
+}
+
+func TestReconcilerLocalTrafficPolicyOverridesUpstream(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30080:http,30443:https@upstream=cluster-ip,30444:https@upstream=endpoints",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+			},
+			ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyLocal,
+		},
+	}
+
+	core, logs := observer.New(zap.WarnLevel)
+
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, &mockIPMapper{}, nil,
+		service.MappingDefaults{}, service.LocalTraffic{NodeName: "node-1"}, zap.New(core))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// only the entry setting another upstream itself is warned about
+	overridden := logs.FilterMessageSnippet("upstream option is overridden").All()
+	require.Len(t, overridden, 1)
+	assert.Equal(t, "30443:https@upstream=cluster-ip", overridden[0].ContextMap()["mapping"])
+	assert.Equal(t, "cluster-ip", overridden[0].ContextMap()["upstream"])
+}
+
+func TestParseWithoutLocalEndpoints(t *testing.T) {
+	t.Parallel()
+
+	action, err := service.ParseWithoutLocalEndpoints("Reject")
+	require.NoError(t, err)
+	assert.Equal(t, service.WithoutLocalEndpointsReject, action)
+
+	action, err = service.ParseWithoutLocalEndpoints("stop")
+	require.NoError(t, err)
+	assert.Equal(t, service.WithoutLocalEndpointsStop, action)
+
+	_, err = service.ParseWithoutLocalEndpoints("drop")
+	assert.Error(t, err)
+}
+
+func TestReconcilerNATMode(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30080@mode=nat,30053/udp@mode=nat,30081@mode=nat;max-connections=10,30082@mode=nat;tcp-keepalive=1m,30083@mode=nat;upstream=dns",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+			ClusterIP: "10.96.0.10",
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	// the defaults of the proxy do not apply to the mappings in NAT mode
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil,
+		service.MappingDefaults{ProxyProtocol: proxyproto.Version1, Timeouts: ip.Timeouts{KeepAlive: 15 * time.Second}, DrainTimeout: 10 * time.Second},
+		service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// "30081" and "30082" set options of the proxy; the DNS name cannot be forwarded to, so
+	// "30083" connects to the ClusterIP as well.
+	assert.Equal(t, []ip.Mapping{
+		{HostPort: 30080, ServicePort: 80, Mode: ip.ModeNAT, Upstream: ip.UpstreamClusterIP, UpstreamHost: "10.96.0.10", Families: ip.FamilyIPv4},
+		{HostPort: 30053, ServicePort: 53, Protocol: ip.ProtocolUDP, Mode: ip.ModeNAT, Upstream: ip.UpstreamClusterIP, UpstreamHost: "10.96.0.10", Families: ip.FamilyIPv4},
+		{HostPort: 30083, ServicePort: 80, Mode: ip.ModeNAT, Upstream: ip.UpstreamClusterIP, UpstreamHost: "10.96.0.10", Families: ip.FamilyIPv4},
+	}, mapper.Calls()[0].Mappings)
+}
+
+func TestReconcilerPortRanges(t *testing.T) {
+	t.Parallel()
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30000-30002:8000-8002@proxy-protocol=v1,8000-8001,30010-30011:8000-8002,30020-30023:8000-8003,30001," +
+					"30100-31200:8000-9100,30030-30029,30040-30041:http",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 8000, Protocol: corev1.ProtocolTCP},
+				{Name: "rtp-1", Port: 8001, Protocol: corev1.ProtocolTCP},
+				{Name: "rtp-2", Port: 8002, Protocol: corev1.ProtocolTCP},
+				{Name: "rtp-3", Port: 8003, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, []string{"8001"},
+		service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// the host port 8001 is disallowed; "30010-30011" does not match the size of the service
+	// range; 8003 is not a TCP port; "30001" is a duplicate; the others are invalid ranges.
+	assert.Equal(t, []ip.Mapping{
+		{HostPort: 30000, ServicePort: 8000, ProxyProtocol: proxyproto.Version1},
+		{HostPort: 30001, ServicePort: 8001, ProxyProtocol: proxyproto.Version1},
+		{HostPort: 30002, ServicePort: 8002, ProxyProtocol: proxyproto.Version1},
+		{HostPort: 8000, ServicePort: 8000},
+	}, mapper.Calls()[0].Mappings)
+}
+
+func TestReconcilerPortRangeSize(t *testing.T) {
+	t.Parallel()
+
+	var svcPorts []corev1.ServicePort
+
+	for port := int32(8000); port <= 8100; port++ {
+		svcPorts = append(svcPorts, corev1.ServicePort{Name: "p" + strconv.Itoa(int(port)), Port: port, Protocol: corev1.ProtocolTCP})
+	}
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "svc",
+			Namespace: "ns",
+			Annotations: map[string]string{
+				"test": "30000-30099:8000-8099,31000-31100:8000-8100",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: svcPorts,
+		},
+	}
+
+	mapper := &mockIPMapper{}
+
+	rec, err := service.NewReconciler("test", &mockClientProvider{objects: []client.Object{svc}}, mapper, nil,
+		service.MappingDefaults{}, service.LocalTraffic{}, zaptest.NewLogger(t))
+	require.NoError(t, err)
+
+	_, err = rec.Reconcile(context.Background(), reconcile.Request{
+		NamespacedName: types.NamespacedName{Name: "svc", Namespace: "ns"},
+	})
+	require.NoError(t, err)
+
+	// a range of 100 ports is allowed, the one of 101 ports is not
+	mappings := mapper.Calls()[0].Mappings
+
+	require.Len(t, mappings, 100)
+	assert.Equal(t, ip.Mapping{HostPort: 30000, ServicePort: 8000}, mappings[0])
+	assert.Equal(t, ip.Mapping{HostPort: 30099, ServicePort: 8099}, mappings[99])
+}